@@ -20,6 +20,7 @@ type Tree struct {
 	asOf          time.Time
 	until         time.Time
 	strideSlice   time.Duration
+	calendar      *encoding.Calendar
 	root          *node
 	bytes         int
 	length        int
@@ -38,7 +39,8 @@ type edge struct {
 	target *node
 }
 
-// New constructs a new Tree.
+// New constructs a new Tree. If calendar is specified, the periods of
+// sub-merged values follow it instead of outResolution.
 func New(
 	outExprs []expr.Expr,
 	inExprs []expr.Expr,
@@ -47,6 +49,7 @@ func New(
 	asOf time.Time,
 	until time.Time,
 	strideSlice time.Duration,
+	calendar *encoding.Calendar,
 ) *Tree {
 	var subMergers [][]expr.SubMerge
 	for _, o := range outExprs {
@@ -61,6 +64,7 @@ func New(
 		asOf:          asOf,
 		until:         until,
 		strideSlice:   strideSlice,
+		calendar:      calendar,
 		root:          &node{},
 	}
 }
@@ -246,7 +250,11 @@ func (n *node) doUpdate(bt *Tree, fullKey []byte, vals []encoding.Sequence, para
 				in := vals[i]
 				inEx := bt.inExprs[i]
 				previousSize := cap(out)
-				out = out.SubMerge(in, metadata, bt.outResolution, bt.inResolution, outEx, inEx, submerge, bt.asOf, bt.until, bt.strideSlice)
+				if bt.calendar != nil {
+					out = out.SubMergeCalendar(in, metadata, bt.calendar, bt.inResolution, outEx, inEx, submerge, bt.asOf, bt.until)
+				} else {
+					out = out.SubMerge(in, metadata, bt.outResolution, bt.inResolution, outEx, inEx, submerge, bt.asOf, bt.until, bt.strideSlice)
+				}
 				n.data[o] = out
 				bytesAdded += cap(out) - previousSize
 			}
@@ -70,8 +70,20 @@ func (f *follower) failed() bool {
 	return atomic.LoadInt32(&f.hasFailed) == 1
 }
 
-func (db *DB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) {
+// Follow sends the WAL entries requested by f to cb until cb fails. The
+// follower reports offsets up to which it has durably stored data on acks,
+// which allows the WAL to be cleaned up behind it. acks may be nil.
+func (db *DB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error, acks <-chan wal.Offset) {
 	go db.processFollowersOnce.Do(db.processFollowers)
+	id := db.registerFollower(f)
+	defer db.unregisterFollower(f.Stream, id)
+	if acks != nil {
+		go func() {
+			for offset := range acks {
+				db.ackFollower(f.Stream, id, offset)
+			}
+		}()
+	}
 	fol := &follower{Follow: *f, cb: cb, entries: make(chan *walEntry, 1000000)} // TODO: make this buffer tunable
 	db.followerJoined <- fol
 	fol.read()
@@ -579,6 +591,17 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 		}
 	}
 
+	durableOffset := func() wal.Offset {
+		var earliestOffset wal.Offset
+		for i, t := range tables {
+			offset := t.durableWALOffset()
+			if i == 0 || earliestOffset.After(offset) {
+				earliestOffset = offset
+			}
+		}
+		return earliestOffset
+	}
+
 	db.opts.Follow(makeFollow, func(data []byte, newOffset wal.Offset) error {
 		select {
 		case <-cancel:
@@ -598,7 +621,7 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 			}
 		}
 		return nil
-	})
+	}, durableOffset)
 }
 
 func sortedPartitionKeys(partitionKeys []string) (string, []string) {
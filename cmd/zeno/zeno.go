@@ -19,8 +19,10 @@ import (
 	"github.com/getlantern/zenodb/cmd"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/rbac"
 	"github.com/getlantern/zenodb/rpc"
 	"github.com/getlantern/zenodb/rpc/server"
+	"github.com/getlantern/zenodb/statsd"
 	"github.com/getlantern/zenodb/web"
 	"github.com/gorilla/mux"
 	"github.com/vharitonsky/iniflags"
@@ -38,7 +40,10 @@ var (
 	maxMemory          = flag.Float64("maxmemory", 0.7, "Set to a non-zero value to cap the total size of the process as a percentage of total system memory. Defaults to 0.7 = 70%.")
 	addr               = flag.String("addr", "localhost:17712", "The address at which to listen for gRPC over TLS connections, defaults to localhost:17712")
 	httpsAddr          = flag.String("httpsaddr", "localhost:17713", "The address at which to listen for JSON over HTTPS connections, defaults to localhost:17713")
+	apiTokensFile      = flag.String("apitokens", "", "if specified, path to a YAML file listing API tokens that may insert via HTTP, each with a token, a list of streams and an optional ratelimit in points per second")
 	password           = flag.String("password", "", "if specified, will authenticate clients using this password")
+	snapshotDir        = flag.String("snapshotdir", "", "if specified along with -password, clients authenticating with the password may take snapshots into subdirectories of this directory")
+	rolesFile          = flag.String("roles", "", "if specified, path to a YAML file defining roles that grant read access to tables, optionally with a forced where predicate, and mapping tokens and GitHub logins to those roles. -password still grants access to everything.")
 	pkfile             = flag.String("pkfile", "pk.pem", "path to the private key PEM file")
 	certfile           = flag.String("certfile", "cert.pem", "path to the certificate PEM file")
 	cookieHashKey      = flag.String("cookiehashkey", "", "key to use for HMAC authentication of web auth cookies, should be 64 bytes, defaults to random 64 bytes if not specified")
@@ -46,6 +51,13 @@ var (
 	oauthClientID      = flag.String("oauthclientid", "", "id to use for oauth client to connect to GitHub")
 	oauthClientSecret  = flag.String("oauthclientsecret", "", "secret id to use for oauth client to connect to GitHub")
 	gitHubOrg          = flag.String("githuborg", "", "the GitHug org against which web users are authenticated")
+	oidcIssuer         = flag.String("oidcissuer", "", "if specified, web users log in with the OpenID Connect issuer at this URL instead of GitHub")
+	oidcClientID       = flag.String("oidcclientid", "", "id to use for oauth client to connect to the -oidcissuer")
+	oidcClientSecret   = flag.String("oidcclientsecret", "", "secret to use for oauth client to connect to the -oidcissuer")
+	oidcRedirectURL    = flag.String("oidcredirecturl", "", "the URL of zeno's /oauth/code endpoint as registered with the -oidcissuer")
+	oidcUsernameClaim  = flag.String("oidcusernameclaim", "email", "the ID token claim that identifies users logging in with -oidcissuer, defaults to email")
+	oidcGroupsClaim    = flag.String("oidcgroupsclaim", "groups", "the ID token claim that lists the groups of users logging in with -oidcissuer, defaults to groups")
+	oidcGroups         = flag.String("oidcgroups", "", "if specified, comma separated list of groups, one of which users logging in with -oidcissuer must belong to")
 	insecure           = flag.Bool("insecure", false, "set to true to disable TLS certificate verification when connecting to other zeno servers (don't use this in production!)")
 	passthrough        = flag.Bool("passthrough", false, "set to true to make this node a passthrough that doesn't capture data in table but is capable of feeding and querying other nodes. requires that -partitions to be specified.")
 	capture            = flag.String("capture", "", "if specified, connect to the node at the given address to receive updates, authenticating with value of -password.  requires that you specify which -partition this node handles.")
@@ -54,7 +66,14 @@ var (
 	feedOverride       = flag.String("feedoverride", "", "if specified, dial network connection for -feed using this address, but verify TLS connection using the address from -feed")
 	numPartitions      = flag.Int("numpartitions", 1, "The number of partitions available to distribute amongst followers")
 	partition          = flag.Int("partition", 0, "use with -follow, the partition number assigned to this follower")
+	promStream         = flag.String("promstream", "prometheus", "The stream into which to insert data received via Prometheus remote write, defaults to prometheus")
+	promCounters       = flag.String("promcounters", "raw", "How to store Prometheus counters, either raw for the cumulative values or delta for the change since the prior sample, defaults to raw")
+	statsdAddr         = flag.String("statsdaddr", "", "if specified, listen for StatsD metrics over UDP at this address")
+	statsdStream       = flag.String("statsdstream", "statsd", "The stream into which to insert StatsD metrics, defaults to statsd")
+	statsdFlush        = flag.Duration("statsdflush", 10*time.Second, "How frequently to insert aggregated StatsD counters, gauges and sets, defaults to 10 seconds")
+	statsdMaxTimers    = flag.Int("statsdmaxtimers", 1000, "The maximum number of values of each StatsD timer to insert per -statsdflush, beyond which a random sample is inserted, defaults to 1000")
 	maxFollowAge       = flag.Duration("maxfollowage", 0, "user with -follow, limits how far to go back when pulling data from leader")
+	followAckInterval  = flag.Duration("followackinterval", 1*time.Minute, "use with -capture, how frequently to tell the leader which data has been durably stored so that it can clean up its WAL, defaults to 1 minute")
 )
 
 func main() {
@@ -73,7 +92,7 @@ func main() {
 	}
 
 	clientSessionCache := tls.NewLRUClientSessionCache(10000)
-	var follow func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error)
+	var follow func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error, durableOffset func() wal.Offset)
 	var registerQueryHandler func(partition int, query planner.QueryClusterFN)
 	if *capture != "" {
 		host, _, _ := net.SplitHostPort(*capture)
@@ -106,18 +125,19 @@ func main() {
 		}
 
 		log.Debugf("Capturing data from %v", *capture)
-		follow = func(ff func() *common.Follow, insert func(data []byte, newOffset wal.Offset) error) {
+		follow = func(ff func() *common.Follow, insert func(data []byte, newOffset wal.Offset) error, durableOffset func() wal.Offset) {
 			minWait := 1 * time.Second
 			maxWait := 1 * time.Minute
 			wait := minWait
 			for {
 				for {
 					f := ff()
-					followFunc, followErr := client.Follow(context.Background(), f)
+					followFunc, ack, followErr := client.Follow(context.Background(), f)
 					if followErr != nil {
 						log.Errorf("Error following stream %v: %v", f.Stream, followErr)
 						break
 					}
+					lastAck := time.Now()
 					for {
 						data, newOffset, followErr := followFunc()
 						if followErr != nil {
@@ -132,6 +152,15 @@ func main() {
 						f.EarliestOffset = newOffset
 						// reset wait time
 						wait = minWait
+						if time.Since(lastAck) > *followAckInterval {
+							// let the leader know which data we no longer need
+							ackErr := ack(durableOffset())
+							if ackErr != nil {
+								log.Errorf("Error acking stream %v: %v", f.Stream, ackErr)
+								break
+							}
+							lastAck = time.Now()
+						}
 					}
 					// exponentialBackoff
 					time.Sleep(wait)
@@ -243,29 +272,97 @@ func main() {
 	fmt.Printf("Listening for gRPC connections at %v\n", l.Addr())
 	fmt.Printf("Listening for HTTP connections at %v\n", hl.Addr())
 
-	go serveHTTP(db, hl)
-	serveRPC(db, l)
+	if *statsdAddr != "" {
+		sl, listenErr := net.ListenPacket("udp", *statsdAddr)
+		if listenErr != nil {
+			log.Fatalf("Unable to listen for StatsD metrics at %v: %v", *statsdAddr, listenErr)
+		}
+		fmt.Printf("Listening for StatsD metrics at %v\n", sl.LocalAddr())
+		go serveStatsD(db, sl)
+	}
+
+	var policy *rbac.Policy
+	if *rolesFile != "" {
+		policy, err = rbac.Load(*rolesFile)
+		if err != nil {
+			log.Fatalf("Unable to load roles: %v", err)
+		}
+	}
+
+	go serveHTTP(db, hl, policy)
+	serveRPC(db, l, policy)
+}
+
+func serveStatsD(db *zenodb.DB, sl net.PacketConn) {
+	err := statsd.Serve(sl, db.InsertRaw, &statsd.Opts{
+		Stream:         *statsdStream,
+		FlushInterval:  *statsdFlush,
+		MaxTimerValues: *statsdMaxTimers,
+	})
+	if err != nil {
+		log.Errorf("Error serving StatsD: %v", err)
+	}
 }
 
-func serveRPC(db *zenodb.DB, l net.Listener) {
+func serveRPC(db *zenodb.DB, l net.Listener, policy *rbac.Policy) {
 	err := rpcserver.Serve(db, l, &rpcserver.Opts{
-		Password: *password,
+		Password:    *password,
+		Policy:      policy,
+		SnapshotDir: *snapshotDir,
 	})
 	if err != nil {
 		log.Fatalf("Error serving gRPC: %v", err)
 	}
 }
 
-func serveHTTP(db *zenodb.DB, hl net.Listener) {
+func serveHTTP(db *zenodb.DB, hl net.Listener, policy *rbac.Policy) {
+	var apiTokens []*web.APIToken
+	if *apiTokensFile != "" {
+		var err error
+		apiTokens, err = web.LoadAPITokens(*apiTokensFile)
+		if err != nil {
+			log.Errorf("Unable to configure web: %v", err)
+			return
+		}
+	}
+
+	var authProvider web.AuthProvider
+	if *oidcIssuer != "" {
+		var allowedGroups []string
+		if *oidcGroups != "" {
+			allowedGroups = strings.Split(*oidcGroups, ",")
+		}
+		var err error
+		authProvider, err = web.NewOIDCProvider(&web.OIDCOpts{
+			Issuer:        *oidcIssuer,
+			ClientID:      *oidcClientID,
+			ClientSecret:  *oidcClientSecret,
+			RedirectURL:   *oidcRedirectURL,
+			UsernameClaim: *oidcUsernameClaim,
+			GroupsClaim:   *oidcGroupsClaim,
+			AllowedGroups: allowedGroups,
+		})
+		if err != nil {
+			log.Errorf("Unable to configure web: %v", err)
+			return
+		}
+	}
+
 	router := mux.NewRouter()
 	err := web.Configure(db, router, &web.Opts{
-		OAuthClientID:     *oauthClientID,
-		OAuthClientSecret: *oauthClientSecret,
-		GitHubOrg:         *gitHubOrg,
-		HashKey:           *cookieHashKey,
-		BlockKey:          *cookieBlockKey,
-		Password:          *password,
-		CacheDir:          filepath.Join(*dbdir, "_webcache"),
+		OAuthClientID:      *oauthClientID,
+		OAuthClientSecret:  *oauthClientSecret,
+		GitHubOrg:          *gitHubOrg,
+		HashKey:            *cookieHashKey,
+		BlockKey:           *cookieBlockKey,
+		Password:           *password,
+		SnapshotDir:        *snapshotDir,
+		CacheDir:           filepath.Join(*dbdir, "_webcache"),
+		PrometheusStream:   *promStream,
+		PrometheusCounters: *promCounters,
+		APITokens:          apiTokens,
+		Policy:             policy,
+		AuthProvider:       authProvider,
 	})
 	if err != nil {
 		log.Errorf("Unable to configure web: %v", err)
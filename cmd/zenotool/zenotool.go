@@ -1,35 +1,67 @@
-// zenotool provides the ability to filter and merge zeno datafiles offline.
+// zenotool provides the ability to filter and merge zeno datafiles offline, to
+// take snapshots of a running zeno server and to restore those snapshots.
+//
+// Usage:
+//
+//	zenotool -table <table> -out <dir> [-where <clause>] [-sort] <file>...
+//	zenotool -addr <addr> -snapshotdir <dir> snapshot
+//	zenotool -snapshotdir <dir> -dbdir <dir> restore
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb"
 	"github.com/getlantern/zenodb/cmd"
+	"github.com/getlantern/zenodb/rpc"
 	"github.com/vharitonsky/iniflags"
 )
 
 var (
 	log = golog.LoggerFor("zenotool")
 
-	table      = flag.String("table", "", "Name of table corresponding to these files")
-	outFile    = flag.String("out", "", "Name of file to which to write output")
-	where      = flag.String("where", "", "SQL WHERE clause for filtering rows")
-	shouldSort = flag.Bool("sort", false, "Sort the output")
+	table       = flag.String("table", "", "Name of table corresponding to these files")
+	outDir      = flag.String("out", "", "Directory to which to write output segments, can be used as the table's directory")
+	where       = flag.String("where", "", "SQL WHERE clause for filtering rows")
+	shouldSort  = flag.Bool("sort", false, "Sort the output")
+	addr        = flag.String("addr", "localhost:17712", "use with snapshot, the address of the zeno server to snapshot, defaults to localhost:17712")
+	password    = flag.String("password", "", "use with snapshot, the password with which to authenticate to the zeno server")
+	insecure    = flag.Bool("insecure", false, "use with snapshot, set to true to disable TLS certificate verification when connecting to the zeno server")
+	snapshotDir = flag.String("snapshotdir", "", "use with snapshot or restore, the directory containing the snapshot. For snapshot, this is a directory on the zeno server, relative to its -snapshotdir.")
+	dbdir       = flag.String("dbdir", "", "use with restore, the database directory into which to restore the snapshot")
 )
 
 func main() {
 	iniflags.SetAllowUnknownFlags(true)
 	iniflags.Parse()
 
+	if flag.NArg() == 1 {
+		switch flag.Arg(0) {
+		case "snapshot":
+			snapshot()
+			return
+		case "restore":
+			restore()
+			return
+		}
+	}
+
+	merge()
+}
+
+func merge() {
 	if *table == "" {
 		log.Fatal("Please specify a table using -table")
 	}
 
-	if *outFile == "" {
-		log.Fatal("Please specify an output file using -out")
+	if *outDir == "" {
+		log.Fatal("Please specify an output directory using -out")
 	}
 
 	cmd.StartPprof()
@@ -47,10 +79,61 @@ func main() {
 	}
 
 	inFiles := flag.Args()
-	err = db.FilterAndMerge(*table, *where, *shouldSort, *outFile, inFiles...)
+	err = db.FilterAndMerge(*table, *where, *shouldSort, *outDir, inFiles...)
 	if err != nil {
 		log.Fatalf("Unable to perform merge: %v", err)
 	}
 
-	log.Debugf("Merged %v -> %v", strings.Join(inFiles, " + "), *outFile)
+	log.Debugf("Merged %v -> %v", strings.Join(inFiles, " + "), *outDir)
+}
+
+func snapshot() {
+	if *snapshotDir == "" {
+		log.Fatal("Please specify a snapshot directory using -snapshotdir")
+	}
+
+	host, _, _ := net.SplitHostPort(*addr)
+	clientTLSConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *insecure,
+	}
+	client, err := rpc.Dial(*addr, &rpc.ClientOpts{
+		Password: *password,
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			conn, dialErr := net.DialTimeout("tcp", addr, timeout)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			tlsConn := tls.Client(conn, clientTLSConfig)
+			return tlsConn, tlsConn.Handshake()
+		},
+	})
+	if err != nil {
+		log.Fatalf("Unable to connect to %v: %v", *addr, err)
+	}
+	defer client.Close()
+
+	report, err := client.Snapshot(context.Background(), *snapshotDir)
+	if err != nil {
+		log.Fatalf("Unable to take snapshot: %v", err)
+	}
+
+	log.Debugf("Snapshotted %v -> %v", *addr, report.Dir)
+}
+
+func restore() {
+	if *snapshotDir == "" {
+		log.Fatal("Please specify a snapshot directory using -snapshotdir")
+	}
+
+	if *dbdir == "" {
+		log.Fatal("Please specify a database directory using -dbdir")
+	}
+
+	err := zenodb.RestoreSnapshot(*snapshotDir, *dbdir)
+	if err != nil {
+		log.Fatalf("Unable to restore snapshot: %v", err)
+	}
+
+	log.Debugf("Restored %v -> %v", *snapshotDir, *dbdir)
 }
@@ -37,7 +37,15 @@ type QueryMetaData struct {
 	AsOf       time.Time
 	Until      time.Time
 	Resolution time.Duration
-	Plan       string
+	// CrosstabHeaders contains, for each field, the values of the crosstab
+	// dimensions that head its column (outermost first), or nil if the field
+	// isn't a crosstab column. It's nil if the query doesn't have a crosstab.
+	CrosstabHeaders [][]string
+	// TimeZone is the name of the time zone in which periods are aligned, for
+	// example "America/New_York". Periods at a fixed resolution are aligned in
+	// UTC.
+	TimeZone string
+	Plan     string
 }
 
 func WithIncludeMemStore(ctx context.Context, includeMemStore bool) context.Context {
@@ -34,6 +34,9 @@ var (
 type Field struct {
 	Expr expr.Expr
 	Name string
+	// Crosstab, for fields produced by a crosstab, contains the values of the
+	// crosstab dimensions that head the field's column, outermost first.
+	Crosstab []string
 }
 
 // NewField is a convenience method for creating new Fields.
@@ -62,6 +65,21 @@ func (fields Fields) Names() []string {
 	return names
 }
 
+// CrosstabHeaders returns the crosstab headers of each field, or nil if none of
+// the fields is a crosstab column.
+func (fields Fields) CrosstabHeaders() [][]string {
+	var headers [][]string
+	for i, field := range fields {
+		if len(field.Crosstab) > 0 {
+			if headers == nil {
+				headers = make([][]string, len(fields))
+			}
+			headers[i] = field.Crosstab
+		}
+	}
+	return headers
+}
+
 func (fields Fields) Exprs() []expr.Expr {
 	exprs := make([]expr.Expr, 0, len(fields))
 	for _, field := range fields {
@@ -220,6 +238,30 @@ type Transform interface {
 	GetSource() Source
 }
 
+// Calendared is implemented by Sources whose periods may follow a calendar
+// rather than a fixed resolution.
+type Calendared interface {
+	// GetCalendar returns the calendar that periods follow, or nil if they
+	// follow a fixed resolution.
+	GetCalendar() *encoding.Calendar
+}
+
+// CalendarFor returns the calendar followed by the periods of the given
+// Source, or nil if they follow a fixed resolution.
+func CalendarFor(source Source) *encoding.Calendar {
+	for source != nil {
+		if calendared, ok := source.(Calendared); ok {
+			return calendared.GetCalendar()
+		}
+		transform, ok := source.(Transform)
+		if !ok {
+			return nil
+		}
+		source = transform.GetSource()
+	}
+	return nil
+}
+
 type rowTransform struct {
 	source RowSource
 }
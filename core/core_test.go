@@ -9,6 +9,7 @@ import (
 	"github.com/getlantern/zenodb/encoding"
 	. "github.com/getlantern/zenodb/expr"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -251,6 +252,146 @@ func TestGroupCrosstabSingle(t *testing.T) {
 	}
 }
 
+func TestGroupCrosstabTop(t *testing.T) {
+	eAdd := ADD(eA, eB)
+	addField := Field{
+		Name: "add",
+		Expr: eAdd,
+	}
+	crosstab := goexpr.Concat(goexpr.Constant("_"), goexpr.Param("y"))
+
+	expectedFields := Fields{}
+	for _, i := range []string{"3", "1"} {
+		cond, err := goexpr.Binary("=", crosstab, goexpr.Constant(i))
+		if !assert.NoError(t, err) {
+			return
+		}
+		expectedFields = append(expectedFields, NewField(i+"_add", IF(cond, eAdd)))
+	}
+	other := goexpr.Not(goexpr.In(crosstab, goexpr.ArrayList{goexpr.Constant("3"), goexpr.Constant("1")}))
+	expectedFields = append(expectedFields, NewField("other_add", IF(other, eAdd)))
+	expectedHeaders := [][]string{[]string{"3"}, []string{"1"}, []string{CrosstabOther}}
+
+	expectedRows := [][][]float64{
+		[][]float64{
+			[]float64{0, 50},
+			[]float64{70, 0},
+			[]float64{0, 0},
+		},
+		[][]float64{
+			[]float64{80, 0},
+			[]float64{0, 0},
+			[]float64{0, 60},
+		},
+	}
+
+	gx := Group(&goodSource{}, GroupOpts{
+		By:            []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+		Crosstab:      crosstab,
+		CrosstabDims:  []goexpr.Expr{goexpr.Param("y")},
+		CrosstabTop:   2,
+		CrosstabTopBy: "add",
+		Fields:        StaticFieldSource{addField},
+		Resolution:    resolution * 2,
+		AsOf:          asOf.Add(2 * resolution),
+		Until:         until.Add(-2 * resolution),
+	})
+
+	var fields Fields
+	err := gx.Iterate(context.Background(), func(inFields Fields) error {
+		fields = inFields
+		if assert.Equal(t, len(expectedFields), len(fields)) {
+			for i, expected := range expectedFields {
+				assert.Equal(t, expected.String(), fields[i].String())
+			}
+			assert.Equal(t, expectedHeaders, fields.CrosstabHeaders())
+		}
+		return nil
+	}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		expectedRow := expectedRows[0]
+		expectedRows = expectedRows[1:]
+		if assert.Equal(t, len(expectedRow), len(vals)) {
+			for i, expected := range expectedRow {
+				val := vals[i]
+				field := fields[i]
+				if assert.Equal(t, len(expected), val.NumPeriods(field.Expr.EncodedWidth())) {
+					for j, f := range expected {
+						actual, _ := val.ValueAt(j, field.Expr)
+						assert.Equal(t, f, actual)
+					}
+				}
+			}
+		}
+		return true, nil
+	})
+
+	if !assert.NoError(t, err) {
+		t.Log(FormatSource(gx))
+	}
+
+	gx = Group(&goodSource{}, GroupOpts{
+		Crosstab:      crosstab,
+		CrosstabTop:   2,
+		CrosstabTopBy: "unknown",
+		Fields:        StaticFieldSource{addField},
+	})
+	err = gx.Iterate(context.Background(), FieldsIgnored, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		return true, nil
+	})
+	assert.Error(t, err, "Unknown TOP BY field should be rejected")
+}
+
+func TestGroupSubtotals(t *testing.T) {
+	eTotal := ADD(eA, eB)
+	gx := Group(&goodSource{}, GroupOpts{
+		By:         []GroupBy{NewGroupBy("x", goexpr.Param("x")), NewGroupBy("y", goexpr.Param("y"))},
+		Fields:     StaticFieldSource{NewField("total", eTotal)},
+		Resolution: resolution * 2,
+		AsOf:       asOf.Add(2 * resolution),
+		Until:      until.Add(-2 * resolution),
+		Subtotals:  [][]string{{"y"}, {"x", "y"}},
+	})
+	if assert.Len(t, gx.GetGroupBy(), 3) {
+		assert.Equal(t, SubtotalDim, gx.GetGroupBy()[0].Name)
+	}
+
+	detailByX := make(map[int]float64)
+	subtotalByX := make(map[int]float64)
+	grandTotal := float64(0)
+	grandTotals := 0
+	err := gx.Iterate(context.Background(), FieldsIgnored, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		total := float64(0)
+		v := vals[0]
+		for p := 0; p < v.NumPeriods(eTotal.EncodedWidth()); p++ {
+			val, _ := v.ValueAt(p, eTotal)
+			total += val
+		}
+		switch key.Get(SubtotalDim) {
+		case nil:
+			detailByX[key.Get("x").(int)] += total
+		case "y":
+			assert.Nil(t, key.Get("y"))
+			subtotalByX[key.Get("x").(int)] += total
+		case "x,y":
+			assert.Nil(t, key.Get("x"))
+			assert.Nil(t, key.Get("y"))
+			grandTotal += total
+			grandTotals++
+		default:
+			assert.Fail(t, "Unexpected subtotal marker", "%v", key.Get(SubtotalDim))
+		}
+		return true, nil
+	})
+
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 120, subtotalByX[1])
+		assert.EqualValues(t, 140, subtotalByX[2])
+		assert.Equal(t, detailByX, subtotalByX, "subtotals should add up the detail rows")
+		assert.Equal(t, 1, grandTotals)
+		assert.EqualValues(t, 260, grandTotal)
+	}
+}
+
 func TestGroupResolutionOnly(t *testing.T) {
 	eTotal := ADD(eA, eB)
 	gx := Group(&goodSource{}, GroupOpts{
@@ -351,6 +492,190 @@ func TestFlattenSortOffsetAndLimit(t *testing.T) {
 	}
 }
 
+func TestFlattenLimitBy(t *testing.T) {
+	f := Flatten(Group(&goodSource{}, GroupOpts{
+		By:     []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+		Fields: StaticFieldSource{NewField("a", eA), NewField("b", eB)},
+	}))
+
+	check := func(l FlatRowSource, expectedXs []int, expectedTSs []time.Time) {
+		var xs []int
+		var tss []time.Time
+		err := l.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+			xs = append(xs, row.Key.Get("x").(int))
+			tss = append(tss, time.Unix(0, row.TS).In(time.UTC))
+			return true, nil
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, expectedXs, xs)
+			assert.Equal(t, expectedTSs, tss)
+		} else {
+			t.Log(FormatSource(l))
+		}
+	}
+
+	check(LimitBy(f, 2, []string{"x"}, NewOrderBy("b", true), NewOrderBy("a", true)),
+		[]int{1, 1, 2, 2},
+		[]time.Time{epoch.Add(-1 * resolution), epoch.Add(-3 * resolution), epoch, epoch.Add(-2 * resolution)})
+
+	// Without an order, the first rows for each group are kept
+	check(LimitBy(f, 2, []string{"x"}),
+		[]int{1, 1, 2, 2},
+		[]time.Time{epoch.Add(-9 * resolution), epoch.Add(-5 * resolution), epoch.Add(-8 * resolution), epoch.Add(-4 * resolution)})
+
+	check(LimitBy(f, 1, []string{"x"}, NewOrderBy("_time", true)),
+		[]int{1, 2},
+		[]time.Time{epoch.Add(-1 * resolution), epoch})
+}
+
+func TestFlattenFill(t *testing.T) {
+	check := func(fill Fill, expected ...float64) {
+		g := Group(&goodSource{}, GroupOpts{
+			By:     []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+			Fields: StaticFieldSource{NewField("b", eB)},
+		})
+		var actual []float64
+		var tss []int64
+		err := FlattenFill(g, fill).Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+			if row.Key.Get("x") == 2 {
+				actual = append(actual, row.Values[0])
+				tss = append(tss, row.TS)
+			}
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		if fill == FillNull {
+			if assert.Len(t, actual, len(expected)) {
+				for i, v := range expected {
+					if v == 0 {
+						assert.True(t, math.IsNaN(actual[i]), "Missing value at %d should be NaN", i)
+					} else {
+						assert.EqualValues(t, v, actual[i])
+					}
+				}
+			}
+		} else {
+			assert.Equal(t, expected, actual, fill.String())
+		}
+		if len(tss) > 0 {
+			assert.Equal(t, until.UnixNano(), tss[len(tss)-1], fill.String())
+		}
+	}
+
+	check(FillNone, 20, 60, 80, 100)
+	check(FillZero, 0, 20, 0, 0, 0, 60, 0, 80, 0, 100)
+	check(FillNull, 0, 20, 0, 0, 0, 60, 0, 80, 0, 100)
+	check(FillPrevious, 20, 20, 20, 20, 60, 60, 80, 80, 100)
+	check(FillLinear, 20, 30, 40, 50, 60, 70, 80, 90, 100)
+
+	fill, err := FillFor("Linear")
+	assert.NoError(t, err)
+	assert.Equal(t, FillLinear, fill)
+	_, err = FillFor("sideways")
+	assert.Error(t, err)
+}
+
+func TestJoin(t *testing.T) {
+	left := Flatten(Group(&goodSource{}, GroupOpts{
+		By:     []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+		Fields: StaticFieldSource{NewField("a", eA), NewField("b", eB)},
+	}))
+	right := Flatten(Group(&goodSource{}, GroupOpts{
+		By:     []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+		Fields: StaticFieldSource{NewField("b", eB), totalField},
+	}))
+	// Only keep right rows for x = 1
+	right = FlatRowFilter(right, "x = 1", func(ctx context.Context, row *FlatRow, fields Fields) (*FlatRow, error) {
+		if row.Key.Get("x") == 1 {
+			return row, nil
+		}
+		return nil, nil
+	})
+
+	check := func(leftJoin bool, expectedRows int) {
+		j := Join(left, right, JoinOpts{Using: []string{"x"}, Left: leftJoin, LeftName: "l", RightName: "r"})
+		rows := 0
+		err := j.Iterate(context.Background(), func(fields Fields) error {
+			assert.Equal(t, []string{"a", "b", "total", "l.a", "l.b", "r.b", "r.total"}, fields.Names())
+			return nil
+		}, func(row *FlatRow) (bool, error) {
+			rows++
+			a, b, total := row.Values[0], row.Values[1], row.Values[2]
+			if row.Key.Get("x") == 1 {
+				assert.EqualValues(t, a+b, total)
+				assert.EqualValues(t, b, row.Values[5], "right b should be available qualified")
+			} else {
+				assert.True(t, math.IsNaN(total), "missing right values should be NaN")
+			}
+			assert.EqualValues(t, a, row.Values[3])
+			assert.EqualValues(t, b, row.Values[4])
+			return true, nil
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, expectedRows, rows)
+		} else {
+			t.Log(FormatSource(j))
+		}
+	}
+	check(false, 4)
+	check(true, 8)
+}
+
+func TestUnion(t *testing.T) {
+	s1 := Flatten(Group(&goodSource{}, GroupOpts{
+		By:     []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+		Fields: StaticFieldSource{NewField("a", eA)},
+	}))
+	s2 := Flatten(Group(&goodSource{}, GroupOpts{
+		By:     []GroupBy{NewGroupBy("y", goexpr.Param("y"))},
+		Fields: StaticFieldSource{NewField("b", eB), NewField("a", eA)},
+	}))
+	u := Union(s1, s2)
+	assert.Equal(t, []GroupBy{NewGroupBy("x", goexpr.Param("x")), NewGroupBy("y", goexpr.Param("y"))}, u.GetGroupBy())
+
+	fromS1 := 0
+	fromS2 := 0
+	err := u.Iterate(context.Background(), func(fields Fields) error {
+		assert.Equal(t, []string{"a", "b"}, fields.Names())
+		return nil
+	}, func(row *FlatRow) (bool, error) {
+		if row.Key.Get("x") != nil {
+			fromS1++
+			assert.True(t, math.IsNaN(row.Values[1]), "missing field should be NaN")
+		} else {
+			fromS2++
+			assert.False(t, math.IsNaN(row.Values[0]))
+			assert.False(t, math.IsNaN(row.Values[1]))
+		}
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 4, fromS1)
+		assert.Equal(t, 8, fromS2)
+	} else {
+		t.Log(FormatSource(u))
+	}
+}
+
+func TestUnionStreams(t *testing.T) {
+	u := Union(Flatten(&infiniteSource{}), Flatten(&infiniteSource{}))
+	rows := 0
+	err := u.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+		rows++
+		return rows < 20, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 20, rows, "Rows should be streamed without waiting for sources to finish")
+
+	u = Union(Flatten(&goodSource{}), Flatten(&errorSource{}))
+	err = u.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+		return true, nil
+	})
+	assert.Equal(t, errTest, err)
+}
+
 func TestUnflattenTransform(t *testing.T) {
 	avgTotal := ADD(AVG("a"), AVG("b"))
 	f := Flatten(&goodSource{})
@@ -2,24 +2,73 @@ package core
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
 )
 
+// Fill determines how Flatten fills in periods for which a row has no values.
+type Fill int
+
+const (
+	// FillNone leaves out periods without values
+	FillNone Fill = iota
+	// FillNull fills in missing values with NaN
+	FillNull
+	// FillZero fills in missing values with 0
+	FillZero
+	// FillPrevious fills in missing values with the most recent prior value
+	FillPrevious
+	// FillLinear fills in missing values by interpolating linearly between the
+	// closest prior and subsequent values
+	FillLinear
+)
+
+var fillNames = []string{"none", "null", "zero", "previous", "linear"}
+
+// FillFor returns the Fill with the given name (e.g. "previous").
+func FillFor(name string) (Fill, error) {
+	for i, fillName := range fillNames {
+		if strings.EqualFold(name, fillName) {
+			return Fill(i), nil
+		}
+	}
+	return FillNone, fmt.Errorf("Unknown fill '%v', use one of %v", name, strings.Join(fillNames, ", "))
+}
+
+func (fill Fill) String() string {
+	if fill < 0 || int(fill) >= len(fillNames) {
+		return fmt.Sprintf("fill(%d)", fill)
+	}
+	return fillNames[fill]
+}
+
 func Flatten(source RowSource) FlatRowSource {
-	return &flatten{rowTransform{source}}
+	return FlattenFill(source, FillNone)
+}
+
+// FlattenFill is like Flatten, but unless fill is FillNone, it also emits rows
+// for periods between the asOf and until of source for which a row has no
+// values, filling in missing values according to fill.
+func FlattenFill(source RowSource, fill Fill) FlatRowSource {
+	return &flatten{rowTransform{source}, fill}
 }
 
 type flatten struct {
 	rowTransform
+	fill Fill
 }
 
 func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow) error {
 	guard := Guard(ctx)
 
 	resolution := f.GetResolution()
+	calendar := CalendarFor(f.source)
 
 	var fields Fields
 	var numFields int
@@ -46,6 +95,9 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 			}
 			newUntil := val.Until()
 			newAsOf := val.AsOf(width, resolution)
+			if calendar != nil {
+				newAsOf = calendar.Add(newUntil, -1*val.NumPeriods(width))
+			}
 			if newUntil.After(until) {
 				until = newUntil
 			}
@@ -54,9 +106,16 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 			}
 		}
 
+		filling := f.fill != FillNone && !until.IsZero()
+		var rows []*FlatRow
+		var rowsFound [][]bool
+		if filling {
+			asOf, until = f.fillRange(asOf, until, resolution, calendar)
+		}
+
 		// Iterate
 		ts := asOf
-		for ; !ts.After(until); ts = ts.Add(resolution) {
+		for ; !ts.After(until); ts = nextPeriod(ts, resolution, calendar) {
 			tsNanos := ts.UnixNano()
 			row := &FlatRow{
 				TS:     tsNanos,
@@ -64,13 +123,29 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 				Values: make([]float64, numFields),
 				fields: fields,
 			}
+			rowFound := make([]bool, numFields)
 			anyNonConstantValueFound := false
 			for i, field := range fields {
-				val, found := vals[i].ValueAtTime(ts, field.Expr, resolution)
+				var val float64
+				var found bool
+				if calendar != nil {
+					val, found = vals[i].ValueAtCalendarTime(ts, field.Expr, calendar)
+				} else {
+					val, found = vals[i].ValueAtTime(ts, field.Expr, resolution)
+				}
 				if found && !field.Expr.IsConstant() {
 					anyNonConstantValueFound = true
 				}
 				row.Values[i] = val
+				rowFound[i] = found
+			}
+			if filling {
+				// asOf itself is the end of the period prior to the time range
+				if ts.After(asOf) {
+					rows = append(rows, row)
+					rowsFound = append(rowsFound, rowFound)
+				}
+				continue
 			}
 			if anyNonConstantValueFound {
 				more, err := onRow(row)
@@ -80,10 +155,103 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 			}
 		}
 
+		for _, row := range f.fill.fillGaps(rows, rowsFound, fields) {
+			more, err := onRow(row)
+			if !more || err != nil {
+				return more, err
+			}
+		}
+
 		return guard.Proceed()
 	})
 }
 
+// nextPeriod returns the end of the period following the one ending at ts.
+func nextPeriod(ts time.Time, resolution time.Duration, calendar *encoding.Calendar) time.Time {
+	if calendar != nil {
+		return calendar.Add(ts, 1)
+	}
+	return ts.Add(resolution)
+}
+
+// fillRange extends the time range of a row to cover the time range of the
+// source, keeping it aligned to the row's periods.
+func (f *flatten) fillRange(asOf time.Time, until time.Time, resolution time.Duration, calendar *encoding.Calendar) (time.Time, time.Time) {
+	if calendar != nil {
+		if sourceUntil := f.GetUntil(); sourceUntil.After(until) {
+			until = calendar.RoundUp(sourceUntil)
+		}
+		if sourceAsOf := f.GetAsOf(); !sourceAsOf.IsZero() && sourceAsOf.Before(asOf) {
+			// asOf is the end of the period prior to the one containing sourceAsOf
+			asOf = calendar.Add(calendar.RoundUp(sourceAsOf.Add(1)), -1)
+		}
+		return asOf, until
+	}
+	rowUntil := until
+	if sourceUntil := f.GetUntil(); sourceUntil.After(until) {
+		until = encoding.RoundTimeUntilDown(sourceUntil, resolution, rowUntil)
+	}
+	if sourceAsOf := f.GetAsOf(); !sourceAsOf.IsZero() && sourceAsOf.Before(asOf) {
+		asOf = encoding.RoundTimeUntilDown(sourceAsOf, resolution, rowUntil)
+	}
+	return asOf, until
+}
+
+// fillGaps fills in the missing values of the given rows, which are in
+// ascending time order, and returns the rows that have any non-constant values
+// after filling.
+func (fill Fill) fillGaps(rows []*FlatRow, found [][]bool, fields Fields) []*FlatRow {
+	hasValues := make([]bool, len(rows))
+	for i, field := range fields {
+		if field.Expr.IsConstant() {
+			continue
+		}
+		prior, next := -1, -1
+		for r, row := range rows {
+			if found[r][i] {
+				hasValues[r] = true
+				prior = r
+				continue
+			}
+			switch fill {
+			case FillNull:
+				row.Values[i] = math.NaN()
+			case FillZero:
+				row.Values[i] = 0
+			case FillPrevious:
+				if prior < 0 {
+					continue
+				}
+				row.Values[i] = rows[prior].Values[i]
+			case FillLinear:
+				if next <= r {
+					for next = r + 1; next < len(rows) && !found[next][i]; next++ {
+					}
+				}
+				if prior < 0 || next >= len(rows) {
+					continue
+				}
+				priorValue, nextValue := rows[prior].Values[i], rows[next].Values[i]
+				row.Values[i] = priorValue + (nextValue-priorValue)*float64(r-prior)/float64(next-prior)
+			default:
+				continue
+			}
+			hasValues[r] = true
+		}
+	}
+
+	result := make([]*FlatRow, 0, len(rows))
+	for r, row := range rows {
+		if hasValues[r] {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
 func (f *flatten) String() string {
+	if f.fill != FillNone {
+		return fmt.Sprintf("flatten fill(%v)", f.fill)
+	}
 	return "flatten"
 }
@@ -20,6 +20,23 @@ var (
 	ClusterCrosstab = goexpr.Param("_crosstab")
 )
 
+const (
+	// CrosstabTotal heads the crosstab columns that total all other columns
+	CrosstabTotal = "*total*"
+	// CrosstabOther heads the crosstab columns that combine the columns that
+	// didn't make it into the top columns
+	CrosstabOther = "*other*"
+	// SubtotalDim is the dimension that marks subtotal rows. Its value lists the
+	// names of the dimensions that were rolled up, separated by commas.
+	SubtotalDim = "_subtotal"
+)
+
+// ClusterCrosstabDim returns the name of the dimension that holds the value of
+// the idx'th dimension of a crosstab that comes from a cluster follower.
+func ClusterCrosstabDim(idx int) string {
+	return fmt.Sprintf("_crosstab_%d", idx)
+}
+
 // GroupBy is a named goexpr.Expr.
 type GroupBy struct {
 	Expr goexpr.Expr
@@ -60,6 +77,21 @@ type GroupOpts struct {
 	AsOf                  time.Time
 	Until                 time.Time
 	StrideSlice           time.Duration
+	// Calendar, if specified, makes periods follow calendar days, weeks or
+	// months instead of Resolution
+	Calendar *encoding.Calendar
+	// CrosstabDims, if specified, are the individual dimensions that make up
+	// Crosstab, whose values head nested columns
+	CrosstabDims []goexpr.Expr
+	// CrosstabTop, if specified, limits the crosstab to the CrosstabTop columns
+	// with the largest total values of the field CrosstabTopBy and combines the
+	// remaining columns into CrosstabOther columns
+	CrosstabTop   int
+	CrosstabTopBy string
+	// Subtotals, if specified, are sets of dimensions from By that are rolled up
+	// into subtotals. For each set, rows are also grouped by just the remaining
+	// dimensions and marked with a SubtotalDim naming the rolled up ones.
+	Subtotals [][]string
 }
 
 func Group(source RowSource, opts GroupOpts) RowSource {
@@ -76,16 +108,29 @@ type group struct {
 }
 
 func (g *group) GetGroupBy() []GroupBy {
-	return g.GroupOpts.By
+	if len(g.Subtotals) == 0 {
+		return g.GroupOpts.By
+	}
+	// Subtotal rows are also grouped by the SubtotalDim marker
+	result := append([]GroupBy{NewGroupBy(SubtotalDim, goexpr.Param(SubtotalDim))}, g.GroupOpts.By...)
+	sort.Sort(sortedGroupBys(result))
+	return result
 }
 
 func (g *group) GetResolution() time.Duration {
+	if g.Calendar != nil {
+		return g.Calendar.Nominal()
+	}
 	if g.Resolution == 0 {
 		return g.source.GetResolution()
 	}
 	return g.Resolution
 }
 
+func (g *group) GetCalendar() *encoding.Calendar {
+	return g.Calendar
+}
+
 func (g *group) GetAsOf() time.Time {
 	asOf := g.AsOf
 	if asOf.IsZero() {
@@ -114,8 +159,12 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 	if len(g.By) == 0 {
 		if g.Crosstab != nil && g.Crosstab.String() == ClusterCrosstab.String() {
 			// Remove cluster crosstab expression
+			crosstabDims := []string{"_crosstab"}
+			for i := range g.CrosstabDims {
+				crosstabDims = append(crosstabDims, ClusterCrosstabDim(i))
+			}
 			sliceKey = func(key bytemap.ByteMap) bytemap.ByteMap {
-				_, nonCrosstab := key.Split("_crosstab")
+				_, nonCrosstab := key.Split(crosstabDims...)
 				return nonCrosstab
 			}
 		} else if g.Crosstab != nil {
@@ -144,8 +193,13 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 		}
 	}
 
+	subtotalMarkers := make([]string, 0, len(g.Subtotals))
+	for _, subtotal := range g.Subtotals {
+		subtotalMarkers = append(subtotalMarkers, strings.Join(subtotal, ","))
+	}
+
 	var bt *bytetree.Tree
-	var ctabs map[string]interface{}
+	var ctabs map[string][]string
 	var kvs []*keyedVals
 	var inFields Fields
 	var outFields Fields
@@ -164,11 +218,18 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 				g.GetAsOf(),
 				g.GetUntil(),
 				g.StrideSlice,
+				g.Calendar,
 			)
 		}
 		metadata := key
 		key = sliceKey(key)
 		bt.Update(key, vals, nil, metadata)
+		for i, subtotal := range g.Subtotals {
+			_, remaining := key.Split(subtotal...)
+			subtotalKey := remaining.AsMap()
+			subtotalKey[SubtotalDim] = subtotalMarkers[i]
+			bt.Update(bytemap.New(subtotalKey), vals, nil, metadata)
+		}
 	}
 
 	err := g.source.Iterate(ctx, func(fields Fields) error {
@@ -182,10 +243,12 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 	}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
 		if g.Crosstab != nil {
 			if ctabs == nil {
-				ctabs = make(map[string]interface{})
+				ctabs = make(map[string][]string)
 			}
 			ctab := g.Crosstab.Eval(key).(string)
-			ctabs[ctab] = nil
+			if _, found := ctabs[ctab]; !found {
+				ctabs[ctab] = g.crosstabHeadersFor(key, ctab)
+			}
 			kvs = append(kvs, &keyedVals{key, vals})
 		} else {
 			updateTree(key, vals)
@@ -202,7 +265,15 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 				sortedCtabs = append(sortedCtabs, ctab)
 			}
 			sort.Strings(sortedCtabs)
-			outFields = make([]Field, 0, (len(sortedCtabs)+1)*len(origOutFields))
+			var otherCtabs []string
+			if g.CrosstabTop > 0 && len(sortedCtabs) > g.CrosstabTop {
+				var topErr error
+				sortedCtabs, otherCtabs, topErr = g.topCrosstabs(sortedCtabs, origOutFields, inFields, kvs)
+				if topErr != nil {
+					return topErr
+				}
+			}
+			outFields = make([]Field, 0, (len(sortedCtabs)+2)*len(origOutFields))
 			var havingField Field
 			for _, ctab := range sortedCtabs {
 				if guard.TimedOut() {
@@ -220,13 +291,25 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 						return condErr
 					}
 					ifex := expr.IF(cond, outField.Expr)
-					outFields = append(outFields, NewField(fmt.Sprintf("%v_%v", strings.ToLower(ctab), outField.Name), ifex))
+					outFields = append(outFields, crosstabField(fmt.Sprintf("%v_%v", strings.ToLower(ctab), outField.Name), ifex, ctabs[ctab]))
+				}
+			}
+			if len(otherCtabs) > 0 {
+				top := make(goexpr.ArrayList, 0, len(sortedCtabs))
+				for _, ctab := range sortedCtabs {
+					top = append(top, goexpr.Constant(ctab))
+				}
+				cond := goexpr.Not(goexpr.In(g.Crosstab, top))
+				for _, outField := range origOutFields {
+					if outField.Name != HavingFieldName {
+						outFields = append(outFields, crosstabField(fmt.Sprintf("other_%v", outField.Name), expr.IF(cond, outField.Expr), []string{CrosstabOther}))
+					}
 				}
 			}
 			if g.CrosstabIncludesTotal {
 				for _, outField := range origOutFields {
 					if outField.Name != HavingFieldName {
-						outFields = append(outFields, NewField(fmt.Sprintf("total_%v", outField.Name), outField.Expr))
+						outFields = append(outFields, crosstabField(fmt.Sprintf("total_%v", outField.Name), outField.Expr, []string{CrosstabTotal}))
 					}
 				}
 			}
@@ -275,6 +358,12 @@ func (g *group) String() string {
 	if g.Crosstab != nil {
 		result.WriteString(fmt.Sprintf("\n       crosstab: %v", g.Crosstab))
 		result.WriteString(fmt.Sprintf("\n       crosstab includes total: %v", g.CrosstabIncludesTotal))
+		if g.CrosstabTop > 0 {
+			result.WriteString(fmt.Sprintf("\n       crosstab top: %v by %v", g.CrosstabTop, g.CrosstabTopBy))
+		}
+	}
+	if len(g.Subtotals) > 0 {
+		result.WriteString(fmt.Sprintf("\n       subtotals: %v", g.Subtotals))
 	}
 	if g.Fields != nil {
 		result.WriteString(fmt.Sprintf("\n       fields: %v", g.Fields))
@@ -282,6 +371,9 @@ func (g *group) String() string {
 	if g.Resolution > 0 {
 		result.WriteString(fmt.Sprintf("\n       resolution: %v", g.Resolution))
 	}
+	if g.Calendar != nil {
+		result.WriteString(fmt.Sprintf("\n       calendar: %v", g.Calendar))
+	}
 	if !g.AsOf.IsZero() {
 		result.WriteString(fmt.Sprintf("\n       as of: %v", g.AsOf.In(time.UTC)))
 	}
@@ -293,3 +385,96 @@ func (g *group) String() string {
 	}
 	return result.String()
 }
+
+func crosstabField(name string, ex expr.Expr, headers []string) Field {
+	field := NewField(name, ex)
+	field.Crosstab = headers
+	return field
+}
+
+// crosstabHeadersFor returns the values of the individual crosstab dimensions
+// for the given key, or just ctab if the crosstab's dimensions aren't known.
+func (g *group) crosstabHeadersFor(key bytemap.ByteMap, ctab string) []string {
+	if len(g.CrosstabDims) == 0 {
+		return []string{ctab}
+	}
+	headers := make([]string, 0, len(g.CrosstabDims))
+	for _, dim := range g.CrosstabDims {
+		header := ""
+		if val := dim.Eval(key); val != nil {
+			header = fmt.Sprint(val)
+		}
+		headers = append(headers, header)
+	}
+	return headers
+}
+
+// topCrosstabs splits the given crosstab values into the CrosstabTop values
+// whose columns have the largest totals of the CrosstabTopBy field, ordered
+// from largest to smallest, and the remaining values.
+func (g *group) topCrosstabs(ctabs []string, fields Fields, inFields Fields, kvs []*keyedVals) ([]string, []string, error) {
+	var byField *Field
+	for i, field := range fields {
+		if field.Name == g.CrosstabTopBy {
+			byField = &fields[i]
+			break
+		}
+	}
+	if byField == nil {
+		return nil, nil, fmt.Errorf("Unknown field %v in crosstab TOP %d BY %v", g.CrosstabTopBy, g.CrosstabTop, g.CrosstabTopBy)
+	}
+
+	bt := bytetree.New(
+		[]expr.Expr{byField.Expr},
+		inFields.Exprs(),
+		g.GetResolution(),
+		g.source.GetResolution(),
+		g.GetAsOf(),
+		g.GetUntil(),
+		g.StrideSlice,
+		g.Calendar,
+	)
+	for _, kv := range kvs {
+		ctab := g.Crosstab.Eval(kv.key).(string)
+		bt.Update(bytemap.FromSortedKeysAndValues([]string{"_crosstab"}, []interface{}{ctab}), kv.vals, nil, kv.key)
+	}
+
+	totals := make(map[string]float64, len(ctabs))
+	width := byField.Expr.EncodedWidth()
+	err := bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		ctab := bytemap.ByteMap(key).Get("_crosstab").(string)
+		seq := data[0]
+		for i := 0; i < seq.NumPeriods(width); i++ {
+			val, found := seq.ValueAt(i, byField.Expr)
+			if found {
+				totals[ctab] += val
+			}
+		}
+		return true, true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ranked := rankedCrosstabs{make([]string, len(ctabs)), totals}
+	copy(ranked.ctabs, ctabs)
+	sort.Sort(ranked)
+	return ranked.ctabs[:g.CrosstabTop], ranked.ctabs[g.CrosstabTop:], nil
+}
+
+// rankedCrosstabs orders crosstab values by descending totals, breaking ties
+// alphabetically.
+type rankedCrosstabs struct {
+	ctabs  []string
+	totals map[string]float64
+}
+
+func (r rankedCrosstabs) Len() int      { return len(r.ctabs) }
+func (r rankedCrosstabs) Swap(i, j int) { r.ctabs[i], r.ctabs[j] = r.ctabs[j], r.ctabs[i] }
+func (r rankedCrosstabs) Less(i, j int) bool {
+	a, b := r.totals[r.ctabs[i]], r.totals[r.ctabs[j]]
+	if a != b {
+		return a > b
+	}
+	return r.ctabs[i] < r.ctabs[j]
+}
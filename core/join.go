@@ -0,0 +1,162 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/expr"
+)
+
+// JoinOpts configures a Join.
+type JoinOpts struct {
+	// Using are the dimensions on which rows are joined, ordered alphabetically
+	Using []string
+	// Left keeps rows from the left source that have no matching rows in the
+	// right source, in which case the right source's values are missing (NaN)
+	Left bool
+	// LeftName and RightName are the names of the left and right sources, used
+	// to qualify the names of their fields (e.g. server_metrics.requests)
+	LeftName  string
+	RightName string
+}
+
+// Join joins the rows of left with the rows of right that have the same values
+// for the Using dimensions and the same timestamp. Joined rows are keyed by the
+// Using dimensions and include the fields of both sources, each qualified with
+// the name of its source. Fields are also available under their unqualified
+// name, except for fields in right whose names are already taken by fields in
+// left.
+//
+// right is read in its entirety before rows from left are joined.
+func Join(left FlatRowSource, right FlatRowSource, opts JoinOpts) FlatRowSource {
+	return &join{
+		flatRowTransform{left},
+		right,
+		opts,
+	}
+}
+
+type join struct {
+	flatRowTransform
+	right FlatRowSource
+	JoinOpts
+}
+
+type joinKey struct {
+	ts  int64
+	key string
+}
+
+func (j *join) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow) error {
+	guard := Guard(ctx)
+
+	var rightFields Fields
+	rightValues := make(map[joinKey][]float64)
+	err := j.right.Iterate(ctx, func(fields Fields) error {
+		rightFields = fields
+		return nil
+	}, func(row *FlatRow) (bool, error) {
+		rightValues[joinKey{row.TS, string(j.keyFor(row))}] = row.Values
+		return guard.Proceed()
+	})
+	if err != nil {
+		return err
+	}
+
+	var outFields Fields
+	var rightIdxs []int
+	var missing []float64
+	return j.source.Iterate(ctx, func(leftFields Fields) error {
+		outFields, rightIdxs = j.fieldsFor(leftFields, rightFields)
+		missing = make([]float64, len(rightFields))
+		for i := range missing {
+			missing[i] = math.NaN()
+		}
+		return onFields(outFields)
+	}, func(row *FlatRow) (bool, error) {
+		key := j.keyFor(row)
+		values, found := rightValues[joinKey{row.TS, string(key)}]
+		if !found {
+			if !j.Left {
+				return guard.Proceed()
+			}
+			values = missing
+		}
+		outRow := &FlatRow{
+			TS:     row.TS,
+			Key:    key,
+			Values: make([]float64, 0, len(outFields)),
+			fields: outFields,
+		}
+		outRow.Values = append(outRow.Values, row.Values...)
+		for _, idx := range rightIdxs {
+			outRow.Values = append(outRow.Values, values[idx])
+		}
+		outRow.Values = append(outRow.Values, row.Values...)
+		outRow.Values = append(outRow.Values, values...)
+		more, err := onRow(outRow)
+		if !more || err != nil {
+			return more, err
+		}
+		return guard.Proceed()
+	})
+}
+
+// fieldsFor determines the fields of joined rows, which are the unqualified
+// fields of left, followed by the unqualified fields of right whose names
+// aren't taken, followed by the qualified fields of left and right. It also
+// returns the indexes of the unqualified fields of right.
+func (j *join) fieldsFor(leftFields Fields, rightFields Fields) (Fields, []int) {
+	outFields := make(Fields, 0, (len(leftFields)+len(rightFields))*2)
+	names := make(map[string]bool, len(leftFields))
+	for _, field := range leftFields {
+		outFields = append(outFields, NewField(field.Name, expr.FIELD(field.Name)))
+		names[field.Name] = true
+	}
+	var rightIdxs []int
+	for i, field := range rightFields {
+		if !names[field.Name] {
+			outFields = append(outFields, NewField(field.Name, expr.FIELD(field.Name)))
+			rightIdxs = append(rightIdxs, i)
+		}
+	}
+	for _, side := range []struct {
+		name   string
+		fields Fields
+	}{{j.LeftName, leftFields}, {j.RightName, rightFields}} {
+		for _, field := range side.fields {
+			name := fmt.Sprintf("%v.%v", side.name, field.Name)
+			outFields = append(outFields, NewField(name, expr.FIELD(name)))
+		}
+	}
+	return outFields, rightIdxs
+}
+
+// keyFor returns the key of the given row limited to the Using dimensions.
+func (j *join) keyFor(row *FlatRow) bytemap.ByteMap {
+	names := make([]string, 0, len(j.Using))
+	values := make([]interface{}, 0, len(j.Using))
+	for _, dim := range j.Using {
+		val := row.Key.Get(dim)
+		if val != nil {
+			names = append(names, dim)
+			values = append(values, val)
+		}
+	}
+	return bytemap.FromSortedKeysAndValues(names, values)
+}
+
+func (j *join) String() string {
+	joinType := "join"
+	if j.Left {
+		joinType = "left join"
+	}
+	result := fmt.Sprintf("%v %v using (%v) with %v", joinType, j.LeftName, strings.Join(j.Using, ", "), j.RightName)
+	for _, line := range strings.Split(strings.TrimSpace(FormatSource(j.right)), "\n") {
+		result = fmt.Sprintf("%v\n    %v", result, line)
+	}
+	return result
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+)
+
+// LimitBy limits the rows from source to the first n rows for each combination
+// of values of the given dimensions, with rows ordered by the given OrderBys or
+// in the order in which they arrive if there are none. _time can be used as a
+// dimension to limit the rows for each timestamp.
+//
+// Unlike Sort, LimitBy doesn't buffer all rows. It only keeps the first n rows
+// of each group, in a bounded heap. Rows are returned one group at a time, in
+// the order in which groups first appeared, and are ordered within each group.
+func LimitBy(source FlatRowSource, n int, dims []string, orderBy ...OrderBy) FlatRowSource {
+	sortedDims := make([]string, len(dims))
+	copy(sortedDims, dims)
+	sort.Strings(sortedDims)
+	return &limitBy{
+		flatRowTransform{source},
+		n,
+		dims,
+		sortedDims,
+		orderBy,
+	}
+}
+
+type limitBy struct {
+	flatRowTransform
+	n          int
+	dims       []string
+	sortedDims []string
+	orderBy    []OrderBy
+}
+
+func (l *limitBy) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow) error {
+	guard := Guard(ctx)
+
+	groups := make(map[string]*limitedRows)
+	var orderedGroups []*limitedRows
+	seq := 0
+	err := l.source.Iterate(ctx, onFields, func(row *FlatRow) (bool, error) {
+		key := string(l.groupKeyFor(row))
+		group := groups[key]
+		if group == nil {
+			group = &limitedRows{orderBy: l.orderBy}
+			groups[key] = group
+			orderedGroups = append(orderedGroups, group)
+		}
+		group.offer(&limitedRow{row, seq}, l.n)
+		seq++
+		return guard.Proceed()
+	})
+
+	if err != ErrDeadlineExceeded {
+		for _, group := range orderedGroups {
+			for _, row := range group.sorted() {
+				if guard.TimedOut() {
+					return ErrDeadlineExceeded
+				}
+
+				more, onRowErr := onRow(row)
+				if onRowErr != nil {
+					return onRowErr
+				}
+				if !more {
+					return err
+				}
+			}
+		}
+	}
+	return err
+}
+
+// groupKeyFor returns the values of the LimitBy dimensions for the given row.
+func (l *limitBy) groupKeyFor(row *FlatRow) bytemap.ByteMap {
+	names := make([]string, 0, len(l.sortedDims))
+	values := make([]interface{}, 0, len(l.sortedDims))
+	for _, dim := range l.sortedDims {
+		var val interface{}
+		if dim == "_time" {
+			val = row.TS
+		} else {
+			val = row.Key.Get(dim)
+		}
+		if val != nil {
+			names = append(names, dim)
+			values = append(values, val)
+		}
+	}
+	return bytemap.FromSortedKeysAndValues(names, values)
+}
+
+func (l *limitBy) String() string {
+	result := fmt.Sprintf("limit %d by %v", l.n, strings.Join(l.dims, ", "))
+	if len(l.orderBy) > 0 {
+		result = fmt.Sprintf("%v order by %v", result, l.orderBy)
+	}
+	return result
+}
+
+type limitedRow struct {
+	*FlatRow
+	seq int
+}
+
+// limitedRows is a heap of the rows kept for one group. Its root is the row
+// that comes last, which is the one replaced when a row that comes before it
+// arrives after the group is full.
+type limitedRows struct {
+	orderBy []OrderBy
+	rows    []*limitedRow
+}
+
+func (r *limitedRows) Len() int           { return len(r.rows) }
+func (r *limitedRows) Swap(i, j int)      { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
+func (r *limitedRows) Less(i, j int) bool { return r.before(r.rows[j], r.rows[i]) }
+
+func (r *limitedRows) Push(x interface{}) {
+	r.rows = append(r.rows, x.(*limitedRow))
+}
+
+func (r *limitedRows) Pop() interface{} {
+	last := len(r.rows) - 1
+	row := r.rows[last]
+	r.rows = r.rows[:last]
+	return row
+}
+
+// before determines whether row a comes before row b, breaking ties by the
+// order in which they arrived.
+func (r *limitedRows) before(a *limitedRow, b *limitedRow) bool {
+	if rowLess(r.orderBy, a.FlatRow, b.FlatRow) {
+		return true
+	}
+	if rowLess(r.orderBy, b.FlatRow, a.FlatRow) {
+		return false
+	}
+	return a.seq < b.seq
+}
+
+// offer keeps the given row if it's among the first n rows of the group.
+func (r *limitedRows) offer(row *limitedRow, n int) {
+	if len(r.rows) < n {
+		heap.Push(r, row)
+		return
+	}
+	if r.before(row, r.rows[0]) {
+		r.rows[0] = row
+		heap.Fix(r, 0)
+	}
+}
+
+// sorted empties the heap, returning its rows in order.
+func (r *limitedRows) sorted() []*FlatRow {
+	result := make([]*FlatRow, len(r.rows))
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(r).(*limitedRow).FlatRow
+	}
+	return result
+}
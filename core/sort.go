@@ -96,9 +96,12 @@ type orderedRows struct {
 func (r orderedRows) Len() int      { return len(r.rows) }
 func (r orderedRows) Swap(i, j int) { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
 func (r orderedRows) Less(i, j int) bool {
-	a := r.rows[i]
-	b := r.rows[j]
-	for _, order := range r.orderBy {
+	return rowLess(r.orderBy, r.rows[i], r.rows[j])
+}
+
+// rowLess determines whether row a sorts before row b according to orderBy.
+func rowLess(orderBy []OrderBy, a *FlatRow, b *FlatRow) bool {
+	for _, order := range orderBy {
 		// _time is a special case
 		if order.Field == "_time" {
 			ta := a.TS
@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"fmt"
+	"math"
 
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
@@ -51,8 +52,12 @@ func (f *unflatten) Iterate(ctx context.Context, onFields OnFields, onRow OnRow)
 		outRow := make(Vals, numOut)
 		params := expr.Map(make(map[string]float64, numIn))
 		for i, field := range inFields {
-			name := field.Name
-			params[name] = row.Values[i]
+			value := row.Values[i]
+			if math.IsNaN(value) {
+				// Missing value, e.g. from a LEFT JOIN or fill(null)
+				continue
+			}
+			params[field.Name] = value
 		}
 		for i, field := range outFields {
 			outRow[i] = encoding.NewValue(field.Expr, ts, params, row.Key)
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+)
+
+// Union combines the rows of several FlatRowSources, like UNION ALL. The
+// combined rows have the fields of all sources, matched by name in the order in
+// which they first appear. Rows from sources that don't have a given field are
+// missing the value for that field (NaN).
+//
+// Since the fields of all sources need to be known before any rows can be
+// returned, the sources are iterated concurrently until each has reported its
+// fields. Rows are then streamed from one source after the other, with the
+// remaining sources waiting their turn, so that rows aren't buffered.
+func Union(sources ...FlatRowSource) FlatRowSource {
+	return &union{sources}
+}
+
+type union struct {
+	sources []FlatRowSource
+}
+
+// unionSource tracks the iteration of one of the sources of a union.
+type unionSource struct {
+	fields  chan Fields
+	proceed chan struct{}
+	rows    chan *FlatRow
+	done    chan error
+	// idxs are the indexes of the source's fields in the combined fields
+	idxs     []int
+	finished bool
+}
+
+func (u *union) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow) error {
+	// Cancelling the context stops any sources that are still running once
+	// we're done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	guard := Guard(ctx)
+
+	sources := make([]*unionSource, 0, len(u.sources))
+	for _, source := range u.sources {
+		current := &unionSource{
+			fields:  make(chan Fields, 1),
+			proceed: make(chan struct{}),
+			rows:    make(chan *FlatRow),
+			done:    make(chan error, 1),
+		}
+		sources = append(sources, current)
+		go current.iterate(ctx, source)
+	}
+
+	var outFields Fields
+	fieldIdxs := make(map[string]int)
+	for _, current := range sources {
+		select {
+		case fields := <-current.fields:
+			for _, field := range fields {
+				idx, found := fieldIdxs[field.Name]
+				if !found {
+					idx = len(outFields)
+					fieldIdxs[field.Name] = idx
+					outFields = append(outFields, field)
+				}
+				current.idxs = append(current.idxs, idx)
+			}
+		case err := <-current.done:
+			if err != nil {
+				return err
+			}
+			// Source finished without reporting fields, so it has no rows
+			current.finished = true
+		}
+	}
+
+	err := onFields(outFields)
+	if err != nil {
+		return err
+	}
+
+	for _, current := range sources {
+		if current.finished {
+			continue
+		}
+		close(current.proceed)
+	rowLoop:
+		for {
+			select {
+			case row := <-current.rows:
+				if guard.TimedOut() {
+					return ErrDeadlineExceeded
+				}
+				values := make([]float64, len(outFields))
+				for i := range values {
+					values[i] = math.NaN()
+				}
+				for i, idx := range current.idxs {
+					values[idx] = row.Values[i]
+				}
+				more, err := onRow(&FlatRow{
+					TS:     row.TS,
+					Key:    row.Key,
+					Values: values,
+					fields: outFields,
+				})
+				if !more || err != nil {
+					return err
+				}
+			case err := <-current.done:
+				if err != nil {
+					return err
+				}
+				break rowLoop
+			}
+		}
+	}
+	return nil
+}
+
+// iterate iterates over the given source, waiting after reporting its fields
+// until it's this source's turn to return rows.
+func (s *unionSource) iterate(ctx context.Context, source FlatRowSource) {
+	s.done <- source.Iterate(ctx, func(fields Fields) error {
+		s.fields <- fields
+		select {
+		case <-s.proceed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, func(row *FlatRow) (bool, error) {
+		select {
+		case s.rows <- row:
+			return true, nil
+		case <-ctx.Done():
+			return false, nil
+		}
+	})
+}
+
+// GetGroupBy returns the dimensions that rows from any of the sources are
+// grouped by.
+func (u *union) GetGroupBy() []GroupBy {
+	var result []GroupBy
+	names := make(map[string]bool)
+	for _, source := range u.sources {
+		for _, groupBy := range source.GetGroupBy() {
+			if !names[groupBy.Name] {
+				result = append(result, groupBy)
+				names[groupBy.Name] = true
+			}
+		}
+	}
+	return result
+}
+
+// GetResolution returns the finest resolution of any of the sources.
+func (u *union) GetResolution() time.Duration {
+	var result time.Duration
+	for _, source := range u.sources {
+		resolution := source.GetResolution()
+		if result == 0 || (resolution > 0 && resolution < result) {
+			result = resolution
+		}
+	}
+	return result
+}
+
+// GetAsOf returns the earliest asOf of any of the sources.
+func (u *union) GetAsOf() time.Time {
+	var result time.Time
+	for _, source := range u.sources {
+		asOf := source.GetAsOf()
+		if result.IsZero() || asOf.Before(result) {
+			result = asOf
+		}
+	}
+	return result
+}
+
+// GetUntil returns the latest until of any of the sources.
+func (u *union) GetUntil() time.Time {
+	var result time.Time
+	for _, source := range u.sources {
+		until := source.GetUntil()
+		if until.After(result) {
+			result = until
+		}
+	}
+	return result
+}
+
+func (u *union) String() string {
+	result := "union all"
+	for _, source := range u.sources {
+		for _, line := range strings.Split(strings.TrimSpace(FormatSource(source)), "\n") {
+			result += "\n  " + line
+		}
+	}
+	return result
+}
@@ -0,0 +1,167 @@
+package encoding
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// CalendarUnit is the unit of time on which the periods of a Calendar are
+// based.
+type CalendarUnit int
+
+const (
+	// CalendarDay is a day from midnight to midnight
+	CalendarDay CalendarUnit = iota
+	// CalendarWeek is a week starting at midnight on Monday
+	CalendarWeek
+	// CalendarMonth is a month starting at midnight on the first day
+	CalendarMonth
+)
+
+const (
+	day = 24 * time.Hour
+	// daysFromEpochToMonday is the number of days between the Unix epoch (a
+	// Thursday) and the first Monday after it (1970-01-05).
+	daysFromEpochToMonday = 4
+)
+
+var (
+	calendarUnitSuffixes = []string{"d", "w", "mo"}
+	calendarPeriodRegex  = regexp.MustCompile(`^(\d+)(d|w|mo)$`)
+)
+
+// Calendar divides time into periods of N calendar days, weeks or months in a
+// specific time zone. Unlike with a fixed resolution, the periods of a Calendar
+// vary in length, for example because of daylight saving time or because
+// months have different numbers of days.
+//
+// Like periods at a fixed resolution, each period is labeled with the time at
+// which it ends and includes that time.
+type Calendar struct {
+	Unit     CalendarUnit
+	N        int
+	Location *time.Location
+}
+
+// NewCalendar constructs a new Calendar with periods of n of the given unit in
+// the given location. If location is nil, it defaults to UTC.
+func NewCalendar(unit CalendarUnit, n int, location *time.Location) *Calendar {
+	if location == nil {
+		location = time.UTC
+	}
+	return &Calendar{Unit: unit, N: n, Location: location}
+}
+
+// ParseCalendar parses a period like 1d, 2w or 1mo into a Calendar in the given
+// location. If period isn't expressed in calendar units, this returns nil.
+func ParseCalendar(period string, location *time.Location) (*Calendar, error) {
+	match := calendarPeriodRegex.FindStringSubmatch(period)
+	if match == nil {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse calendar period %v: %v", period, err)
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("Calendar period %v must be positive", period)
+	}
+	for unit, suffix := range calendarUnitSuffixes {
+		if suffix == match[2] {
+			return NewCalendar(CalendarUnit(unit), n, location), nil
+		}
+	}
+	return nil, nil
+}
+
+// RoundUp returns the end of the period containing ts, which is also the
+// label of that period. Times that fall on the boundary between two periods
+// belong to the earlier one, just like with RoundTimeUp.
+func (c *Calendar) RoundUp(ts time.Time) time.Time {
+	period := c.periodOf(ts)
+	start := c.startOf(period)
+	if !start.Before(ts) {
+		return start
+	}
+	return c.startOf(period + 1)
+}
+
+// Add adds the given number of periods to ts, which should be a period
+// boundary.
+func (c *Calendar) Add(ts time.Time, periods int) time.Time {
+	return c.startOf(c.periodOf(ts) + periods)
+}
+
+// PeriodsBetween returns the number of periods between the period boundaries
+// from and to.
+func (c *Calendar) PeriodsBetween(from time.Time, to time.Time) int {
+	return c.periodOf(to) - c.periodOf(from)
+}
+
+// Nominal returns the nominal length of a period, treating all days as 24
+// hours long and all months as 30 days long.
+func (c *Calendar) Nominal() time.Duration {
+	switch c.Unit {
+	case CalendarWeek:
+		return time.Duration(c.N) * 7 * day
+	case CalendarMonth:
+		return time.Duration(c.N) * 30 * day
+	default:
+		return time.Duration(c.N) * day
+	}
+}
+
+// TimeZone returns the name of the time zone in which periods are aligned.
+func (c *Calendar) TimeZone() string {
+	return c.Location.String()
+}
+
+// periodOf returns the index of the period containing ts (or starting at ts,
+// if ts is a period boundary), counting from the Unix epoch.
+func (c *Calendar) periodOf(ts time.Time) int {
+	year, month, dayOfMonth := ts.In(c.Location).Date()
+	var units int
+	switch c.Unit {
+	case CalendarMonth:
+		units = (year-1970)*12 + int(month) - 1
+	default:
+		units = int(time.Date(year, month, dayOfMonth, 0, 0, 0, 0, time.UTC).Unix() / int64(day/time.Second))
+		if c.Unit == CalendarWeek {
+			units = floorDiv(units-daysFromEpochToMonday, 7)
+		}
+	}
+	return floorDiv(units, c.N)
+}
+
+// startOf returns the time at which the period with the given index starts.
+func (c *Calendar) startOf(period int) time.Time {
+	units := period * c.N
+	switch c.Unit {
+	case CalendarMonth:
+		return time.Date(1970, time.Month(units+1), 1, 0, 0, 0, 0, c.Location)
+	case CalendarWeek:
+		return time.Date(1970, 1, 1+daysFromEpochToMonday+units*7, 0, 0, 0, 0, c.Location)
+	default:
+		return time.Date(1970, 1, 1+units, 0, 0, 0, 0, c.Location)
+	}
+}
+
+// Period returns the period in the form accepted by ParseCalendar, like 1d, 2w
+// or 1mo.
+func (c *Calendar) Period() string {
+	return fmt.Sprintf("%d%v", c.N, calendarUnitSuffixes[c.Unit])
+}
+
+func (c *Calendar) String() string {
+	return fmt.Sprintf("%v in %v", c.Period(), c.TimeZone())
+}
+
+func floorDiv(a int, b int) int {
+	result := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		result--
+	}
+	return result
+}
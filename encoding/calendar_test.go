@@ -0,0 +1,76 @@
+package encoding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalendarDays(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cal := NewCalendar(CalendarDay, 1, ny)
+
+	midnight := time.Date(2017, 3, 12, 0, 0, 0, 0, ny)
+	nextMidnight := time.Date(2017, 3, 13, 0, 0, 0, 0, ny)
+	assert.Equal(t, nextMidnight, cal.RoundUp(midnight.Add(time.Second)))
+	assert.Equal(t, midnight, cal.RoundUp(midnight), "boundary should belong to earlier period")
+	// Daylight saving time started on March 12th, 2017, so that day was only 23
+	// hours long
+	assert.Equal(t, 23*time.Hour, cal.Add(midnight, 1).Sub(midnight))
+	assert.Equal(t, nextMidnight, cal.Add(midnight, 1))
+	assert.Equal(t, midnight, cal.Add(nextMidnight, -1))
+	assert.Equal(t, 1, cal.PeriodsBetween(midnight, nextMidnight))
+	// 2 AM UTC is still the prior day in New York
+	assert.Equal(t, time.Date(2017, 3, 11, 0, 0, 0, 0, ny), cal.RoundUp(time.Date(2017, 3, 11, 2, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 24*time.Hour, cal.Nominal())
+	assert.Equal(t, "1d", cal.Period())
+	assert.Equal(t, "1d in America/New_York", cal.String())
+}
+
+func TestCalendarWeeks(t *testing.T) {
+	cal := NewCalendar(CalendarWeek, 1, nil)
+	// October 18th, 2017 was a Wednesday
+	assert.Equal(t, time.Date(2017, 10, 23, 0, 0, 0, 0, time.UTC), cal.RoundUp(time.Date(2017, 10, 18, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2017, 10, 16, 0, 0, 0, 0, time.UTC), cal.Add(time.Date(2017, 10, 23, 0, 0, 0, 0, time.UTC), -1))
+	// Weeks before the epoch
+	assert.Equal(t, time.Date(1969, 12, 29, 0, 0, 0, 0, time.UTC), cal.RoundUp(time.Date(1969, 12, 25, 0, 0, 0, 1, time.UTC)))
+
+	cal = NewCalendar(CalendarWeek, 2, nil)
+	boundary := cal.RoundUp(time.Date(2017, 10, 18, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Monday, boundary.Weekday())
+	assert.Equal(t, 14*24*time.Hour, cal.Add(boundary, 1).Sub(boundary))
+}
+
+func TestCalendarMonths(t *testing.T) {
+	cal := NewCalendar(CalendarMonth, 1, nil)
+	feb := time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, mar, cal.RoundUp(time.Date(2017, 2, 14, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 28*24*time.Hour, cal.Add(feb, 1).Sub(feb))
+	assert.Equal(t, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), cal.Add(feb, -2))
+	assert.Equal(t, 14, cal.PeriodsBetween(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), mar))
+
+	cal = NewCalendar(CalendarMonth, 3, nil)
+	assert.Equal(t, time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC), cal.RoundUp(feb))
+}
+
+func TestParseCalendar(t *testing.T) {
+	cal, err := ParseCalendar("2w", time.UTC)
+	if assert.NoError(t, err) && assert.NotNil(t, cal) {
+		assert.Equal(t, CalendarWeek, cal.Unit)
+		assert.Equal(t, 2, cal.N)
+	}
+	cal, err = ParseCalendar("1mo", time.UTC)
+	if assert.NoError(t, err) && assert.NotNil(t, cal) {
+		assert.Equal(t, CalendarMonth, cal.Unit)
+	}
+	cal, err = ParseCalendar("5m", time.UTC)
+	assert.NoError(t, err)
+	assert.Nil(t, cal, "minutes aren't calendar periods")
+	_, err = ParseCalendar("0d", time.UTC)
+	assert.Error(t, err)
+}
@@ -259,21 +259,9 @@ func (seq Sequence) SubMerge(other Sequence, metadata goexpr.Params, resolution
 	resultUntil := result.Until()
 	otherUntil := other.Until()
 	if shiftBack > 0 {
-		shiftedOtherUntil := otherUntil.Add(shiftBack)
-		if shiftedOtherUntil.After(until) {
-			shiftedOtherUntil = until
-		}
-		growByPeriods := int(shiftedOtherUntil.Sub(otherUntil) / otherResolution)
-		if growByPeriods > 0 {
-			growBy := growByPeriods * otherWidth
-			// grow other to give us a chance to pick up the shifted values
-			grown := make(Sequence, len(other)+growBy)
-			grown.SetUntil(shiftedOtherUntil)
-			copy(grown[Width64bits+growBy:], other[Width64bits:])
-			other = grown
-			otherUntil = shiftedOtherUntil
-			otherPeriods = other.NumPeriods(otherWidth)
-		}
+		other = other.growForShift(otherWidth, otherResolution, shiftBack, until)
+		otherUntil = other.Until()
+		otherPeriods = other.NumPeriods(otherWidth)
 	}
 	newUntil := RoundTimeUntilUp(otherUntil, resolution, until)
 	if len(result) <= Width64bits {
@@ -313,12 +301,93 @@ func (seq Sequence) SubMerge(other Sequence, metadata goexpr.Params, resolution
 			break
 		}
 		if strideSlice <= 0 || (po+untilOffset)%scale < strideSlicePeriods {
-			submerge(result[Width64bits+p*width:], other[Width64bits+po*otherWidth:], otherResolution, metadata)
+			submerge(result[Width64bits+p*width:], other[Width64bits+po*otherWidth:], otherResolution, resolution, metadata)
+		}
+	}
+	return
+}
+
+// SubMergeCalendar is like SubMerge, except that the periods of the resulting
+// Sequence follow the given Calendar rather than a fixed resolution. The
+// submerge function is given the Calendar's nominal resolution.
+func (seq Sequence) SubMergeCalendar(other Sequence, metadata goexpr.Params, calendar *Calendar, otherResolution time.Duration, ex expr.Expr, otherEx expr.Expr, submerge expr.SubMerge, asOf time.Time, until time.Time) (result Sequence) {
+	shiftBack := -1 * ex.Shift()
+	result = seq
+	otherWidth := otherEx.EncodedWidth()
+	other = other.Truncate(otherWidth, otherResolution, asOf.Add(-1*shiftBack), until)
+	if shiftBack > 0 {
+		other = other.growForShift(otherWidth, otherResolution, shiftBack, until)
+	}
+	otherPeriods := other.NumPeriods(otherWidth)
+	if otherPeriods == 0 {
+		return
+	}
+
+	width := ex.EncodedWidth()
+	otherUntil := other.Until()
+	newUntil := calendar.RoundUp(otherUntil)
+	newAsOf := calendar.RoundUp(otherUntil.Add(-1 * time.Duration(otherPeriods-1) * otherResolution))
+	if len(result) <= Width64bits {
+		result = NewSequence(width, calendar.PeriodsBetween(newAsOf, newUntil)+1)
+		result.SetUntil(newUntil)
+	} else {
+		periodsToPrepend := calendar.PeriodsBetween(result.Until(), newUntil)
+		if periodsToPrepend > 0 {
+			prepended := NewSequence(width, periodsToPrepend)
+			prepended.SetUntil(newUntil)
+			// Append existing data
+			result = append(prepended, result[Width64bits:]...)
+		}
+		periodsNeeded := calendar.PeriodsBetween(newAsOf, result.Until()) + 1
+		if periodsNeeded > result.NumPeriods(width) {
+			appended := NewSequence(width, periodsNeeded)
+			copy(appended, result)
+			result = appended
 		}
 	}
+
+	resultUntil := result.Until()
+	resolution := calendar.Nominal()
+	for po := 0; po < otherPeriods; po++ {
+		otherTime := otherUntil.Add(-1 * time.Duration(po) * otherResolution)
+		p := calendar.PeriodsBetween(calendar.RoundUp(otherTime), resultUntil)
+		submerge(result[Width64bits+p*width:], other[Width64bits+po*otherWidth:], otherResolution, resolution, metadata)
+	}
 	return
 }
 
+// growForShift grows the Sequence by up to shiftBack worth of periods (but not
+// past until) to give shifted expressions a chance to pick up shifted values.
+func (seq Sequence) growForShift(width int, resolution time.Duration, shiftBack time.Duration, until time.Time) Sequence {
+	oldUntil := seq.Until()
+	shiftedUntil := oldUntil.Add(shiftBack)
+	if shiftedUntil.After(until) {
+		shiftedUntil = until
+	}
+	growByPeriods := int(shiftedUntil.Sub(oldUntil) / resolution)
+	if growByPeriods <= 0 {
+		return seq
+	}
+	growBy := growByPeriods * width
+	grown := make(Sequence, len(seq)+growBy)
+	grown.SetUntil(shiftedUntil)
+	copy(grown[Width64bits+growBy:], seq[Width64bits:])
+	return grown
+}
+
+// ValueAtCalendarTime is like ValueAtTime, but assumes that periods follow the
+// given Calendar.
+func (seq Sequence) ValueAtCalendarTime(t time.Time, e expr.Expr, calendar *Calendar) (val float64, found bool) {
+	if e.IsConstant() {
+		val, found, _ = e.Get(nil)
+		return
+	}
+	if len(seq) == 0 {
+		return 0, false
+	}
+	return seq.ValueAt(calendar.PeriodsBetween(calendar.RoundUp(t), seq.Until()), e)
+}
+
 // Merge merges the other Sequence into this Sequence by applying the given
 // Expr's merge operator to each period in both Sequences. The resulting
 // Sequence will start at the early of the two Sequence's start times, and will
@@ -279,6 +279,58 @@ func doTestSequenceSubMerge(t *testing.T, _strideSlice int) {
 	testSubMergeParts(random)
 }
 
+func TestSequenceSubMergeCalendar(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cal := NewCalendar(CalendarDay, 1, ny)
+	inResolution := time.Hour
+	// Daylight saving time started on March 12th, 2017, so that day was only 23
+	// hours long
+	asOf := time.Date(2017, 3, 11, 0, 0, 0, 0, ny)
+	until := time.Date(2017, 3, 14, 0, 0, 0, 0, ny)
+	inPeriods := int(until.Sub(asOf) / inResolution)
+
+	eIn := SUM(FIELD("a"))
+	eOut := SUM(FIELD("a"))
+	submerge := eOut.SubMergers([]Expr{eIn})[0]
+	params := FloatParams(1)
+	expectedVals := []float64{24, 23, 24}
+
+	assertResult := func(result Sequence) {
+		if assert.Equal(t, until.In(time.UTC), result.Until().In(time.UTC)) {
+			var resultVals []float64
+			for i := 0; i < result.NumPeriods(eOut.EncodedWidth()); i++ {
+				val, _ := result.ValueAt(i, eOut)
+				resultVals = append(resultVals, val)
+			}
+			assert.EqualValues(t, expectedVals, resultVals)
+			val, found := result.ValueAtCalendarTime(time.Date(2017, 3, 12, 12, 0, 0, 0, ny), eOut, cal)
+			assert.True(t, found)
+			assert.EqualValues(t, 23, val)
+		}
+	}
+
+	// Try it with a single big in sequence
+	in := NewSequence(eIn.EncodedWidth(), inPeriods)
+	in.SetUntil(until)
+	for i := 0; i < inPeriods; i++ {
+		in.UpdateValueAt(i, eIn, params, nil)
+	}
+	var result Sequence
+	result = result.SubMergeCalendar(in, nil, cal, inResolution, eOut, eIn, submerge, asOf, until)
+	assertResult(result)
+
+	// Try it with a bunch of small sequences in random order
+	result = nil
+	for _, o := range rand.Perm(inPeriods) {
+		in := NewFloatValue(eIn, until.Add(-1*time.Duration(o)*inResolution), 1)
+		result = result.SubMergeCalendar(in, nil, cal, inResolution, eOut, eIn, submerge, asOf, until)
+	}
+	assertResult(result)
+}
+
 func randBelow(res time.Duration) time.Duration {
 	return time.Duration(-1 * rand.Intn(int(res)))
 }
@@ -48,11 +48,55 @@ func validateWrappedInAggregate(wrapped Expr) error {
 	if wrapped == nil {
 		return fmt.Errorf("Aggregate cannot wrap nil expression")
 	}
-	typeOfWrapped := reflect.TypeOf(wrapped)
-	if typeOfWrapped != fieldType && typeOfWrapped != constType && typeOfWrapped != boundedType {
-		return fmt.Errorf("Aggregate can only wrap field and constant expressions, not %v", typeOfWrapped)
+	if wrapped.EncodedWidth() > 0 {
+		return fmt.Errorf("Aggregate cannot wrap %v, which is itself aggregated", wrapped)
 	}
-	return wrapped.Validate()
+	return validatePerPoint(wrapped)
+}
+
+// validatePerPoint validates an expression that gets evaluated against each
+// individual point rather than against aggregated values, like the expressions
+// wrapped by aggregates. Such expressions may combine fields and constants with
+// math, IF and BOUNDED, but they can't be shifted since individual points
+// aren't retained.
+func validatePerPoint(e Expr) error {
+	switch t := e.(type) {
+	case *field, *constant:
+		return nil
+	case *bounded:
+		return validatePerPoint(t.wrapped)
+	case *unaryMathExpr:
+		return validatePerPoint(t.Wrapped)
+	case *ifExpr:
+		return validatePerPoint(t.Wrapped)
+	case *binaryExpr:
+		err := validatePerPoint(t.Left)
+		if err == nil {
+			err = validatePerPoint(t.Right)
+		}
+		return err
+	case *coalesce:
+		return validateAllPerPoint(t.Wrapped)
+	case *caseExpr:
+		return validateAllPerPoint(t.parts())
+	case *shift:
+		return fmt.Errorf("Cannot shift individual points in %v, shift an aggregate instead", e)
+	case *lookback:
+		return fmt.Errorf("Cannot calculate %v for individual points, use it on an aggregate instead", t.Name)
+	case *moving:
+		return fmt.Errorf("Cannot calculate %v for individual points, use it on an aggregate instead", t.Name)
+	}
+	return fmt.Errorf("%v of type %v cannot be evaluated for individual points", e, reflect.TypeOf(e))
+}
+
+func validateAllPerPoint(exprs []Expr) error {
+	for _, e := range exprs {
+		err := validatePerPoint(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (e *aggregate) EncodedWidth() int {
@@ -104,7 +148,7 @@ func (e *aggregate) SubMergers(subs []Expr) []SubMerge {
 	return result
 }
 
-func (e *aggregate) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+func (e *aggregate) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
 	e.Merge(data, data, other)
 }
 
@@ -2,6 +2,7 @@ package expr
 
 import (
 	"testing"
+	"time"
 
 	"github.com/getlantern/goexpr"
 	"github.com/stretchr/testify/assert"
@@ -37,16 +38,25 @@ func TestSUMConditional(t *testing.T) {
 }
 
 func TestValidateAggregate(t *testing.T) {
-	sum := SUM(MULT(CONST(1), CONST(2)))
-	assert.Error(t, sum.Validate())
-	avg := AVG(MULT(CONST(1), CONST(2)))
-	assert.Error(t, avg.Validate())
+	sum := SUM(SUM(FIELD("a")))
+	assert.Error(t, sum.Validate(), "Nested aggregates should be rejected")
+	avg := AVG(ADD(FIELD("a"), MAX(FIELD("b"))))
+	assert.Error(t, avg.Validate(), "Aggregates nested in math should be rejected")
 	wavg := WAVG(FIELD("b"), SUM(FIELD("c")))
 	assert.Error(t, wavg.Validate())
+	shifted := SUM(SHIFT(FIELD("a"), time.Hour))
+	assert.Error(t, shifted.Validate(), "Shifting individual points should be rejected")
 	ok := SUM(CONST(1))
 	assert.NoError(t, ok.Validate())
 	ok2 := AVG(FIELD("b"))
 	assert.NoError(t, ok2.Validate())
+	ok3 := SUM(MULT(CONST(1), CONST(2)))
+	assert.NoError(t, ok3.Validate())
+	ok4 := SUM(MULT(FIELD("a"), BOUNDED(FIELD("b"), 0, 10)))
+	assert.NoError(t, ok4.Validate())
+	log, _ := UnaryMath("LOG10", FIELD("a"))
+	ok5 := PERCENTILE(IF(nil, log), 90)
+	assert.NoError(t, ok5.Validate())
 }
 
 func boundedA() Expr {
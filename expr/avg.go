@@ -33,7 +33,7 @@ func (e *avg) Validate() error {
 	if e.Weight.EncodedWidth() > 0 {
 		return fmt.Errorf("Weight expression %v must be a constant or directly derived from a field", e.Weight)
 	}
-	return nil
+	return validatePerPoint(e.Weight)
 }
 
 func (e *avg) EncodedWidth() int {
@@ -94,7 +94,7 @@ func (e *avg) SubMergers(subs []Expr) []SubMerge {
 	return result
 }
 
-func (e *avg) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+func (e *avg) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
 	e.Merge(data, data, other)
 }
 
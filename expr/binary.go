@@ -2,7 +2,6 @@ package expr
 
 import (
 	"fmt"
-	"reflect"
 	"time"
 
 	"github.com/getlantern/goexpr"
@@ -11,6 +10,10 @@ import (
 
 var binaryExprs = make(map[string]func(left interface{}, right interface{}) *binaryExpr)
 
+// binaryFuncs are the binary expressions that are written as function calls,
+// like POW(a, b), rather than as operators.
+var binaryFuncs = make(map[string]bool)
+
 func binaryExprFor(op string, left interface{}, right interface{}) *binaryExpr {
 	ctor, found := binaryExprs[op]
 	if !found {
@@ -30,6 +33,13 @@ func registerBinaryExpr(op string, calc calcFN) {
 	}
 }
 
+// registerBinaryFunc registers a binary expression that's written as a function
+// call.
+func registerBinaryFunc(name string, calc calcFN) {
+	registerBinaryExpr(name, calc)
+	binaryFuncs[name] = true
+}
+
 type calcFN func(left float64, right float64) float64
 
 type binaryExpr struct {
@@ -51,14 +61,12 @@ func validateWrappedInBinary(wrapped Expr) error {
 	if wrapped == nil {
 		return fmt.Errorf("Binary expression cannot wrap nil expression")
 	}
-	typeOfWrapped := reflect.TypeOf(wrapped)
-	if typeOfWrapped == aggregateType || typeOfWrapped == ifType || typeOfWrapped == avgType || typeOfWrapped == constType || typeOfWrapped == shiftType || typeOfWrapped == unaryMathType {
-		return nil
-	}
-	if typeOfWrapped == binaryType {
-		return wrapped.Validate()
+	if wrapped.EncodedWidth() == 0 && !wrapped.IsConstant() {
+		// Values of unaggregated expressions aren't retained, so there's nothing
+		// to combine with the other side once the point has been aggregated.
+		return fmt.Errorf("Binary expression cannot wrap unaggregated expression %v, aggregate it first", wrapped)
 	}
-	return fmt.Errorf("Binary expression must wrap only aggregate, if, constant or shift expressions, or other binary expressions that wrap only aggregate or constant expressions, not %v of type %v", wrapped, typeOfWrapped)
+	return wrapped.Validate()
 }
 
 func (e *binaryExpr) EncodedWidth() int {
@@ -106,7 +114,7 @@ func (e *binaryExpr) SubMergers(subs []Expr) []SubMerge {
 	return result
 }
 
-func (e *binaryExpr) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+func (e *binaryExpr) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
 	e.Merge(data, data, other)
 }
 
@@ -119,14 +127,32 @@ func combinedSubMerge(left SubMerge, width int, right SubMerge) SubMerge {
 		return left
 	}
 	if left == nil {
-		return func(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
-			right(data[width:], other, otherRes, metadata)
+		return func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+			right(data[width:], other, otherRes, res, metadata)
 		}
 	}
-	return func(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
-		left(data, other, otherRes, metadata)
-		right(data[width:], other, otherRes, metadata)
+	return func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+		left(data, other, otherRes, res, metadata)
+		right(data[width:], other, otherRes, res, metadata)
+	}
+}
+
+// combinedSubMergers builds SubMerges for an expression whose encoding consists
+// of the encodings of parts, one after the other. If filter is non-nil, it's
+// used to wrap the SubMerge for each part.
+func combinedSubMergers(parts []Expr, subs []Expr, filter func(part int, sm SubMerge) SubMerge) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	offset := 0
+	for p, part := range parts {
+		for i, sm := range part.SubMergers(subs) {
+			if sm != nil && filter != nil {
+				sm = filter(p, sm)
+			}
+			result[i] = combinedSubMerge(result[i], offset, sm)
+		}
+		offset += part.EncodedWidth()
 	}
+	return result
 }
 
 func (e *binaryExpr) Get(b []byte) (float64, bool, []byte) {
@@ -143,6 +169,9 @@ func (e *binaryExpr) IsConstant() bool {
 }
 
 func (e *binaryExpr) String() string {
+	if binaryFuncs[e.Op] {
+		return fmt.Sprintf("%v(%v, %v)", e.Op, e.Left, e.Right)
+	}
 	return fmt.Sprintf("(%v %v %v)", e.Left, e.Op, e.Right)
 }
 
@@ -30,6 +30,10 @@ func TestDIVZeroZero(t *testing.T) {
 	doTestCalc(t, DIV("c", "c"), 0)
 }
 
+func TestPerPointCalc(t *testing.T) {
+	doTestCalc(t, SUM(MULT("a", ADD("b", "d"))), 48.4)
+}
+
 func TestValidateBinary(t *testing.T) {
 	bad := MULT(FIELD("a"), FIELD("b"))
 	assert.Error(t, bad.Validate())
@@ -41,6 +45,8 @@ func TestValidateBinary(t *testing.T) {
 	assert.NoError(t, ok3.Validate())
 	ok4 := MULT(CONST(1), ADD(AVG(FIELD("b")), GT(CONST(3), SUM("c"))))
 	assert.NoError(t, ok4.Validate())
+	bad2 := ADD(SUM(FIELD("a")), BOUNDED(FIELD("b"), 0, 10))
+	assert.Error(t, bad2.Validate())
 }
 
 func doTestCalc(t *testing.T, e Expr, expected float64) {
@@ -0,0 +1,301 @@
+package expr
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// When is a branch of a CASE expression. A branch either has a DimCond, which
+// is checked against the dimensions of each point as it's added (like IF), or a
+// Cond, which is checked against values and holds if it evaluates to something
+// other than 0.
+type When struct {
+	DimCond goexpr.Expr
+	Cond    Expr
+	Value   Expr
+}
+
+// WHEN creates a branch for CASE that's taken when the value expression cond
+// is true.
+func WHEN(cond interface{}, value interface{}) *When {
+	return &When{Cond: exprFor(cond), Value: exprFor(value)}
+}
+
+// WHEN_DIM creates a branch for CASE that includes only points whose
+// dimensions satisfy cond. Each point is included by at most one branch, the
+// first one whose cond it satisfies. The branch is taken if it includes any
+// points.
+func WHEN_DIM(cond goexpr.Expr, value interface{}) *When {
+	return &When{DimCond: cond, Value: exprFor(value)}
+}
+
+// CASE creates an Expr that obtains its value from the first of the given
+// branches that is taken, or from elseValue if none is taken. elseValue may be
+// nil, in which case the value is unset if no branch is taken. If there are
+// any dimension branches, elseValue includes only points that weren't included
+// by any of them.
+func CASE(whens []*When, elseValue interface{}) Expr {
+	e := &caseExpr{Whens: whens}
+	if elseValue != nil {
+		e.Else = exprFor(elseValue)
+	}
+	return e
+}
+
+type caseExpr struct {
+	Whens []*When
+	Else  Expr
+}
+
+// parts returns the sub-expressions whose encodings make up the encoding of
+// this expression, in order.
+func (e *caseExpr) parts() []Expr {
+	parts := make([]Expr, 0, len(e.Whens)*2+1)
+	for _, when := range e.Whens {
+		if when.Cond != nil {
+			parts = append(parts, when.Cond)
+		}
+		parts = append(parts, when.Value)
+	}
+	if e.Else != nil {
+		parts = append(parts, e.Else)
+	}
+	return parts
+}
+
+func (e *caseExpr) Validate() error {
+	if len(e.Whens) == 0 {
+		return fmt.Errorf("CASE requires at least one WHEN")
+	}
+	for _, when := range e.Whens {
+		if when.Value == nil || (when.Cond == nil && when.DimCond == nil) {
+			return fmt.Errorf("Each WHEN requires a condition and a value")
+		}
+	}
+	if e.EncodedWidth() == 0 && !e.IsConstant() {
+		return fmt.Errorf("CASE with conditions on dimensions or fields must aggregate its values, or be wrapped in an aggregate")
+	}
+	for _, part := range e.parts() {
+		err := validateWrappedInBinary(part)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *caseExpr) EncodedWidth() int {
+	width := 0
+	for _, part := range e.parts() {
+		width += part.EncodedWidth()
+	}
+	return width
+}
+
+func (e *caseExpr) Shift() time.Duration {
+	return minShift(e.parts())
+}
+
+// dimBranch returns the index of the dimension branch that includes a point
+// with the given metadata, or -1 if none does.
+func (e *caseExpr) dimBranch(metadata goexpr.Params) int {
+	for i, when := range e.Whens {
+		if when.DimCond != nil && dimCondHolds(when.DimCond, metadata) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *caseExpr) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	branch := e.dimBranch(metadata)
+	if e.EncodedWidth() == 0 {
+		// Evaluating an individual point, take the first applicable branch
+		for i, when := range e.Whens {
+			if when.DimCond != nil {
+				if i != branch {
+					continue
+				}
+			} else {
+				_, cond, condUpdated := when.Cond.Update(b, params, metadata)
+				if !(condUpdated || when.Cond.IsConstant()) || cond == 0 {
+					continue
+				}
+			}
+			_, value, updated := when.Value.Update(b, params, metadata)
+			return b, value, updated || when.Value.IsConstant()
+		}
+		if e.Else == nil {
+			return b, 0, false
+		}
+		_, value, updated := e.Else.Update(b, params, metadata)
+		return b, value, updated || e.Else.IsConstant()
+	}
+
+	remain := b
+	anyUpdated := false
+	update := func(part Expr, include bool) {
+		var updated bool
+		if include {
+			remain, _, updated = part.Update(remain, params, metadata)
+			anyUpdated = anyUpdated || updated
+		} else {
+			_, _, remain = part.Get(remain)
+		}
+	}
+	for i, when := range e.Whens {
+		if when.DimCond != nil {
+			update(when.Value, i == branch)
+		} else {
+			update(when.Cond, true)
+			update(when.Value, true)
+		}
+	}
+	if e.Else != nil {
+		update(e.Else, branch == -1)
+	}
+	value, _, _ := e.Get(b)
+	return remain, value, anyUpdated
+}
+
+func (e *caseExpr) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	for _, part := range e.parts() {
+		b, x, y = part.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
+func (e *caseExpr) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+			return result
+		}
+	}
+
+	// Map parts to the dimension branch that they belong to, if any
+	branches := make([]int, 0, len(e.Whens)*2+1)
+	for i, when := range e.Whens {
+		if when.Cond != nil {
+			branches = append(branches, i, i)
+		} else {
+			branches = append(branches, i)
+		}
+	}
+	branches = append(branches, -1)
+	return combinedSubMergers(e.parts(), subs, func(part int, sm SubMerge) SubMerge {
+		branch := branches[part]
+		if branch >= 0 && e.Whens[branch].DimCond == nil {
+			// Value branches include all points
+			return sm
+		}
+		return func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+			if e.dimBranch(metadata) == branch {
+				sm(data, other, otherRes, res, metadata)
+			}
+		}
+	})
+}
+
+func (e *caseExpr) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *caseExpr) Get(b []byte) (float64, bool, []byte) {
+	result, resultSet, taken := float64(0), false, false
+	remain := b
+	for _, when := range e.Whens {
+		condHolds := true
+		if when.Cond != nil {
+			var cond float64
+			var condSet bool
+			cond, condSet, remain = when.Cond.Get(remain)
+			condHolds = condSet && cond != 0
+		}
+		var value float64
+		var wasSet bool
+		value, wasSet, remain = when.Value.Get(remain)
+		if when.DimCond != nil {
+			// Dimension branches are taken if they included any points
+			condHolds = wasSet
+		}
+		if condHolds && !taken {
+			result, resultSet, taken = value, wasSet, true
+		}
+	}
+	if e.Else != nil {
+		var value float64
+		var wasSet bool
+		value, wasSet, remain = e.Else.Get(remain)
+		if !taken {
+			result, resultSet = value, wasSet
+		}
+	}
+	return result, resultSet, remain
+}
+
+func (e *caseExpr) IsConstant() bool {
+	for _, when := range e.Whens {
+		if when.DimCond != nil {
+			return false
+		}
+	}
+	for _, part := range e.parts() {
+		if !part.IsConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *caseExpr) String() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("CASE")
+	for _, when := range e.Whens {
+		if when.DimCond != nil {
+			fmt.Fprintf(buf, " WHEN_DIM %v THEN %v", when.DimCond, when.Value)
+		} else {
+			fmt.Fprintf(buf, " WHEN %v THEN %v", when.Cond, when.Value)
+		}
+	}
+	if e.Else != nil {
+		fmt.Fprintf(buf, " ELSE %v", e.Else)
+	}
+	buf.WriteString(" END")
+	return buf.String()
+}
+
+func (e *caseExpr) DecodeMsgpack(dec *msgpack.Decoder) error {
+	m := make(map[string]interface{})
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	whens, _ := m["Whens"].([]interface{})
+	e.Whens = make([]*When, 0, len(whens))
+	for _, _when := range whens {
+		wm := make(map[string]interface{})
+		switch t := _when.(type) {
+		case map[string]interface{}:
+			wm = t
+		case map[interface{}]interface{}:
+			for key, value := range t {
+				wm[fmt.Sprint(key)] = value
+			}
+		default:
+			return fmt.Errorf("Unexpected encoding of WHEN: %v", _when)
+		}
+		when := &When{}
+		when.DimCond, _ = wm["DimCond"].(goexpr.Expr)
+		when.Cond, _ = wm["Cond"].(Expr)
+		when.Value, _ = wm["Value"].(Expr)
+		e.Whens = append(e.Whens, when)
+	}
+	e.Else, _ = m["Else"].(Expr)
+	return nil
+}
@@ -0,0 +1,111 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCASEOnValues(t *testing.T) {
+	e := msgpacked(t, CASE([]*When{
+		WHEN(GT(SUM("a"), 10), CONST(2)),
+		WHEN(GT(SUM("a"), 5), CONST(1)),
+	}, CONST(0)))
+	assert.NoError(t, e.Validate())
+
+	b := make([]byte, e.EncodedWidth())
+	val, _, _ := e.Get(b)
+	assertFloatEquals(t, 0, val)
+	_, val, _ = e.Update(b, Map{"a": 6}, nil)
+	assertFloatEquals(t, 1, val)
+	_, val, _ = e.Update(b, Map{"a": 6}, nil)
+	assertFloatEquals(t, 2, val)
+
+	noElse := CASE([]*When{WHEN(GT(SUM("a"), 10), SUM("a"))}, nil)
+	_, isSet, _ := noElse.Get(make([]byte, noElse.EncodedWidth()))
+	assert.False(t, isSet)
+}
+
+func TestCASEOnDims(t *testing.T) {
+	isX, _ := goexpr.Binary("==", goexpr.Param("d"), goexpr.Constant("x"))
+	isXOrY, _ := goexpr.Binary("OR", isX, mustBinary(t, "==", goexpr.Param("d"), goexpr.Constant("y")))
+	e := msgpacked(t, CASE([]*When{
+		WHEN_DIM(isX, SUM("a")),
+		WHEN_DIM(isXOrY, MAX("a")),
+	}, SUM("b")))
+	assert.NoError(t, e.Validate())
+
+	update := func(b []byte, d string, a float64) {
+		e.Update(b, Map{"a": a, "b": 1}, goexpr.MapParams{"d": d})
+	}
+
+	// Only y and z
+	b := make([]byte, e.EncodedWidth())
+	update(b, "z", 1)
+	val, _, _ := e.Get(b)
+	assertFloatEquals(t, 1, val)
+	update(b, "y", 3)
+	update(b, "y", 2)
+	val, _, _ = e.Get(b)
+	assertFloatEquals(t, 3, val)
+
+	// x takes precedence, and doesn't count towards y
+	b2 := make([]byte, e.EncodedWidth())
+	update(b2, "x", 5)
+	update(b2, "x", 5)
+	val, _, _ = e.Get(b2)
+	assertFloatEquals(t, 10, val)
+
+	b3 := make([]byte, e.EncodedWidth())
+	e.Merge(b3, b, b2)
+	val, _, _ = e.Get(b3)
+	assertFloatEquals(t, 10, val)
+
+	// Sub merging routes each point to only one branch
+	sms := e.SubMergers([]Expr{SUM("a"), MAX("a"), SUM("b")})
+	if assert.Len(t, sms, 3) {
+		sum, max, sumB := SUM("a"), MAX("a"), SUM("b")
+		bsum := make([]byte, sum.EncodedWidth())
+		bmax := make([]byte, max.EncodedWidth())
+		bsumB := make([]byte, sumB.EncodedWidth())
+		sum.Update(bsum, Map{"a": 4}, nil)
+		max.Update(bmax, Map{"a": 4}, nil)
+		sumB.Update(bsumB, Map{"b": 1}, nil)
+
+		b4 := make([]byte, e.EncodedWidth())
+		for i, other := range [][]byte{bsum, bmax, bsumB} {
+			sms[i](b4, other, 0, 0, goexpr.MapParams{"d": "y"})
+		}
+		val, _, _ = e.Get(b4)
+		assertFloatEquals(t, 4, val)
+		remain := b4[sum.EncodedWidth()+max.EncodedWidth():]
+		_, isSet, _ := sumB.Get(remain)
+		assert.False(t, isSet, "Else branch shouldn't have included y")
+	}
+
+	assert.Error(t, CASE([]*When{WHEN_DIM(isX, CONST(1))}, CONST(0)).Validate(), "Unaggregated dimension CASE should be rejected")
+}
+
+func TestCASEPerPoint(t *testing.T) {
+	isX, _ := goexpr.Binary("==", goexpr.Param("d"), goexpr.Constant("x"))
+	e := msgpacked(t, SUM(CASE([]*When{
+		WHEN_DIM(isX, CONST(100)),
+		WHEN(GT("a", 5), "a"),
+	}, CONST(1))))
+	assert.NoError(t, e.Validate())
+	b := make([]byte, e.EncodedWidth())
+	e.Update(b, Map{"a": 7}, goexpr.MapParams{"d": "x"})
+	e.Update(b, Map{"a": 7}, goexpr.MapParams{"d": "y"})
+	e.Update(b, Map{"a": 2}, goexpr.MapParams{"d": "y"})
+	val, _, _ := e.Get(b)
+	assertFloatEquals(t, 108, val)
+}
+
+func mustBinary(t *testing.T, op string, left goexpr.Expr, right goexpr.Expr) goexpr.Expr {
+	e, err := goexpr.Binary(op, left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
@@ -0,0 +1,153 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// COALESCE creates an Expr that obtains its value from the first of the given
+// expressions that has a value set.
+func COALESCE(first interface{}, more ...interface{}) Expr {
+	wrapped := make([]Expr, 0, len(more)+1)
+	wrapped = append(wrapped, exprFor(first))
+	for _, e := range more {
+		wrapped = append(wrapped, exprFor(e))
+	}
+	return &coalesce{wrapped}
+}
+
+type coalesce struct {
+	Wrapped []Expr
+}
+
+func (e *coalesce) Validate() error {
+	for _, wrapped := range e.Wrapped {
+		err := validateWrappedInBinary(wrapped)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *coalesce) EncodedWidth() int {
+	width := 0
+	for _, wrapped := range e.Wrapped {
+		width += wrapped.EncodedWidth()
+	}
+	return width
+}
+
+func (e *coalesce) Shift() time.Duration {
+	return minShift(e.Wrapped)
+}
+
+func (e *coalesce) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	if e.EncodedWidth() == 0 {
+		// Evaluating an individual point
+		for _, wrapped := range e.Wrapped {
+			_, value, updated := wrapped.Update(b, params, metadata)
+			if updated || wrapped.IsConstant() {
+				return b, value, true
+			}
+		}
+		return b, 0, false
+	}
+
+	remain := b
+	anyUpdated := false
+	for _, wrapped := range e.Wrapped {
+		var updated bool
+		remain, _, updated = wrapped.Update(remain, params, metadata)
+		anyUpdated = anyUpdated || updated
+	}
+	value, _, _ := e.Get(b)
+	return remain, value, anyUpdated
+}
+
+func (e *coalesce) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	for _, wrapped := range e.Wrapped {
+		b, x, y = wrapped.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
+func (e *coalesce) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+			return result
+		}
+	}
+	return combinedSubMergers(e.Wrapped, subs, nil)
+}
+
+func (e *coalesce) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *coalesce) Get(b []byte) (float64, bool, []byte) {
+	result, resultSet := float64(0), false
+	remain := b
+	for _, wrapped := range e.Wrapped {
+		var value float64
+		var wasSet bool
+		value, wasSet, remain = wrapped.Get(remain)
+		if wasSet && !resultSet {
+			result, resultSet = value, true
+		}
+	}
+	return result, resultSet, remain
+}
+
+func (e *coalesce) IsConstant() bool {
+	for _, wrapped := range e.Wrapped {
+		if !wrapped.IsConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *coalesce) String() string {
+	wrapped := make([]string, 0, len(e.Wrapped))
+	for _, w := range e.Wrapped {
+		wrapped = append(wrapped, w.String())
+	}
+	return fmt.Sprintf("COALESCE(%v)", strings.Join(wrapped, ", "))
+}
+
+func (e *coalesce) DecodeMsgpack(dec *msgpack.Decoder) error {
+	m := make(map[string]interface{})
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	wrapped, _ := m["Wrapped"].([]interface{})
+	e.Wrapped = make([]Expr, 0, len(wrapped))
+	for _, w := range wrapped {
+		wrappedExpr, ok := w.(Expr)
+		if !ok {
+			return fmt.Errorf("Unexpected encoding of COALESCE argument: %v", w)
+		}
+		e.Wrapped = append(e.Wrapped, wrappedExpr)
+	}
+	return nil
+}
+
+// minShift returns the smallest Shift of the given expressions.
+func minShift(exprs []Expr) time.Duration {
+	var result time.Duration
+	for i, e := range exprs {
+		shift := e.Shift()
+		if i == 0 || shift < result {
+			result = shift
+		}
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package expr
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestCOALESCE(t *testing.T) {
+	e := msgpacked(t, COALESCE(SUM("a"), MAX("b"), 0))
+	assert.NoError(t, e.Validate())
+	assert.Equal(t, "COALESCE(SUM(a), MAX(b), 0.000000)", e.String())
+
+	b := make([]byte, e.EncodedWidth())
+	val, isSet, _ := e.Get(b)
+	assert.True(t, isSet, "Constant should be used when nothing else is set")
+	assertFloatEquals(t, 0, val)
+
+	_, val, updated := e.Update(b, Map{"b": 3}, nil)
+	assert.True(t, updated)
+	assertFloatEquals(t, 3, val)
+
+	b2 := make([]byte, e.EncodedWidth())
+	e.Update(b2, Map{"a": 5}, nil)
+	b3 := make([]byte, e.EncodedWidth())
+	e.Merge(b3, b, b2)
+	val, _, _ = e.Get(b3)
+	assertFloatEquals(t, 5, val)
+
+	sms := e.SubMergers([]Expr{MAX("b"), SUM("c")})
+	if assert.Len(t, sms, 2) {
+		assert.Nil(t, sms[1])
+		b4 := make([]byte, e.EncodedWidth())
+		sms[0](b4, b[SUM("a").EncodedWidth():], 0, 0, nil)
+		val, _, _ = e.Get(b4)
+		assertFloatEquals(t, 3, val)
+	}
+
+	noDefault := COALESCE(SUM("a"), SUM("b"))
+	_, isSet, _ = noDefault.Get(make([]byte, noDefault.EncodedWidth()))
+	assert.False(t, isSet)
+
+	assert.Error(t, COALESCE(SUM("a"), "b").Validate())
+}
+
+func TestCOALESCEDecodeMalformed(t *testing.T) {
+	b, err := msgpack.Marshal(map[string]interface{}{"Wrapped": []interface{}{"a"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	e := &coalesce{}
+	assert.Error(t, e.DecodeMsgpack(msgpack.NewDecoder(bytes.NewReader(b))), "Non-expression argument should fail to decode")
+}
+
+func TestCOALESCEPerPoint(t *testing.T) {
+	e := msgpacked(t, MIN(COALESCE("a", "b", 10)))
+	assert.NoError(t, e.Validate())
+	b := make([]byte, e.EncodedWidth())
+	e.Update(b, Map{"a": 5}, nil)
+	val, _, _ := e.Get(b)
+	assertFloatEquals(t, 5, val)
+	e.Update(b, Map{"b": 2}, nil)
+	val, _, _ = e.Get(b)
+	assertFloatEquals(t, 2, val)
+	e.Update(b, Map{"c": 1}, nil)
+	val, _, _ = e.Get(b)
+	assertFloatEquals(t, 2, val)
+}
@@ -71,7 +71,7 @@ func TestCombined(t *testing.T) {
 	sms := e.SubMergers(fields)
 	for i, sm := range sms {
 		if sm != nil {
-			sm(be, data[i], 0, nil)
+			sm(be, data[i], 0, 0, nil)
 		}
 	}
 	val, _, _ = e.Get(be)
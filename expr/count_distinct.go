@@ -0,0 +1,162 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/spaolacci/murmur3"
+)
+
+const (
+	// hllPrecision is the number of bits of the hash used to select a
+	// HyperLogLog register. 10 bits gives 1024 registers, for a standard error
+	// of about 3%.
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+)
+
+var (
+	hllAlpha = 0.7213 / (1 + 1.079/float64(hllRegisters))
+)
+
+// COUNT_DISTINCT creates an Expr that estimates the number of distinct values
+// of the given dimension expression using a HyperLogLog sketch. The registers
+// of the sketch are stored inline, so the sketch can be merged across periods,
+// resolutions and partitions.
+func COUNT_DISTINCT(dim goexpr.Expr) Expr {
+	return &countDistinct{dim}
+}
+
+type countDistinct struct {
+	Dim goexpr.Expr
+}
+
+func (e *countDistinct) Validate() error {
+	if e.Dim == nil {
+		return fmt.Errorf("COUNT_DISTINCT requires a dimension expression")
+	}
+	return nil
+}
+
+func (e *countDistinct) EncodedWidth() int {
+	return 1 + hllRegisters
+}
+
+func (e *countDistinct) Shift() time.Duration {
+	return 0
+}
+
+func (e *countDistinct) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	remain := b[1+hllRegisters:]
+	if metadata == nil {
+		return remain, e.calc(b), false
+	}
+	val := e.Dim.Eval(metadata)
+	if val == nil {
+		return remain, e.calc(b), false
+	}
+	b[0] = 1
+	e.add(b[1:], val)
+	return remain, e.calc(b), true
+}
+
+func (e *countDistinct) add(registers []byte, val interface{}) {
+	var data []byte
+	switch v := val.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		data = []byte(fmt.Sprint(v))
+	}
+	h := murmur3.Sum64(data)
+	idx := h >> (64 - hllPrecision)
+	// rho is the position of the leftmost 1 bit in the remaining bits of the
+	// hash. We set a sentinel bit so that rho never exceeds the number of
+	// remaining bits.
+	w := h<<hllPrecision | 1<<(hllPrecision-1)
+	rho := byte(1)
+	for w&(1<<63) == 0 {
+		rho++
+		w <<= 1
+	}
+	if rho > registers[idx] {
+		registers[idx] = rho
+	}
+}
+
+func (e *countDistinct) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	remainB := b[1+hllRegisters:]
+	remainX := x[1+hllRegisters:]
+	remainY := y[1+hllRegisters:]
+	xWasSet := x[0] == 1
+	yWasSet := y[0] == 1
+	if !xWasSet && !yWasSet {
+		// Nothing to save, just advance
+		return remainB, remainX, remainY
+	}
+	b[0] = 1
+	for i := 1; i <= hllRegisters; i++ {
+		r := x[i]
+		if y[i] > r {
+			r = y[i]
+		}
+		b[i] = r
+	}
+	return remainB, remainX, remainY
+}
+
+func (e *countDistinct) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+		}
+	}
+	return result
+}
+
+func (e *countDistinct) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *countDistinct) Get(b []byte) (float64, bool, []byte) {
+	remain := b[1+hllRegisters:]
+	wasSet := b[0] == 1
+	if !wasSet {
+		return 0, wasSet, remain
+	}
+	return e.calc(b), wasSet, remain
+}
+
+func (e *countDistinct) calc(b []byte) float64 {
+	if b[0] != 1 {
+		return 0
+	}
+	sum := float64(0)
+	zeros := 0
+	for _, r := range b[1 : 1+hllRegisters] {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	m := float64(hllRegisters)
+	estimate := hllAlpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(estimate + 0.5)
+}
+
+func (e *countDistinct) IsConstant() bool {
+	return false
+}
+
+func (e *countDistinct) String() string {
+	return fmt.Sprintf("COUNT_DISTINCT(%v)", e.Dim)
+}
@@ -0,0 +1,55 @@
+package expr
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCOUNT_DISTINCT(t *testing.T) {
+	e := msgpacked(t, COUNT_DISTINCT(goexpr.Param("d")))
+	assert.NoError(t, e.Validate())
+	assert.Equal(t, "COUNT_DISTINCT(d)", e.String())
+
+	b1 := make([]byte, e.EncodedWidth())
+	b2 := make([]byte, e.EncodedWidth())
+	_, isSet, _ := e.Get(b1)
+	assert.False(t, isSet)
+
+	// Missing dimension doesn't count
+	_, _, updated := e.Update(b1, nil, goexpr.MapParams{"other": "x"})
+	assert.False(t, updated)
+
+	// 0-599 go into b1 and 400-999 go into b2, with each value inserted twice
+	for i := 0; i < 600; i++ {
+		for j := 0; j < 2; j++ {
+			e.Update(b1, nil, goexpr.MapParams{"d": fmt.Sprintf("val%d", i)})
+			e.Update(b2, nil, goexpr.MapParams{"d": fmt.Sprintf("val%d", i+400)})
+		}
+	}
+
+	val, isSet, _ := e.Get(b1)
+	if assert.True(t, isSet) {
+		assert.InEpsilon(t, 600, val, 0.05)
+	}
+
+	b3 := make([]byte, e.EncodedWidth())
+	e.Merge(b3, b1, b2)
+	val, isSet, _ = e.Get(b3)
+	if assert.True(t, isSet) {
+		assert.InEpsilon(t, 1000, val, 0.05)
+	}
+
+	sms := e.SubMergers([]Expr{COUNT_DISTINCT(goexpr.Param("d")), COUNT_DISTINCT(goexpr.Param("e")), SUM("d")})
+	if assert.Len(t, sms, 3) {
+		assert.Nil(t, sms[1])
+		assert.Nil(t, sms[2])
+		b4 := make([]byte, e.EncodedWidth())
+		sms[0](b4, b1, 0, 0, nil)
+		sms[0](b4, b2, 0, 0, nil)
+		val, _, _ = e.Get(b4)
+		assert.InEpsilon(t, 1000, val, 0.05)
+	}
+}
@@ -22,15 +22,17 @@ const (
 var (
 	binaryEncoding = binary.BigEndian
 
-	fieldType     = reflect.TypeOf((*field)(nil))
-	constType     = reflect.TypeOf((*constant)(nil))
-	boundedType   = reflect.TypeOf((*bounded)(nil))
-	aggregateType = reflect.TypeOf((*aggregate)(nil))
-	ifType        = reflect.TypeOf((*ifExpr)(nil))
-	avgType       = reflect.TypeOf((*avg)(nil))
-	binaryType    = reflect.TypeOf((*binaryExpr)(nil))
-	shiftType     = reflect.TypeOf((*shift)(nil))
-	unaryMathType = reflect.TypeOf((*unaryMathExpr)(nil))
+	fieldType         = reflect.TypeOf((*field)(nil))
+	constType         = reflect.TypeOf((*constant)(nil))
+	boundedType       = reflect.TypeOf((*bounded)(nil))
+	aggregateType     = reflect.TypeOf((*aggregate)(nil))
+	ifType            = reflect.TypeOf((*ifExpr)(nil))
+	avgType           = reflect.TypeOf((*avg)(nil))
+	binaryType        = reflect.TypeOf((*binaryExpr)(nil))
+	shiftType         = reflect.TypeOf((*shift)(nil))
+	unaryMathType     = reflect.TypeOf((*unaryMathExpr)(nil))
+	percentileType    = reflect.TypeOf((*percentile)(nil))
+	countDistinctType = reflect.TypeOf((*countDistinct)(nil))
 )
 
 func init() {
@@ -43,6 +45,12 @@ func init() {
 	msgpack.RegisterExt(56, &binaryExpr{})
 	msgpack.RegisterExt(57, &shift{})
 	msgpack.RegisterExt(58, &unaryMathExpr{})
+	msgpack.RegisterExt(59, &percentile{})
+	msgpack.RegisterExt(60, &countDistinct{})
+	msgpack.RegisterExt(61, &coalesce{})
+	msgpack.RegisterExt(62, &caseExpr{})
+	msgpack.RegisterExt(63, &lookback{})
+	msgpack.RegisterExt(64, &moving{})
 }
 
 // Params is an interface for data structures that can contain named values.
@@ -71,8 +79,9 @@ func (p FloatParams) Get(name string) (val float64, found bool) {
 
 // SubMerge is a function that merges other into data for a given Expr,
 // potentially taking into account the supplied metadata. otherRes is the amount
-// of time represented by each period in other.
-type SubMerge func(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params)
+// of time represented by each period in other and res is the amount of time
+// represented by each period in data.
+type SubMerge func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params)
 
 // An Expr is expression that stores its value in a byte array and that
 // evaluates to a float64.
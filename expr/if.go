@@ -67,22 +67,28 @@ func (e *ifExpr) condSubMerger(wrapped SubMerge) SubMerge {
 	if wrapped == nil {
 		return nil
 	}
-	return func(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	return func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
 		if e.include(metadata) {
-			wrapped(data, other, otherRes, metadata)
+			wrapped(data, other, otherRes, res, metadata)
 		}
 	}
 }
 
-func (e *ifExpr) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+func (e *ifExpr) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
 	e.Wrapped.Merge(data, data, other)
 }
 
 func (e *ifExpr) include(metadata goexpr.Params) bool {
-	if metadata == nil || e.Cond == nil {
+	return dimCondHolds(e.Cond, metadata)
+}
+
+// dimCondHolds evaluates the given condition on dimensions against metadata,
+// treating a missing condition or missing metadata as true.
+func dimCondHolds(cond goexpr.Expr, metadata goexpr.Params) bool {
+	if metadata == nil || cond == nil {
 		return true
 	}
-	val := e.Cond.Eval(metadata)
+	val := cond.Eval(metadata)
 	return val != nil && val.(bool)
 }
 
@@ -0,0 +1,195 @@
+package expr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+// RATE creates an Expr that obtains its value as the per-second rate at which
+// wrapped increased since the prior period. wrapped is treated like a counter,
+// so if it decreased, it's assumed to have been reset and the rate is
+// calculated from its current value alone.
+func RATE(wrapped interface{}) Expr {
+	return newLookback("RATE", wrapped, time.Second)
+}
+
+// DELTA creates an Expr that obtains its value as the difference between the
+// value of wrapped in the current period and the prior period.
+func DELTA(wrapped interface{}) Expr {
+	return newLookback("DELTA", wrapped, 0)
+}
+
+// DERIVATIVE creates an Expr that obtains its value as the change in wrapped
+// since the prior period per unit of time.
+func DERIVATIVE(wrapped interface{}, unit time.Duration) Expr {
+	return newLookback("DERIVATIVE", wrapped, unit)
+}
+
+func newLookback(name string, wrapped interface{}, unit time.Duration) Expr {
+	return &lookback{name, exprFor(wrapped), unit}
+}
+
+// lookback is an Expr whose value depends on the value of Wrapped in the
+// current and the prior period. It's encoded as the state of Wrapped for the
+// current period, followed by the state of Wrapped for the prior period,
+// followed by the resolution of the period.
+type lookback struct {
+	Name    string
+	Wrapped Expr
+	Unit    time.Duration
+}
+
+func (e *lookback) Validate() error {
+	if e.Wrapped.EncodedWidth() == 0 {
+		return fmt.Errorf("%v requires an aggregate, like %v(SUM(%v))", e.Name, e.Name, e.Wrapped)
+	}
+	if e.Name == "DERIVATIVE" && e.Unit <= 0 {
+		return fmt.Errorf("DERIVATIVE requires a positive unit, not %v", e.Unit)
+	}
+	return e.Wrapped.Validate()
+}
+
+func (e *lookback) EncodedWidth() int {
+	return e.Wrapped.EncodedWidth()*2 + width64bits
+}
+
+func (e *lookback) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *lookback) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	// Points only ever update the current period, the prior period is only
+	// populated when sub-merging
+	_, _, updated := e.Wrapped.Update(b, params, metadata)
+	value, _, remain := e.Get(b)
+	return remain, value, updated
+}
+
+func (e *lookback) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	b, x, y = e.Wrapped.Merge(b, x, y)
+	b, x, y = e.Wrapped.Merge(b, x, y)
+	res := binaryEncoding.Uint64(x)
+	if res == 0 {
+		res = binaryEncoding.Uint64(y)
+	}
+	binaryEncoding.PutUint64(b, res)
+	return b[width64bits:], x[width64bits:], y[width64bits:]
+}
+
+func (e *lookback) SubMergers(subs []Expr) []SubMerge {
+	sms := make([]SubMerge, len(subs))
+	matched := false
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			sms[i] = e.subMerge
+			matched = true
+		}
+	}
+	if matched {
+		// We have an exact match, use that
+		return sms
+	}
+
+	sms = e.Wrapped.SubMergers(subs)
+	for i, sm := range sms {
+		sms[i] = e.lookbackSubMerger(sm, subs[i].EncodedWidth())
+	}
+	return sms
+}
+
+// lookbackSubMerger sub-merges other into both the current and prior period
+// of data. Sequences are stored in descending time order, so the prior period
+// starts res worth of periods further along in other. If other doesn't extend
+// that far (i.e. at the start of a sequence), the prior period is left unset.
+func (e *lookback) lookbackSubMerger(wrapped SubMerge, subWidth int) SubMerge {
+	if wrapped == nil {
+		return nil
+	}
+	width := e.Wrapped.EncodedWidth()
+	return func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+		wrapped(data, other, otherRes, res, metadata)
+		if otherRes > 0 && res >= otherRes {
+			n := int(res/otherRes) * subWidth
+			if n < len(other) {
+				wrapped(data[width:], other[n:], otherRes, res, metadata)
+			}
+		}
+		binaryEncoding.PutUint64(data[width*2:], uint64(res))
+	}
+}
+
+func (e *lookback) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *lookback) Get(b []byte) (float64, bool, []byte) {
+	current, currentSet, remain := e.Wrapped.Get(b)
+	prior, priorSet, remain := e.Wrapped.Get(remain)
+	if len(remain) < width64bits {
+		return 0, false, remain
+	}
+	res := time.Duration(binaryEncoding.Uint64(remain))
+	remain = remain[width64bits:]
+	if !currentSet || !priorSet || res <= 0 {
+		return 0, false, remain
+	}
+	delta := current - prior
+	switch e.Name {
+	case "DELTA":
+		return delta, true, remain
+	case "RATE":
+		if delta < 0 {
+			// Counter was reset
+			delta = current
+		}
+	}
+	return delta * float64(e.Unit) / float64(res), true, remain
+}
+
+func (e *lookback) IsConstant() bool {
+	return false
+}
+
+func (e *lookback) String() string {
+	if e.Name == "DERIVATIVE" {
+		return fmt.Sprintf("DERIVATIVE(%v, %v)", e.Wrapped, e.Unit)
+	}
+	return fmt.Sprintf("%v(%v)", e.Name, e.Wrapped)
+}
+
+// LookBack returns how much data from before a given period is needed to
+// calculate the value of e in that period when querying at the given
+// resolution.
+func LookBack(e Expr, resolution time.Duration) time.Duration {
+	switch t := e.(type) {
+	case *lookback:
+		return resolution + LookBack(t.Wrapped, resolution)
+	case *moving:
+		return time.Duration(t.periodsIn(resolution)-1)*resolution + LookBack(t.Wrapped, resolution)
+	case *binaryExpr:
+		return maxLookBack([]Expr{t.Left, t.Right}, resolution)
+	case *shift:
+		return LookBack(t.Wrapped, resolution)
+	case *unaryMathExpr:
+		return LookBack(t.Wrapped, resolution)
+	case *ifExpr:
+		return LookBack(t.Wrapped, resolution)
+	case *coalesce:
+		return maxLookBack(t.Wrapped, resolution)
+	case *caseExpr:
+		return maxLookBack(t.parts(), resolution)
+	}
+	return 0
+}
+
+func maxLookBack(exprs []Expr, resolution time.Duration) time.Duration {
+	var result time.Duration
+	for _, e := range exprs {
+		if lookBack := LookBack(e, resolution); lookBack > result {
+			result = lookBack
+		}
+	}
+	return result
+}
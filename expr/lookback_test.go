@@ -0,0 +1,77 @@
+package expr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookback(t *testing.T) {
+	sub := SUM("a")
+	subWidth := sub.EncodedWidth()
+
+	// Source periods at 1 second resolution, newest first
+	other := make([]byte, subWidth*4)
+	for i, v := range []float64{4, 3, 2, 1} {
+		sub.Update(other[i*subWidth:], Map{"a": v}, nil)
+	}
+
+	subMergeAll := func(e Expr) []byte {
+		width := e.EncodedWidth()
+		data := make([]byte, width*2)
+		sm := e.SubMergers([]Expr{sub})[0]
+		for po := 0; po < 4; po++ {
+			p := po / 2
+			sm(data[p*width:], other[po*subWidth:], time.Second, 2*time.Second, nil)
+		}
+		return data
+	}
+
+	check := func(e Expr, expected float64) {
+		e = msgpacked(t, e)
+		assert.NoError(t, e.Validate())
+		data := subMergeAll(e)
+		val, isSet, _ := e.Get(data)
+		assert.True(t, isSet, e.String())
+		assertFloatEquals(t, expected, val)
+		_, isSet, _ = e.Get(data[e.EncodedWidth():])
+		assert.False(t, isSet, "%v should be unset without a prior period", e)
+	}
+
+	check(DELTA(SUM("a")), 4)
+	check(RATE(SUM("a")), 2)
+	check(DERIVATIVE(SUM("a"), time.Minute), 120)
+
+	e := DELTA(SUM("a"))
+	assert.Equal(t, "DELTA(SUM(a))", e.String())
+	assert.Equal(t, "DERIVATIVE(SUM(a), 1m0s)", DERIVATIVE(SUM("a"), time.Minute).String())
+	assert.Equal(t, time.Minute, LookBack(ADD(SUM("b"), e), time.Minute))
+	assert.EqualValues(t, 0, LookBack(ADD(SUM("b"), SUM("a")), time.Minute))
+
+	// Exact matches merge everything, including the prior period and resolution
+	data := subMergeAll(e)
+	merged := make([]byte, e.EncodedWidth())
+	e.SubMergers([]Expr{e})[0](merged, data, 2*time.Second, 2*time.Second, nil)
+	val, isSet, _ := e.Get(merged)
+	assert.True(t, isSet)
+	assertFloatEquals(t, 4, val)
+
+	assert.Error(t, RATE("a").Validate())
+	assert.Error(t, SUM(RATE(SUM("a"))).Validate())
+	assert.Error(t, DERIVATIVE(SUM("a"), 0).Validate())
+}
+
+func TestRateCounterReset(t *testing.T) {
+	e := RATE(SUM("a"))
+	width := SUM("a").EncodedWidth()
+	b := make([]byte, e.EncodedWidth())
+	SUM("a").Update(b, Map{"a": 10}, nil)
+	SUM("a").Update(b[width:], Map{"a": 50}, nil)
+	binaryEncoding.PutUint64(b[width*2:], uint64(5*time.Second))
+	val, isSet, _ := e.Get(b)
+	assert.True(t, isSet)
+	assertFloatEquals(t, 2, val)
+	val, _, _ = DELTA(SUM("a")).Get(b)
+	assertFloatEquals(t, -40, val)
+}
@@ -13,6 +13,75 @@ var unaryMathFNs = map[string]func(float64) float64{
 	"LN":    math.Log,
 	"LOG2":  math.Log2,
 	"LOG10": math.Log10,
+	"ABS":   math.Abs,
+	"SQRT":  math.Sqrt,
+	"EXP":   math.Exp,
+	"CEIL":  math.Ceil,
+	"FLOOR": math.Floor,
+	"ROUND": round,
+}
+
+func init() {
+	registerBinaryFunc("POW", math.Pow)
+
+	registerBinaryFunc("MOD", func(left float64, right float64) float64 {
+		if right == 0 {
+			return 0
+		}
+		return math.Mod(left, right)
+	})
+
+	registerBinaryFunc("ROUND", func(left float64, right float64) float64 {
+		factor := math.Pow(10, math.Floor(right))
+		return round(left*factor) / factor
+	})
+
+	registerBinaryFunc("GREATEST", math.Max)
+
+	registerBinaryFunc("LEAST", math.Min)
+}
+
+// POW creates an Expr that raises base to the power of exponent.
+func POW(base interface{}, exponent interface{}) Expr {
+	return binaryExprFor("POW", base, exponent)
+}
+
+// MOD creates an Expr that obtains the remainder of dividing left by right. If
+// right is 0, this returns 0.
+func MOD(left interface{}, right interface{}) Expr {
+	return binaryExprFor("MOD", left, right)
+}
+
+// ROUND creates an Expr that rounds val to the given number of decimal places,
+// rounding half away from zero.
+func ROUND(val interface{}, places interface{}) Expr {
+	return binaryExprFor("ROUND", val, places)
+}
+
+// GREATEST creates an Expr that obtains the largest of the given values.
+func GREATEST(first interface{}, second interface{}, more ...interface{}) Expr {
+	return foldBinaryExpr("GREATEST", first, second, more)
+}
+
+// LEAST creates an Expr that obtains the smallest of the given values.
+func LEAST(first interface{}, second interface{}, more ...interface{}) Expr {
+	return foldBinaryExpr("LEAST", first, second, more)
+}
+
+func foldBinaryExpr(op string, first interface{}, second interface{}, more []interface{}) Expr {
+	result := binaryExprFor(op, first, second)
+	for _, next := range more {
+		result = binaryExprFor(op, result, next)
+	}
+	return result
+}
+
+// round rounds half away from zero.
+func round(val float64) float64 {
+	if val < 0 {
+		return -math.Floor(-val + 0.5)
+	}
+	return math.Floor(val + 0.5)
 }
 
 type unaryMathExpr struct {
@@ -44,7 +113,11 @@ func (e *unaryMathExpr) Shift() time.Duration {
 }
 
 func (e *unaryMathExpr) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
-	return e.Wrapped.Update(b, params, metadata)
+	remain, value, updated := e.Wrapped.Update(b, params, metadata)
+	if updated {
+		value = e.fn(value)
+	}
+	return remain, value, updated
 }
 
 func (e *unaryMathExpr) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
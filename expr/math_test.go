@@ -19,6 +19,71 @@ func TestLog10(t *testing.T) {
 	doTestUnaryMath(t, "LOG10", 10, 1)
 }
 
+func TestAbs(t *testing.T) {
+	doTestUnaryMath(t, "ABS", -2.5, 2.5)
+}
+
+func TestSqrt(t *testing.T) {
+	doTestUnaryMath(t, "SQRT", 16, 4)
+}
+
+func TestExp(t *testing.T) {
+	doTestUnaryMath(t, "EXP", 1, math.E)
+}
+
+func TestCeil(t *testing.T) {
+	doTestUnaryMath(t, "CEIL", 1.2, 2)
+}
+
+func TestFloor(t *testing.T) {
+	doTestUnaryMath(t, "FLOOR", -1.2, -2)
+}
+
+func TestRound(t *testing.T) {
+	doTestUnaryMath(t, "ROUND", -2.5, -3)
+	doTestCalc(t, ROUND("d", 0), 1)
+	doTestCalc(t, ROUND(DIV("a", 3), 2), 2.93)
+	doTestCalc(t, ROUND(MULT("a", 100), -2), 900)
+}
+
+func TestPow(t *testing.T) {
+	doTestCalc(t, POW("b", 2), 19.36)
+}
+
+func TestMod(t *testing.T) {
+	doTestCalc(t, MOD("a", "b"), 0)
+	doTestCalc(t, MOD("a", 3), 2.8)
+	doTestCalc(t, MOD("a", "c"), 0)
+}
+
+func TestGreatestAndLeast(t *testing.T) {
+	doTestCalc(t, GREATEST("b", "a", "d"), 8.8)
+	doTestCalc(t, LEAST("b", "a", "d"), 1.1)
+	assert.Equal(t, "LEAST(LEAST(b, a), d)", LEAST("b", "a", "d").String())
+}
+
+func TestValidateMath(t *testing.T) {
+	assert.NoError(t, ROUND(SUM("a"), 2).Validate())
+	assert.NoError(t, SUM(POW("a", 2)).Validate())
+	assert.NoError(t, GREATEST(SUM("a"), MAX("b"), 0).Validate())
+	assert.Error(t, GREATEST(SUM("a"), "b").Validate())
+}
+
+func TestNestedUnaryMath(t *testing.T) {
+	perPoint, err := UnaryMath("LOG10", "a")
+	if !assert.NoError(t, err) {
+		return
+	}
+	doTestCalc(t, SUM(perPoint), math.Log10(8.8))
+
+	aggregated, err := UnaryMath("LOG2", DIV(SUM("a"), SUM("b")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, aggregated.Validate())
+	doTestCalc(t, aggregated, 1)
+}
+
 func doTestUnaryMath(t *testing.T, name string, in float64, expected float64) {
 	e, err := UnaryMath(name, CONST(in))
 	if !assert.NoError(t, err) {
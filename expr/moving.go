@@ -0,0 +1,161 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+// MOVING_SUM creates an Expr that obtains its value by aggregating wrapped over
+// the given window of time, ending with (and including) the current period.
+// wrapped must be a SUM or COUNT, whose aggregate over the window is the sum of
+// their values in the periods in the window.
+func MOVING_SUM(wrapped interface{}, window time.Duration) Expr {
+	return &moving{"MOVING_SUM", exprFor(wrapped), window}
+}
+
+// MOVING_AVG is like MOVING_SUM, but obtains the per-period average by dividing
+// by the number of periods in the window. Periods before the start of the data
+// don't count towards the average.
+func MOVING_AVG(wrapped interface{}, window time.Duration) Expr {
+	return &moving{"MOVING_AVG", exprFor(wrapped), window}
+}
+
+// moving is an Expr that aggregates Wrapped over a window of periods. It's
+// encoded as the state of Wrapped aggregated over the whole window, followed by
+// the number of periods in the window that were available.
+type moving struct {
+	Name    string
+	Wrapped Expr
+	Window  time.Duration
+}
+
+func (e *moving) Validate() error {
+	if e.Wrapped.EncodedWidth() == 0 {
+		return fmt.Errorf("%v requires an aggregate, like %v(SUM(%v), '1h')", e.Name, e.Name, e.Wrapped)
+	}
+	// Only for additive aggregates is the aggregate over the window the sum of
+	// the per-period values
+	if agg, ok := e.Wrapped.(*aggregate); !ok || (agg.Name != "SUM" && agg.Name != "COUNT") {
+		return fmt.Errorf("%v requires SUM or COUNT, not %v", e.Name, e.Wrapped)
+	}
+	if e.Window <= 0 {
+		return fmt.Errorf("%v requires a positive window, not %v", e.Name, e.Window)
+	}
+	return e.Wrapped.Validate()
+}
+
+func (e *moving) EncodedWidth() int {
+	return e.Wrapped.EncodedWidth() + width64bits
+}
+
+func (e *moving) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *moving) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	_, _, updated := e.Wrapped.Update(b, params, metadata)
+	value, _, remain := e.Get(b)
+	return remain, value, updated
+}
+
+func (e *moving) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	b, x, y = e.Wrapped.Merge(b, x, y)
+	periods := binaryEncoding.Uint64(x)
+	if otherPeriods := binaryEncoding.Uint64(y); otherPeriods > periods {
+		periods = otherPeriods
+	}
+	binaryEncoding.PutUint64(b, periods)
+	return b[width64bits:], x[width64bits:], y[width64bits:]
+}
+
+func (e *moving) SubMergers(subs []Expr) []SubMerge {
+	sms := make([]SubMerge, len(subs))
+	matched := false
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			sms[i] = e.subMerge
+			matched = true
+		}
+	}
+	if matched {
+		// We have an exact match, use that
+		return sms
+	}
+
+	sms = e.Wrapped.SubMergers(subs)
+	for i, sm := range sms {
+		sms[i] = e.windowedSubMerger(sm, subs[i].EncodedWidth())
+	}
+	return sms
+}
+
+// windowedSubMerger sub-merges the periods in other that fall into the same
+// position within each of the periods in the window. Since every period in
+// other that makes up the current period gets sub-merged, this ends up
+// including all of the data in the window. Sequences are stored in descending
+// time order, so earlier periods are further along in other.
+func (e *moving) windowedSubMerger(wrapped SubMerge, subWidth int) SubMerge {
+	if wrapped == nil {
+		return nil
+	}
+	width := e.Wrapped.EncodedWidth()
+	return func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+		wrapped(data, other, otherRes, res, metadata)
+		periods := uint64(1)
+		if otherRes > 0 && res >= otherRes {
+			stride := int(res/otherRes) * subWidth
+			for i := 1; i < e.periodsIn(res); i++ {
+				n := i * stride
+				if n >= len(other) {
+					break
+				}
+				wrapped(data, other[n:], otherRes, res, metadata)
+				periods++
+			}
+		}
+		if periods > binaryEncoding.Uint64(data[width:]) {
+			binaryEncoding.PutUint64(data[width:], periods)
+		}
+	}
+}
+
+// periodsIn returns the number of periods at the given resolution that make up
+// the window, which is always at least 1.
+func (e *moving) periodsIn(res time.Duration) int {
+	periods := int(math.Ceil(float64(e.Window) / float64(res)))
+	if periods < 1 {
+		periods = 1
+	}
+	return periods
+}
+
+func (e *moving) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *moving) Get(b []byte) (float64, bool, []byte) {
+	value, wasSet, remain := e.Wrapped.Get(b)
+	if len(remain) < width64bits {
+		return 0, false, remain
+	}
+	periods := binaryEncoding.Uint64(remain)
+	remain = remain[width64bits:]
+	if !wasSet {
+		return 0, false, remain
+	}
+	if e.Name == "MOVING_AVG" && periods > 1 {
+		value = value / float64(periods)
+	}
+	return value, true, remain
+}
+
+func (e *moving) IsConstant() bool {
+	return false
+}
+
+func (e *moving) String() string {
+	return fmt.Sprintf("%v(%v, %v)", e.Name, e.Wrapped, e.Window)
+}
@@ -0,0 +1,57 @@
+package expr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoving(t *testing.T) {
+	sub := SUM("a")
+	subWidth := sub.EncodedWidth()
+
+	// Source periods at 1 second resolution, newest first
+	inPeriods := 6
+	other := make([]byte, subWidth*inPeriods)
+	for i := 0; i < inPeriods; i++ {
+		sub.Update(other[i*subWidth:], Map{"a": float64(inPeriods - i)}, nil)
+	}
+
+	check := func(e Expr, res time.Duration, expected ...float64) {
+		e = msgpacked(t, e)
+		assert.NoError(t, e.Validate())
+		width := e.EncodedWidth()
+		scale := int(res / time.Second)
+		data := make([]byte, width*len(expected))
+		sm := e.SubMergers([]Expr{sub})[0]
+		for po := 0; po < inPeriods; po++ {
+			sm(data[po/scale*width:], other[po*subWidth:], time.Second, res, nil)
+		}
+		for i, v := range expected {
+			val, isSet, _ := e.Get(data[i*width:])
+			assert.True(t, isSet)
+			assertFloatEquals(t, v, val)
+		}
+	}
+
+	check(MOVING_SUM(SUM("a"), 4*time.Second), 2*time.Second, 18, 10, 3)
+	check(MOVING_AVG(SUM("a"), 4*time.Second), 2*time.Second, 9, 5, 3)
+	check(MOVING_AVG(SUM("a"), 4*time.Second), time.Second, 4.5, 3.5, 2.5, 2, 1.5, 1)
+	check(MOVING_SUM(SUM("a"), time.Second), 2*time.Second, 11, 7, 3)
+
+	e := MOVING_AVG(SUM("a"), time.Hour)
+	assert.Equal(t, "MOVING_AVG(SUM(a), 1h0m0s)", e.String())
+	assert.Equal(t, 50*time.Minute, LookBack(e, 10*time.Minute))
+	assert.Equal(t, 60*time.Minute, LookBack(RATE(e), 10*time.Minute))
+	assert.EqualValues(t, 0, LookBack(e, 2*time.Hour))
+
+	assert.Error(t, MOVING_SUM("a", time.Hour).Validate())
+	assert.Error(t, MOVING_SUM(SUM("a"), 0).Validate())
+	assert.Error(t, SUM(MOVING_AVG(SUM("a"), time.Hour)).Validate())
+	assert.NoError(t, MOVING_AVG(COUNT("a"), time.Hour).Validate())
+	for _, nonAdditive := range []Expr{AVG("a"), MIN("a"), MAX("a"), DIV(SUM("a"), COUNT("a"))} {
+		assert.Error(t, MOVING_AVG(nonAdditive, time.Hour).Validate(), "MOVING_AVG(%v) should be rejected", nonAdditive)
+		assert.Error(t, MOVING_SUM(nonAdditive, time.Hour).Validate(), "MOVING_SUM(%v) should be rejected", nonAdditive)
+	}
+}
@@ -0,0 +1,237 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+const (
+	// percentileCentroids is the maximum number of centroids retained by the
+	// sketch backing PERCENTILE. More centroids give better accuracy at the cost
+	// of a larger encoded width.
+	percentileCentroids = 32
+
+	centroidWidth = width64bits * 2
+)
+
+// PERCENTILE creates an Expr that estimates the given percentile (0-100) of
+// the given value. The estimate is based on a fixed-size, mergeable sketch of
+// weighted centroids, so it can be rolled up across periods and partitions.
+func PERCENTILE(val interface{}, p float64) Expr {
+	return &percentile{exprFor(val), p}
+}
+
+// MEDIAN creates an Expr that estimates the median of the given value.
+func MEDIAN(val interface{}) Expr {
+	return PERCENTILE(val, 50)
+}
+
+type percentile struct {
+	Value      Expr
+	Percentile float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+func (e *percentile) Validate() error {
+	if e.Percentile < 0 || e.Percentile > 100 {
+		return fmt.Errorf("Percentile %v must be between 0 and 100", e.Percentile)
+	}
+	return validateWrappedInAggregate(e.Value)
+}
+
+func (e *percentile) EncodedWidth() int {
+	return 1 + percentileCentroids*centroidWidth + e.Value.EncodedWidth()
+}
+
+func (e *percentile) Shift() time.Duration {
+	return e.Value.Shift()
+}
+
+func (e *percentile) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	var buf [percentileCentroids + 1]centroid
+	centroids, _, remain := e.load(b, buf[:0])
+	remain, value, updated := e.Value.Update(remain, params, metadata)
+	if updated {
+		centroids = insertCentroid(centroids, centroid{value, 1})
+		centroids = compressCentroids(centroids, percentileCentroids)
+		e.save(b, centroids)
+	}
+	return remain, e.calc(centroids), updated
+}
+
+func (e *percentile) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	var bufX, bufY [percentileCentroids]centroid
+	var buf [percentileCentroids * 2]centroid
+	centroidsX, xWasSet, remainX := e.load(x, bufX[:0])
+	centroidsY, yWasSet, remainY := e.load(y, bufY[:0])
+	if !xWasSet && !yWasSet {
+		// Nothing to save, just advance
+		return b[1+percentileCentroids*centroidWidth:], remainX, remainY
+	}
+	centroids := mergeCentroids(buf[:0], centroidsX, centroidsY)
+	centroids = compressCentroids(centroids, percentileCentroids)
+	return e.save(b, centroids), remainX, remainY
+}
+
+func (e *percentile) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, 0, len(subs))
+	for _, sub := range subs {
+		var sm SubMerge
+		// The sketch doesn't depend on the requested percentile, so we can
+		// sub-merge from any percentile over the same value.
+		other, ok := sub.(*percentile)
+		if ok && e.Value.String() == other.Value.String() {
+			sm = e.subMerge
+		}
+		result = append(result, sm)
+	}
+	return result
+}
+
+func (e *percentile) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *percentile) Get(b []byte) (float64, bool, []byte) {
+	var buf [percentileCentroids]centroid
+	centroids, wasSet, remain := e.load(b, buf[:0])
+	if !wasSet {
+		return 0, wasSet, remain
+	}
+	return e.calc(centroids), wasSet, remain
+}
+
+// calc estimates the percentile by treating each centroid's weight as being
+// centered on its mean and interpolating linearly between adjacent centroids.
+func (e *percentile) calc(centroids []centroid) float64 {
+	if len(centroids) == 0 {
+		return 0
+	}
+	total := float64(0)
+	for _, c := range centroids {
+		total += c.weight
+	}
+	rank := e.Percentile / 100 * total
+	cumulative := float64(0)
+	priorCenter := float64(0)
+	for i, c := range centroids {
+		center := cumulative + c.weight/2
+		if rank <= center {
+			if i == 0 {
+				return c.mean
+			}
+			prior := centroids[i-1]
+			return prior.mean + (c.mean-prior.mean)*(rank-priorCenter)/(center-priorCenter)
+		}
+		cumulative += c.weight
+		priorCenter = center
+	}
+	return centroids[len(centroids)-1].mean
+}
+
+func (e *percentile) load(b []byte, centroids []centroid) ([]centroid, bool, []byte) {
+	remain := b[1+percentileCentroids*centroidWidth:]
+	wasSet := b[0] == 1
+	if wasSet {
+		for i := 0; i < percentileCentroids; i++ {
+			offset := 1 + i*centroidWidth
+			weight := math.Float64frombits(binaryEncoding.Uint64(b[offset+width64bits:]))
+			if weight == 0 {
+				// Centroids are stored contiguously, so we're done
+				break
+			}
+			mean := math.Float64frombits(binaryEncoding.Uint64(b[offset:]))
+			centroids = append(centroids, centroid{mean, weight})
+		}
+	}
+	return centroids, wasSet, remain
+}
+
+func (e *percentile) save(b []byte, centroids []centroid) []byte {
+	b[0] = 1
+	for i := 0; i < percentileCentroids; i++ {
+		offset := 1 + i*centroidWidth
+		c := centroid{}
+		if i < len(centroids) {
+			c = centroids[i]
+		}
+		binaryEncoding.PutUint64(b[offset:], math.Float64bits(c.mean))
+		binaryEncoding.PutUint64(b[offset+width64bits:], math.Float64bits(c.weight))
+	}
+	return b[1+percentileCentroids*centroidWidth:]
+}
+
+// insertCentroid inserts c into centroids, keeping centroids sorted by mean.
+func insertCentroid(centroids []centroid, c centroid) []centroid {
+	i := len(centroids)
+	for i > 0 && centroids[i-1].mean > c.mean {
+		i--
+	}
+	centroids = append(centroids, centroid{})
+	copy(centroids[i+1:], centroids[i:])
+	centroids[i] = c
+	return centroids
+}
+
+// mergeCentroids merges the sorted centroids in x and y into result.
+func mergeCentroids(result []centroid, x []centroid, y []centroid) []centroid {
+	for len(x) > 0 && len(y) > 0 {
+		if x[0].mean <= y[0].mean {
+			result = append(result, x[0])
+			x = x[1:]
+		} else {
+			result = append(result, y[0])
+			y = y[1:]
+		}
+	}
+	result = append(result, x...)
+	return append(result, y...)
+}
+
+// compressCentroids combines adjacent centroids until at most max remain. At
+// each step, it combines the pair with the lowest combined weight relative to
+// q(1-q), where q is the pair's approximate quantile. This favors combining
+// centroids in the dense middle of the distribution and preserves accuracy in
+// the tails.
+func compressCentroids(centroids []centroid, max int) []centroid {
+	for len(centroids) > max {
+		total := float64(0)
+		for _, c := range centroids {
+			total += c.weight
+		}
+		best := 0
+		bestCost := math.MaxFloat64
+		cumulative := float64(0)
+		for i := 0; i < len(centroids)-1; i++ {
+			a, b := centroids[i], centroids[i+1]
+			weight := a.weight + b.weight
+			q := (cumulative + weight/2) / total
+			cost := weight / (q * (1 - q))
+			if cost < bestCost {
+				best = i
+				bestCost = cost
+			}
+			cumulative += a.weight
+		}
+		a, b := centroids[best], centroids[best+1]
+		weight := a.weight + b.weight
+		centroids[best] = centroid{(a.mean*a.weight + b.mean*b.weight) / weight, weight}
+		centroids = append(centroids[:best+1], centroids[best+2:]...)
+	}
+	return centroids
+}
+
+func (e *percentile) IsConstant() bool {
+	return e.Value.IsConstant()
+}
+
+func (e *percentile) String() string {
+	return fmt.Sprintf("PERCENTILE(%v, %v)", e.Value, e.Percentile)
+}
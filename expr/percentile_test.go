@@ -0,0 +1,58 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPERCENTILE(t *testing.T) {
+	e := msgpacked(t, PERCENTILE("a", 95))
+	median := msgpacked(t, MEDIAN("a"))
+	assert.NoError(t, e.Validate())
+	assert.Error(t, PERCENTILE("a", 101).Validate())
+	assert.Error(t, PERCENTILE(SUM("a"), 50).Validate())
+
+	b := make([]byte, e.EncodedWidth())
+	_, isSet, _ := e.Get(b)
+	assert.False(t, isSet)
+
+	// Spread updates over two buffers so that we also test merging
+	b1 := make([]byte, e.EncodedWidth())
+	b2 := make([]byte, e.EncodedWidth())
+	for i := 1; i <= 1000; i++ {
+		params := Map{"a": float64(i)}
+		e.Update(b, params, nil)
+		if i%2 == 0 {
+			e.Update(b1, params, nil)
+		} else {
+			e.Update(b2, params, nil)
+		}
+	}
+
+	val, isSet, _ := e.Get(b)
+	if assert.True(t, isSet) {
+		assert.InDelta(t, 950, val, 10)
+	}
+
+	b3 := make([]byte, e.EncodedWidth())
+	e.Merge(b3, b1, b2)
+	val, isSet, _ = e.Get(b3)
+	if assert.True(t, isSet) {
+		assert.InDelta(t, 950, val, 10)
+	}
+
+	// Sub-merge into the median, which shares the same underlying sketch
+	sms := median.SubMergers([]Expr{e, SUM("a"), PERCENTILE("b", 95)})
+	if assert.Len(t, sms, 3) {
+		assert.NotNil(t, sms[0])
+		assert.Nil(t, sms[1])
+		assert.Nil(t, sms[2])
+		b4 := make([]byte, median.EncodedWidth())
+		sms[0](b4, b3, 0, 0, nil)
+		val, isSet, _ = median.Get(b4)
+		if assert.True(t, isSet) {
+			assert.InDelta(t, 500, val, 25)
+		}
+	}
+}
@@ -19,6 +19,9 @@ func SHIFT(wrapped interface{}, offset time.Duration) Expr {
 }
 
 func (e *shift) Validate() error {
+	if e.Wrapped.EncodedWidth() == 0 && !e.Wrapped.IsConstant() {
+		return fmt.Errorf("Cannot shift unaggregated expression %v, shift an aggregate instead", e.Wrapped)
+	}
 	return e.Wrapped.Validate()
 }
 
@@ -63,15 +66,15 @@ func (e *shift) shiftedSubMerger(wrapped SubMerge, subWidth int) SubMerge {
 	if wrapped == nil {
 		return nil
 	}
-	return func(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	return func(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
 		n := -1 * int(e.Offset/otherRes) * subWidth
 		if n >= 0 && n < len(other) {
-			wrapped(data, other[n:], otherRes, metadata)
+			wrapped(data, other[n:], otherRes, res, metadata)
 		}
 	}
 }
 
-func (e *shift) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+func (e *shift) subMerge(data []byte, other []byte, otherRes time.Duration, res time.Duration, metadata goexpr.Params) {
 	e.Wrapped.Merge(data, data, other)
 }
 
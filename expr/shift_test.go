@@ -43,7 +43,7 @@ func TestShiftSubMerge(t *testing.T) {
 	subs := fs.SubMergers([]Expr{fa})
 	for i := 0; i < periods; i++ {
 		for _, sub := range subs {
-			sub(s[i*fs.EncodedWidth():], a[i*fa.EncodedWidth():], res, nil)
+			sub(s[i*fs.EncodedWidth():], a[i*fa.EncodedWidth():], res, res, nil)
 		}
 	}
 	for i := 0; i < periods; i++ {
@@ -37,7 +37,10 @@ func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals
 	encoding.WriteInt32(dimsLen, len(dims))
 	valsLen := make([]byte, encoding.Width32bits)
 	encoding.WriteInt32(valsLen, len(vals))
+	// Snapshots briefly block inserts while copying the active WAL segment
+	db.snapshotMutex.RLock()
 	_, err := w.Write(tsd, dimsLen, dims, valsLen, vals)
+	db.snapshotMutex.RUnlock()
 	if err != nil {
 		log.Error(err)
 		if lastErr == nil {
@@ -47,6 +50,29 @@ func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals
 	return lastErr
 }
 
+// RecordRejectedInserts records that the given number of points destined for
+// the given stream were rejected before reaching the WAL, for example because
+// the client wasn't authorized to insert them. The points are counted as
+// rejected by every table that reads from the stream, except for rollup tiers,
+// which would otherwise count the same points again.
+func (db *DB) RecordRejectedInserts(stream string, count int) {
+	stream = strings.TrimSpace(strings.ToLower(stream))
+	db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(db.orderedTables))
+	for _, t := range db.orderedTables {
+		if !t.Virtual && t.rollupResolution == 0 && t.From == stream {
+			tables = append(tables, t)
+		}
+	}
+	db.tablesMutex.RUnlock()
+
+	for _, t := range tables {
+		t.statsMutex.Lock()
+		t.stats.RejectedPoints += int64(count)
+		t.statsMutex.Unlock()
+	}
+}
+
 type walRead struct {
 	data   []byte
 	offset wal.Offset
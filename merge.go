@@ -2,6 +2,7 @@ package zenodb
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/getlantern/bytemap"
@@ -16,21 +17,22 @@ var (
 	emptyOffset = make(wal.Offset, wal.OffsetSize)
 )
 
-// FilterAndMerge merges the specified inFiles into the given outFile, where
-// inFiles and outFiles are all valid filestore files. The schema is based on
-// the named table. If whereClause is specified, rows are filtered by comparing
-// them to the whereClause. The merge is performed as a disk-based merge in
-// order to use minimal memory. If shouldSort is true, the output will be sorted
-// by key.
-func (db *DB) FilterAndMerge(table string, whereClause string, shouldSort bool, outFile string, inFiles ...string) error {
+// FilterAndMerge merges the specified inFiles into segments in the given
+// outDir, where inFiles are all valid filestore files. The segments are
+// recorded in a manifest in outDir, so outDir can be used as the directory of
+// the named table, whose schema is used for the merge. If whereClause is
+// specified, rows are filtered by comparing them to the whereClause. The merge
+// is performed as a disk-based merge in order to use minimal memory. If
+// shouldSort is true, the output will be sorted by key.
+func (db *DB) FilterAndMerge(table string, whereClause string, shouldSort bool, outDir string, inFiles ...string) error {
 	t := db.getTable(table)
 	if t == nil {
 		return errors.New("Table %v not found", table)
 	}
-	return t.filterAndMerge(whereClause, shouldSort, outFile, inFiles)
+	return t.filterAndMerge(whereClause, shouldSort, outDir, inFiles)
 }
 
-func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile string, inFiles []string) error {
+func (t *table) filterAndMerge(whereClause string, shouldSort bool, outDir string, inFiles []string) error {
 	okayToReuseBuffers := false
 	rawOkay := false
 
@@ -51,11 +53,17 @@ func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile stri
 		}
 	}
 
-	// Create output file
-	out, err := os.OpenFile(outFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	err = os.MkdirAll(outDir, 0755)
 	if err != nil {
-		return errors.New("Unable to create outFile at %v: %v", outFile, err)
+		return errors.New("Unable to create outDir at %v: %v", outDir, err)
 	}
+
+	// Merge into a single file first, then split that into segments
+	out, err := ioutil.TempFile(outDir, "merging")
+	if err != nil {
+		return errors.New("Unable to create merge file in %v: %v", outDir, err)
+	}
+	defer os.Remove(out.Name())
 	defer out.Close()
 
 	fso := &fileStore{
@@ -64,9 +72,8 @@ func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile stri
 	}
 	cout, err := fso.createOutWriter(out, t.fields, offset, shouldSort)
 	if err != nil {
-		return errors.New("Unable to create out writer for %v: %v", outFile, err)
+		return errors.New("Unable to create out writer for %v: %v", out.Name(), err)
 	}
-	defer cout.Close()
 
 	truncateBefore := t.truncateBefore()
 	for _, inFile := range inFiles {
@@ -83,8 +90,23 @@ func (t *table) filterAndMerge(whereClause string, shouldSort bool, outFile stri
 			return errors.New("Error iterating on %v: %v", inFile, err)
 		}
 	}
+	err = cout.Close()
+	if err != nil {
+		return errors.New("Unable to finish writing merge file %v: %v", out.Name(), err)
+	}
 
-	return nil
+	rs := &rowStore{
+		t:      t,
+		fields: t.fields,
+		opts:   &rowStoreOptions{dir: outDir, segmentPeriod: t.segmentPeriod()},
+	}
+	segments, err := rs.splitIntoSegments(out.Name(), offset)
+	if err != nil {
+		return err
+	}
+	rs.filesMx.Lock()
+	defer rs.filesMx.Unlock()
+	return rs.writeManifest(segments, offset)
 }
 
 func whereFor(whereClause string) (goexpr.Expr, error) {
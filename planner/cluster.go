@@ -8,7 +8,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/getlantern/goexpr"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/sql"
 )
 
@@ -50,6 +52,10 @@ func (cs *clusterSource) GetResolution() time.Duration {
 	return cs.planAsIfLocal.GetResolution()
 }
 
+func (cs *clusterSource) GetCalendar() *encoding.Calendar {
+	return core.CalendarFor(cs.planAsIfLocal)
+}
+
 func (cs *clusterSource) GetAsOf() time.Time {
 	return cs.planAsIfLocal.GetAsOf()
 }
@@ -99,6 +105,13 @@ func pushdownAllowed(opts *Opts, query *sql.Query) (bool, error) {
 		return false, nil
 	}
 
+	if query.Join != nil {
+		allowed, err := joinPushdownAllowed(opts, query)
+		if !allowed || err != nil {
+			return allowed, err
+		}
+	}
+
 	if query.FromSubQuery != nil {
 		if len(query.FromSubQuery.OrderBy) > 0 || query.FromSubQuery.Crosstab != nil || query.FromSubQuery.Limit > 0 || query.FromSubQuery.Offset > 0 {
 			// If subquery contains order by, crosstab, limit or offset, we can't push down
@@ -110,6 +123,10 @@ func pushdownAllowed(opts *Opts, query *sql.Query) (bool, error) {
 	parentGroupByAll := true
 	parentGroupParams := make(map[string]bool)
 	for current := query; current != nil; current = current.FromSubQuery {
+		if current.Union != nil {
+			log.Debug("Pushdown not allowed because subquery contains union")
+			return false, nil
+		}
 		if current.FromSubQuery == nil {
 			// we've reached the bottom
 			t, err := opts.GetTable(current.From, func(tableFields core.Fields) (core.Fields, error) {
@@ -134,7 +151,12 @@ func pushdownAllowed(opts *Opts, query *sql.Query) (bool, error) {
 					groupParams = parentGroupParams
 				} else {
 					groupParams = make(map[string]bool)
+					rolledUp := rolledUpDims(current)
 					for _, groupBy := range current.GroupBy {
+						if rolledUp[groupBy.Name] {
+							// Subtotals over this dimension span partitions
+							continue
+						}
 						groupBy.Expr.WalkOneToOneParams(func(param string) {
 							if parentGroupByAll || parentGroupParams[groupBy.Name] {
 								groupParams[param] = true
@@ -156,7 +178,11 @@ func pushdownAllowed(opts *Opts, query *sql.Query) (bool, error) {
 
 		if !current.GroupByAll {
 			groupParams := make(map[string]bool)
+			rolledUp := rolledUpDims(current)
 			for _, groupBy := range current.GroupBy {
+				if rolledUp[groupBy.Name] {
+					continue
+				}
 				groupBy.Expr.WalkOneToOneParams(func(param string) {
 					if parentGroupByAll || parentGroupParams[groupBy.Name] {
 						groupParams[param] = true
@@ -171,6 +197,46 @@ func pushdownAllowed(opts *Opts, query *sql.Query) (bool, error) {
 	return false, fmt.Errorf("Should never reach this branch of pushdownAllowed")
 }
 
+// rolledUpDims returns the names of the dimensions that the given query rolls
+// up into subtotals. Since subtotal rows combine rows with different values for
+// these dimensions, they don't keep the rows of different partitions apart.
+func rolledUpDims(query *sql.Query) map[string]bool {
+	result := make(map[string]bool)
+	for _, subtotal := range query.Subtotals {
+		for _, dim := range subtotal {
+			result[dim] = true
+		}
+	}
+	return result
+}
+
+// routeToTier rewrites a query against a tiered table to read from the tier
+// that covers it. This way, the leader and all partitions read the same tier
+// even if they'd pick different ones on their own, for example because their
+// clocks differ.
+func routeToTier(opts *Opts, query *sql.Query) (*sql.Query, error) {
+	if query.FromSubQuery != nil || query.Join != nil {
+		return query, nil
+	}
+
+	source, maxShiftBack, queryFields, err := sourceForTable(query, opts)
+	if err != nil {
+		return nil, err
+	}
+	tier := fmt.Sprint(tierFor(query, source, opts.Now(query.From), maxShiftBack, queryFields))
+	if strings.EqualFold(tier, query.From) {
+		return query, nil
+	}
+
+	routed, err := query.WithFrom(tier)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Routing query to tier %v: %v", tier, routed.SQL)
+	fixupSubQuery(routed, opts)
+	return routed, nil
+}
+
 func planClusterPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, error) {
 	pail, err := planAsIfLocal(opts, query.SQL)
 	if err != nil {
@@ -191,7 +257,7 @@ func planClusterPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, erro
 func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, error) {
 	// Remove group by, having, order by and limit from query
 	sqlString := query.SQL
-	crosstabString := concatForCrosstab(sqlString)
+	crosstabString, crosstabDims := concatForCrosstab(sqlString)
 	lowerSQL := strings.ToLower(sqlString)
 	indexOfGroupBy := strings.Index(lowerSQL, "group by ")
 	indexOfHaving := strings.Index(lowerSQL, "having ")
@@ -249,6 +315,18 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 	if hasCrosstab {
 		groupByParts = append(groupByParts, crosstabString)
 		query.Crosstab = core.ClusterCrosstab
+		if len(crosstabDims) > 1 {
+			// Keep the individual dimensions of multi-dimensional crosstabs so
+			// that we can head nested columns with them
+			query.CrosstabDims = make([]goexpr.Expr, 0, len(crosstabDims))
+			for i, dim := range crosstabDims {
+				name := core.ClusterCrosstabDim(i)
+				groupByParts = append(groupByParts, fmt.Sprintf("%v as %v", dim, name))
+				query.CrosstabDims = append(query.CrosstabDims, goexpr.Param(name))
+			}
+		} else {
+			query.CrosstabDims = nil
+		}
 	}
 	if query.Resolution != 0 {
 		groupByParts = append(groupByParts, fmt.Sprintf("period(%v)", query.Resolution))
@@ -290,7 +368,7 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 	query.Until = time.Time{}
 	query.Resolution = 0
 
-	flat := core.Flatten(addGroupBy(source, query, true, query.Resolution, 0))
+	flat := core.FlattenFill(addGroupBy(source, query, true, query.Resolution, 0), query.Fill)
 	if query.HasHaving {
 		flat = addHaving(flat, query)
 	}
@@ -311,7 +389,10 @@ func planAsIfLocal(opts *Opts, sqlString string) (core.FlatRowSource, error) {
 	return planLocal(query, unclusteredOpts)
 }
 
-func concatForCrosstab(sql string) string {
+// concatForCrosstab returns the concatenation of the CROSSTAB dimensions in
+// the given SQL as the _crosstab dimension, along with the SQL for each of the
+// individual dimensions.
+func concatForCrosstab(sql string) (string, []string) {
 	crosstab := "CROSSTABT"
 	idx := strings.Index(strings.ToUpper(sql), crosstab)
 	if idx < 0 {
@@ -319,31 +400,39 @@ func concatForCrosstab(sql string) string {
 		idx = strings.Index(strings.ToUpper(sql), crosstab)
 	}
 	if idx < 0 {
-		return ""
+		return "", nil
 	}
 	var out []byte
+	var dims []string
 	out = append(out, []byte("concat('_', ")...)
 	idx += len(crosstab + "(")
+	dimStart := idx
 	level := 1
+	var quote byte
 parseLoop:
 	for ; idx < len(sql); idx++ {
 		c := sql[idx]
-		switch c {
-		case '(':
+		out = append(out, c)
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
 			level++
-			out = append(out, c)
-			fmt.Printf("Descend at %v\n", string(out))
-		case ')':
+		case c == ',' && level == 1:
+			dims = append(dims, strings.TrimSpace(sql[dimStart:idx]))
+			dimStart = idx + 1
+		case c == ')':
 			level--
-			out = append(out, c)
-			fmt.Printf("Ascend at %v\n", string(out))
 			if level == 0 {
+				dims = append(dims, strings.TrimSpace(sql[dimStart:idx]))
 				break parseLoop
 			}
-		default:
-			out = append(out, c)
 		}
 	}
 	out = append(out, []byte(" as _crosstab")...)
-	return string(out)
+	return string(out), dims
 }
@@ -0,0 +1,104 @@
+package planner
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// sourceForJoin plans both sides of a JOIN as separate queries that group by
+// the joined dimensions, joins their results and unflattens them so that the
+// rest of the query can be applied as if selecting from a subquery.
+func sourceForJoin(query *sql.Query, opts *Opts) (core.RowSource, error) {
+	left, err := Plan(joinSideSQL(query, query.From), opts)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to plan %v side of join: %v", query.From, err)
+	}
+	right, err := Plan(joinSideSQL(query, query.Join.Table), opts)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to plan %v side of join: %v", query.Join.Table, err)
+	}
+	joined := core.Join(left, right, core.JoinOpts{
+		Using:     query.Join.Using,
+		Left:      query.Join.Left,
+		LeftName:  query.From,
+		RightName: query.Join.Table,
+	})
+	return core.Unflatten(joined, query.FieldsNoHaving), nil
+}
+
+// joinSideSQL builds the query for one side of a JOIN, which reads all fields
+// of the given table in the query's time range, filtered by the query's WHERE
+// (which only references joined dimensions) and grouped by the joined
+// dimensions and the query's period.
+func joinSideSQL(query *sql.Query, table string) string {
+	result := &bytes.Buffer{}
+	fmt.Fprintf(result, "select * from %v", table)
+	if query.AsOfOffset != 0 {
+		fmt.Fprintf(result, " ASOF '%v'", query.AsOfOffset)
+	} else if !query.AsOf.IsZero() {
+		fmt.Fprintf(result, " ASOF '%v'", query.AsOf.Format(time.RFC3339Nano))
+	}
+	if query.UntilOffset != 0 {
+		fmt.Fprintf(result, " UNTIL '%v'", query.UntilOffset)
+	} else if !query.Until.IsZero() {
+		fmt.Fprintf(result, " UNTIL '%v'", query.Until.Format(time.RFC3339Nano))
+	}
+	if query.WhereSQL != "" {
+		fmt.Fprintf(result, " %v", query.WhereSQL)
+	}
+	groupByParts := append([]string{}, query.Join.Using...)
+	if query.Calendar != nil {
+		groupByParts = append(groupByParts, fmt.Sprintf("period(%v, '%v')", query.Calendar.Period(), query.Calendar.TimeZone()))
+	} else if query.Resolution != 0 {
+		groupByParts = append(groupByParts, fmt.Sprintf("period(%v)", query.Resolution))
+	}
+	fmt.Fprintf(result, " group by %v", strings.Join(groupByParts, ", "))
+	return result.String()
+}
+
+// joinPushdownAllowed determines whether a JOIN can be performed on each
+// follower in a cluster, which is the case if both tables are partitioned
+// identically and all partition keys are among the joined dimensions.
+func joinPushdownAllowed(opts *Opts, query *sql.Query) (bool, error) {
+	leftPartitionBy, err := partitionByFor(opts, query.From)
+	if err != nil {
+		return false, err
+	}
+	rightPartitionBy, err := partitionByFor(opts, query.Join.Table)
+	if err != nil {
+		return false, err
+	}
+	if len(leftPartitionBy) == 0 || strings.Join(leftPartitionBy, ",") != strings.Join(rightPartitionBy, ",") {
+		log.Debugf("Pushdown not allowed because %v and %v are not partitioned identically", query.From, query.Join.Table)
+		return false, nil
+	}
+	using := make(map[string]bool, len(query.Join.Using))
+	for _, dim := range query.Join.Using {
+		using[dim] = true
+	}
+	for _, partitionKey := range leftPartitionBy {
+		if !using[partitionKey] {
+			log.Debugf("Pushdown not allowed because partition key %v is not among joined dimensions %v", partitionKey, query.Join.Using)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func partitionByFor(opts *Opts, table string) ([]string, error) {
+	t, err := opts.GetTable(table, func(tableFields core.Fields) (core.Fields, error) {
+		return tableFields, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	partitionBy := append([]string{}, t.GetPartitionBy()...)
+	sort.Strings(partitionBy)
+	return partitionBy, nil
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/sql"
 )
 
@@ -16,20 +17,28 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 	fixupSubQuery(query, opts)
 
 	var source core.RowSource
+	var maxShiftBack time.Duration
+	var queryFields core.Fields
 	var err error
 	if query.FromSubQuery != nil {
 		source, err = sourceForSubQuery(query, opts)
 		if err != nil {
 			return nil, err
 		}
+	} else if query.Join != nil {
+		source, err = sourceForJoin(query, opts)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		source, err = sourceForTable(query, opts)
+		source, maxShiftBack, queryFields, err = sourceForTable(query, opts)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	now := opts.Now(query.From)
+	source = tierFor(query, source, now, maxShiftBack, queryFields)
 	asOf, asOfChanged, until, untilChanged := asOfUntilFor(query, opts, source, now)
 	sourceAsOf := source.GetAsOf()
 	if asOf.Before(sourceAsOf) {
@@ -41,6 +50,15 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 		return nil, err
 	}
 
+	if asOfChanged || untilChanged {
+		if restrictable, ok := source.(TimeRestrictable); ok {
+			// Shifted fields need data from before asOf, as do fields that look
+			// back at prior periods
+			lookBack := maxShiftBack + lookBackFor(queryFields, periodFor(query, resolution))
+			restrictable.RestrictTimeRange(asOf.Add(-1*lookBack), until)
+		}
+	}
+
 	if query.Where != nil {
 		source, err = applySubQueryFilters(query, opts, source)
 		if err != nil {
@@ -50,12 +68,12 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 
 	needsGroupBy := asOfChanged || untilChanged || resolutionChanged ||
 		!query.GroupByAll || query.HasSpecificFields || query.HasHaving ||
-		query.Crosstab != nil || strideSlice > 0
+		query.Crosstab != nil || strideSlice > 0 || query.Calendar != nil
 	if needsGroupBy {
 		source = addGroupBy(source, query, resolutionTruncated || resolutionChanged, resolution, strideSlice)
 	}
 
-	flat := core.Flatten(source)
+	flat := core.FlattenFill(source, query.Fill)
 
 	if query.HasHaving {
 		flat = addHaving(flat, query)
@@ -72,21 +90,49 @@ func sourceForSubQuery(query *sql.Query, opts *Opts) (core.RowSource, error) {
 	return core.Unflatten(subSource, query.FieldsNoHaving), nil
 }
 
-func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
-	return opts.GetTable(query.From, func(tableFields core.Fields) (core.Fields, error) {
+// tierFor routes the query to the finest tier of the given source that covers
+// it, if the source is Tiered.
+func tierFor(query *sql.Query, source core.RowSource, now time.Time, maxShiftBack time.Duration, queryFields core.Fields) core.RowSource {
+	tiered, ok := source.(Tiered)
+	if !ok {
+		return source
+	}
+	asOf := query.AsOf
+	if query.AsOfOffset != 0 {
+		asOf = now.Add(query.AsOfOffset)
+	}
+	if !asOf.IsZero() {
+		asOf = asOf.Add(-1 * (maxShiftBack + lookBackFor(queryFields, periodFor(query, query.Resolution))))
+	}
+	return tiered.TierFor(asOf, query.Resolution)
+}
+
+func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, time.Duration, core.Fields, error) {
+	var maxShiftBack time.Duration
+	var queryFields core.Fields
+	source, err := opts.GetTable(query.From, func(tableFields core.Fields) (core.Fields, error) {
+		fields, err := query.Fields.Get(tableFields)
+		if err == nil {
+			for _, field := range fields {
+				if shiftBack := -1 * field.Expr.Shift(); shiftBack > maxShiftBack {
+					maxShiftBack = shiftBack
+				}
+			}
+			queryFields = fields
+		}
+
 		if query.HasSelectAll {
 			// For SELECT *, include all table fields
 			return tableFields, nil
 		}
 
+		if err != nil {
+			return nil, err
+		}
 		tableExprs := tableFields.Exprs()
 
 		// Otherwise, figure out minimum set of fields needed by query
 		includedFields := make([]bool, len(tableFields))
-		fields, err := query.Fields.Get(tableFields)
-		if err != nil {
-			return nil, err
-		}
 		for _, field := range fields {
 			sms := field.Expr.SubMergers(tableExprs)
 			for i, sm := range sms {
@@ -105,6 +151,28 @@ func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
 
 		return result, nil
 	})
+	return source, maxShiftBack, queryFields, err
+}
+
+// periodFor returns the length of the query's periods, which for calendar
+// periods is their nominal length.
+func periodFor(query *sql.Query, resolution time.Duration) time.Duration {
+	if query.Calendar != nil {
+		return query.Calendar.Nominal()
+	}
+	return resolution
+}
+
+// lookBackFor returns how much data from before each period the given fields
+// need when querying at the given resolution.
+func lookBackFor(fields core.Fields, resolution time.Duration) time.Duration {
+	var result time.Duration
+	for _, field := range fields {
+		if lookBack := expr.LookBack(field.Expr, resolution); lookBack > result {
+			result = lookBack
+		}
+	}
+	return result
 }
 
 func asOfUntilFor(query *sql.Query, opts *Opts, source core.RowSource, now time.Time) (time.Time, bool, time.Time, bool) {
@@ -18,23 +18,63 @@ type Table interface {
 	GetPartitionBy() []string
 }
 
+// TimeRestrictable is an optional interface for Tables that can avoid reading
+// data outside of the time range needed by a query.
+type TimeRestrictable interface {
+	RestrictTimeRange(asOf time.Time, until time.Time)
+}
+
+// Tiered is an optional interface for Tables that keep their data at several
+// resolutions with different retention periods.
+type Tiered interface {
+	// TierFor returns the Table that should be used for a query starting at
+	// asOf with the given resolution. Zero values mean that the query doesn't
+	// specify asOf or resolution.
+	TierFor(asOf time.Time, resolution time.Duration) Table
+}
+
 type Opts struct {
 	GetTable        func(table string, includedFields func(tableFields core.Fields) (core.Fields, error)) (Table, error)
 	Now             func(table string) time.Time
 	IsSubQuery      bool
 	SubQueryResults [][]interface{}
 	QueryCluster    QueryClusterFN
+	// Restrict, if specified, limits which tables may be queried and forces
+	// predicates on the rows read from them.
+	Restrict sql.RestrictFN
 }
 
 func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
+	if opts.Restrict != nil {
+		restrictedSQL, err := sql.Restrict(sqlString, opts.Restrict)
+		if err != nil {
+			return nil, err
+		}
+		sqlString = restrictedSQL
+		// The restrictions are now part of the SQL, including that of subqueries
+		// and of queries pushed down to the cluster, so don't apply them again.
+		unrestrictedOpts := &Opts{}
+		*unrestrictedOpts = *opts
+		unrestrictedOpts.Restrict = nil
+		opts = unrestrictedOpts
+	}
+
 	query, err := sql.Parse(sqlString)
 	if err != nil {
 		return nil, err
 	}
 
+	if query.Union != nil {
+		return planUnion(query, opts)
+	}
+
 	fixupSubQuery(query, opts)
 
 	if opts.QueryCluster != nil {
+		query, err = routeToTier(opts, query)
+		if err != nil {
+			return nil, err
+		}
 		allowPushdown, err := pushdownAllowed(opts, query)
 		if err != nil {
 			return nil, err
@@ -42,7 +82,7 @@ func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
 		if allowPushdown {
 			return planClusterPushdown(opts, query)
 		}
-		if query.FromSubQuery == nil {
+		if query.FromSubQuery == nil && query.Join == nil {
 			return planClusterNonPushdown(opts, query)
 		}
 	}
@@ -50,6 +90,20 @@ func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
 	return planLocal(query, opts)
 }
 
+// planUnion plans each of the queries combined with UNION ALL on its own and
+// orders and limits the combined result.
+func planUnion(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
+	sources := make([]core.FlatRowSource, 0, len(query.Union))
+	for _, sub := range query.Union {
+		source, err := Plan(sub.SQL, opts)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return addOrderLimitOffset(core.Union(sources...), query), nil
+}
+
 func fixupSubQuery(query *sql.Query, opts *Opts) {
 	if opts.IsSubQuery {
 		// Change field to _points field
@@ -66,6 +120,11 @@ func addGroupBy(source core.RowSource, query *sql.Query, applyResolution bool, r
 		AsOf:                  query.AsOf,
 		Until:                 query.Until,
 		StrideSlice:           strideSlice,
+		Calendar:              query.Calendar,
+		CrosstabDims:          query.CrosstabDims,
+		CrosstabTop:           query.CrosstabTop,
+		CrosstabTopBy:         query.CrosstabTopBy,
+		Subtotals:             query.Subtotals,
 	}
 	if applyResolution {
 		opts.Resolution = resolution
@@ -74,6 +133,11 @@ func addGroupBy(source core.RowSource, query *sql.Query, applyResolution bool, r
 }
 
 func addOrderLimitOffset(flat core.FlatRowSource, query *sql.Query) core.FlatRowSource {
+	if query.LimitBy != nil {
+		// Limit before sorting so that only the remaining rows need to be sorted
+		flat = core.LimitBy(flat, query.LimitBy.N, query.LimitBy.Dims, query.OrderBy...)
+	}
+
 	if len(query.OrderBy) > 0 {
 		flat = core.Sort(flat, query.OrderBy...)
 	}
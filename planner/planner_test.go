@@ -3,6 +3,7 @@ package planner
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -150,7 +151,7 @@ func TestPlans(t *testing.T) {
 
 	nonPushdownScenario("CROSSTAB, pushdown not allowed",
 		"SELECT * FROM TableA GROUP BY CROSSTAB(ct1, CONCAT('|', ct2))",
-		"select * from TableA group by concat('_', ct1, concat('|', ct2)) as _crosstab",
+		"select * from TableA group by concat('_', ct1, concat('|', ct2)) as _crosstab, ct1 as _crosstab_0, concat('|', ct2) as _crosstab_1",
 		func(source RowSource) RowSource {
 			return Group(source, GroupOpts{
 				Fields:                textFieldSource("*"),
@@ -169,7 +170,7 @@ func TestPlans(t *testing.T) {
 
 	nonPushdownScenario("CROSSTABT, pushdown not allowed",
 		"SELECT * FROM TableA GROUP BY CROSSTABT(ct1, CONCAT('|', ct2))",
-		"select * from TableA group by concat('_', ct1, concat('|', ct2)) as _crosstab",
+		"select * from TableA group by concat('_', ct1, concat('|', ct2)) as _crosstab, ct1 as _crosstab_0, concat('|', ct2) as _crosstab_1",
 		func(source RowSource) RowSource {
 			return Group(source, GroupOpts{
 				Fields:                textFieldSource("*"),
@@ -186,6 +187,57 @@ func TestPlans(t *testing.T) {
 			CrosstabIncludesTotal: true,
 		})
 
+	nonPushdownScenario("CROSSTAB with TOP, pushdown not allowed",
+		"SELECT * FROM TableA GROUP BY CROSSTAB(ct1) TOP 3 BY a",
+		"select * from TableA group by concat('_', ct1) as _crosstab",
+		func(source RowSource) RowSource {
+			return Group(source, GroupOpts{
+				Fields:        textFieldSource("*"),
+				Crosstab:      goexpr.Concat(goexpr.Constant("_"), goexpr.Param("ct1")),
+				CrosstabTop:   3,
+				CrosstabTopBy: "a",
+			})
+		},
+		func(source RowSource) Source {
+			return Flatten(source)
+		},
+		GroupOpts{
+			Fields:        textFieldSource("passthrough"),
+			Crosstab:      goexpr.Param("_crosstab"),
+			CrosstabTop:   3,
+			CrosstabTopBy: "a",
+		})
+
+	pushdownScenario("ROLLUP of non-partition dimension, pushdown allowed",
+		"SELECT * FROM TableA GROUP BY y, x, ROLLUP(z)",
+		"select * from TableA group by y, x, rollup(z)",
+		func(source RowSource) Source {
+			return Flatten(Group(source, GroupOpts{
+				Fields:    textFieldSource("*"),
+				By:        []GroupBy{groupByX, groupByY, NewGroupBy("z", goexpr.Param("z"))},
+				Subtotals: [][]string{{"z"}},
+			}))
+		})
+
+	nonPushdownScenario("ROLLUP of partition dimensions, pushdown not allowed",
+		"SELECT * FROM TableA GROUP BY ROLLUP(x, y)",
+		"select * from TableA group by x, y",
+		func(source RowSource) RowSource {
+			return Group(source, GroupOpts{
+				By:        []GroupBy{groupByX, groupByY},
+				Fields:    textFieldSource("*"),
+				Subtotals: [][]string{{"y"}, {"x", "y"}},
+			})
+		},
+		func(source RowSource) Source {
+			return Flatten(source)
+		},
+		GroupOpts{
+			By:        []GroupBy{groupByX, groupByY},
+			Fields:    textFieldSource("passthrough"),
+			Subtotals: [][]string{{"y"}, {"x", "y"}},
+		})
+
 	pushdownScenario("HAVING clause",
 		"SELECT * FROM TableA HAVING a+b > 0",
 		"select * from TableA having a+b > 0",
@@ -228,7 +280,7 @@ func TestPlans(t *testing.T) {
 
 	nonPushdownScenario("HAVING clause with complete group by and CROSSTAB, pushdown not allowed",
 		"SELECT * FROM TableA GROUP BY y, x, CROSSTAB(ct1, ct2) HAVING a+b > 0",
-		"select *, a+b > 0 as _having from TableA group by x, y, concat('_', ct1, ct2) as _crosstab",
+		"select *, a+b > 0 as _having from TableA group by x, y, concat('_', ct1, ct2) as _crosstab, ct1 as _crosstab_0, ct2 as _crosstab_1",
 		func(source RowSource) RowSource {
 			return Group(source, GroupOpts{
 				By:       []GroupBy{groupByX, groupByY},
@@ -521,6 +573,31 @@ func TestPlans(t *testing.T) {
 		})), NewOrderBy("total", true)), 2), 5)
 	})
 
+	scenario("LIMIT BY", "SELECT * FROM TableA GROUP BY y ORDER BY a DESC LIMIT 2 BY y LIMIT 5", func() Source {
+		return Limit(
+			Sort(
+				LimitBy(
+					Flatten(
+						Group(&testTable{"tablea", defaultFields}, GroupOpts{
+							By:     []GroupBy{groupByY},
+							Fields: textFieldSource("*"),
+						}),
+					), 2, []string{"y"}, NewOrderBy("a", true),
+				), NewOrderBy("a", true),
+			), 5,
+		)
+	}, func() Source {
+		t := &clusterRowSource{
+			clusterSource{
+				query: &sql.Query{SQL: "select * from TableA group by y"},
+			},
+		}
+		return Limit(Sort(LimitBy(Flatten(Group(t, GroupOpts{
+			Fields: textFieldSource("passthrough"),
+			By:     []GroupBy{groupByY},
+		})), 2, []string{"y"}, NewOrderBy("a", true)), NewOrderBy("a", true)), 5)
+	})
+
 	for i, sqlString := range queries {
 		opts := defaultOpts()
 		plan, err := Plan(sqlString, opts)
@@ -588,6 +665,68 @@ LIMIT 1
 	verify(plan)
 }
 
+func TestPlanRestricted(t *testing.T) {
+	restrict := func(table string) (string, error) {
+		if table != "tablea" {
+			return "", fmt.Errorf("Not authorized to query table %v", table)
+		}
+		return "x = 1", nil
+	}
+
+	sqlString := "SELECT * FROM TableA WHERE y = 3"
+	opts := defaultOpts()
+	opts.Restrict = restrict
+	plan, err := Plan(sqlString, opts)
+	if assert.NoError(t, err) {
+		expected := Flatten(RowFilter(&testTable{"tablea", defaultFields}, "where (y = 3) and (x = 1)", nil))
+		assert.Equal(t, FormatSource(expected), FormatSource(plan))
+	}
+
+	opts.QueryCluster = queryCluster
+	plan, err = Plan(sqlString, opts)
+	if assert.NoError(t, err) {
+		expected := &clusterFlatRowSource{
+			clusterSource{
+				query: &sql.Query{SQL: "select * from TableA where (y = 3) and (x = 1)"},
+			},
+		}
+		assert.Equal(t, FormatSource(expected), FormatSource(plan), "Restriction should be pushed down to cluster")
+	}
+
+	_, err = Plan("SELECT * FROM TableA WHERE y IN (SELECT y FROM TableB)", opts)
+	assert.Error(t, err, "Restriction should apply to subqueries")
+}
+
+func TestPlanTiered(t *testing.T) {
+	opts := defaultOpts()
+	opts.GetTable = func(table string, includedFields func(tableFields Fields) (Fields, error)) (Table, error) {
+		included, err := includedFields(defaultFields)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(table, "_1h") {
+			return &tierTable{testTable{table, included}}, nil
+		}
+		return &tieredTable{testTable{table, included}}, nil
+	}
+
+	plan, err := Plan("SELECT * FROM TableA ASOF '-1000h'", opts)
+	if assert.NoError(t, err) {
+		assert.Contains(t, FormatSource(plan), "tablea_1h", "Query beyond table's retention should use tier")
+	}
+
+	opts.QueryCluster = queryCluster
+	plan, err = Plan("SELECT * FROM TableA ASOF '-1000h'", opts)
+	if assert.NoError(t, err) {
+		assert.Contains(t, FormatSource(plan), "from tablea_1h", "Query sent to cluster should be routed to tier")
+	}
+
+	plan, err = Plan("SELECT * FROM TableA ASOF '-1h'", opts)
+	if assert.NoError(t, err) {
+		assert.Contains(t, FormatSource(plan), "from TableA", "Query within table's retention should not be routed to tier")
+	}
+}
+
 func defaultOpts() *Opts {
 	return &Opts{
 		GetTable: func(table string, includedFields func(tableFields Fields) (Fields, error)) (Table, error) {
@@ -700,6 +839,26 @@ func (t *testTable) String() string {
 	return t.name
 }
 
+// tieredTable emulates a table with a tier that keeps its data for longer
+type tieredTable struct {
+	testTable
+}
+
+func (t *tieredTable) TierFor(asOf time.Time, resolution time.Duration) Table {
+	if asOf.IsZero() || !asOf.Before(t.GetAsOf()) {
+		return t
+	}
+	return &tierTable{testTable{t.name + "_1h", t.fields}}
+}
+
+type tierTable struct {
+	testTable
+}
+
+func (t *tierTable) GetAsOf() time.Time {
+	return asOf.Add(-52 * 7 * 24 * time.Hour)
+}
+
 // type partition emulates a partition in a cluster, partitioning by x then y
 type partition struct {
 	testTable
@@ -749,3 +908,24 @@ func (tes textExprSource) Get(known Fields) (Expr, error) {
 func (tes textExprSource) String() string {
 	return string(tes)
 }
+
+func TestJoinSideSQL(t *testing.T) {
+	query, err := sql.Parse("SELECT SUM(client_metrics.errors) AS errors FROM client_metrics JOIN server_metrics USING (server, country) WHERE country = 'us' GROUP BY server, period(1d, 'America/New_York')")
+	if !assert.NoError(t, err) {
+		return
+	}
+	sideSQL := joinSideSQL(query, query.Join.Table)
+	assert.Equal(t, "select * from server_metrics where country = 'us' group by country, server, period(1d, 'America/New_York')", sideSQL)
+	side, err := sql.Parse(sideSQL)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, side.Where, "WHERE should be pushed down to each side")
+		if assert.NotNil(t, side.Calendar, "Calendar period should be passed through to each side") {
+			assert.Equal(t, query.Calendar.String(), side.Calendar.String())
+		}
+	}
+
+	query, err = sql.Parse("SELECT SUM(client_metrics.errors) AS errors FROM client_metrics JOIN server_metrics USING (server) GROUP BY server, period(1h)")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from client_metrics group by server, period(1h0m0s)", joinSideSQL(query, query.From))
+	}
+}
@@ -10,9 +10,17 @@ import (
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/sql"
 )
 
 func (db *DB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
+	return db.QueryRestricted(sqlString, isSubQuery, subQueryResults, includeMemStore, nil)
+}
+
+// QueryRestricted is like Query but limits the tables and rows that may be
+// read using the given restrict function. The restrictions also apply to
+// subqueries and to queries pushed down to followers.
+func (db *DB) QueryRestricted(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, restrict sql.RestrictFN) (core.FlatRowSource, error) {
 	opts := &planner.Opts{
 		GetTable: func(table string, outFields func(tableFields core.Fields) (core.Fields, error)) (planner.Table, error) {
 			return db.getQueryable(table, outFields, includeMemStore)
@@ -20,6 +28,7 @@ func (db *DB) Query(sqlString string, isSubQuery bool, subQueryResults [][]inter
 		Now:             db.now,
 		IsSubQuery:      isSubQuery,
 		SubQueryResults: subQueryResults,
+		Restrict:        restrict,
 	}
 	if db.opts.Passthrough {
 		opts.QueryCluster = func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
@@ -42,8 +51,6 @@ func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields)
 	if t.Virtual {
 		return nil, fmt.Errorf("Table %v is virtual and cannot be queried", table)
 	}
-	until := encoding.RoundTimeUp(db.clock.Now(), t.Resolution)
-	asOf := encoding.RoundTimeUp(until.Add(-1*t.RetentionPeriod), t.Resolution)
 	fields := t.getFields()
 	out, err := outFields(fields)
 	if err != nil {
@@ -52,16 +59,28 @@ func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields)
 	if out == nil {
 		out = t.getFields()
 	}
-	return &queryable{t, out, asOf, until, includeMemStore}, nil
+	return t.queryable(out, includeMemStore), nil
+}
+
+func (t *table) queryable(fields core.Fields, includeMemStore bool) *queryable {
+	until := encoding.RoundTimeUp(t.db.clock.Now(), t.Resolution)
+	asOf := encoding.RoundTimeUp(until.Add(-1*t.RetentionPeriod), t.Resolution)
+	return &queryable{t: t, fields: fields, asOf: asOf, until: until, includeMemStore: includeMemStore}
 }
 
 func MetaDataFor(source core.FlatRowSource, fields core.Fields) *common.QueryMetaData {
+	timeZone := time.UTC.String()
+	if calendar := core.CalendarFor(source); calendar != nil {
+		timeZone = calendar.TimeZone()
+	}
 	return &common.QueryMetaData{
-		FieldNames: fields.Names(),
-		AsOf:       source.GetAsOf(),
-		Until:      source.GetUntil(),
-		Resolution: source.GetResolution(),
-		Plan:       core.FormatSource(source),
+		FieldNames:      fields.Names(),
+		CrosstabHeaders: fields.CrosstabHeaders(),
+		AsOf:            source.GetAsOf(),
+		Until:           source.GetUntil(),
+		Resolution:      source.GetResolution(),
+		TimeZone:        timeZone,
+		Plan:            core.FormatSource(source),
 	}
 }
 
@@ -71,6 +90,10 @@ type queryable struct {
 	asOf            time.Time
 	until           time.Time
 	includeMemStore bool
+	// readAsOf and readUntil optionally restrict which segments are read when
+	// iterating
+	readAsOf  time.Time
+	readUntil time.Time
 }
 
 func (q *queryable) GetGroupBy() []core.GroupBy {
@@ -93,6 +116,43 @@ func (q *queryable) GetPartitionBy() []string {
 	return q.t.PartitionBy
 }
 
+// TierFor picks the finest of this table and its rollup tiers that supports
+// the given resolution and still holds data as of the given time. If no tier
+// goes back far enough, the compatible tier with the longest retention is
+// used.
+func (q *queryable) TierFor(asOf time.Time, resolution time.Duration) planner.Table {
+	rollups := q.t.getRollups()
+	if len(rollups) == 0 {
+		return q
+	}
+
+	var best *queryable
+	for _, t := range append([]*table{q.t}, rollups...) {
+		if resolution > 0 && (resolution < t.Resolution || resolution%t.Resolution != 0) {
+			continue
+		}
+		candidate := q
+		if t != q.t {
+			candidate = t.queryable(q.fields, q.includeMemStore)
+		}
+		if asOf.IsZero() || !asOf.Before(candidate.asOf) {
+			return candidate
+		}
+		// Tiers are ordered by increasing retention
+		best = candidate
+	}
+
+	if best == nil {
+		return q
+	}
+	return best
+}
+
+func (q *queryable) RestrictTimeRange(asOf time.Time, until time.Time) {
+	q.readAsOf = asOf
+	q.readUntil = until
+}
+
 func (q *queryable) String() string {
 	return q.t.Name
 }
@@ -106,7 +166,7 @@ func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow c
 
 	// When iterating, as an optimization, we read only the needed fields (not
 	// all table fields).
-	return q.t.iterate(ctx, q.fields, q.includeMemStore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+	return q.t.iterate(ctx, q.fields, q.includeMemStore, q.readAsOf, q.readUntil, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
 		return onRow(key, vals)
 	})
 }
@@ -0,0 +1,233 @@
+// Package rbac provides role-based access control for queries. Tokens and
+// principals (users and groups) are mapped to roles, each of which grants read
+// access to a set of tables and can force a predicate on the rows read from
+// them.
+package rbac
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// Role grants read access to tables.
+type Role struct {
+	// Name identifies the role.
+	Name string `yaml:"name"`
+	// Tables lists the tables that the role may query, "*" allows all tables.
+	Tables []string `yaml:"tables"`
+	// Where, if specified, is a predicate that is forced on all rows read by
+	// the role, for example app = 'x'.
+	Where string `yaml:"where"`
+}
+
+// Config configures roles and the tokens and principals that hold them.
+type Config struct {
+	Roles []*Role `yaml:"roles"`
+	// Tokens maps secret API tokens to the names of their roles.
+	Tokens map[string][]string `yaml:"tokens"`
+	// Principals maps the identities of logged in users, i.e. user names and
+	// groups, to the names of their roles. These are only ever looked up for
+	// users who've logged in, never for presented tokens.
+	Principals map[string][]string `yaml:"principals"`
+}
+
+// Load loads a Policy from the YAML Config at filename.
+func Load(filename string) (*Policy, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read roles from %v: %v", filename, err)
+	}
+	cfg := &Config{}
+	err = yaml.Unmarshal(b, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse roles from %v: %v", filename, err)
+	}
+	return New(cfg)
+}
+
+// Policy determines the Access granted to tokens and principals.
+type Policy struct {
+	roles      map[string]*role
+	tokens     map[string][]string
+	principals map[string][]string
+}
+
+// New constructs a Policy from the given Config.
+func New(cfg *Config) (*Policy, error) {
+	p := &Policy{
+		roles:      make(map[string]*role, len(cfg.Roles)),
+		tokens:     make(map[string][]string, len(cfg.Tokens)),
+		principals: make(map[string][]string, len(cfg.Principals)),
+	}
+	for _, r := range cfg.Roles {
+		if r.Name == "" {
+			return nil, errors.New("Role name must not be empty")
+		}
+		if p.roles[r.Name] != nil {
+			return nil, fmt.Errorf("Duplicate role %v", r.Name)
+		}
+		if r.Where != "" {
+			err := sql.ValidateWhere(r.Where)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid where for role %v: %v", r.Name, err)
+			}
+		}
+		ro := &role{tables: make(map[string]bool, len(r.Tables)), where: strings.TrimSpace(r.Where)}
+		for _, table := range r.Tables {
+			table = normalizeTable(table)
+			if table == "*" {
+				ro.allTables = true
+			}
+			ro.tables[table] = true
+		}
+		p.roles[r.Name] = ro
+	}
+
+	for token, roleNames := range cfg.Tokens {
+		if token == "" {
+			return nil, errors.New("Token must not be empty")
+		}
+		for _, roleName := range roleNames {
+			if p.roles[roleName] == nil {
+				// Don't include the token in the error, it's a secret
+				return nil, fmt.Errorf("Token has unknown role %v", roleName)
+			}
+		}
+		p.tokens[token] = roleNames
+	}
+
+	for principal, roleNames := range cfg.Principals {
+		if principal == "" {
+			return nil, errors.New("Principal must not be empty")
+		}
+		for _, roleName := range roleNames {
+			if p.roles[roleName] == nil {
+				return nil, fmt.Errorf("Principal %v has unknown role %v", principal, roleName)
+			}
+		}
+		p.principals[principal] = roleNames
+	}
+	return p, nil
+}
+
+// AccessFor returns the Access granted by the combined roles of the given
+// principals, for example a logged in user and the groups to which they
+// belong. Only pass identities that have been verified by logging in. found is
+// false if none of the principals is known.
+func (p *Policy) AccessFor(principals ...string) (access *Access, found bool) {
+	roleNames := make(map[string]bool)
+	for _, principal := range principals {
+		names, ok := p.principals[principal]
+		if !ok {
+			continue
+		}
+		found = true
+		for _, name := range names {
+			roleNames[name] = true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	return p.accessForRoles(roleNames), true
+}
+
+// AccessForToken returns the Access granted by the roles of the given API
+// token. found is false if the token is unknown.
+func (p *Policy) AccessForToken(token string) (access *Access, found bool) {
+	var roleNames map[string]bool
+	// Compare against every token rather than looking it up so that timing
+	// doesn't reveal anything about valid tokens
+	for candidate, names := range p.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			roleNames = make(map[string]bool, len(names))
+			for _, name := range names {
+				roleNames[name] = true
+			}
+		}
+	}
+	if roleNames == nil {
+		return nil, false
+	}
+	return p.accessForRoles(roleNames), true
+}
+
+func (p *Policy) accessForRoles(roleNames map[string]bool) *Access {
+	sortedNames := make([]string, 0, len(roleNames))
+	for name := range roleNames {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+	access := &Access{name: strings.Join(sortedNames, ",")}
+	for _, name := range sortedNames {
+		access.roles = append(access.roles, p.roles[name])
+	}
+	return access
+}
+
+type role struct {
+	allTables bool
+	tables    map[string]bool
+	where     string
+}
+
+// Access is the combined access granted by a token's or principal's roles. A
+// nil Access is unrestricted.
+type Access struct {
+	name  string
+	roles []*role
+}
+
+// Name identifies the combination of roles making up this Access, tokens and
+// principals with the same roles have the same Name.
+func (a *Access) Name() string {
+	if a == nil {
+		return ""
+	}
+	return a.name
+}
+
+// Restrict implements sql.RestrictFN. A table may be queried if any of the
+// roles grant access to it. The rows that may be read are those matching the
+// predicate of any of the granting roles.
+func (a *Access) Restrict(table string) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	table = normalizeTable(table)
+	var wheres []string
+	for _, ro := range a.roles {
+		if !ro.allTables && !ro.tables[table] {
+			continue
+		}
+		if ro.where == "" {
+			// Role can read all rows
+			return "", nil
+		}
+		wheres = append(wheres, fmt.Sprintf("(%v)", ro.where))
+	}
+	if len(wheres) == 0 {
+		return "", fmt.Errorf("Not authorized to query table %v", table)
+	}
+	return strings.Join(wheres, " OR "), nil
+}
+
+// RestrictFN returns a sql.RestrictFN that enforces this Access, or nil if
+// the Access is unrestricted.
+func (a *Access) RestrictFN() sql.RestrictFN {
+	if a == nil {
+		return nil
+	}
+	return a.Restrict
+}
+
+func normalizeTable(table string) string {
+	return strings.TrimSpace(strings.ToLower(table))
+}
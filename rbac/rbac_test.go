@@ -0,0 +1,85 @@
+package rbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccess(t *testing.T) {
+	p, err := New(&Config{
+		Roles: []*Role{
+			{Name: "admin", Tables: []string{"*"}},
+			{Name: "team-x", Tables: []string{"Inbound"}, Where: "app = 'x'"},
+			{Name: "team-y", Tables: []string{"inbound", "outbound"}, Where: "app = 'y'"},
+		},
+		Tokens: map[string][]string{
+			"s3cr3t": {"team-y"},
+		},
+		Principals: map[string][]string{
+			"alice": {"admin", "team-x"},
+			"bob":   {"team-x"},
+			"carol": {"team-y", "team-x"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, found := p.AccessFor("dave")
+	assert.False(t, found)
+
+	alice, found := p.AccessFor("alice")
+	if assert.True(t, found) {
+		where, err := alice.Restrict("inbound")
+		assert.NoError(t, err)
+		assert.Empty(t, where, "Unrestricted role should win")
+	}
+
+	bob, _ := p.AccessFor("bob")
+	where, err := bob.Restrict(" INBOUND")
+	assert.NoError(t, err)
+	assert.Equal(t, "(app = 'x')", where)
+	_, err = bob.Restrict("outbound")
+	assert.Error(t, err)
+
+	carol, _ := p.AccessFor("carol")
+	assert.Equal(t, "team-x,team-y", carol.Name())
+	where, err = carol.Restrict("inbound")
+	assert.NoError(t, err)
+	assert.Equal(t, "(app = 'x') OR (app = 'y')", where)
+	where, err = carol.Restrict("outbound")
+	assert.NoError(t, err)
+	assert.Equal(t, "(app = 'y')", where)
+
+	combined, found := p.AccessFor("dave", "bob", "carol")
+	if assert.True(t, found, "Any known principal should grant access") {
+		assert.Equal(t, carol.Name(), combined.Name())
+	}
+
+	token, found := p.AccessForToken("s3cr3t")
+	if assert.True(t, found) {
+		assert.Equal(t, "team-y", token.Name())
+	}
+	_, found = p.AccessForToken("alice")
+	assert.False(t, found, "User name presented as a token should be rejected")
+	_, found = p.AccessForToken("")
+	assert.False(t, found)
+	_, found = p.AccessFor("s3cr3t")
+	assert.False(t, found, "Token should not be usable as a user name")
+
+	var unrestricted *Access
+	assert.Nil(t, unrestricted.RestrictFN())
+	where, err = unrestricted.Restrict("anything")
+	assert.NoError(t, err)
+	assert.Empty(t, where)
+
+	_, err = New(&Config{Principals: map[string][]string{"bob": {"unknown"}}})
+	assert.Error(t, err, "Unknown roles should be rejected")
+	_, err = New(&Config{Tokens: map[string][]string{"s3cr3t": {"unknown"}}})
+	assert.Error(t, err, "Unknown roles for tokens should be rejected")
+	_, err = New(&Config{Roles: []*Role{{Name: "a"}, {Name: "a"}}})
+	assert.Error(t, err, "Duplicate roles should be rejected")
+	_, err = New(&Config{Roles: []*Role{{Name: "a", Where: "app ="}}})
+	assert.Error(t, err, "Invalid where should be rejected")
+}
@@ -0,0 +1,139 @@
+package zenodb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// RollupOpts configures a rollup tier of a table.
+type RollupOpts struct {
+	// Resolution is the resolution at which the tier keeps data. It must be an
+	// even multiple of the table's resolution.
+	Resolution time.Duration
+	// RetentionPeriod limits how long data is kept in the tier. It must be
+	// longer than the RetentionPeriod of the table and of any finer tiers.
+	RetentionPeriod time.Duration
+}
+
+// rollupTableName names the table for the tier of the given table at the
+// given resolution, for example combined_1h.
+func rollupTableName(name string, resolution time.Duration) string {
+	res := resolution.String()
+	if strings.HasSuffix(res, "m0s") {
+		res = res[:len(res)-2]
+	}
+	if strings.HasSuffix(res, "h0m") {
+		res = res[:len(res)-2]
+	}
+	return fmt.Sprintf("%v_%v", name, res)
+}
+
+// rollupOpts builds the TableOpts for the given tier of the table configured by
+// opts.
+func (opts *TableOpts) rollupOpts(rollup *RollupOpts) *TableOpts {
+	return &TableOpts{
+		Name:             rollupTableName(opts.Name, rollup.Resolution),
+		View:             opts.View,
+		MinFlushLatency:  opts.MinFlushLatency,
+		MaxFlushLatency:  opts.MaxFlushLatency,
+		RetentionPeriod:  rollup.RetentionPeriod,
+		Backfill:         opts.Backfill,
+		PartitionBy:      opts.PartitionBy,
+		SQL:              opts.SQL,
+		rollupResolution: rollup.Resolution,
+	}
+}
+
+// sortedRollups validates the rollups configured by opts against the given
+// table resolution and returns them sorted from finest to coarsest.
+func sortedRollups(opts *TableOpts, resolution time.Duration) ([]*RollupOpts, error) {
+	rollups := make([]*RollupOpts, len(opts.Rollups))
+	copy(rollups, opts.Rollups)
+	sort.Sort(byResolution(rollups))
+
+	priorResolution := resolution
+	priorRetention := opts.RetentionPeriod
+	for _, rollup := range rollups {
+		if resolution <= 0 || rollup.Resolution <= priorResolution || rollup.Resolution%resolution != 0 {
+			return nil, errors.New("Rollup resolution %v for table %v must be a distinct multiple of the table's resolution %v", rollup.Resolution, opts.Name, resolution)
+		}
+		if rollup.RetentionPeriod <= priorRetention {
+			return nil, errors.New("Rollup retention period %v for table %v must be longer than %v", rollup.RetentionPeriod, opts.Name, priorRetention)
+		}
+		priorResolution = rollup.Resolution
+		priorRetention = rollup.RetentionPeriod
+	}
+
+	return rollups, nil
+}
+
+// createRollups creates the tables for the tiers configured by opts.
+func (db *DB) createRollups(opts *TableOpts, resolution time.Duration) ([]*table, error) {
+	rollups, err := sortedRollups(opts, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]*table, 0, len(rollups))
+	for _, rollup := range rollups {
+		rollupOpts := opts.rollupOpts(rollup)
+		log.Debugf("Creating rollup %v of %v at resolution %v", rollupOpts.Name, opts.Name, rollup.Resolution)
+		err := db.CreateTable(rollupOpts)
+		if err != nil {
+			return nil, errors.New("Unable to create rollup %v: %v", rollupOpts.Name, err)
+		}
+		tables = append(tables, db.getTable(rollupOpts.Name))
+	}
+
+	return tables, nil
+}
+
+// alterRollups applies opts to the existing tiers of this table and creates
+// any newly configured tiers.
+func (t *table) alterRollups(opts *TableOpts) error {
+	rollups, err := sortedRollups(opts, t.Resolution)
+	if err != nil {
+		return err
+	}
+
+	tables := make([]*table, 0, len(rollups))
+	for _, rollup := range rollups {
+		rollupOpts := opts.rollupOpts(rollup)
+		existing := t.db.getTable(rollupOpts.Name)
+		if existing != nil {
+			err = existing.Alter(rollupOpts)
+			if err != nil {
+				return err
+			}
+			tables = append(tables, existing)
+			continue
+		}
+		t.log.Debugf("Creating rollup %v at resolution %v", rollupOpts.Name, rollup.Resolution)
+		err = t.db.CreateTable(rollupOpts)
+		if err != nil {
+			return errors.New("Unable to create rollup %v: %v", rollupOpts.Name, err)
+		}
+		tables = append(tables, t.db.getTable(rollupOpts.Name))
+	}
+
+	t.rollupsMx.Lock()
+	t.rollups = tables
+	t.rollupsMx.Unlock()
+	return nil
+}
+
+func (t *table) getRollups() []*table {
+	t.rollupsMx.RLock()
+	defer t.rollupsMx.RUnlock()
+	return t.rollups
+}
+
+type byResolution []*RollupOpts
+
+func (s byResolution) Len() int           { return len(s) }
+func (s byResolution) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byResolution) Less(i, j int) bool { return s[i].Resolution < s[j].Resolution }
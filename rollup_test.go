@@ -0,0 +1,108 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollupTableName(t *testing.T) {
+	assert.Equal(t, "combined_1h", rollupTableName("combined", time.Hour))
+	assert.Equal(t, "combined_5m", rollupTableName("combined", 5*time.Minute))
+	assert.Equal(t, "combined_1h30m", rollupTableName("combined", 90*time.Minute))
+	assert.Equal(t, "combined_30s", rollupTableName("combined", 30*time.Second))
+}
+
+func TestSortedRollups(t *testing.T) {
+	opts := &TableOpts{
+		Name:            "combined",
+		RetentionPeriod: 24 * time.Hour,
+		Rollups: []*RollupOpts{
+			{Resolution: 24 * time.Hour, RetentionPeriod: 365 * 24 * time.Hour},
+			{Resolution: time.Hour, RetentionPeriod: 30 * 24 * time.Hour},
+		},
+	}
+	rollups, err := sortedRollups(opts, 5*time.Minute)
+	if assert.NoError(t, err) && assert.Len(t, rollups, 2) {
+		assert.Equal(t, time.Hour, rollups[0].Resolution)
+		assert.Equal(t, 24*time.Hour, rollups[1].Resolution)
+	}
+
+	_, err = sortedRollups(opts, 7*time.Minute)
+	assert.Error(t, err, "Rollup resolution should have to be a multiple of table resolution")
+
+	opts.Rollups[0].RetentionPeriod = 7 * 24 * time.Hour
+	_, err = sortedRollups(opts, 5*time.Minute)
+	assert.Error(t, err, "Coarser rollup should have to have longer retention")
+}
+
+func TestRollupQuery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir:         tmpDir,
+		VirtualTime: true,
+	})
+	if !assert.NoError(t, err, "Unable to create DB") {
+		return
+	}
+
+	err = db.CreateTable(&TableOpts{
+		Name:            "test",
+		MaxFlushLatency: time.Millisecond,
+		RetentionPeriod: 10 * time.Second,
+		SQL:             "SELECT SUM(i) AS i FROM inbound GROUP BY u, period(1s)",
+		Rollups: []*RollupOpts{
+			{Resolution: 10 * time.Second, RetentionPeriod: time.Hour},
+		},
+	})
+	if !assert.NoError(t, err, "Unable to create table") {
+		return
+	}
+
+	epoch := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		db.Insert("inbound", epoch.Add(time.Duration(i)*time.Second), map[string]interface{}{"u": 1}, map[string]float64{"i": float64(i + 1)})
+	}
+	// Give the data time to be processed by the table and its tier
+	time.Sleep(1 * time.Second)
+
+	// Move past the table's retention period
+	db.Insert("inbound", epoch.Add(time.Minute), map[string]interface{}{"u": 1}, map[string]float64{"i": 100})
+	time.Sleep(1 * time.Second)
+
+	source, err := db.Query("SELECT i FROM test ASOF '-2m' GROUP BY _", false, nil, false)
+	if !assert.NoError(t, err, "Query beyond table's retention period should be allowed") {
+		return
+	}
+	assert.Contains(t, core.FormatSource(source), "test_10s", "Query should be answered from tier")
+
+	total := float64(0)
+	earliest := int64(0)
+	err = source.Iterate(context.Background(), func(fields core.Fields) error {
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		total += row.Values[0]
+		if earliest == 0 || row.TS < earliest {
+			earliest = row.TS
+		}
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 106, total, "Tier should hold data that aged out of the table as well as recent data")
+		assert.True(t, earliest <= epoch.Add(10*time.Second).UnixNano(), "Tier should hold data from before the table's retention period")
+	}
+
+	db.RecordRejectedInserts("inbound", 3)
+	assert.EqualValues(t, 3, db.TableStats("test").RejectedPoints)
+	assert.EqualValues(t, 0, db.TableStats("test_10s").RejectedPoints, "Rejected points shouldn't be counted again by tiers")
+}
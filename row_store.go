@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -29,21 +30,32 @@ import (
 const (
 	// File format versions
 	FileVersion_4      = 4
-	CurrentFileVersion = FileVersion_4
+	FileVersion_5      = 5 // time-partitioned segments
+	CurrentFileVersion = FileVersion_5
 
 	offsetFilename = "offset"
+
+	// minSortBufferBytes is the least amount of memory used for sorting rows
+	// before spilling them to disk.
+	minSortBufferBytes = 10 * 1024 * 1024
 )
 
 var (
 	fieldsDelims = map[int]string{
 		FileVersion_4: "|",
+		FileVersion_5: "|",
 	}
+
+	// iterationCtx is used to give each iteration over a memstore a unique
+	// context for removing keys from the tree.
+	iterationCtx int64
 )
 
 type rowStoreOptions struct {
 	dir             string
 	minFlushLatency time.Duration
 	maxFlushLatency time.Duration
+	segmentPeriod   time.Duration
 }
 
 type insert struct {
@@ -59,12 +71,14 @@ type rowStore struct {
 	fieldUpdates        chan core.Fields
 	opts                *rowStoreOptions
 	memStore            *memstore
-	fileStore           *fileStore
+	segments            []*fileStore
+	walOffset           wal.Offset
 	inserts             chan *insert
 	forceFlushes        chan bool
 	forceFlushCompletes chan bool
 	flushCount          int
 	mx                  sync.RWMutex
+	filesMx             sync.Mutex
 }
 
 type memstore struct {
@@ -89,57 +103,6 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 		return nil, nil, fmt.Errorf("Unable to create folder for row store: %v", err)
 	}
 
-	existingFileName := ""
-	files, err := ioutil.ReadDir(opts.dir)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Unable to read contents of directory: %v", err)
-	}
-	var walOffset wal.Offset
-	if len(files) > 0 {
-		// files are sorted by name, in our case timestamp, so the last file in the
-		// list is the most recent. That's the one that we want.
-		for i := len(files) - 1; i >= 0; i-- {
-			filename := files[i].Name()
-			existingFileName = filepath.Join(opts.dir, files[i].Name())
-			if filename == offsetFilename {
-				// This is an offset file, just read the offset
-				o, err := ioutil.ReadFile(existingFileName)
-				if err != nil {
-					t.log.Errorf("Unable to read offset: %v", err)
-				} else if len(o) != wal.OffsetSize {
-					t.log.Errorf("Invalid offset found in offset file")
-				} else {
-					walOffset = wal.Offset(o)
-				}
-				continue
-			}
-
-			// Version is currently unused, just read it to advance through file
-			versionFor(existingFileName)
-
-			// Get WAL offset
-			newWALOffset, opened, err := readWALOffset(existingFileName)
-			if err != nil {
-				if !opened {
-					return nil, nil, err
-				} else {
-					log.Errorf("Unable to read offset from existing file %v, assuming corrupted and will remove: %v", existingFileName, err)
-					rmErr := os.Remove(existingFileName)
-					if rmErr != nil {
-						return nil, nil, fmt.Errorf("Unable to remove corrupted file %v: %v", existingFileName, err)
-					}
-					continue
-				}
-			}
-
-			if newWALOffset.After(walOffset) {
-				walOffset = newWALOffset
-			}
-			t.log.Debugf("Initializing row store from %v", existingFileName)
-			break
-		}
-	}
-
 	fields := t.getFields()
 	rs := &rowStore{
 		opts:                opts,
@@ -149,13 +112,15 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 		inserts:             make(chan *insert),
 		forceFlushes:        make(chan bool),
 		forceFlushCompletes: make(chan bool),
-		fileStore: &fileStore{
-			t:        t,
-			fields:   fields,
-			filename: existingFileName,
-		},
 	}
 
+	segments, walOffset, err := rs.openSegments()
+	if err != nil {
+		return nil, nil, err
+	}
+	rs.segments = segments
+	rs.walOffset = walOffset
+
 	go rs.processInserts()
 	go rs.removeOldFiles()
 
@@ -205,7 +170,7 @@ func (rs *rowStore) forceFlush() {
 
 func (rs *rowStore) newMemStore() *memstore {
 	fields := rs.fields
-	tree := bytetree.New(fields.Exprs(), nil, rs.t.Resolution, 0, time.Time{}, time.Time{}, 0)
+	tree := bytetree.New(fields.Exprs(), nil, rs.t.Resolution, 0, time.Time{}, time.Time{}, 0, nil)
 	return &memstore{fields: fields, tree: tree}
 }
 
@@ -288,17 +253,72 @@ func (rs *rowStore) processInserts() {
 	}
 }
 
-func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
+func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, asOf time.Time, until time.Time, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
 	guard := core.Guard(ctx)
 
 	rs.mx.RLock()
-	fs := rs.fileStore
+	segments := rs.segments
 	var ms *memstore
 	if includeMemStore {
 		ms = rs.memStore.copy()
 	}
 	rs.mx.RUnlock()
-	return fs.iterate(outFields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+
+	if ms != nil {
+		// Include windows that so far only exist in the memstore
+		touched := rs.newSegmentSet(segments, rs.t.truncateBefore())
+		touched.addAll(segments)
+		touched.addMemStore(ms)
+		segments = touched.sorted()
+	}
+
+	// Only read segments that overlap the requested time range. Each segment is
+	// merged with the portion of the memstore that falls into its window.
+	overlapping := make([]*fileStore, 0, len(segments))
+	for _, fs := range segments {
+		if fs.overlaps(asOf, until) {
+			overlapping = append(overlapping, fs)
+		}
+	}
+
+	if len(overlapping) == 1 {
+		// Every key appears only once, stream it straight through
+		return overlapping[0].iterate(outFields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			return guard.ProceedAfter(onValue(key, columns))
+		})
+	}
+
+	// The same key can appear in several segments, so merge its sequences from
+	// all segments before emitting it. Segment files aren't necessarily sorted
+	// by key, so we first sort each segment by key on disk and then stream a
+	// merge of the sorted segments, which only holds one row per segment in
+	// memory.
+	if len(outFields) == 0 {
+		outFields = rs.fields
+	}
+	stop := make(chan interface{})
+	var sortedFiles []string
+	defer func() {
+		close(stop)
+		for _, filename := range sortedFiles {
+			os.Remove(filename)
+		}
+	}()
+
+	sorted := make([]*sortedSegment, 0, len(overlapping))
+	for _, fs := range overlapping {
+		if guard.TimedOut() {
+			return core.ErrDeadlineExceeded
+		}
+		sortedFile, err := fs.sortByKey(outFields, ms)
+		if err != nil {
+			return err
+		}
+		sortedFiles = append(sortedFiles, sortedFile)
+		sorted = append(sorted, rs.streamSorted(sortedFile, outFields, stop))
+	}
+
+	return rs.mergeSorted(sorted, outFields, rs.t.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
 		return guard.ProceedAfter(onValue(key, columns))
 	})
 }
@@ -306,16 +326,13 @@ func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeM
 func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.Duration) {
 	shouldSort := allowSort && rs.t.shouldSort()
 	willSort := "not sorted"
-	if shouldSort {
-	}
-
 	if shouldSort {
 		defer rs.t.stopSorting()
 		willSort = "sorted"
 	}
 
 	rs.mx.RLock()
-	fs := rs.fileStore
+	segments := rs.segments
 	rs.mx.RUnlock()
 	// We allow raw most of the time for efficiency purposes, but every 10 flushes
 	// we don't so that we have an opportunity to truncate old data.
@@ -325,48 +342,84 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 		rs.t.log.Debug("Disallowing raw on flush to force truncation")
 	}
 
-	fs.t.log.Debugf("Starting flush, %v", willSort)
+	rs.t.log.Debugf("Starting flush, %v", willSort)
 	start := time.Now()
 
-	out, err := ioutil.TempFile("", "nextrowstore")
-	if err != nil {
-		panic(err)
-	}
-	defer out.Close()
-
-	highWaterMark := fs.flush(out, rs.fields, nil, ms.offset, ms, shouldSort, disallowRaw)
-
-	fi, err := out.Stat()
-	if err != nil {
-		fs.t.log.Errorf("Unable to stat output file to get size: %v", err)
-	}
-	// Note - we left-pad the unix nano value to the widest possible length to
-	// ensure lexicographical sort matches time-based sort (e.g. on directory
-	// listing).
-	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
-	err = os.Rename(out.Name(), newFileStoreName)
-	if err != nil {
-		panic(err)
-	}
+	flushed, highWaterMark, size := rs.flushSegments(segments, ms, ms.offset, shouldSort, disallowRaw)
 
-	fs = &fileStore{rs.t, rs.fields, newFileStoreName}
+	// Move the new segments into place and record them in the manifest. Until
+	// the manifest is written, the old versions of the segments remain current.
+	rs.filesMx.Lock()
+	segments = rs.installSegments(flushed, ms.offset)
 	ms = rs.newMemStore()
 	rs.mx.Lock()
-	rs.fileStore = fs
+	rs.segments = segments
 	rs.memStore = ms
 	rs.mx.Unlock()
+	rs.filesMx.Unlock()
 
 	flushDuration := time.Now().Sub(start)
-	if fi != nil {
-		rs.t.log.Debugf("Flushed to %v in %v, size %v. %v.", newFileStoreName, flushDuration, humanize.Bytes(uint64(fi.Size())), willSort)
-	} else {
-		rs.t.log.Debugf("Flushed to %v in %v. %v.", newFileStoreName, flushDuration, willSort)
-	}
+	rs.t.log.Debugf("Flushed %d segments in %v, size %v. %v.", len(flushed), flushDuration, humanize.Bytes(uint64(size)), willSort)
 
 	rs.t.updateHighWaterMarkDisk(highWaterMark)
 	return ms, flushDuration
 }
 
+// flushSegments writes new versions of the segments touched by the given
+// memstore to temporary files, returning them along with the high water mark
+// and total size of the written data.
+func (rs *rowStore) flushSegments(segments []*fileStore, ms *memstore, offset wal.Offset, shouldSort bool, disallowRaw bool) ([]*fileStore, int64, int64) {
+	// Only the segments touched by the memstore get rewritten
+	touched := rs.newSegmentSet(segments, rs.t.truncateBefore())
+	touched.addMemStore(ms)
+
+	highWaterMark := int64(0)
+	size := int64(0)
+	flushed := make([]*fileStore, 0, len(touched.segments))
+	for _, fs := range touched.sorted() {
+		out, err := ioutil.TempFile("", "nextrowstore")
+		if err != nil {
+			panic(err)
+		}
+
+		nextHighWaterMark := fs.flush(out, rs.fields, nil, offset, ms, shouldSort, disallowRaw)
+		if nextHighWaterMark > highWaterMark {
+			highWaterMark = nextHighWaterMark
+		}
+
+		fi, err := out.Stat()
+		if err != nil {
+			rs.t.log.Errorf("Unable to stat output file to get size: %v", err)
+		} else {
+			size += fi.Size()
+		}
+		out.Close()
+		flushed = append(flushed, &fileStore{t: rs.t, fields: rs.fields, filename: out.Name(), asOf: fs.asOf, until: fs.until})
+	}
+
+	return flushed, highWaterMark, size
+}
+
+// installSegments moves the given flushed segments into place and records them
+// in the manifest along with the given offset, returning the resulting
+// segments. Callers must hold filesMx.
+func (rs *rowStore) installSegments(flushed []*fileStore, offset wal.Offset) []*fileStore {
+	for _, fs := range flushed {
+		newFileStoreName := rs.segmentFilename(fs.asOf, fs.until)
+		err := os.Rename(fs.filename, newFileStoreName)
+		if err != nil {
+			panic(err)
+		}
+		fs.filename = newFileStoreName
+	}
+	segments := replaceSegments(rs.segments, flushed)
+	err := rs.writeManifest(segments, offset)
+	if err != nil {
+		panic(err)
+	}
+	return segments
+}
+
 func (fs *fileStore) flush(out *os.File, fields core.Fields, filter goexpr.Expr, offset wal.Offset, ms *memstore, shouldSort bool, disallowRaw bool) int64 {
 	cout, err := fs.createOutWriter(out, fields, offset, shouldSort)
 	if err != nil {
@@ -435,10 +488,14 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offset wa
 	}
 
 	less := func(a []byte, b []byte) bool {
-		return bytes.Compare(a, b) < 0
+		return bytes.Compare(rowKey(a), rowKey(b)) < 0
 	}
 
-	cout, sortErr := emsort.New(sout, chunk, less, int(fs.t.db.maxMemoryBytes())/10)
+	sortBufferBytes := int(fs.t.db.maxMemoryBytes()) / 10
+	if sortBufferBytes < minSortBufferBytes {
+		sortBufferBytes = minSortBufferBytes
+	}
+	cout, sortErr := emsort.New(sout, chunk, less, sortBufferBytes)
 	if sortErr != nil {
 		panic(sortErr)
 	}
@@ -446,6 +503,12 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offset wa
 	return cout, nil
 }
 
+// rowKey returns the key of the given encoded row.
+func rowKey(row []byte) []byte {
+	keyLength, rest := encoding.ReadInt16(row[encoding.Width64bits:])
+	return rest[:keyLength]
+}
+
 func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goexpr.Expr, truncateBefore time.Time, shouldSort bool, key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (int64, error) {
 	highWaterMark := int64(0)
 
@@ -461,9 +524,15 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 		return highWaterMark, nil
 	}
 
+	// Drop expired periods as well as anything outside of this fileStore's
+	// window
+	asOf := truncateBefore
+	if fs.asOf.After(asOf) {
+		asOf = fs.asOf
+	}
 	hasActiveSequence := false
 	for i, seq := range columns {
-		seq = seq.Truncate(fields[i].Expr.EncodedWidth(), fs.t.Resolution, truncateBefore, time.Time{})
+		seq = seq.Truncate(fields[i].Expr.EncodedWidth(), fs.t.Resolution, asOf, fs.until)
 		columns[i] = seq
 		if seq != nil {
 			hasActiveSequence = true
@@ -539,44 +608,33 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 }
 
 func (rs *rowStore) writeOffset(offset wal.Offset) error {
-	out, err := ioutil.TempFile("", "nextoffset")
-	if err != nil {
-		panic(err)
-	}
-	defer out.Close()
-
-	_, err = out.Write(offset)
-	if err != nil {
-		return fmt.Errorf("Unable to write next offset: %v", err)
-	}
-
-	err = out.Close()
-	if err != nil {
-		return fmt.Errorf("Unable to close offset file: %v", err)
-	}
-
-	return os.Rename(out.Name(), filepath.Join(rs.opts.dir, offsetFilename))
+	rs.filesMx.Lock()
+	defer rs.filesMx.Unlock()
+	return rs.writeManifest(rs.segments, offset)
 }
 
 func (rs *rowStore) removeOldFiles() {
 	for {
 		time.Sleep(10 * time.Second)
+		rs.expireSegments()
+
+		// Any file that isn't referenced by the manifest is either an old version
+		// of a segment, an expired segment or a leftover from an older file
+		// format.
+		rs.filesMx.Lock()
+		referenced := make(map[string]bool, len(rs.segments)+1)
+		referenced[segmentsFilename] = true
+		for _, fs := range rs.segments {
+			referenced[filepath.Base(fs.filename)] = true
+		}
 		files, err := ioutil.ReadDir(rs.opts.dir)
+		rs.filesMx.Unlock()
 		if err != nil {
 			log.Errorf("Unable to list data files in %v: %v", rs.opts.dir, err)
 		}
-		// Note - the list of files is sorted by name, which in our case is the
-		// timestamp, so that means they're sorted chronologically. We don't want
-		// to delete the last file in the list because that's the current one.
-		foundLatest := false
-		for i := len(files) - 1; i >= 0; i-- {
-			filename := files[i].Name()
-			if filename == offsetFilename {
-				// Ignore offset file
-				continue
-			}
-			if !foundLatest {
-				foundLatest = true
+		for _, file := range files {
+			filename := file.Name()
+			if referenced[filename] {
 				continue
 			}
 			rs.t.db.waitForBackupToFinish()
@@ -599,14 +657,19 @@ func (rs *rowStore) removeOldFiles() {
 // key can be up to 64KB
 // numcolumns is 16 bits (i.e. 65,536 columns allowed)
 // col*len is 64 bits
+//
+// A fileStore with a non-zero asOf and/or until only holds periods in the
+// window (asOf, until].
 type fileStore struct {
 	t        *table
 	fields   core.Fields
 	filename string
+	asOf     time.Time
+	until    time.Time
 }
 
 func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBuffer bool, rawOkay bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) error {
-	ctx := time.Now().UnixNano()
+	ctx := atomic.AddInt64(&iterationCtx, 1)
 
 	if fs.t.log.IsTraceEnabled() {
 		fs.t.log.Tracef("Iterating with memstore ? %v from file %v", ms != nil, fs.filename)
@@ -705,7 +768,7 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 
 			var msColumns []encoding.Sequence
 			if ms != nil {
-				msColumns = ms.tree.Remove(ctx, key)
+				msColumns = fs.clipToWindow(ms.fields, ms.tree.Remove(ctx, key))
 			}
 			if msColumns == nil && rawOkay {
 				// There's nothing to merge in, just pass through the raw data
@@ -766,6 +829,11 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 	// Read remaining stuff from memstore
 	if ms != nil {
 		ms.tree.Walk(ctx, func(key []byte, msColumns []encoding.Sequence) (bool, bool, error) {
+			msColumns = fs.clipToWindow(ms.fields, msColumns)
+			if msColumns == nil {
+				// Nothing in this fileStore's window
+				return true, false, nil
+			}
 			columns := make([]encoding.Sequence, len(outFields))
 			for i, msColumn := range msColumns {
 				memToOut(columns, i, msColumn)
@@ -781,8 +849,8 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 func versionFor(filename string) int {
 	fileVersion := 0
 	parts := strings.Split(filepath.Base(filename), "_")
-	if len(parts) == 3 {
-		versionString := strings.Split(parts[2], ".")[0]
+	if len(parts) >= 3 {
+		versionString := strings.Split(parts[len(parts)-1], ".")[0]
 		var versionErr error
 		fileVersion, versionErr = strconv.Atoi(versionString)
 		if versionErr != nil {
@@ -792,6 +860,47 @@ func versionFor(filename string) int {
 	return fileVersion
 }
 
+// clipToWindow clips the given memstore columns to this fileStore's window. If
+// none of the columns have data in the window, this returns nil.
+func (fs *fileStore) clipToWindow(fields core.Fields, columns []encoding.Sequence) []encoding.Sequence {
+	if columns == nil || (fs.asOf.IsZero() && fs.until.IsZero()) {
+		return columns
+	}
+	var result []encoding.Sequence
+	for i, seq := range columns {
+		if i >= len(fields) {
+			break
+		}
+		width := fields[i].Expr.EncodedWidth()
+		seq = seq.Truncate(width, fs.t.Resolution, fs.asOf, time.Time{})
+		if len(seq) > 0 && !fs.until.IsZero() && seq.Until().After(fs.until) {
+			// Truncating the end of a sequence modifies it in place, so work on a
+			// copy to avoid clobbering the memstore
+			seq = append(encoding.Sequence(nil), seq...).Truncate(width, fs.t.Resolution, time.Time{}, fs.until)
+		}
+		if len(seq) == 0 {
+			continue
+		}
+		if result == nil {
+			result = make([]encoding.Sequence, len(columns))
+		}
+		result[i] = seq
+	}
+	return result
+}
+
+// overlaps indicates whether this fileStore's window overlaps the time range
+// (asOf, until]. Zero values mean unbounded.
+func (fs *fileStore) overlaps(asOf time.Time, until time.Time) bool {
+	if !until.IsZero() && !fs.asOf.IsZero() && !fs.asOf.Before(until) {
+		return false
+	}
+	if !asOf.IsZero() && !fs.until.IsZero() && !fs.until.After(asOf) {
+		return false
+	}
+	return true
+}
+
 func rowMapper(outFields core.Fields, inFields core.Fields) func(out []encoding.Sequence, i int, seq encoding.Sequence) bool {
 	outIdxs := outIdxsFor(outFields, inFields)
 
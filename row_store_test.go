@@ -4,8 +4,13 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/getlantern/bytemap"
 	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +35,87 @@ func TestStorage(t *testing.T) {
 		cs.insert(&insert{})
 	}
 }
+
+func TestSegmentWindows(t *testing.T) {
+	tb := &table{
+		log: golog.LoggerFor("segmenttest"),
+	}
+	tb.Resolution = time.Minute
+	rs := &rowStore{
+		t:    tb,
+		opts: &rowStoreOptions{segmentPeriod: 10 * time.Minute},
+	}
+
+	epoch := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	existing := &fileStore{asOf: epoch.Add(5 * time.Minute), until: epoch.Add(15 * time.Minute)}
+	ss := rs.newSegmentSet([]*fileStore{existing}, time.Time{})
+
+	assert.True(t, existing == ss.segmentAt(epoch.Add(10*time.Minute)), "Period covered by existing segment should use that segment")
+	assert.True(t, existing == ss.segmentAt(epoch.Add(15*time.Minute)), "Period at end of existing segment should use that segment")
+
+	fs := ss.segmentAt(epoch.Add(3 * time.Minute))
+	assert.Equal(t, epoch, fs.asOf, "New segment should be aligned to segment period")
+	assert.Equal(t, epoch.Add(5*time.Minute), fs.until, "New segment should be trimmed to start of existing segment")
+
+	fs = ss.segmentAt(epoch.Add(16 * time.Minute))
+	assert.Equal(t, epoch.Add(15*time.Minute), fs.asOf, "New segment should be trimmed to end of existing segment")
+	assert.Equal(t, epoch.Add(20*time.Minute), fs.until, "New segment should be aligned to segment period")
+
+	assert.True(t, existing.overlaps(time.Time{}, time.Time{}))
+	assert.True(t, existing.overlaps(epoch.Add(14*time.Minute), epoch.Add(30*time.Minute)))
+	assert.False(t, existing.overlaps(epoch.Add(15*time.Minute), epoch.Add(30*time.Minute)))
+	assert.False(t, existing.overlaps(epoch, epoch.Add(5*time.Minute)))
+	assert.True(t, existing.overlaps(epoch, epoch.Add(6*time.Minute)))
+
+	assert.Equal(t, time.Minute, tb.segmentPeriod(), "Segment period should be at least the resolution")
+	assert.Equal(t, defaultSegmentPeriod, (&table{}).segmentPeriod(), "Segment period should always be positive")
+	rs.opts.segmentPeriod = 0
+	fs = rs.newSegmentSet(nil, time.Time{}).segmentAt(epoch.Add(3 * time.Minute))
+	assert.True(t, fs.asOf.Before(fs.until), "Segments should never be empty, even without a segment period")
+}
+
+func TestMergeSorted(t *testing.T) {
+	tb := &table{
+		log: golog.LoggerFor("mergetest"),
+	}
+	tb.Resolution = time.Minute
+	rs := &rowStore{t: tb}
+	fields := core.Fields{core.NewField("a", expr.SUM("a"))}
+	ts := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	segment := func(rows ...*sortedRow) *sortedSegment {
+		ss := &sortedSegment{
+			rows: make(chan *sortedRow, len(rows)),
+			errs: make(chan error, 1),
+		}
+		for _, row := range rows {
+			ss.rows <- row
+		}
+		ss.errs <- nil
+		close(ss.rows)
+		return ss
+	}
+	row := func(key string, val float64) *sortedRow {
+		return &sortedRow{
+			key:     bytemap.New(map[string]interface{}{"k": key}),
+			columns: []encoding.Sequence{encoding.NewFloatValue(fields[0].Expr, ts, val)},
+		}
+	}
+
+	var keys []string
+	var vals []float64
+	err := rs.mergeSorted([]*sortedSegment{
+		segment(row("a", 1), row("c", 3)),
+		segment(row("b", 2), row("c", 30)),
+		segment(),
+	}, fields, time.Time{}, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+		keys = append(keys, key.Get("k").(string))
+		val, _ := columns[0].ValueAt(0, fields[0].Expr)
+		vals = append(vals, val)
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a", "b", "c"}, keys, "Keys should be merged in order")
+		assert.Equal(t, []float64{1, 2, 33}, vals, "Sequences for the same key should be merged")
+	}
+}
@@ -52,6 +52,12 @@ type Point struct {
 	Offset wal.Offset
 }
 
+// FollowAck is sent by followers to report the offset up to which they've
+// durably stored data from the leader.
+type FollowAck struct {
+	Offset wal.Offset
+}
+
 type RemoteQueryResult struct {
 	Fields       core.Fields
 	Key          bytemap.ByteMap
@@ -65,15 +71,27 @@ type RegisterQueryHandler struct {
 	Partition int
 }
 
+// Snapshot requests a snapshot of the database to the given directory on the
+// server.
+type Snapshot struct {
+	Dir string
+}
+
+type SnapshotReport struct {
+	Dir string
+}
+
 type Client interface {
 	NewInserter(ctx context.Context, stream string, opts ...grpc.CallOption) (Inserter, error)
 
 	Query(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) error, error)
 
-	Follow(ctx context.Context, in *common.Follow, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), error)
+	Follow(ctx context.Context, in *common.Follow, opts ...grpc.CallOption) (next func() (data []byte, newOffset wal.Offset, err error), ack func(durableOffset wal.Offset) error, err error)
 
 	ProcessRemoteQuery(ctx context.Context, partition int, query planner.QueryClusterFN, opts ...grpc.CallOption) error
 
+	Snapshot(ctx context.Context, dir string, opts ...grpc.CallOption) (*SnapshotReport, error)
+
 	Close() error
 }
 
@@ -85,6 +103,8 @@ type Server interface {
 	Follow(*common.Follow, grpc.ServerStream) error
 
 	HandleRemoteQueries(r *RegisterQueryHandler, stream grpc.ServerStream) error
+
+	Snapshot(*Snapshot, grpc.ServerStream) error
 }
 
 var ServiceDesc = grpc.ServiceDesc{
@@ -101,6 +121,7 @@ var ServiceDesc = grpc.ServiceDesc{
 			StreamName:    "follow",
 			Handler:       followHandler,
 			ServerStreams: true,
+			ClientStreams: true,
 		},
 		{
 			StreamName:    "remoteQuery",
@@ -113,6 +134,11 @@ var ServiceDesc = grpc.ServiceDesc{
 			Handler:       insertHandler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "snapshot",
+			Handler:       snapshotHandler,
+			ServerStreams: true,
+		},
 	},
 }
 
@@ -143,3 +169,11 @@ func remoteQueryHandler(srv interface{}, stream grpc.ServerStream) error {
 	}
 	return srv.(Server).HandleRemoteQueries(r, stream)
 }
+
+func snapshotHandler(srv interface{}, stream grpc.ServerStream) error {
+	s := new(Snapshot)
+	if err := stream.RecvMsg(s); err != nil {
+		return err
+	}
+	return srv.(Server).Snapshot(s, stream)
+}
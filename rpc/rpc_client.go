@@ -142,16 +142,13 @@ func (c *client) Query(ctx context.Context, sqlString string, includeMemStore bo
 	return md, iterate, nil
 }
 
-func (c *client) Follow(ctx context.Context, f *common.Follow, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), error) {
+func (c *client) Follow(ctx context.Context, f *common.Follow, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), func(durableOffset wal.Offset) error, error) {
 	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[1], c.cc, "/zenodb/follow", opts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := stream.SendMsg(f); err != nil {
-		return nil, err
-	}
-	if err := stream.CloseSend(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	next := func() ([]byte, wal.Offset, error) {
@@ -163,7 +160,11 @@ func (c *client) Follow(ctx context.Context, f *common.Follow, opts ...grpc.Call
 		return point.Data, point.Offset, nil
 	}
 
-	return next, nil
+	ack := func(durableOffset wal.Offset) error {
+		return stream.SendMsg(&FollowAck{durableOffset})
+	}
+
+	return next, ack, nil
 }
 
 func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query planner.QueryClusterFN, opts ...grpc.CallOption) error {
@@ -228,6 +229,26 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 	return nil
 }
 
+func (c *client) Snapshot(ctx context.Context, dir string, opts ...grpc.CallOption) (*SnapshotReport, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[4], c.cc, "/zenodb/snapshot", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.SendMsg(&Snapshot{Dir: dir}); err != nil {
+		return nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	report := &SnapshotReport{}
+	err = stream.RecvMsg(report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
 func (c *client) Close() error {
 	return c.cc.Close()
 }
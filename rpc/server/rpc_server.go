@@ -2,6 +2,7 @@ package rpcserver
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
@@ -12,7 +13,9 @@ import (
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/rbac"
 	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/sql"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"net"
@@ -27,29 +30,42 @@ type Opts struct {
 	// Password, if specified, is the password that clients must present in order
 	// to access the server.
 	Password string
+
+	// Policy, if specified, grants role-based query access to clients that
+	// present a token in place of the password.
+	Policy *rbac.Policy
+
+	// SnapshotDir, if specified, is the directory in which clients may take
+	// snapshots. Snapshots are only allowed if both SnapshotDir and Password are
+	// specified.
+	SnapshotDir string
 }
 
 // DB is an interface for database-like things (implemented by common.DB).
 type DB interface {
 	InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
 
-	Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error)
+	QueryRestricted(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, restrict sql.RestrictFN) (core.FlatRowSource, error)
 
-	Follow(f *common.Follow, cb func([]byte, wal.Offset) error)
+	Follow(f *common.Follow, cb func([]byte, wal.Offset) error, acks <-chan wal.Offset)
 
 	RegisterQueryHandler(partition int, query planner.QueryClusterFN)
+
+	Snapshot(dir string) error
 }
 
 func Serve(db DB, l net.Listener, opts *Opts) error {
 	l = &rpc.SnappyListener{l}
 	gs := grpc.NewServer(grpc.CustomCodec(rpc.Codec))
-	gs.RegisterService(&rpc.ServiceDesc, &server{db, opts.Password})
+	gs.RegisterService(&rpc.ServiceDesc, &server{db, opts.Password, opts.Policy, opts.SnapshotDir})
 	return gs.Serve(l)
 }
 
 type server struct {
-	db       DB
-	password string
+	db          DB
+	password    string
+	policy      *rbac.Policy
+	snapshotDir string
 }
 
 func (s *server) Insert(stream grpc.ServerStream) error {
@@ -109,12 +125,12 @@ func (s *server) Insert(stream grpc.ServerStream) error {
 }
 
 func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) error {
-	authorizeErr := s.authorize(stream)
+	access, authorizeErr := s.authorizeQuery(stream)
 	if authorizeErr != nil {
 		return authorizeErr
 	}
 
-	source, err := s.db.Query(q.SQLString, q.IsSubQuery, q.SubQueryResults, q.IncludeMemStore)
+	source, err := s.db.QueryRestricted(q.SQLString, q.IsSubQuery, q.SubQueryResults, q.IncludeMemStore, access.RestrictFN())
 	if err != nil {
 		return err
 	}
@@ -146,9 +162,22 @@ func (s *server) Follow(f *common.Follow, stream grpc.ServerStream) error {
 
 	log.Debugf("Follower %d joined", f.PartitionNumber)
 	defer log.Debugf("Follower %d left", f.PartitionNumber)
+	acks := make(chan wal.Offset)
+	go func() {
+		// Read acks until the follower disconnects (older followers close their
+		// side of the stream right away)
+		defer close(acks)
+		for {
+			ack := &rpc.FollowAck{}
+			if err := stream.RecvMsg(ack); err != nil {
+				return
+			}
+			acks <- ack.Offset
+		}
+	}()
 	s.db.Follow(f, func(data []byte, newOffset wal.Offset) error {
 		return stream.SendMsg(&rpc.Point{data, newOffset})
-	})
+	}, acks)
 	return nil
 }
 
@@ -243,6 +272,28 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 	return err
 }
 
+func (s *server) Snapshot(snapshot *rpc.Snapshot, stream grpc.ServerStream) error {
+	if s.password == "" || s.snapshotDir == "" {
+		return log.Error("Snapshots require a password and a snapshot directory to be configured on the server")
+	}
+	authorizeErr := s.authorize(stream)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	dir, err := zenodb.SnapshotDir(s.snapshotDir, snapshot.Dir)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Taking snapshot to %v", dir)
+	err = s.db.Snapshot(dir)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.SnapshotReport{Dir: dir})
+}
+
 func (s *server) authorize(stream grpc.ServerStream) error {
 	if s.password == "" {
 		log.Debug("No password specified, allowing access to world")
@@ -254,10 +305,33 @@ func (s *server) authorize(stream grpc.ServerStream) error {
 	}
 	passwords := md[rpc.PasswordKey]
 	for _, password := range passwords {
-		if password == s.password {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1 {
 			// authorized
 			return nil
 		}
 	}
 	return log.Error("None of the provided passwords matched, not authorized!")
 }
+
+// authorizeQuery is like authorize but also accepts tokens granted access by
+// the rbac.Policy. A nil Access means that the query is unrestricted.
+func (s *server) authorizeQuery(stream grpc.ServerStream) (*rbac.Access, error) {
+	if s.policy == nil {
+		return nil, s.authorize(stream)
+	}
+	md, ok := metadata.FromContext(stream.Context())
+	if !ok {
+		return nil, log.Error("No metadata provided, unable to authenticate")
+	}
+	for _, token := range md[rpc.PasswordKey] {
+		if s.password != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.password)) == 1 {
+			// authorized for everything
+			return nil, nil
+		}
+		access, found := s.policy.AccessForToken(token)
+		if found {
+			return access, nil
+		}
+	}
+	return nil, log.Error("None of the provided tokens matched, not authorized!")
+}
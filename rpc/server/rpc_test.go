@@ -13,6 +13,7 @@ import (
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/sql"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -92,13 +93,17 @@ func (db *mockDB) NumInserts() int {
 	return int(atomic.LoadInt64(&db.numInserts))
 }
 
-func (db *mockDB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
+func (db *mockDB) QueryRestricted(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, restrict sql.RestrictFN) (core.FlatRowSource, error) {
 	return nil, nil
 }
 
-func (db *mockDB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) {
+func (db *mockDB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error, acks <-chan wal.Offset) {
 }
 
 func (db *mockDB) RegisterQueryHandler(partition int, query planner.QueryClusterFN) {
 
 }
+
+func (db *mockDB) Snapshot(dir string) error {
+	return nil
+}
@@ -0,0 +1,521 @@
+package zenodb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// segmentsFilename is the name of the manifest that records the current set
+	// of segments along with the WAL offset up to which they're durable. The
+	// manifest is encoded as:
+	//   offset|segment1\n|segment2\n|...|lastsegment\n
+	segmentsFilename = "segments"
+
+	legacyFilePrefix  = "filestore_"
+	segmentFilePrefix = "segment_"
+
+	// defaultSegmentPeriod is used for tables that have neither a segment
+	// period, retention period nor resolution.
+	defaultSegmentPeriod = 24 * time.Hour
+)
+
+// segmentFilename builds a unique filename for a segment holding the window
+// (asOf, until].
+func (rs *rowStore) segmentFilename(asOf time.Time, until time.Time) string {
+	// Note - we left-pad the unix nano values to the widest possible length to
+	// ensure lexicographical sort matches time-based sort (e.g. on directory
+	// listing).
+	return filepath.Join(rs.opts.dir, fmt.Sprintf("%v%020d_%020d_%020d_%d.dat", segmentFilePrefix, asOf.UnixNano(), until.UnixNano(), time.Now().UnixNano(), CurrentFileVersion))
+}
+
+// segmentFor opens the segment stored in the given file, determining its
+// window from the filename.
+func (rs *rowStore) segmentFor(filename string) (*fileStore, error) {
+	parts := strings.Split(filepath.Base(filename), "_")
+	if len(parts) != 5 || parts[0]+"_" != segmentFilePrefix {
+		return nil, fmt.Errorf("Invalid segment filename %v", filename)
+	}
+	asOf, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse asOf for segment %v: %v", filename, err)
+	}
+	until, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse until for segment %v: %v", filename, err)
+	}
+	return &fileStore{
+		t:        rs.t,
+		fields:   rs.fields,
+		filename: filename,
+		asOf:     time.Unix(0, asOf),
+		until:    time.Unix(0, until),
+	}, nil
+}
+
+// openSegments reads the current segments and WAL offset from the manifest. If
+// there's no manifest yet, it migrates the data from the older single file
+// format.
+func (rs *rowStore) openSegments() ([]*fileStore, wal.Offset, error) {
+	manifest, err := ioutil.ReadFile(filepath.Join(rs.opts.dir, segmentsFilename))
+	if os.IsNotExist(err) {
+		return rs.migrateLegacyFiles()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read segments manifest: %v", err)
+	}
+	if len(manifest) < wal.OffsetSize {
+		return nil, nil, fmt.Errorf("Segments manifest is missing offset")
+	}
+
+	walOffset := wal.Offset(manifest[:wal.OffsetSize])
+	var segments []*fileStore
+	for _, name := range strings.Split(string(manifest[wal.OffsetSize:]), "\n") {
+		if name == "" {
+			continue
+		}
+		fs, err := rs.segmentFor(filepath.Join(rs.opts.dir, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		segments = append(segments, fs)
+	}
+	sortSegments(segments)
+	rs.t.log.Debugf("Initializing row store from %d segments", len(segments))
+	return segments, walOffset, nil
+}
+
+// migrateLegacyFiles splits the most recent file from the older single file
+// format into segments and records them in a new manifest.
+func (rs *rowStore) migrateLegacyFiles() ([]*fileStore, wal.Offset, error) {
+	files, err := ioutil.ReadDir(rs.opts.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read contents of directory: %v", err)
+	}
+
+	existingFileName := ""
+	var walOffset wal.Offset
+	// files are sorted by name, in our case timestamp, so the last file in the
+	// list is the most recent. That's the one that we want.
+	for i := len(files) - 1; i >= 0; i-- {
+		filename := files[i].Name()
+		fullFilename := filepath.Join(rs.opts.dir, filename)
+		if filename == offsetFilename {
+			// This is an offset file, just read the offset
+			o, err := ioutil.ReadFile(fullFilename)
+			if err != nil {
+				rs.t.log.Errorf("Unable to read offset: %v", err)
+			} else if len(o) != wal.OffsetSize {
+				rs.t.log.Errorf("Invalid offset found in offset file")
+			} else if wal.Offset(o).After(walOffset) {
+				walOffset = wal.Offset(o)
+			}
+			continue
+		}
+		if existingFileName != "" || !strings.HasPrefix(filename, legacyFilePrefix) {
+			continue
+		}
+
+		// Get WAL offset
+		newWALOffset, opened, err := readWALOffset(fullFilename)
+		if err != nil {
+			if !opened {
+				return nil, nil, err
+			}
+			log.Errorf("Unable to read offset from existing file %v, assuming corrupted and will remove: %v", fullFilename, err)
+			rmErr := os.Remove(fullFilename)
+			if rmErr != nil {
+				return nil, nil, fmt.Errorf("Unable to remove corrupted file %v: %v", fullFilename, err)
+			}
+			continue
+		}
+
+		if newWALOffset.After(walOffset) {
+			walOffset = newWALOffset
+		}
+		existingFileName = fullFilename
+	}
+
+	var segments []*fileStore
+	if existingFileName != "" {
+		rs.t.log.Debugf("Splitting %v into segments", existingFileName)
+		segments, err = rs.splitIntoSegments(existingFileName, walOffset)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rs.filesMx.Lock()
+	defer rs.filesMx.Unlock()
+	err = rs.writeManifest(segments, walOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return segments, walOffset, nil
+}
+
+func (rs *rowStore) splitIntoSegments(filename string, walOffset wal.Offset) ([]*fileStore, error) {
+	legacy := &fileStore{t: rs.t, fields: rs.fields, filename: filename}
+	windows := rs.newSegmentSet(nil, rs.t.truncateBefore())
+	err := legacy.iterate(rs.fields, nil, true, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		for i, seq := range columns {
+			windows.add(seq, rs.fields[i].Expr.EncodedWidth())
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %v: %v", filename, err)
+	}
+
+	segments := make([]*fileStore, 0, len(windows.segments))
+	for _, window := range windows.sorted() {
+		// Read the legacy file once per window, relying on the write to drop
+		// everything outside of the window.
+		in := &fileStore{t: rs.t, fields: rs.fields, filename: filename, asOf: window.asOf, until: window.until}
+		out, err := ioutil.TempFile("", "nextsegment")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create segment: %v", err)
+		}
+		in.flush(out, rs.fields, nil, walOffset, nil, false, true)
+		out.Close()
+		segmentName := rs.segmentFilename(window.asOf, window.until)
+		err = os.Rename(out.Name(), segmentName)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to move segment into place: %v", err)
+		}
+		segments = append(segments, &fileStore{t: rs.t, fields: rs.fields, filename: segmentName, asOf: window.asOf, until: window.until})
+	}
+	return segments, nil
+}
+
+// writeManifest atomically records the given segments and WAL offset in the
+// segments manifest. Callers must hold filesMx.
+func (rs *rowStore) writeManifest(segments []*fileStore, offset wal.Offset) error {
+	if len(offset) == 0 {
+		offset = emptyOffset
+	}
+
+	out, err := ioutil.TempFile("", "nextsegments")
+	if err != nil {
+		return fmt.Errorf("Unable to create segments manifest: %v", err)
+	}
+	defer out.Close()
+
+	_, err = out.Write(encodeManifest(segments, offset))
+	if err != nil {
+		return fmt.Errorf("Unable to write segments manifest: %v", err)
+	}
+
+	err = out.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to close segments manifest: %v", err)
+	}
+
+	err = os.Rename(out.Name(), filepath.Join(rs.opts.dir, segmentsFilename))
+	if err != nil {
+		return fmt.Errorf("Unable to move segments manifest into place: %v", err)
+	}
+
+	rs.walOffset = offset
+	return nil
+}
+
+// encodeManifest encodes the manifest for the given segments and WAL offset.
+func encodeManifest(segments []*fileStore, offset wal.Offset) []byte {
+	var buf bytes.Buffer
+	buf.Write(offset)
+	for _, fs := range segments {
+		buf.WriteString(filepath.Base(fs.filename))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// expireSegments drops segments whose windows fall entirely outside of the
+// table's retention period. The files themselves are removed by
+// removeOldFiles.
+func (rs *rowStore) expireSegments() {
+	truncateBefore := rs.t.truncateBefore()
+
+	rs.filesMx.Lock()
+	defer rs.filesMx.Unlock()
+
+	segments := make([]*fileStore, 0, len(rs.segments))
+	for _, fs := range rs.segments {
+		if fs.until.After(truncateBefore) {
+			segments = append(segments, fs)
+		} else {
+			rs.t.log.Debugf("Expiring segment %v", fs.filename)
+		}
+	}
+	if len(segments) == len(rs.segments) {
+		return
+	}
+
+	err := rs.writeManifest(segments, rs.walOffset)
+	if err != nil {
+		rs.t.log.Errorf("Unable to expire segments: %v", err)
+		return
+	}
+	rs.mx.Lock()
+	rs.segments = segments
+	rs.mx.Unlock()
+}
+
+// segmentSet collects the segments that hold some set of periods, keyed by the
+// end of their windows. Periods that aren't covered by an existing segment are
+// assigned to a new, empty segment.
+type segmentSet struct {
+	rs             *rowStore
+	existing       []*fileStore
+	truncateBefore time.Time
+	segments       map[int64]*fileStore
+}
+
+func (rs *rowStore) newSegmentSet(existing []*fileStore, truncateBefore time.Time) *segmentSet {
+	return &segmentSet{
+		rs:             rs,
+		existing:       existing,
+		truncateBefore: truncateBefore,
+		segments:       make(map[int64]*fileStore),
+	}
+}
+
+// addAll adds the given segments regardless of what periods they hold.
+func (ss *segmentSet) addAll(segments []*fileStore) {
+	for _, fs := range segments {
+		ss.segments[fs.until.UnixNano()] = fs
+	}
+}
+
+// addMemStore adds the segments that hold the periods in the given memstore.
+func (ss *segmentSet) addMemStore(ms *memstore) {
+	ms.tree.Walk(0, func(key []byte, columns []encoding.Sequence) (bool, bool, error) {
+		for i, seq := range columns {
+			if i >= len(ms.fields) {
+				break
+			}
+			ss.add(seq, ms.fields[i].Expr.EncodedWidth())
+		}
+		return true, true, nil
+	})
+}
+
+// add adds the segments that hold the unexpired periods in the given
+// sequence.
+func (ss *segmentSet) add(seq encoding.Sequence, width int) {
+	if seq.NumPeriods(width) == 0 {
+		return
+	}
+	asOf := seq.AsOf(width, ss.rs.t.Resolution)
+	for ts := seq.Until(); ts.After(asOf) && ts.After(ss.truncateBefore); {
+		fs := ss.segmentAt(ts)
+		if !fs.asOf.Before(ts) {
+			// Segments always cover at least one period, so this shouldn't
+			// happen. Bail out rather than looping forever.
+			ss.rs.t.log.Errorf("Segment %v - %v doesn't cover %v, not adding remaining periods", fs.asOf, fs.until, ts)
+			return
+		}
+		key := fs.until.UnixNano()
+		if ss.segments[key] == nil {
+			ss.segments[key] = fs
+		}
+		// Skip to the next segment
+		ts = fs.asOf
+	}
+}
+
+// segmentAt returns the existing segment that covers ts or, if there isn't
+// one, a new segment aligned to the segment period. New segments are trimmed
+// so that they don't overlap existing segments, which can happen if the
+// segment period changed since they were written.
+func (ss *segmentSet) segmentAt(ts time.Time) *fileStore {
+	period := ss.rs.opts.segmentPeriod
+	if period <= 0 {
+		period = defaultSegmentPeriod
+	}
+	until := encoding.RoundTimeUp(ts, period)
+	asOf := until.Add(-1 * period)
+	for _, fs := range ss.existing {
+		if fs.asOf.Before(ts) && !fs.until.Before(ts) {
+			return fs
+		}
+		if fs.until.Before(ts) && fs.until.After(asOf) {
+			asOf = fs.until
+		}
+		if !fs.asOf.Before(ts) && fs.asOf.Before(until) {
+			until = fs.asOf
+		}
+	}
+	return &fileStore{t: ss.rs.t, fields: ss.rs.fields, asOf: asOf, until: until}
+}
+
+func (ss *segmentSet) sorted() []*fileStore {
+	segments := make([]*fileStore, 0, len(ss.segments))
+	for _, fs := range ss.segments {
+		segments = append(segments, fs)
+	}
+	sortSegments(segments)
+	return segments
+}
+
+// replaceSegments returns a sorted copy of segments in which segments are
+// replaced by the replacement with the same window, if any.
+func replaceSegments(segments []*fileStore, replacements []*fileStore) []*fileStore {
+	byKey := make(map[int64]*fileStore, len(segments)+len(replacements))
+	for _, fs := range segments {
+		byKey[fs.until.UnixNano()] = fs
+	}
+	for _, fs := range replacements {
+		byKey[fs.until.UnixNano()] = fs
+	}
+	result := make([]*fileStore, 0, len(byKey))
+	for _, fs := range byKey {
+		result = append(result, fs)
+	}
+	sortSegments(result)
+	return result
+}
+
+func sortSegments(segments []*fileStore) {
+	sort.Sort(byUntil(segments))
+}
+
+type byUntil []*fileStore
+
+func (s byUntil) Len() int           { return len(s) }
+func (s byUntil) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byUntil) Less(i, j int) bool { return s[i].until.Before(s[j].until) }
+
+// sortByKey writes the rows of this segment, merged with the portion of the
+// given memstore that falls into its window, to a temporary file sorted by key.
+// It returns the name of that file.
+func (fs *fileStore) sortByKey(fields core.Fields, ms *memstore) (string, error) {
+	out, err := ioutil.TempFile("", "sortedsegment")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create file for sorted segment: %v", err)
+	}
+	defer out.Close()
+
+	cout, err := fs.createOutWriter(out, fields, emptyOffset, true)
+	if err == nil {
+		truncateBefore := fs.t.truncateBefore()
+		err = fs.iterate(fields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			_, writeErr := fs.doWrite(cout, fields, nil, truncateBefore, true, key, columns, raw)
+			return writeErr == nil, writeErr
+		})
+		if err == nil {
+			err = cout.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("Unable to sort segment %v: %v", fs.filename, err)
+	}
+	return out.Name(), nil
+}
+
+// sortedSegment streams the rows of a segment that was sorted by key.
+type sortedSegment struct {
+	rows chan *sortedRow
+	errs chan error
+	next *sortedRow
+}
+
+type sortedRow struct {
+	key     bytemap.ByteMap
+	columns []encoding.Sequence
+}
+
+// streamSorted streams the rows from the given sorted file until they run out
+// or stop is closed.
+func (rs *rowStore) streamSorted(filename string, fields core.Fields, stop <-chan interface{}) *sortedSegment {
+	ss := &sortedSegment{
+		rows: make(chan *sortedRow),
+		errs: make(chan error, 1),
+	}
+	fs := &fileStore{t: rs.t, fields: fields, filename: filename}
+	go func() {
+		ss.errs <- fs.iterate(fields, nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			select {
+			case ss.rows <- &sortedRow{key, columns}:
+				return true, nil
+			case <-stop:
+				return false, nil
+			}
+		})
+		close(ss.rows)
+	}()
+	return ss
+}
+
+// advance reads the next row, leaving next nil once all rows have been read.
+func (ss *sortedSegment) advance() error {
+	row, ok := <-ss.rows
+	if !ok {
+		ss.next = nil
+		return <-ss.errs
+	}
+	ss.next = row
+	return nil
+}
+
+// mergeSorted merges the rows of the given sorted segments in order of their
+// keys, merging the sequences of keys that appear in more than one segment.
+func (rs *rowStore) mergeSorted(sorted []*sortedSegment, fields core.Fields, truncateBefore time.Time, onRow func(bytemap.ByteMap, []encoding.Sequence) (bool, error)) error {
+	for _, ss := range sorted {
+		err := ss.advance()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		var key bytemap.ByteMap
+		found := false
+		for _, ss := range sorted {
+			if ss.next != nil && (!found || bytes.Compare(ss.next.key, key) < 0) {
+				key = ss.next.key
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+
+		var columns []encoding.Sequence
+		for _, ss := range sorted {
+			if ss.next == nil || !bytes.Equal(ss.next.key, key) {
+				continue
+			}
+			if columns == nil {
+				columns = ss.next.columns
+			} else {
+				for i, seq := range ss.next.columns {
+					columns[i] = columns[i].Merge(seq, fields[i].Expr, rs.t.Resolution, truncateBefore)
+				}
+			}
+			err := ss.advance()
+			if err != nil {
+				return err
+			}
+		}
+
+		more, err := onRow(key, columns)
+		if !more || err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package zenodb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	backupLockFilename = ".backup_lock"
+
+	// snapshotFilename marks a complete snapshot. It's written last and records
+	// the time at which the snapshot was taken.
+	snapshotFilename = ".snapshot"
+)
+
+// Snapshot takes a consistent copy of the database in dir, which must not
+// already exist. For each table, the snapshot captures the current segments
+// along with the WAL offset up to which they're durable. For each stream, it
+// captures the WAL segments following those offsets. Inserts continue while the
+// snapshot is taken, except for a brief pause per stream while its active WAL
+// segment is copied.
+//
+// Use RestoreSnapshot to bring a node back to the state captured in the
+// snapshot.
+func (db *DB) Snapshot(dir string) (err error) {
+	if db.opts.ReadOnly {
+		return errors.New("Unable to snapshot read-only database")
+	}
+	if _, statErr := os.Stat(dir); statErr == nil {
+		return errors.New("Snapshot directory %v already exists", dir)
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.New("Unable to create snapshot directory %v: %v", dir, err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// Holding the backup lock keeps the WALs from being truncated or compressed
+	// while we copy them.
+	releaseLock, err := db.acquireBackupLock()
+	if err != nil {
+		return err
+	}
+	defer releaseLock()
+
+	db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(db.orderedTables))
+	for _, t := range db.orderedTables {
+		if !t.Virtual {
+			tables = append(tables, t)
+		}
+	}
+	streams := make([]string, 0, len(db.streams))
+	for stream := range db.streams {
+		streams = append(streams, stream)
+	}
+	db.tablesMutex.RUnlock()
+
+	start := time.Now()
+	// Capture the tables before the WALs. The WALs only grow, so they'll include
+	// everything following the offsets recorded for the tables.
+	for _, t := range tables {
+		db.refreshBackupLock()
+		err = t.rowStore.snapshot(filepath.Join(dir, t.Name))
+		if err != nil {
+			return errors.New("Unable to snapshot table %v: %v", t.Name, err)
+		}
+	}
+	for _, stream := range streams {
+		db.refreshBackupLock()
+		err = db.snapshotWAL(stream, filepath.Join(dir, "_wal", stream))
+		if err != nil {
+			return errors.New("Unable to snapshot WAL for stream %v: %v", stream, err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, snapshotFilename), []byte(start.UTC().Format(time.RFC3339Nano)), 0644)
+	if err != nil {
+		return errors.New("Unable to mark snapshot as complete: %v", err)
+	}
+	log.Debugf("Snapshotted %d tables and %d streams to %v in %v", len(tables), len(streams), dir, time.Now().Sub(start))
+	return nil
+}
+
+// SnapshotDir resolves the requested snapshot directory dir, which must be
+// relative to and stay within root. Servers use this to keep clients from
+// writing snapshots to arbitrary locations.
+func SnapshotDir(root string, dir string) (string, error) {
+	if root == "" {
+		return "", errors.New("No snapshot directory configured")
+	}
+	if dir == "" {
+		return "", errors.New("Please specify a snapshot directory")
+	}
+	if filepath.IsAbs(dir) {
+		return "", errors.New("Snapshot directory %v must be relative to the server's snapshot directory", dir)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(dir), "/") {
+		if part == ".." {
+			return "", errors.New("Snapshot directory %v must not contain ..", dir)
+		}
+	}
+	return filepath.Join(root, dir), nil
+}
+
+// snapshot copies the current segments and manifest into dir.
+func (rs *rowStore) snapshot(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	rs.filesMx.Lock()
+	defer rs.filesMx.Unlock()
+
+	for _, fs := range rs.segments {
+		// Segments are never modified once written, so it's safe to link them
+		err = linkOrCopyFile(fs.filename, filepath.Join(dir, filepath.Base(fs.filename)))
+		if err != nil {
+			return err
+		}
+	}
+
+	offset := rs.walOffset
+	if len(offset) == 0 {
+		offset = emptyOffset
+	}
+	return ioutil.WriteFile(filepath.Join(dir, segmentsFilename), encodeManifest(rs.segments, offset), 0644)
+}
+
+// snapshotWAL copies the WAL segments for the given stream into dir.
+func (db *DB) snapshotWAL(stream string, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	walDir := filepath.Join(db.opts.Dir, "_wal", stream)
+	copied := make(map[string]bool)
+	copyFiles := func(includeActive bool, copyFile func(string, string) error) error {
+		// Note - ReadDir sorts by filename, so the active segment is last
+		files, err := ioutil.ReadDir(walDir)
+		if err != nil {
+			return err
+		}
+		for i, file := range files {
+			if !includeActive && i == len(files)-1 {
+				break
+			}
+			name := file.Name()
+			if copied[name] {
+				continue
+			}
+			err = copyFile(filepath.Join(walDir, name), filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			copied[name] = true
+		}
+		return nil
+	}
+
+	// Older segments aren't written to anymore, so we can copy them without
+	// holding up inserts.
+	err = copyFiles(false, linkOrCopyFile)
+	if err != nil {
+		return err
+	}
+
+	db.tablesMutex.RLock()
+	w := db.streams[stream]
+	db.tablesMutex.RUnlock()
+
+	// Pause inserts and sync anything the WAL has buffered to disk before
+	// copying the active segment.
+	db.snapshotMutex.Lock()
+	defer db.snapshotMutex.Unlock()
+	err = w.Sync()
+	if err != nil {
+		return fmt.Errorf("Unable to sync WAL: %v", err)
+	}
+	return copyFiles(true, copyFile)
+}
+
+// RestoreSnapshot restores the snapshot in snapshotDir to dbDir, which must not
+// already contain a database. Opening a DB at dbDir then resumes each table
+// from the WAL offset captured in the snapshot, bringing it back to exactly the
+// state at the time of the snapshot.
+func RestoreSnapshot(snapshotDir string, dbDir string) error {
+	_, err := os.Stat(filepath.Join(snapshotDir, snapshotFilename))
+	if err != nil {
+		return errors.New("%v does not contain a complete snapshot: %v", snapshotDir, err)
+	}
+
+	existing, err := ioutil.ReadDir(dbDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Unable to read db dir %v: %v", dbDir, err)
+	}
+	if len(existing) > 0 {
+		return errors.New("Unable to restore snapshot into non-empty db dir %v", dbDir)
+	}
+
+	return filepath.Walk(snapshotDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(snapshotDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dbDir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if rel == snapshotFilename {
+			return nil
+		}
+		// Copy rather than link so that the restored db can't modify the
+		// snapshot.
+		return copyFile(path, target)
+	})
+}
+
+// acquireBackupLock creates the backup lock file, pausing the deletion of old
+// files until the returned function is called.
+func (db *DB) acquireBackupLock() (func(), error) {
+	lockFile := filepath.Join(db.opts.Dir, backupLockFilename)
+	file, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, errors.New("Another backup is already in progress")
+		}
+		return nil, errors.New("Unable to create backup lock: %v", err)
+	}
+	file.Close()
+	return func() {
+		removeErr := os.Remove(lockFile)
+		if removeErr != nil {
+			log.Errorf("Unable to remove backup lock %v: %v", lockFile, removeErr)
+		}
+	}, nil
+}
+
+// refreshBackupLock updates the modification time of the backup lock so that
+// long-running snapshots don't exceed MaxBackupWait.
+func (db *DB) refreshBackupLock() {
+	now := time.Now()
+	err := os.Chtimes(filepath.Join(db.opts.Dir, backupLockFilename), now, now)
+	if err != nil {
+		log.Errorf("Unable to refresh backup lock: %v", err)
+	}
+}
+
+func linkOrCopyFile(from string, to string) error {
+	err := os.Link(from, to)
+	if err == nil {
+		return nil
+	}
+	// Linking fails across filesystems, fall back to copying
+	return copyFile(from, to)
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return fmt.Errorf("Unable to copy %v to %v: %v", from, to, err)
+	}
+	return out.Close()
+}
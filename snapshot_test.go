@@ -0,0 +1,153 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbsnapshottest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotDir := filepath.Join(tmpDir, "snapshot")
+	files := map[string]string{
+		filepath.Join("table_a", segmentsFilename):     "manifest",
+		filepath.Join("table_a", "segment_1.dat"):      "segment",
+		filepath.Join("_wal", "stream_a", "000000001"): "wal",
+	}
+	for name, data := range files {
+		path := filepath.Join(snapshotDir, name)
+		if !assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755)) {
+			return
+		}
+		if !assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644)) {
+			return
+		}
+	}
+
+	dbDir := filepath.Join(tmpDir, "db")
+	assert.Error(t, RestoreSnapshot(snapshotDir, dbDir), "Restoring incomplete snapshot should fail")
+
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(snapshotDir, snapshotFilename), []byte("now"), 0644)) {
+		return
+	}
+	if !assert.NoError(t, RestoreSnapshot(snapshotDir, dbDir)) {
+		return
+	}
+	for name, data := range files {
+		restored, err := ioutil.ReadFile(filepath.Join(dbDir, name))
+		if assert.NoError(t, err) {
+			assert.Equal(t, data, string(restored))
+		}
+	}
+	_, err = os.Stat(filepath.Join(dbDir, snapshotFilename))
+	assert.True(t, os.IsNotExist(err), "Snapshot marker shouldn't be restored")
+
+	assert.Error(t, RestoreSnapshot(snapshotDir, dbDir), "Restoring into existing db should fail")
+}
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbsnapshottest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tableOpts := func() *TableOpts {
+		return &TableOpts{
+			Name:            "test",
+			MinFlushLatency: time.Hour,
+			MaxFlushLatency: time.Hour,
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT SUM(i) AS i FROM inbound GROUP BY u, period(1s)",
+		}
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:         filepath.Join(tmpDir, "db"),
+		VirtualTime: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	if !assert.NoError(t, db.CreateTable(tableOpts())) {
+		return
+	}
+
+	epoch := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	insert := func(db *DB, i int) {
+		db.Insert("inbound", epoch.Add(time.Duration(i)*time.Second), map[string]interface{}{"u": 1}, map[string]float64{"i": float64(i)})
+	}
+	insert(db, 1)
+	insert(db, 2)
+	time.Sleep(500 * time.Millisecond)
+	// Flush some of the data to segments and leave the rest in the WAL
+	db.getTable("test").rowStore.forceFlush()
+	insert(db, 3)
+	time.Sleep(500 * time.Millisecond)
+
+	snapshotDir := filepath.Join(tmpDir, "snapshot")
+	if !assert.NoError(t, db.Snapshot(snapshotDir)) {
+		return
+	}
+	assert.Error(t, db.Snapshot(snapshotDir), "Snapshotting into existing directory should fail")
+
+	// Data inserted after the snapshot shouldn't be restored
+	insert(db, 4)
+
+	restoredDir := filepath.Join(tmpDir, "restored")
+	if !assert.NoError(t, RestoreSnapshot(snapshotDir, restoredDir)) {
+		return
+	}
+	restored, err := NewDB(&DBOpts{
+		Dir:         restoredDir,
+		VirtualTime: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer restored.Close()
+	if !assert.NoError(t, restored.CreateTable(tableOpts())) {
+		return
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	source, err := restored.Query("SELECT i FROM test GROUP BY _", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	total := float64(0)
+	err = source.Iterate(context.Background(), func(fields core.Fields) error {
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		total += row.Values[0]
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 6, total, "Restored DB should hold the data from segments and WAL as of the snapshot")
+	}
+}
+
+func TestSnapshotDir(t *testing.T) {
+	dir, err := SnapshotDir("/snapshots", "daily/2017-01-01")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/snapshots/daily/2017-01-01", dir)
+	}
+	for _, invalid := range []string{"", "/tmp/snapshot", "../snapshot", "daily/../../snapshot"} {
+		_, err = SnapshotDir("/snapshots", invalid)
+		assert.Error(t, err, "%v should be rejected", invalid)
+	}
+	_, err = SnapshotDir("", "daily")
+	assert.Error(t, err, "Snapshots should require a configured snapshot directory")
+}
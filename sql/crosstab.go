@@ -0,0 +1,89 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/sqlparser"
+)
+
+var (
+	crosstabRegex = regexp.MustCompile("(?i)\\bcrosstabt?\\s*\\(")
+	// sqlparser doesn't understand TOP n BY field, so we rewrite it into a
+	// TOP(n, field) in the GROUP BY clause, which it does understand.
+	crosstabTopRegex = regexp.MustCompile("(?i)^\\s+top\\s+(\\d+)\\s+by\\s+`?([a-z_][a-z0-9_]*)`?")
+)
+
+// rewriteCrosstabTop rewrites CROSSTAB(dims) TOP n BY field in the given SQL to
+// CROSSTAB(dims), TOP(n, field).
+func rewriteCrosstabTop(sqlString string) string {
+	for _, match := range crosstabRegex.FindAllStringIndex(sqlString, -1) {
+		end := closingParen(sqlString, match[1])
+		if end < 0 {
+			return sqlString
+		}
+		top := crosstabTopRegex.FindStringSubmatchIndex(sqlString[end+1:])
+		if top == nil {
+			continue
+		}
+		n := sqlString[end+1+top[2] : end+1+top[3]]
+		by := sqlString[end+1+top[4] : end+1+top[5]]
+		return fmt.Sprintf("%v, top(%v, %v)%v", sqlString[:end+1], n, by, sqlString[end+1+top[1]:])
+	}
+	return sqlString
+}
+
+// closingParen returns the index of the parenthesis that closes the one just
+// before idx in sqlString, or -1 if there is none.
+func closingParen(sqlString string, idx int) int {
+	depth := 1
+	var quote rune
+	for i, r := range sqlString[idx:] {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth == 0 {
+				return idx + i
+			}
+		}
+	}
+	return -1
+}
+
+func (q *Query) applyCrosstab(fn *sqlparser.FuncExpr, ex goexpr.Expr) error {
+	q.Crosstab = ex
+	q.CrosstabIncludesTotal = strings.HasSuffix(strings.ToUpper(string(fn.Name)), "T")
+	q.CrosstabDims = make([]goexpr.Expr, 0, len(fn.Exprs))
+	for i := range fn.Exprs {
+		dim, err := paramGoExpr(fn, i)
+		if err != nil {
+			return err
+		}
+		q.CrosstabDims = append(q.CrosstabDims, dim)
+	}
+	return nil
+}
+
+func (q *Query) applyCrosstabTop(fn *sqlparser.FuncExpr) error {
+	if len(fn.Exprs) != 2 {
+		return ErrInvalidCrosstabTop
+	}
+	n, err := strconv.Atoi(strings.Trim(nodeToString(fn.Exprs[0]), "'\""))
+	if err != nil || n <= 0 {
+		return ErrInvalidCrosstabTop
+	}
+	q.CrosstabTop = n
+	q.CrosstabTopBy = strings.ToLower(strings.Trim(nodeToString(fn.Exprs[1]), "`'\""))
+	return nil
+}
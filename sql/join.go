@@ -0,0 +1,129 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/goexpr"
+)
+
+// sqlparser doesn't understand USING, so we find JOINs ourselves
+var joinRegex = regexp.MustCompile("(?i)\\s+(left\\s+(?:outer\\s+)?|inner\\s+)?join\\s+`?([a-z_][a-z0-9_]*)`?\\s+using\\s*\\(([^)]*)\\)")
+
+// Join is a JOIN ... USING (dims) clause. It joins the rows of the table in
+// the FROM clause with the rows of another table that have the same values for
+// the given dimensions in the same period.
+type Join struct {
+	// Table is the table being joined
+	Table string
+	// Using are the dimensions on which rows are joined, ordered alphabetically
+	Using []string
+	// Left indicates a LEFT JOIN, which keeps rows of the FROM table that have
+	// no matching rows in Table
+	Left bool
+}
+
+func (j *Join) String() string {
+	joinType := "join"
+	if j.Left {
+		joinType = "left join"
+	}
+	return fmt.Sprintf("%v %v using (%v)", joinType, j.Table, strings.Join(j.Using, ", "))
+}
+
+// checkWhere makes sure that the given WHERE condition only references the
+// joined dimensions, which are the only dimensions left after joining and can
+// be filtered on both sides of the join.
+func (j *Join) checkWhere(where goexpr.Expr) error {
+	using := make(map[string]bool, len(j.Using))
+	for _, dim := range j.Using {
+		using[dim] = true
+	}
+	var err error
+	where.WalkParams(func(name string) {
+		if !using[name] {
+			err = ErrJoinWhere
+		}
+	})
+	return err
+}
+
+func (q *Query) applyJoin(join *Join) error {
+	if q.FromSubQuery != nil {
+		return ErrJoinSubQuery
+	}
+	if q.HasSelectAll {
+		return ErrJoinSelectAll
+	}
+	q.Join = join
+	q.SQL = withJoin(q.SQL, q.From, join)
+	return nil
+}
+
+// extractJoin removes the JOIN ... USING (dims) clause of the outermost query
+// from the given SQL. It returns the remaining SQL along with the Join, which
+// is nil if the query doesn't have one.
+func extractJoin(sqlString string) (string, *Join, error) {
+	for _, match := range joinRegex.FindAllStringSubmatchIndex(sqlString, -1) {
+		if !topLevel(sqlString, match[0]) {
+			// JOINs in subqueries are left for sqlparser to reject
+			continue
+		}
+		join := &Join{
+			Table: strings.ToLower(sqlString[match[4]:match[5]]),
+			Left:  match[2] >= 0 && strings.HasPrefix(strings.ToLower(sqlString[match[2]:match[3]]), "left"),
+		}
+		for _, dim := range strings.Split(sqlString[match[6]:match[7]], ",") {
+			dim = strings.ToLower(strings.Trim(strings.TrimSpace(dim), "`"))
+			if dim == "" {
+				return "", nil, ErrJoinUsing
+			}
+			join.Using = append(join.Using, dim)
+		}
+		sort.Strings(join.Using)
+		return sqlString[:match[0]] + sqlString[match[1]:], join, nil
+	}
+	return sqlString, nil, nil
+}
+
+// withJoin adds the given Join back into the given SQL, right after the table
+// in the FROM clause of the outermost query.
+func withJoin(sqlString string, from string, join *Join) string {
+	fromRegex := regexp.MustCompile(fmt.Sprintf("(?i)\\bfrom\\s+`?%v\\b`?", regexp.QuoteMeta(from)))
+	for _, match := range fromRegex.FindAllStringIndex(sqlString, -1) {
+		if topLevel(sqlString, match[0]) {
+			return fmt.Sprintf("%v %v%v", sqlString[:match[1]], join, sqlString[match[1]:])
+		}
+	}
+	return sqlString
+}
+
+// topLevel determines whether the given index in sqlString is outside of any
+// parentheses, string literals or backquoted identifiers. Quotes escaped with a
+// backslash don't end string literals.
+func topLevel(sqlString string, idx int) bool {
+	depth := 0
+	var quote rune
+	escaped := false
+	for _, r := range sqlString[:idx] {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && quote != '`' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		}
+	}
+	return depth == 0 && quote == 0
+}
@@ -0,0 +1,59 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// sqlparser doesn't understand LIMIT n BY dims, so we find it ourselves
+	limitByRegex = regexp.MustCompile("(?i)\\s+limit\\s+(\\d+)\\s+by\\s+(`?[a-z_][a-z0-9_]*`?(?:\\s*,\\s*`?[a-z_][a-z0-9_]*`?)*)")
+	// trailingLimitRegex matches the LIMIT clause at the end of formatted SQL
+	trailingLimitRegex = regexp.MustCompile("(?i)\\s+limit\\s+[^\\s,]+(?:\\s*,\\s*[^\\s,]+)?\\s*$")
+)
+
+// LimitBy is a LIMIT n BY dims clause. It limits the result to the first N
+// rows (per ORDER BY) for each combination of values of the given dimensions.
+type LimitBy struct {
+	N int
+	// Dims are the dimensions by which rows are limited, in the order given.
+	// _time limits rows for each timestamp.
+	Dims []string
+}
+
+func (l *LimitBy) String() string {
+	return fmt.Sprintf("limit %d by %v", l.N, strings.Join(l.Dims, ", "))
+}
+
+// extractLimitBy removes the LIMIT n BY dims clause of the outermost query from
+// the given SQL. It returns the remaining SQL along with the LimitBy, which is
+// nil if the query doesn't have one.
+func extractLimitBy(sqlString string) (string, *LimitBy, error) {
+	for _, match := range limitByRegex.FindAllStringSubmatchIndex(sqlString, -1) {
+		if !topLevel(sqlString, match[0]) {
+			continue
+		}
+		n, err := strconv.Atoi(sqlString[match[2]:match[3]])
+		if err != nil || n <= 0 {
+			return "", nil, ErrInvalidLimitBy
+		}
+		limitBy := &LimitBy{N: n}
+		for _, dim := range strings.Split(sqlString[match[4]:match[5]], ",") {
+			limitBy.Dims = append(limitBy.Dims, strings.ToLower(strings.Trim(strings.TrimSpace(dim), "`")))
+		}
+		return sqlString[:match[0]] + sqlString[match[1]:], limitBy, nil
+	}
+	return sqlString, nil, nil
+}
+
+// withLimitBy adds the given LimitBy back into the given formatted SQL, right
+// before its LIMIT clause if it has one.
+func withLimitBy(sqlString string, limitBy *LimitBy) string {
+	idx := len(sqlString)
+	if match := trailingLimitRegex.FindStringIndex(sqlString); match != nil {
+		idx = match[0]
+	}
+	return fmt.Sprintf("%v %v%v", sqlString[:idx], limitBy, sqlString[idx:])
+}
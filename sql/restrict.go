@@ -0,0 +1,176 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/getlantern/sqlparser"
+)
+
+// RestrictFN determines whether the given table may be queried. If it may, it
+// returns a predicate (in SQL) that must be applied to all rows read from the
+// table, or "" if all rows may be read.
+type RestrictFN func(table string) (where string, err error)
+
+// Restrict rewrites the given SQL query so that every table that it reads,
+// including tables read by subqueries in its FROM and WHERE clauses, is checked
+// with restrict and has the corresponding predicate ANDed into its WHERE
+// clause.
+//
+// Predicates can't be applied to the rows of joined tables, so JOINs are only
+// allowed between tables whose rows may all be read.
+//
+// Each SELECT combined with UNION ALL is restricted separately.
+func Restrict(sqlString string, restrict RestrictFN) (string, error) {
+	parts, err := splitUnion(sqlString)
+	if err != nil {
+		return "", err
+	}
+	restrictedParts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		restrictedPart, err := restrictPart(part, restrict)
+		if err != nil {
+			return "", err
+		}
+		restrictedParts = append(restrictedParts, restrictedPart)
+	}
+	return strings.Join(restrictedParts, " union all "), nil
+}
+
+func restrictPart(sqlString string, restrict RestrictFN) (string, error) {
+	stmt, ext, err := parseSelect(sqlString)
+	if err != nil {
+		return "", err
+	}
+	from := strings.ToLower(nodeToString(stmt.From))
+	if ext.join != nil {
+		for _, table := range []string{from, ext.join.Table} {
+			where, err := restrict(table)
+			if err != nil {
+				return "", err
+			}
+			if where != "" {
+				return "", ErrJoinRestricted
+			}
+		}
+	}
+	err = restrictSelect(stmt, restrict)
+	if err != nil {
+		return "", err
+	}
+	restricted := nodeToString(stmt)
+	if ext.join != nil {
+		restricted = withJoin(restricted, from, ext.join)
+	}
+	if ext.limitBy != nil {
+		restricted = withLimitBy(restricted, ext.limitBy)
+	}
+	return restricted, nil
+}
+
+func restrictSelect(stmt *sqlparser.Select, restrict RestrictFN) error {
+	if stmt.Where != nil {
+		err := restrictBoolExpr(stmt.Where.Expr, restrict)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(stmt.From) == 0 {
+		return fmt.Errorf("Missing FROM clause")
+	}
+	f, ok := stmt.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return fmt.Errorf("Unknown from expression of type %v", reflect.TypeOf(stmt.From[0]))
+	}
+	switch e := f.Expr.(type) {
+	case *sqlparser.Subquery:
+		// The restriction is applied within the subquery
+		return restrictSubquery(e, restrict)
+	case *sqlparser.TableName:
+		where, err := restrict(strings.ToLower(string(e.Name)))
+		if err != nil {
+			return err
+		}
+		if where == "" {
+			return nil
+		}
+		forced, err := parseWhere(where)
+		if err != nil {
+			return err
+		}
+		if stmt.Where == nil {
+			stmt.Where = sqlparser.NewWhere(sqlparser.WhereStr, forced)
+		} else {
+			stmt.Where.Expr = &sqlparser.AndExpr{
+				Left:  &sqlparser.ParenBoolExpr{Expr: stmt.Where.Expr},
+				Right: forced,
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown from expression of type %v", reflect.TypeOf(f.Expr))
+	}
+}
+
+func restrictBoolExpr(_e sqlparser.BoolExpr, restrict RestrictFN) error {
+	switch e := _e.(type) {
+	case *sqlparser.AndExpr:
+		err := restrictBoolExpr(e.Left, restrict)
+		if err != nil {
+			return err
+		}
+		return restrictBoolExpr(e.Right, restrict)
+	case *sqlparser.OrExpr:
+		err := restrictBoolExpr(e.Left, restrict)
+		if err != nil {
+			return err
+		}
+		return restrictBoolExpr(e.Right, restrict)
+	case *sqlparser.NotExpr:
+		return restrictBoolExpr(e.Expr, restrict)
+	case *sqlparser.ParenBoolExpr:
+		return restrictBoolExpr(e.Expr, restrict)
+	case *sqlparser.ComparisonExpr:
+		for _, side := range []sqlparser.ValExpr{e.Left, e.Right} {
+			sq, ok := side.(*sqlparser.Subquery)
+			if ok {
+				err := restrictSubquery(sq, restrict)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func restrictSubquery(sq *sqlparser.Subquery, restrict RestrictFN) error {
+	stmt, ok := sq.Select.(*sqlparser.Select)
+	if !ok {
+		return fmt.Errorf("Subquery requires a SELECT statement")
+	}
+	return restrictSelect(stmt, restrict)
+}
+
+// parseWhere parses a standalone predicate, wrapping it in parentheses so that
+// it binds correctly when combined with other predicates.
+func parseWhere(where string) (sqlparser.BoolExpr, error) {
+	parsed, err := sqlparser.Parse(fmt.Sprintf("SELECT * FROM restricted WHERE %v", where))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse predicate %v: %v", where, err)
+	}
+	stmt := parsed.(*sqlparser.Select)
+	return &sqlparser.ParenBoolExpr{Expr: stmt.Where.Expr}, nil
+}
+
+// ValidateWhere checks that the given predicate can be used with Restrict.
+func ValidateWhere(where string) error {
+	forced, err := parseWhere(where)
+	if err != nil {
+		return err
+	}
+	_, err = goExprFor(forced)
+	return err
+}
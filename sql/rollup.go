@@ -0,0 +1,91 @@
+package sql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/getlantern/sqlparser"
+	"github.com/getlantern/zenodb/core"
+)
+
+// applyRollup handles a ROLLUP(a, b) or CUBE(a, b) in the GROUP BY clause. It
+// returns the dimensions to group by along with the alternative sets of them
+// that are rolled up into subtotals. For ROLLUP(a, b) these are [], [b] and
+// [a b], for CUBE(a, b) they are [], [a], [b] and [a b].
+func applyRollup(fn *sqlparser.FuncExpr) ([]core.GroupBy, [][]string, error) {
+	if len(fn.Exprs) < 1 {
+		return nil, nil, ErrRollupArity
+	}
+	dims := make([]core.GroupBy, 0, len(fn.Exprs))
+	names := make([]string, 0, len(fn.Exprs))
+	for _, e := range fn.Exprs {
+		nse, ok := e.(*sqlparser.NonStarExpr)
+		if !ok {
+			return nil, nil, ErrWildcardNotAllowed
+		}
+		dim, err := groupByFor(nse)
+		if err != nil {
+			return nil, nil, err
+		}
+		dims = append(dims, dim)
+		names = append(names, dim.Name)
+	}
+
+	var sets [][]string
+	if strings.EqualFold("CUBE", string(fn.Name)) {
+		// Every combination of dimensions
+		for mask := 0; mask < 1<<uint(len(names)); mask++ {
+			set := make([]string, 0, len(names))
+			for i, name := range names {
+				if mask&(1<<uint(i)) != 0 {
+					set = append(set, name)
+				}
+			}
+			sets = append(sets, set)
+		}
+	} else {
+		// Dimensions are rolled up from right to left
+		for i := len(names); i >= 0; i-- {
+			sets = append(sets, append([]string{}, names[i:]...))
+		}
+	}
+	return dims, sets, nil
+}
+
+// combineSubtotals combines the rolled up sets of several ROLLUPs and CUBEs
+// into the sets of dimensions to subtotal by, leaving out the set that doesn't
+// roll up anything.
+func combineSubtotals(rollups [][][]string) [][]string {
+	combined := [][]string{nil}
+	for _, sets := range rollups {
+		next := make([][]string, 0, len(combined)*len(sets))
+		for _, prior := range combined {
+			for _, set := range sets {
+				next = append(next, append(append([]string{}, prior...), set...))
+			}
+		}
+		combined = next
+	}
+
+	var result [][]string
+	seen := make(map[string]bool, len(combined))
+	for _, set := range combined {
+		if len(set) == 0 {
+			continue
+		}
+		sort.Strings(set)
+		unique := set[:1]
+		for _, name := range set[1:] {
+			if name != unique[len(unique)-1] {
+				unique = append(unique, name)
+			}
+		}
+		set = unique
+		key := strings.Join(set, ",")
+		if !seen[key] {
+			result = append(result, set)
+			seen[key] = true
+		}
+	}
+	return result
+}
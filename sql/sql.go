@@ -19,6 +19,7 @@ import (
 	"github.com/getlantern/golog"
 	"github.com/getlantern/sqlparser"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
 )
 
@@ -30,30 +31,82 @@ var (
 	ErrSelectNoName                  = errors.New("All expressions in SELECT must either reference a column name or include an AS alias")
 	ErrIfArity                       = errors.New("IF requires two parameters, like IF(dim = 1, SUM(b))")
 	ErrBoundedArity                  = errors.New("BOUNDED requires three parameters, like BOUNDED(b, 0, 100)")
+	ErrPercentileArity               = errors.New("PERCENTILE requires two parameters, like PERCENTILE(b, 95)")
+	ErrCountDistinctArity            = errors.New("COUNT_DISTINCT requires one parameter, like COUNT_DISTINCT(dim)")
 	ErrShiftArity                    = errors.New("SHIFT requires two parameters, like SHIFT(SUM(b), '-1h')")
+	ErrRateArity                     = errors.New("RATE requires one parameter, like RATE(SUM(b))")
+	ErrDeltaArity                    = errors.New("DELTA requires one parameter, like DELTA(SUM(b))")
+	ErrDerivativeArity               = errors.New("DERIVATIVE requires two parameters, like DERIVATIVE(SUM(b), '1m')")
+	ErrMovingArity                   = errors.New("MOVING_AVG and MOVING_SUM require two parameters, like MOVING_AVG(SUM(b), '1h')")
 	ErrCrosshiftArity                = errors.New("CROSSHIFT requires three parameters, like CROSSHIFT(SUM(b), '1h', '-1d')")
 	ErrCrosshiftZeroCutoffOrInterval = errors.New("CROSSHIFT cutoff and interval must be non-zero")
 	ErrCROSSTABArity                 = errors.New("CROSSTAB requires at least one argument")
 	ErrCROSSTABUnique                = errors.New("Only one CROSSTAB statement allowed per query")
+	ErrInvalidCrosstabTop            = errors.New("Please specify the top columns of a CROSSTAB in the form CROSSTAB(dim) TOP 5 BY field where 5 can be any positive number")
+	ErrCrosstabTopWithoutCrosstab    = errors.New("TOP n BY field can only be used with a CROSSTAB")
+	ErrCoalesceArity                 = errors.New("COALESCE requires at least one parameter, like COALESCE(SUM(b), 0)")
 	ErrAggregateArity                = errors.New("Aggregate functions take only one parameter, like SUM(b)")
 	ErrWildcardNotAllowed            = errors.New("Wildcard * is not supported")
-	ErrNestedFunctionCall            = errors.New("Nested function calls are not currently supported in SELECT")
-	ErrInvalidPeriod                 = errors.New("Please specify a period in the form period(5s) where 5s can be any valid Go duration expression")
+	ErrInvalidPeriod                 = errors.New("Please specify a period in the form period(5s) where 5s can be any valid Go duration expression, or in the form period(1d, 'America/New_York') where 1d can be any number of days (d), weeks (w) or months (mo)")
+	ErrTimeZoneWithoutCalendar       = errors.New("A time zone can only be specified for periods of days (d), weeks (w) or months (mo), like period(1d, 'America/New_York')")
+	ErrStrideWithCalendar            = errors.New("stride() can't be combined with a period of days, weeks or months in a time zone")
+	ErrLookBackWithCalendar          = errors.New("RATE, DELTA, DERIVATIVE, MOVING_AVG and MOVING_SUM can't be combined with a period of days, weeks or months in a time zone")
+	ErrJoinUsing                     = errors.New("Please specify a join in the form JOIN table USING (dim1, dim2), joining on anything other than dimensions is not supported")
+	ErrJoinSubQuery                  = errors.New("JOIN requires a table in the FROM clause, not a subquery")
+	ErrJoinSelectAll                 = errors.New("JOIN requires selecting specific fields, SELECT * is not supported")
+	ErrJoinRestricted                = errors.New("JOIN is not supported on tables with restricted access")
+	ErrJoinWhere                     = errors.New("WHERE in a query with a JOIN can only reference the dimensions in its USING clause")
+	ErrUnionDistinct                 = errors.New("Only UNION ALL is supported, UNION without ALL is not")
+	ErrUnionOrderBy                  = errors.New("ORDER BY and LIMIT are only allowed after the last SELECT of a UNION ALL, where they apply to the combined result")
+	ErrUnionNotAllowed               = errors.New("UNION ALL is only supported in queries, not in table or view definitions")
+	ErrRollupArity                   = errors.New("ROLLUP and CUBE require at least one dimension, like ROLLUP(country, city)")
+	ErrRollupWildcard                = errors.New("ROLLUP and CUBE can't be combined with GROUP BY *")
+	ErrRollupNotAllowed              = errors.New("ROLLUP and CUBE are only supported in queries, not in table or view definitions")
+	ErrInvalidLimitBy                = errors.New("Please specify LIMIT BY in the form LIMIT 10 BY dim1, dim2 where 10 can be any positive number")
 	ErrInvalidStride                 = errors.New("Please specify a stride in the form stride(5s) where 5s can be any valid Go duration expression")
+	ErrInvalidFill                   = errors.New("Please specify a fill in the form fill(previous) where previous can be any of none, null, zero, previous or linear")
 )
 
 var aggregateFuncs = map[string]func(interface{}) expr.Expr{
-	"SUM":   expr.SUM,
-	"MIN":   expr.MIN,
-	"MAX":   expr.MAX,
-	"COUNT": expr.COUNT,
-	"AVG":   expr.AVG,
+	"SUM":    expr.SUM,
+	"MIN":    expr.MIN,
+	"MAX":    expr.MAX,
+	"COUNT":  expr.COUNT,
+	"AVG":    expr.AVG,
+	"MEDIAN": expr.MEDIAN,
 }
 
 var binaryAggregateFuncs = map[string]func(interface{}, interface{}) expr.Expr{
 	"WAVG": expr.WAVG,
 }
 
+// valueFuncs are functions other than aggregates that always produce values
+// rather than dimensions.
+var valueFuncs = map[string]bool{
+	"IF":             true,
+	"BOUNDED":        true,
+	"SHIFT":          true,
+	"PERCENTILE":     true,
+	"COUNT_DISTINCT": true,
+	"COALESCE":       true,
+	"RATE":           true,
+	"DELTA":          true,
+	"DERIVATIVE":     true,
+	"MOVING_AVG":     true,
+	"MOVING_SUM":     true,
+}
+
+var binaryMathFuncs = map[string]func(interface{}, interface{}) expr.Expr{
+	"POW":   expr.POW,
+	"MOD":   expr.MOD,
+	"ROUND": expr.ROUND,
+}
+
+var variadicMathFuncs = map[string]func(interface{}, interface{}, ...interface{}) expr.Expr{
+	"GREATEST": expr.GREATEST,
+	"LEAST":    expr.LEAST,
+}
+
 var operators = map[string]func(interface{}, interface{}) expr.Expr{
 	"+": expr.ADD,
 	"-": expr.SUB,
@@ -162,6 +215,7 @@ type Query struct {
 	From         string
 	FromSubQuery *Query
 	FromSQL      string
+	Join         *Join
 	Resolution   time.Duration
 	Where        goexpr.Expr
 	WhereSQL     string
@@ -170,39 +224,123 @@ type Query struct {
 	Until        time.Time
 	UntilOffset  time.Duration
 	Stride       time.Duration
+	// Calendar, if set, makes periods follow calendar days, weeks or months in
+	// a specific time zone instead of Resolution
+	Calendar *encoding.Calendar
+	// Fill determines how periods without data are filled in
+	Fill core.Fill
 	// GroupBy are the GroupBy expressions ordered alphabetically by name.
 	GroupBy    []core.GroupBy
 	GroupByAll bool
 	// Crosstab is the goexpr.Expr used for crosstabs (goes into columns rather than rows)
 	Crosstab              goexpr.Expr
 	CrosstabIncludesTotal bool
+	CrosstabDims          []goexpr.Expr
+	CrosstabTop           int
+	CrosstabTopBy         string
 	HasHaving             bool
 	HavingSQL             string
 	OrderBy               []core.OrderBy
 	Offset                int
 	Limit                 int
+	// Union, if set, are the queries whose results are combined with UNION ALL,
+	// in which case only SQL, OrderBy, Offset and Limit are also set.
+	Union []*Query
+	// Subtotals are the sets of GroupBy dimensions that are rolled up into
+	// subtotals by ROLLUP or CUBE, each ordered alphabetically.
+	Subtotals [][]string
+	// LimitBy, if set, limits the number of rows for each combination of values
+	// of its dimensions. It applies after OrderBy and before Offset and Limit.
+	LimitBy *LimitBy
 }
 
 // TableFor returns the table in the FROM clause of this query
 func TableFor(sql string) (string, error) {
-	parsed, err := sqlparser.Parse(sql)
+	parts, err := splitUnion(sql)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) > 1 {
+		return "", ErrUnionNotAllowed
+	}
+	stmt, _, err := parseSelect(sql)
 	if err != nil {
 		return "", err
 	}
-	stmt := parsed.(*sqlparser.Select)
 	return strings.ToLower(nodeToString(stmt.From[0])), nil
 }
 
+// WithFrom returns a copy of this query that reads from the given table instead
+// of the one in its FROM clause. The table is replaced in the parsed statement,
+// so literals and other clauses that mention the original table are left
+// alone.
+func (q *Query) WithFrom(table string) (*Query, error) {
+	stmt, ext, err := parseSelect(q.SQL)
+	if err != nil {
+		return nil, err
+	}
+	if len(stmt.From) == 0 {
+		return nil, fmt.Errorf("Missing FROM clause")
+	}
+	var tableName *sqlparser.TableName
+	if f, ok := stmt.From[0].(*sqlparser.AliasedTableExpr); ok {
+		tableName, _ = f.Expr.(*sqlparser.TableName)
+	}
+	if tableName == nil {
+		return nil, fmt.Errorf("Unable to change the table of a query that doesn't select from a table")
+	}
+	tableName.Name = sqlparser.TableIdent(table)
+	return parse(stmt, ext)
+}
+
 // Parse parses a SQL statement and returns a corresponding *Query object.
 func Parse(sql string) (*Query, error) {
-	parsed, err := sqlparser.Parse(sql)
+	parts, err := splitUnion(sql)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) > 1 {
+		return parseUnion(parts)
+	}
+	stmt, ext, err := parseSelect(sql)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing %v: %v", sql, err)
+		return nil, err
 	}
-	return parse(parsed.(*sqlparser.Select))
+	return parse(stmt, ext)
+}
+
+// extensions are the clauses that sqlparser doesn't understand, which are
+// removed from the SQL before parsing and applied separately.
+type extensions struct {
+	join    *Join
+	limitBy *LimitBy
 }
 
-func parse(stmt *sqlparser.Select) (*Query, error) {
+// parseSelect parses a single SELECT statement, along with its extensions.
+func parseSelect(sql string) (*sqlparser.Select, *extensions, error) {
+	ext := &extensions{}
+	sqlWithoutLimitBy, limitBy, err := extractLimitBy(rewriteCrosstabTop(sql))
+	if err != nil {
+		return nil, nil, err
+	}
+	ext.limitBy = limitBy
+	sqlWithoutJoin, join, err := extractJoin(sqlWithoutLimitBy)
+	if err != nil {
+		return nil, nil, err
+	}
+	ext.join = join
+	parsed, err := sqlparser.Parse(sqlWithoutJoin)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing %v: %v", sql, err)
+	}
+	stmt, ok := parsed.(*sqlparser.Select)
+	if !ok {
+		return nil, nil, fmt.Errorf("Only SELECT statements are supported")
+	}
+	return stmt, ext, nil
+}
+
+func parse(stmt *sqlparser.Select, ext *extensions) (*Query, error) {
 	q := &Query{
 		SQL: nodeToString(stmt),
 	}
@@ -211,6 +349,16 @@ func parse(stmt *sqlparser.Select) (*Query, error) {
 		return nil, err
 	}
 	q.checkForFields(stmt)
+	if ext.join != nil {
+		err = q.applyJoin(ext.join)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ext.limitBy != nil {
+		q.LimitBy = ext.limitBy
+		q.SQL = withLimitBy(q.SQL, ext.limitBy)
+	}
 	q.HasHaving = stmt.Having != nil
 	if q.HasHaving {
 		q.HavingSQL = fmt.Sprintf("%v AS %v", nodeToString(stmt.Having.Expr), core.HavingFieldName)
@@ -231,13 +379,15 @@ func parse(stmt *sqlparser.Select) (*Query, error) {
 		}
 		q.Fields = &selectClause{
 			stmt:    combinedFields.(*sqlparser.Select),
-			fielded: fielded{sql: sql},
+			query:   q,
+			fielded: fielded{sql: sql, joined: q.Join != nil},
 		}
 	}
 	if hasSelect {
 		q.FieldsNoHaving = &selectClause{
 			stmt:    stmt,
-			fielded: fielded{sql: nodeToString(stmt.SelectExprs)},
+			query:   q,
+			fielded: fielded{sql: nodeToString(stmt.SelectExprs), joined: q.Join != nil},
 		}
 	}
 	if stmt.Where != nil {
@@ -245,6 +395,12 @@ func parse(stmt *sqlparser.Select) (*Query, error) {
 		if err != nil {
 			return nil, err
 		}
+		if q.Join != nil {
+			err = q.Join.checkWhere(q.Where)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	if stmt.TimeRange != nil {
 		err = q.applyTimeRange(stmt)
@@ -286,6 +442,9 @@ func (q *Query) checkForFields(stmt *sqlparser.Select) {
 type fielded struct {
 	fieldsMap map[string]core.Field
 	sql       string
+	// joined indicates that fields may be qualified with the name of one of
+	// the joined tables, like server_metrics.requests
+	joined bool
 }
 
 func (f *fielded) init(known core.Fields) {
@@ -300,7 +459,8 @@ func (f *fielded) String() string {
 }
 
 type selectClause struct {
-	stmt *sqlparser.Select
+	stmt  *sqlparser.Select
+	query *Query
 	fielded
 }
 
@@ -341,6 +501,16 @@ func (s *selectClause) Get(known core.Fields) (core.Fields, error) {
 		}
 	}
 
+	if s.query != nil && s.query.Calendar != nil {
+		// Calendar periods vary in length, so functions that look back at prior
+		// periods can't compute their values
+		for _, field := range fields {
+			if expr.LookBack(field.Expr, time.Nanosecond) > 0 {
+				return nil, ErrLookBackWithCalendar
+			}
+		}
+	}
+
 	return fields, nil
 }
 
@@ -463,6 +633,8 @@ func (q *Query) applyFrom(stmt *sqlparser.Select) error {
 			q.From = strings.ToLower(string(e.Name))
 			return nil
 		}
+	case *sqlparser.JoinTableExpr:
+		return ErrJoinUsing
 	}
 	return fmt.Errorf("Unknown from expression of type %v", reflect.TypeOf(stmt.From[0]))
 }
@@ -510,6 +682,7 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 	groupedByAnything := false
 	groupBy := make(map[string]core.GroupBy)
 	var groupByNames []string
+	var rollups [][][]string
 	for _, e := range stmt.GroupBy {
 		groupedByAnything = true
 		_, ok := e.(*sqlparser.StarExpr)
@@ -524,14 +697,13 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 		fn, ok := nse.Expr.(*sqlparser.FuncExpr)
 		if ok && strings.EqualFold("PERIOD", string(fn.Name)) {
 			log.Trace("Detected period in group by")
-			if len(fn.Exprs) != 1 {
+			if len(fn.Exprs) < 1 || len(fn.Exprs) > 2 {
 				return ErrInvalidPeriod
 			}
-			res, err := nodeToDuration(fn.Exprs[0])
+			err := q.applyPeriod(fn.Exprs)
 			if err != nil {
 				return err
 			}
-			q.Resolution = res
 		} else if ok && strings.EqualFold("STRIDE", string(fn.Name)) {
 			log.Trace("Detected stride in group by")
 			if len(fn.Exprs) != 1 {
@@ -542,8 +714,36 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 				return err
 			}
 			q.Stride = stride
+		} else if ok && strings.EqualFold("FILL", string(fn.Name)) {
+			log.Trace("Detected fill in group by")
+			if len(fn.Exprs) != 1 {
+				return ErrInvalidFill
+			}
+			fill, err := core.FillFor(strings.Trim(nodeToString(fn.Exprs[0]), "'\""))
+			if err != nil {
+				return err
+			}
+			q.Fill = fill
+		} else if ok && strings.EqualFold("TOP", string(fn.Name)) {
+			log.Trace("Detected crosstab top in group by")
+			err := q.applyCrosstabTop(fn)
+			if err != nil {
+				return err
+			}
+		} else if ok && (strings.EqualFold("ROLLUP", string(fn.Name)) || strings.EqualFold("CUBE", string(fn.Name))) {
+			log.Trace("Detected rollup in group by")
+			dims, sets, err := applyRollup(fn)
+			if err != nil {
+				return err
+			}
+			for _, dim := range dims {
+				if _, found := groupBy[dim.Name]; !found {
+					groupByNames = append(groupByNames, dim.Name)
+				}
+				groupBy[dim.Name] = dim
+			}
+			rollups = append(rollups, sets)
 		} else {
-			var nestedEx sqlparser.Expr
 			isCrosstab := ok && strings.HasPrefix(strings.ToUpper(string(fn.Name)), "CROSSTAB")
 			if isCrosstab {
 				log.Trace("Detected crosstab in group by")
@@ -553,31 +753,22 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 				if q.Crosstab != nil {
 					return ErrCROSSTABUnique
 				}
-				nestedEx = fn
+				ex, err := goExprFor(fn)
+				if err != nil {
+					return err
+				}
+				err = q.applyCrosstab(fn, ex)
+				if err != nil {
+					return err
+				}
 			} else {
 				log.Trace("Dimension specified in group by")
-				nestedEx = nse.Expr
-			}
-			ex, err := goExprFor(nestedEx)
-			if err != nil {
-				return err
-			}
-			if isCrosstab {
-				q.Crosstab = ex
-				q.CrosstabIncludesTotal = strings.HasSuffix(strings.ToUpper(string(fn.Name)), "T")
-			} else {
-				name := string(nse.As)
-				if len(name) == 0 {
-					cname, ok := nestedEx.(*sqlparser.ColName)
-					if ok {
-						name = string(cname.Name)
-					}
+				dim, err := groupByFor(nse)
+				if err != nil {
+					return err
 				}
-				if len(name) == 0 {
-					return fmt.Errorf("Expression %v needs to be named via an AS", nodeToString(nse))
-				}
-				groupBy[name] = core.NewGroupBy(name, ex)
-				groupByNames = append(groupByNames, name)
+				groupBy[dim.Name] = dim
+				groupByNames = append(groupByNames, dim.Name)
 			}
 		}
 	}
@@ -591,6 +782,74 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 			q.GroupBy = append(q.GroupBy, groupBy[name])
 		}
 	}
+	if len(rollups) > 0 {
+		if q.GroupByAll {
+			return ErrRollupWildcard
+		}
+		q.Subtotals = combineSubtotals(rollups)
+	}
+	if q.CrosstabTop > 0 && q.Crosstab == nil {
+		return ErrCrosstabTopWithoutCrosstab
+	}
+	if q.Calendar != nil && q.Stride > 0 {
+		return ErrStrideWithCalendar
+	}
+	return nil
+}
+
+// groupByFor builds the GroupBy for a dimension in the GROUP BY clause, which
+// is named after the column it references or its AS alias.
+func groupByFor(nse *sqlparser.NonStarExpr) (core.GroupBy, error) {
+	ex, err := goExprFor(nse.Expr)
+	if err != nil {
+		return core.GroupBy{}, err
+	}
+	name := string(nse.As)
+	if len(name) == 0 {
+		cname, ok := nse.Expr.(*sqlparser.ColName)
+		if ok {
+			name = string(cname.Name)
+		}
+	}
+	if len(name) == 0 {
+		return core.GroupBy{}, fmt.Errorf("Expression %v needs to be named via an AS", nodeToString(nse))
+	}
+	return core.NewGroupBy(name, ex), nil
+}
+
+// applyPeriod applies a period like period(5m), period(1mo) or
+// period(1d, 'America/New_York'). Periods of weeks or months, as well as
+// periods of days in a time zone, follow the calendar. Other periods are fixed
+// durations aligned to the Unix epoch.
+func (q *Query) applyPeriod(args sqlparser.SelectExprs) error {
+	location := time.UTC
+	hasTimeZone := len(args) > 1
+	if hasTimeZone {
+		timeZone := strings.Trim(nodeToString(args[1]), "'\"")
+		var err error
+		location, err = time.LoadLocation(timeZone)
+		if err != nil {
+			return fmt.Errorf("Unknown time zone %v: %v", timeZone, err)
+		}
+	}
+	calendar, err := encoding.ParseCalendar(durationString(args[0]), location)
+	if err != nil {
+		return err
+	}
+	if calendar != nil && (hasTimeZone || calendar.Unit != encoding.CalendarDay) {
+		q.Calendar = calendar
+		q.Resolution = 0
+		return nil
+	}
+	if hasTimeZone {
+		return ErrTimeZoneWithoutCalendar
+	}
+	res, err := nodeToDuration(args[0])
+	if err != nil {
+		return err
+	}
+	q.Resolution = res
+	q.Calendar = nil
 	return nil
 }
 
@@ -601,10 +860,16 @@ type havingClause struct {
 
 func (h *havingClause) Get(known core.Fields) (expr.Expr, error) {
 	h.init(known)
-	filter, _ := h.exprFor(h.stmt.Having.Expr, true)
+	filter, err := h.exprFor(h.stmt.Having.Expr, true)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression for HAVING clause: %v", err)
+	}
 	log.Tracef("Applying having: %v", filter)
-	having := filter.(expr.Expr)
-	err := having.Validate()
+	having, ok := filter.(expr.Expr)
+	if !ok {
+		return nil, fmt.Errorf("Invalid expression for HAVING clause: %v", filter)
+	}
+	err = having.Validate()
 	if err != nil {
 		return nil, fmt.Errorf("Invalid expression for HAVING clause: %v", err)
 	}
@@ -662,6 +927,24 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 		if fname == "SHIFT" {
 			return f.shiftExprFor(e, fname, defaultToSum)
 		}
+		if fname == "RATE" || fname == "DELTA" || fname == "DERIVATIVE" {
+			return f.lookbackExprFor(e, fname, defaultToSum)
+		}
+		if fname == "MOVING_AVG" || fname == "MOVING_SUM" {
+			return f.movingExprFor(e, fname, defaultToSum)
+		}
+		if fname == "PERCENTILE" {
+			return f.percentileExprFor(e, fname, defaultToSum)
+		}
+		if fname == "COUNT_DISTINCT" {
+			return f.countDistinctExprFor(e, fname, defaultToSum)
+		}
+		if fname == "COALESCE" {
+			return f.coalesceExprFor(e, fname, defaultToSum)
+		}
+		if _, ok := variadicMathFuncs[fname]; ok {
+			return f.variadicMathExprFor(e, fname, defaultToSum)
+		}
 		switch len(e.Exprs) {
 		case 1:
 			return f.unaryFuncExprFor(e, fname, defaultToSum)
@@ -671,6 +954,8 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 			return nil, ErrAggregateArity
 		}
 
+	case *sqlparser.CaseExpr:
+		return f.caseExprFor(e, defaultToSum)
 	case *sqlparser.ComparisonExpr:
 		return f.comparisonExprFor(e, defaultToSum)
 	case *sqlparser.BinaryExpr:
@@ -704,6 +989,9 @@ func (f *fielded) columnExprFor(e *sqlparser.ColName, defaultToSum bool) (interf
 		// This is a special name that stands for "value present"
 		return expr.GT(core.PointsField.Expr, expr.CONST(0)), nil
 	}
+	if f.joined && len(e.Qualifier) > 0 {
+		name = fmt.Sprintf("%v.%v", strings.ToLower(string(e.Qualifier)), name)
+	}
 
 	// Default to a sum over the field
 	ex := expr.FIELD(name)
@@ -730,7 +1018,7 @@ func (f *fielded) ifExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bo
 	if !ok {
 		return nil, ErrWildcardNotAllowed
 	}
-	valueEx, valueErr := f.exprFor(_valueEx.Expr, true)
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, defaultToSum)
 	if valueErr != nil {
 		return nil, valueErr
 	}
@@ -780,7 +1068,7 @@ func (f *fielded) shiftExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum
 	if !ok {
 		return nil, ErrWildcardNotAllowed
 	}
-	valueEx, valueErr := f.exprFor(_valueEx.Expr, true)
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, defaultToSum)
 	if valueErr != nil {
 		return nil, valueErr
 	}
@@ -791,6 +1079,102 @@ func (f *fielded) shiftExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum
 	return expr.SHIFT(valueEx, offset), nil
 }
 
+func (f *fielded) lookbackExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	switch fname {
+	case "RATE":
+		if len(e.Exprs) != 1 {
+			return nil, ErrRateArity
+		}
+	case "DELTA":
+		if len(e.Exprs) != 1 {
+			return nil, ErrDeltaArity
+		}
+	default:
+		if len(e.Exprs) != 2 {
+			return nil, ErrDerivativeArity
+		}
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, defaultToSum)
+	if valueErr != nil {
+		return nil, valueErr
+	}
+	switch fname {
+	case "RATE":
+		return expr.RATE(valueEx), nil
+	case "DELTA":
+		return expr.DELTA(valueEx), nil
+	}
+	unit, unitErr := nodeToDuration(e.Exprs[1])
+	if unitErr != nil {
+		return nil, unitErr
+	}
+	return expr.DERIVATIVE(valueEx, unit), nil
+}
+
+func (f *fielded) movingExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) != 2 {
+		return nil, ErrMovingArity
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, defaultToSum)
+	if valueErr != nil {
+		return nil, valueErr
+	}
+	window, windowErr := nodeToDuration(e.Exprs[1])
+	if windowErr != nil {
+		return nil, windowErr
+	}
+	if fname == "MOVING_AVG" {
+		return expr.MOVING_AVG(valueEx, window), nil
+	}
+	return expr.MOVING_SUM(valueEx, window), nil
+}
+
+func (f *fielded) percentileExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) != 2 {
+		return nil, ErrPercentileArity
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	_percentileEx, ok := e.Exprs[1].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, err := f.exprFor(_valueEx.Expr, false)
+	if err != nil {
+		return nil, err
+	}
+	percentile, err := strconv.ParseFloat(nodeToString(_percentileEx.Expr), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse percentile parameter to PERCENTILE: %v", err)
+	}
+	return expr.PERCENTILE(valueEx, percentile), nil
+}
+
+func (f *fielded) countDistinctExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) != 1 {
+		return nil, ErrCountDistinctArity
+	}
+	_dimEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	dimEx, err := goExprFor(_dimEx.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return expr.COUNT_DISTINCT(dimEx), nil
+}
+
 func (f *fielded) unaryFuncExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
 	var fn func(interface{}) (expr.Expr, error)
 	_fn, ok := aggregateFuncs[fname]
@@ -819,10 +1203,16 @@ func (f *fielded) unaryFuncExprFor(e *sqlparser.FuncExpr, fname string, defaultT
 
 func (f *fielded) binaryFuncExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
 	fn, ok := binaryAggregateFuncs[fname]
-	if !ok {
-		return nil, fmt.Errorf("Unknown function '%v'", fname)
+	if ok {
+		log.Tracef("Found function: %v", fname)
+		defaultToSum = false
+	} else {
+		fn, ok = binaryMathFuncs[fname]
+		if !ok {
+			return nil, fmt.Errorf("Unknown function '%v'", fname)
+		}
+		log.Tracef("Found math function: %v", fname)
 	}
-	log.Tracef("Found function: %v", fname)
 	_param1, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
 	if !ok {
 		return nil, ErrWildcardNotAllowed
@@ -831,17 +1221,140 @@ func (f *fielded) binaryFuncExprFor(e *sqlparser.FuncExpr, fname string, default
 	if !ok {
 		return nil, ErrWildcardNotAllowed
 	}
-	se1, err := f.exprFor(_param1.Expr, false)
+	se1, err := f.exprFor(_param1.Expr, defaultToSum)
 	if err != nil {
 		return nil, err
 	}
-	se2, err := f.exprFor(_param2.Expr, false)
+	se2, err := f.exprFor(_param2.Expr, defaultToSum)
 	if err != nil {
 		return nil, err
 	}
 	return fn(se1, se2), nil
 }
 
+func (f *fielded) variadicMathExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) < 2 {
+		return nil, fmt.Errorf("%v requires at least two parameters, like %v(a, b)", fname, fname)
+	}
+	params := make([]interface{}, 0, len(e.Exprs))
+	for _, _param := range e.Exprs {
+		param, ok := _param.(*sqlparser.NonStarExpr)
+		if !ok {
+			return nil, ErrWildcardNotAllowed
+		}
+		se, err := f.exprFor(param.Expr, defaultToSum)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, se)
+	}
+	return variadicMathFuncs[fname](params[0], params[1], params[2:]...), nil
+}
+
+func (f *fielded) coalesceExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) == 0 {
+		return nil, ErrCoalesceArity
+	}
+	params := make([]interface{}, 0, len(e.Exprs))
+	for _, _param := range e.Exprs {
+		param, ok := _param.(*sqlparser.NonStarExpr)
+		if !ok {
+			return nil, ErrWildcardNotAllowed
+		}
+		se, err := f.exprFor(param.Expr, defaultToSum)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, se)
+	}
+	return expr.COALESCE(params[0], params[1:]...), nil
+}
+
+func (f *fielded) caseExprFor(e *sqlparser.CaseExpr, defaultToSum bool) (interface{}, error) {
+	whens := make([]*expr.When, 0, len(e.Whens))
+	for _, when := range e.Whens {
+		var cond sqlparser.Expr = when.Cond
+		if e.Expr != nil {
+			// Simple CASE, compare the operand to each WHEN
+			right, ok := when.Cond.(sqlparser.ValExpr)
+			if !ok {
+				return nil, fmt.Errorf("Unable to compare %v to %v in CASE", nodeToString(e.Expr), nodeToString(when.Cond))
+			}
+			cond = &sqlparser.ComparisonExpr{Left: e.Expr, Operator: "=", Right: right}
+		}
+		value, err := f.exprFor(when.Val, defaultToSum)
+		if err != nil {
+			return nil, err
+		}
+		if f.isValueCondition(cond) {
+			valueCond, condErr := f.exprFor(cond, defaultToSum)
+			if condErr != nil {
+				return nil, condErr
+			}
+			whens = append(whens, expr.WHEN(valueCond, value))
+		} else {
+			dimCond, condErr := goExprFor(cond)
+			if condErr != nil {
+				return nil, condErr
+			}
+			whens = append(whens, expr.WHEN_DIM(dimCond, value))
+		}
+	}
+	var elseValue interface{}
+	if e.Else != nil {
+		var err error
+		elseValue, err = f.exprFor(e.Else, defaultToSum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expr.CASE(whens, elseValue), nil
+}
+
+// isValueCondition determines whether the given condition is evaluated against
+// values, which is the case if it references fields or aggregates. Otherwise,
+// it's evaluated against dimensions.
+func (f *fielded) isValueCondition(_e sqlparser.Expr) bool {
+	switch e := _e.(type) {
+	case *sqlparser.AndExpr:
+		return f.isValueCondition(e.Left) || f.isValueCondition(e.Right)
+	case *sqlparser.OrExpr:
+		return f.isValueCondition(e.Left) || f.isValueCondition(e.Right)
+	case *sqlparser.NotExpr:
+		return f.isValueCondition(e.Expr)
+	case *sqlparser.ParenBoolExpr:
+		return f.isValueCondition(e.Expr)
+	case *sqlparser.ComparisonExpr:
+		return f.isValueCondition(e.Left) || f.isValueCondition(e.Right)
+	case *sqlparser.BinaryExpr:
+		return f.isValueCondition(e.Left) || f.isValueCondition(e.Right)
+	case sqlparser.ValTuple:
+		for _, ve := range e {
+			if f.isValueCondition(ve) {
+				return true
+			}
+		}
+	case *sqlparser.ColName:
+		name := strings.ToLower(string(e.Name))
+		_, found := f.fieldsMap[name]
+		return found || name == "_"
+	case *sqlparser.FuncExpr:
+		fname := strings.ToUpper(string(e.Name))
+		_, isAggregate := aggregateFuncs[fname]
+		_, isBinaryAggregate := binaryAggregateFuncs[fname]
+		if isAggregate || isBinaryAggregate || valueFuncs[fname] {
+			return true
+		}
+		for _, _param := range e.Exprs {
+			param, ok := _param.(*sqlparser.NonStarExpr)
+			if ok && f.isValueCondition(param.Expr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (f *fielded) comparisonExprFor(e *sqlparser.ComparisonExpr, defaultToSum bool) (interface{}, error) {
 	_op := string(e.Operator)
 	if log.IsTraceEnabled() {
@@ -851,11 +1364,11 @@ func (f *fielded) comparisonExprFor(e *sqlparser.ComparisonExpr, defaultToSum bo
 	if !ok {
 		return nil, fmt.Errorf("Unknown condition %v", _op)
 	}
-	left, err := f.exprFor(e.Left, true)
+	left, err := f.exprFor(e.Left, defaultToSum)
 	if err != nil {
 		return nil, err
 	}
-	right, err := f.exprFor(e.Right, true)
+	right, err := f.exprFor(e.Right, defaultToSum)
 	if err != nil {
 		return nil, err
 	}
@@ -871,11 +1384,11 @@ func (f *fielded) binaryExprFor(e *sqlparser.BinaryExpr, defaultToSum bool) (int
 	if !ok {
 		return nil, fmt.Errorf("Unknown operator %v", _op)
 	}
-	left, err := f.exprFor(e.Left, true)
+	left, err := f.exprFor(e.Left, defaultToSum)
 	if err != nil {
 		return nil, err
 	}
-	right, err := f.exprFor(e.Right, true)
+	right, err := f.exprFor(e.Right, defaultToSum)
 	if err != nil {
 		return nil, err
 	}
@@ -883,11 +1396,11 @@ func (f *fielded) binaryExprFor(e *sqlparser.BinaryExpr, defaultToSum bool) (int
 }
 
 func (f *fielded) andExprFor(e *sqlparser.AndExpr, defaultToSum bool) (interface{}, error) {
-	left, err := f.exprFor(e.Left, true)
+	left, err := f.exprFor(e.Left, defaultToSum)
 	if err != nil {
 		return "", err
 	}
-	right, err := f.exprFor(e.Right, true)
+	right, err := f.exprFor(e.Right, defaultToSum)
 	if err != nil {
 		return "", err
 	}
@@ -895,11 +1408,11 @@ func (f *fielded) andExprFor(e *sqlparser.AndExpr, defaultToSum bool) (interface
 }
 
 func (f *fielded) orExprFor(e *sqlparser.OrExpr, defaultToSum bool) (interface{}, error) {
-	left, err := f.exprFor(e.Left, true)
+	left, err := f.exprFor(e.Left, defaultToSum)
 	if err != nil {
 		return "", err
 	}
-	right, err := f.exprFor(e.Right, true)
+	right, err := f.exprFor(e.Right, defaultToSum)
 	if err != nil {
 		return "", err
 	}
@@ -963,7 +1476,7 @@ func goExprFor(_e sqlparser.Expr) (goexpr.Expr, error) {
 				if !ok {
 					return nil, fmt.Errorf("Subquery requires a SELECT statement")
 				}
-				_sq, parseErr := parse(stmt)
+				_sq, parseErr := parse(stmt, &extensions{})
 				if parseErr != nil {
 					return nil, fmt.Errorf("In subquery %v: %v", nodeToString(stmt), parseErr)
 				}
@@ -1138,10 +1651,14 @@ func stringToTimeOrDuration(str string) (time.Time, time.Duration, error) {
 }
 
 func nodeToDuration(node sqlparser.SQLNode) (time.Duration, error) {
-	str := nodeToString(node)
-	dur, err := ParseDuration(strings.ToLower(strings.Replace(strings.Trim(str, "''"), " as ", "", 1)))
+	dur, err := ParseDuration(durationString(node))
 	if err != nil {
-		err = fmt.Errorf("Unable to parse duration %v: %v", str, err)
+		err = fmt.Errorf("Unable to parse duration %v: %v", nodeToString(node), err)
 	}
 	return dur, err
 }
+
+// durationString normalizes a duration like 5m, which the parser sees as 5 AS m
+func durationString(node sqlparser.SQLNode) string {
+	return strings.ToLower(strings.Replace(strings.Trim(nodeToString(node), "''"), " as ", "", 1))
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/getlantern/goexpr/isp"
 	"github.com/getlantern/goexpr/redis"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
 	. "github.com/getlantern/zenodb/expr"
 	"github.com/kylelemons/godebug/pretty"
 	"github.com/stretchr/testify/assert"
@@ -373,11 +374,639 @@ FROM Table_A
 	assert.True(t, q.GroupByAll)
 }
 
+func TestPercentile(t *testing.T) {
+	q, err := Parse(`
+SELECT PERCENTILE(latency, 95) AS p95, MEDIAN(latency) AS p50, PERCENTILE(BOUNDED(latency, 0, 1000), 99.9) AS p999
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 3) {
+		assert.Equal(t, core.NewField("p95", PERCENTILE("latency", 95)).String(), fields[0].String())
+		assert.Equal(t, core.NewField("p50", MEDIAN("latency")).String(), fields[1].String())
+		assert.Equal(t, core.NewField("p999", PERCENTILE(BOUNDED("latency", 0, 1000), 99.9)).String(), fields[2].String())
+	}
+
+	q, err = Parse(`SELECT PERCENTILE(latency) AS p FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Equal(t, ErrPercentileArity, err)
+	}
+}
+
+func TestCountDistinct(t *testing.T) {
+	q, err := Parse(`
+SELECT COUNT_DISTINCT(user_id) AS unique_users
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 1) {
+		assert.Equal(t, core.NewField("unique_users", COUNT_DISTINCT(goexpr.Param("user_id"))).String(), fields[0].String())
+	}
+
+	q, err = Parse(`SELECT COUNT_DISTINCT(a, b) AS u FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Equal(t, ErrCountDistinctArity, err)
+	}
+}
+
+func TestNestedFunctions(t *testing.T) {
+	q, err := Parse(`
+SELECT
+	LOG10(SUM(a) / SUM(b)) AS ratio,
+	SUM(a * b) AS product,
+	AVG(IF(dim = 'x', LN(a))) AS cond,
+	SHIFT(SUM(a) / COUNT(b), '1h') AS shifted,
+	BOUNDED(MAX(a) - MIN(a), 0, 10) AS spread
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	unaryMath := func(name string, wrapped interface{}) Expr {
+		result, _ := UnaryMath(name, wrapped)
+		return result
+	}
+	cond, err := goexpr.Binary("==", goexpr.Param("dim"), goexpr.Constant("x"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 5) {
+		assert.Equal(t, core.NewField("ratio", unaryMath("LOG10", DIV(SUM("a"), SUM("b")))).String(), fields[0].String())
+		assert.Equal(t, core.NewField("product", SUM(MULT("a", "b"))).String(), fields[1].String())
+		assert.Equal(t, core.NewField("cond", AVG(IF(cond, unaryMath("LN", "a")))).String(), fields[2].String())
+		assert.Equal(t, core.NewField("shifted", SHIFT(DIV(SUM("a"), COUNT("b")), time.Hour)).String(), fields[3].String())
+		assert.Equal(t, core.NewField("spread", BOUNDED(SUB(MAX("a"), MIN("a")), 0, 10)).String(), fields[4].String())
+	}
+
+	for _, impossible := range []string{
+		"SELECT SUM(MAX(a)) AS x FROM Table_A",
+		"SELECT SUM(a + MAX(b)) AS x FROM Table_A",
+		"SELECT SUM(SHIFT(a, '1h')) AS x FROM Table_A",
+	} {
+		q, err = Parse(impossible)
+		if assert.NoError(t, err) {
+			_, err = q.Fields.Get(nil)
+			assert.Error(t, err, impossible)
+		}
+	}
+}
+
+func TestMathFunctions(t *testing.T) {
+	q, err := Parse(`
+SELECT
+	ABS(SUM(a) - SUM(b)) AS diff,
+	ROUND(AVG(a), 2) AS rounded,
+	SUM(POW(a, 2)) AS squares,
+	GREATEST(MAX(a), MAX(b), 0) AS biggest,
+	SQRT(MOD(SUM(a), 7)) AS odd
+FROM Table_A
+HAVING LEAST(SUM(a), SUM(b)) > EXP(1) AND FLOOR(SUM(a)) = CEIL(SUM(a))
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	unaryMath := func(name string, wrapped interface{}) Expr {
+		result, _ := UnaryMath(name, wrapped)
+		return result
+	}
+	if assert.Len(t, fields, 6) {
+		assert.Equal(t, core.NewField("diff", unaryMath("ABS", SUB(SUM("a"), SUM("b")))).String(), fields[0].String())
+		assert.Equal(t, core.NewField("rounded", ROUND(AVG("a"), 2)).String(), fields[1].String())
+		assert.Equal(t, core.NewField("squares", SUM(POW("a", 2))).String(), fields[2].String())
+		assert.Equal(t, core.NewField("biggest", GREATEST(MAX("a"), MAX("b"), 0)).String(), fields[3].String())
+		assert.Equal(t, core.NewField("odd", unaryMath("SQRT", MOD(SUM("a"), 7))).String(), fields[4].String())
+		having := AND(GT(LEAST(SUM("a"), SUM("b")), unaryMath("EXP", 1)), EQ(unaryMath("FLOOR", SUM("a")), unaryMath("CEIL", SUM("a"))))
+		assert.Equal(t, core.NewField(core.HavingFieldName, having).String(), fields[5].String())
+	}
+
+	q, err = Parse(`SELECT GREATEST(a) AS g FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestCaseAndCoalesce(t *testing.T) {
+	q, err := Parse(`
+SELECT
+	CASE WHEN dim = 'x' THEN SUM(a) WHEN SUM(a) > 10 THEN MAX(b) ELSE 0 END AS picked,
+	SUM(CASE WHEN a > 5 THEN a ELSE 0 END) AS big,
+	COALESCE(AVG(b), MAX(b), 0) AS defaulted
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(core.Fields{core.NewField("a", SUM("a"))})
+	if !assert.NoError(t, err) {
+		return
+	}
+	cond, err := goexpr.Binary("==", goexpr.Param("dim"), goexpr.Constant("x"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 3) {
+		picked := CASE([]*When{WHEN_DIM(cond, SUM("a")), WHEN(GT(SUM("a"), 10), MAX("b"))}, 0)
+		assert.Equal(t, core.NewField("picked", picked).String(), fields[0].String())
+		big := SUM(CASE([]*When{WHEN(GT("a", 5), "a")}, 0))
+		assert.Equal(t, core.NewField("big", big).String(), fields[1].String())
+		assert.Equal(t, core.NewField("defaulted", COALESCE(AVG("b"), MAX("b"), 0)).String(), fields[2].String())
+	}
+
+	q, err = Parse(`SELECT CASE WHEN dim = 'x' THEN 1 ELSE 0 END AS unaggregated FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Error(t, err)
+	}
+}
+
+func TestLookbackFunctions(t *testing.T) {
+	q, err := Parse(`
+SELECT
+	RATE(bytes) AS bytes_per_second,
+	DELTA(MAX(b)) AS b_change,
+	DERIVATIVE(SUM(b), '1m') AS b_per_minute
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 3) {
+		assert.Equal(t, core.NewField("bytes_per_second", RATE(SUM("bytes"))).String(), fields[0].String())
+		assert.Equal(t, core.NewField("b_change", DELTA(MAX("b"))).String(), fields[1].String())
+		assert.Equal(t, core.NewField("b_per_minute", DERIVATIVE(SUM("b"), time.Minute)).String(), fields[2].String())
+	}
+
+	for _, sql := range []string{
+		`SELECT RATE(a, b) AS x FROM Table_A`,
+		`SELECT DERIVATIVE(a) AS x FROM Table_A`,
+	} {
+		q, err = Parse(sql)
+		if assert.NoError(t, err) {
+			_, err = q.Fields.Get(nil)
+			assert.Error(t, err, sql)
+		}
+	}
+}
+
+func TestMovingFunctions(t *testing.T) {
+	q, err := Parse(`
+SELECT
+	MOVING_AVG(bytes, '1h') AS smoothed,
+	MOVING_SUM(COUNT(b), '30m') AS recent
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 2) {
+		assert.Equal(t, core.NewField("smoothed", MOVING_AVG(SUM("bytes"), time.Hour)).String(), fields[0].String())
+		assert.Equal(t, core.NewField("recent", MOVING_SUM(COUNT("b"), 30*time.Minute)).String(), fields[1].String())
+	}
+
+	q, err = Parse(`SELECT MOVING_AVG(bytes) AS x FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Equal(t, ErrMovingArity, err)
+	}
+
+	for _, sql := range []string{
+		`SELECT MOVING_AVG(AVG(bytes), '1h') AS x FROM Table_A`,
+		`SELECT MOVING_AVG(MAX(bytes), '1h') AS x FROM Table_A`,
+		`SELECT MOVING_SUM(PERCENTILE(bytes, 99), '1h') AS x FROM Table_A`,
+		`SELECT MOVING_AVG(SUM(bytes) / COUNT(bytes), '1h') AS x FROM Table_A`,
+	} {
+		q, err = Parse(sql)
+		if assert.NoError(t, err, sql) {
+			_, err = q.Fields.Get(nil)
+			assert.Error(t, err, "Non-additive aggregate should be rejected: %v", sql)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	q, err := Parse(`SELECT * FROM Table_A GROUP BY x, period('5s')`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, core.FillNone, q.Fill)
+	}
+
+	for fill, expected := range map[string]core.Fill{
+		"none":     core.FillNone,
+		"null":     core.FillNull,
+		"ZERO":     core.FillZero,
+		"previous": core.FillPrevious,
+		"'linear'": core.FillLinear,
+	} {
+		q, err = Parse(fmt.Sprintf(`SELECT * FROM Table_A GROUP BY x, period('5s'), fill(%v)`, fill))
+		if assert.NoError(t, err, fill) {
+			assert.Equal(t, expected, q.Fill, fill)
+			assert.Equal(t, 5*time.Second, q.Resolution)
+			assert.Len(t, q.GroupBy, 1)
+		}
+	}
+
+	_, err = Parse(`SELECT * FROM Table_A GROUP BY x, fill(sideways)`)
+	assert.Error(t, err)
+	_, err = Parse(`SELECT * FROM Table_A GROUP BY x, fill()`)
+	assert.Equal(t, ErrInvalidFill, err)
+}
+
+func TestCalendarPeriod(t *testing.T) {
+	q, err := Parse(`SELECT * FROM Table_A GROUP BY x, period(1d)`)
+	if assert.NoError(t, err) {
+		assert.Nil(t, q.Calendar, "days without a time zone should be a fixed duration")
+		assert.Equal(t, 24*time.Hour, q.Resolution)
+	}
+
+	q, err = Parse(`SELECT * FROM Table_A GROUP BY x, period(1d, 'America/New_York')`)
+	if assert.NoError(t, err) && assert.NotNil(t, q.Calendar) {
+		assert.Equal(t, encoding.CalendarDay, q.Calendar.Unit)
+		assert.Equal(t, 1, q.Calendar.N)
+		assert.Equal(t, "America/New_York", q.Calendar.TimeZone())
+		assert.EqualValues(t, 0, q.Resolution)
+	}
+
+	q, err = Parse(`SELECT * FROM Table_A GROUP BY x, period(2w)`)
+	if assert.NoError(t, err) && assert.NotNil(t, q.Calendar) {
+		assert.Equal(t, encoding.CalendarWeek, q.Calendar.Unit)
+		assert.Equal(t, 2, q.Calendar.N)
+		assert.Equal(t, "UTC", q.Calendar.TimeZone())
+	}
+
+	q, err = Parse(`SELECT * FROM Table_A GROUP BY x, period('1mo')`)
+	if assert.NoError(t, err) && assert.NotNil(t, q.Calendar) {
+		assert.Equal(t, encoding.CalendarMonth, q.Calendar.Unit)
+	}
+
+	_, err = Parse(`SELECT * FROM Table_A GROUP BY x, period(1d, 'Nowhere/Special')`)
+	assert.Error(t, err)
+	_, err = Parse(`SELECT * FROM Table_A GROUP BY x, period(5m, 'America/New_York')`)
+	assert.Equal(t, ErrTimeZoneWithoutCalendar, err)
+	_, err = Parse(`SELECT * FROM Table_A GROUP BY x, period(1mo), stride(2mo)`)
+	assert.Error(t, err)
+	_, err = Parse(`SELECT * FROM Table_A GROUP BY x, period(1w), stride(1d)`)
+	assert.Equal(t, ErrStrideWithCalendar, err)
+
+	for _, field := range []string{
+		"RATE(SUM(b))",
+		"DELTA(SUM(b))",
+		"DERIVATIVE(SUM(b), '1s')",
+		"MOVING_AVG(SUM(b), '7d')",
+		"MOVING_SUM(SUM(b), '7d')",
+		"SUM(b) / RATE(SUM(b))",
+	} {
+		for _, period := range []string{"period(1d, 'America/New_York')", "period(1mo)"} {
+			sql := fmt.Sprintf(`SELECT %v AS x FROM Table_A GROUP BY x, %v`, field, period)
+			q, err = Parse(sql)
+			if assert.NoError(t, err, sql) {
+				_, err = q.Fields.Get(nil)
+				assert.Equal(t, ErrLookBackWithCalendar, err, sql)
+			}
+		}
+		sql := fmt.Sprintf(`SELECT %v AS x FROM Table_A GROUP BY x, period(1d)`, field)
+		q, err = Parse(sql)
+		if assert.NoError(t, err, sql) {
+			_, err = q.Fields.Get(nil)
+			assert.NoError(t, err, "Fixed periods should allow %v", field)
+		}
+	}
+
+	q, err = Parse(`SELECT SUM(b) AS x FROM Table_A GROUP BY y, period(1mo) HAVING RATE(SUM(b)) > 1`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Equal(t, ErrLookBackWithCalendar, err, "HAVING should also be checked")
+	}
+}
+
+func TestCrosstabTop(t *testing.T) {
+	q, err := Parse(`SELECT requests FROM Table_A GROUP BY x, CROSSTABT(dim_a, CONCAT('|', dim_b)) TOP 3 BY requests ORDER BY x`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, goexpr.Concat(goexpr.Constant("_"), goexpr.Param("dim_a"), goexpr.Concat(goexpr.Constant("|"), goexpr.Param("dim_b"))), q.Crosstab)
+	assert.Equal(t, []goexpr.Expr{goexpr.Param("dim_a"), goexpr.Concat(goexpr.Constant("|"), goexpr.Param("dim_b"))}, q.CrosstabDims)
+	assert.True(t, q.CrosstabIncludesTotal)
+	assert.Equal(t, 3, q.CrosstabTop)
+	assert.Equal(t, "requests", q.CrosstabTopBy)
+	assert.Len(t, q.GroupBy, 1)
+	assert.Len(t, q.OrderBy, 1)
+
+	// The rewritten SQL can be parsed again
+	q, err = Parse(q.SQL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, q.CrosstabTop)
+		assert.Equal(t, "requests", q.CrosstabTopBy)
+	}
+
+	q, err = Parse(`SELECT requests FROM Table_A GROUP BY x, CROSSTAB(dim_a)`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, q.CrosstabTop)
+		assert.Len(t, q.CrosstabDims, 1)
+	}
+
+	_, err = Parse(`SELECT requests FROM Table_A GROUP BY x, CROSSTAB(dim_a) TOP 0 BY requests`)
+	assert.Equal(t, ErrInvalidCrosstabTop, err)
+	_, err = Parse(`SELECT requests FROM Table_A GROUP BY x, TOP(3, requests)`)
+	assert.Equal(t, ErrCrosstabTopWithoutCrosstab, err)
+}
+
+func TestRollup(t *testing.T) {
+	q, err := Parse(`SELECT requests FROM Table_A GROUP BY ROLLUP(country, LEN(city) AS city_len), period('1h')`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, q.GroupBy, 2) {
+		assert.Equal(t, core.NewGroupBy("city_len", goexpr.Len(goexpr.Param("city"))).String(), q.GroupBy[0].String())
+		assert.Equal(t, core.NewGroupBy("country", goexpr.Param("country")).String(), q.GroupBy[1].String())
+	}
+	assert.Equal(t, [][]string{{"city_len"}, {"city_len", "country"}}, q.Subtotals)
+	assert.Equal(t, time.Hour, q.Resolution)
+
+	q, err = Parse(`SELECT requests FROM Table_A GROUP BY x, CUBE(a, b)`)
+	if assert.NoError(t, err) {
+		assert.Len(t, q.GroupBy, 3)
+		assert.Equal(t, [][]string{{"a"}, {"b"}, {"a", "b"}}, q.Subtotals)
+	}
+
+	q, err = Parse(`SELECT requests FROM Table_A GROUP BY ROLLUP(a), ROLLUP(b)`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]string{{"b"}, {"a"}, {"a", "b"}}, q.Subtotals)
+	}
+
+	q, err = Parse(`SELECT requests FROM Table_A GROUP BY a, b`)
+	if assert.NoError(t, err) {
+		assert.Nil(t, q.Subtotals)
+	}
+
+	_, err = Parse(`SELECT requests FROM Table_A GROUP BY ROLLUP()`)
+	assert.Error(t, err)
+	_, err = Parse(`SELECT requests FROM Table_A GROUP BY *, ROLLUP(a)`)
+	assert.Equal(t, ErrRollupWildcard, err)
+}
+
+func TestJoin(t *testing.T) {
+	q, err := Parse(`
+SELECT SUM(client_metrics.errors) / SUM(server_metrics.requests) AS error_rate
+FROM client_metrics
+LEFT JOIN server_metrics USING (server, country)
+WHERE country = 'us'
+GROUP BY server, period('1h')
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "client_metrics", q.From)
+	if assert.NotNil(t, q.Join) {
+		assert.Equal(t, "server_metrics", q.Join.Table)
+		assert.Equal(t, []string{"country", "server"}, q.Join.Using)
+		assert.True(t, q.Join.Left)
+	}
+	assert.Contains(t, q.SQL, "FROM client_metrics left join server_metrics using (country, server)")
+	fields, err := q.Fields.Get(nil)
+	if assert.NoError(t, err) && assert.Len(t, fields, 1) {
+		assert.Equal(t, core.NewField("error_rate", DIV(SUM("client_metrics.errors"), SUM("server_metrics.requests"))).String(), fields[0].String())
+	}
+
+	q, err = Parse(`SELECT requests FROM client_metrics INNER JOIN server_metrics USING (server)`)
+	if assert.NoError(t, err) && assert.NotNil(t, q.Join) {
+		assert.False(t, q.Join.Left)
+		assert.Equal(t, []string{"server"}, q.Join.Using)
+	}
+
+	q, err = Parse(`SELECT requests FROM client_metrics`)
+	if assert.NoError(t, err) {
+		assert.Nil(t, q.Join)
+	}
+
+	_, err = Parse(`SELECT * FROM client_metrics JOIN server_metrics USING (server)`)
+	assert.Equal(t, ErrJoinSelectAll, err)
+	_, err = Parse(`SELECT requests FROM (SELECT * FROM client_metrics) JOIN server_metrics USING (server)`)
+	assert.Equal(t, ErrJoinSubQuery, err)
+	_, err = Parse(`SELECT requests FROM client_metrics JOIN server_metrics ON client_metrics.server = server_metrics.server`)
+	assert.Equal(t, ErrJoinUsing, err)
+	_, err = Parse(`SELECT requests FROM client_metrics JOIN server_metrics USING (server) WHERE server = 'a' AND region = 'eu'`)
+	assert.Equal(t, ErrJoinWhere, err, "WHERE on dimensions that aren't joined should be rejected")
+}
+
+func TestUnionAll(t *testing.T) {
+	q, err := Parse(`
+SELECT SUM(requests) AS requests FROM client_metrics GROUP BY server
+UNION ALL
+SELECT SUM(requests) AS requests, AVG(load) AS load FROM server_metrics WHERE reason = 'union all' GROUP BY server
+ORDER BY requests DESC
+LIMIT 10
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, q.Union, 2) {
+		assert.Equal(t, "client_metrics", q.Union[0].From)
+		assert.Equal(t, "server_metrics", q.Union[1].From)
+		assert.Empty(t, q.Union[1].OrderBy, "ORDER BY should apply to combined result")
+		assert.Equal(t, 0, q.Union[1].Limit, "LIMIT should apply to combined result")
+		assert.NotContains(t, q.Union[1].SQL, "limit")
+	}
+	assert.Equal(t, []core.OrderBy{core.NewOrderBy("requests", true)}, q.OrderBy)
+	assert.Equal(t, 10, q.Limit)
+	assert.Contains(t, q.SQL, " union all ")
+	assert.Contains(t, q.SQL, "limit 10")
+
+	table, err := TableFor(`SELECT requests FROM client_metrics`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "client_metrics", table)
+	}
+	_, err = TableFor(`SELECT requests FROM client_metrics UNION ALL SELECT requests FROM server_metrics`)
+	assert.Equal(t, ErrUnionNotAllowed, err)
+	_, err = Parse(`SELECT requests FROM client_metrics UNION SELECT requests FROM server_metrics`)
+	assert.Equal(t, ErrUnionDistinct, err)
+	_, err = Parse(`SELECT requests FROM client_metrics LIMIT 5 UNION ALL SELECT requests FROM server_metrics`)
+	assert.Equal(t, ErrUnionOrderBy, err)
+
+	q, err = Parse(`SELECT requests FROM client_metrics WHERE reason = 'it\'s union all' UNION ALL SELECT requests FROM server_metrics`)
+	if assert.NoError(t, err) && assert.Len(t, q.Union, 2) {
+		assert.Equal(t, "client_metrics", q.Union[0].From)
+		assert.Equal(t, "server_metrics", q.Union[1].From)
+	}
+
+	q, err = Parse("SELECT requests FROM client_metrics WHERE `it's` = 'x' UNION ALL SELECT requests FROM server_metrics")
+	if assert.NoError(t, err) && assert.Len(t, q.Union, 2) {
+		assert.Equal(t, "client_metrics", q.Union[0].From)
+		assert.Equal(t, "server_metrics", q.Union[1].From)
+	}
+}
+
+func TestLimitBy(t *testing.T) {
+	q, err := Parse(`SELECT requests FROM Table_A GROUP BY server, path ORDER BY requests DESC LIMIT 10 BY server LIMIT 100`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &LimitBy{N: 10, Dims: []string{"server"}}, q.LimitBy)
+	assert.Equal(t, []core.OrderBy{core.NewOrderBy("requests", true)}, q.OrderBy)
+	assert.Equal(t, 100, q.Limit)
+	assert.Contains(t, q.SQL, "order by requests desc limit 10 by server limit 100")
+
+	// The SQL with LIMIT BY added back can be parsed again
+	q, err = Parse(q.SQL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &LimitBy{N: 10, Dims: []string{"server"}}, q.LimitBy)
+		assert.Equal(t, 100, q.Limit)
+	}
+
+	q, err = Parse("SELECT requests FROM Table_A GROUP BY server, path, period('1h') LIMIT 3 BY `server`, _time")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &LimitBy{N: 3, Dims: []string{"server", "_time"}}, q.LimitBy)
+		assert.Equal(t, 0, q.Limit)
+	}
+
+	q, err = Parse(`SELECT requests FROM Table_A LIMIT 5`)
+	if assert.NoError(t, err) {
+		assert.Nil(t, q.LimitBy)
+	}
+
+	q, err = Parse(`SELECT requests FROM client_metrics UNION ALL SELECT requests FROM server_metrics ORDER BY requests DESC LIMIT 2 BY server`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &LimitBy{N: 2, Dims: []string{"server"}}, q.LimitBy)
+		assert.Nil(t, q.Union[1].LimitBy, "LIMIT BY should apply to combined result")
+	}
+
+	_, err = Parse(`SELECT requests FROM Table_A LIMIT 0 BY server`)
+	assert.Equal(t, ErrInvalidLimitBy, err)
+	_, err = Parse(`SELECT requests FROM client_metrics LIMIT 2 BY server UNION ALL SELECT requests FROM server_metrics`)
+	assert.Equal(t, ErrUnionOrderBy, err)
+
+	q, err = Parse("SELECT requests FROM Table_A WHERE `it's` = 'limit 1 by path' GROUP BY server, path LIMIT 2 BY server")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &LimitBy{N: 2, Dims: []string{"server"}}, q.LimitBy)
+	}
+}
+
+func TestTopLevel(t *testing.T) {
+	for _, tc := range []struct {
+		sql      string
+		expected bool
+	}{
+		{`SELECT a FROM t WHERE b = 'x' `, true},
+		{`SELECT a FROM t WHERE b = 'it\'s `, false},
+		{`SELECT a FROM t WHERE b = 'it\'s' `, true},
+		{`SELECT a FROM t WHERE b = 'c:\\' `, true},
+		{`SELECT a FROM t WHERE b = 'it''s' `, true},
+		{`SELECT a FROM t WHERE b = "it\"s" `, true},
+		{"SELECT a FROM t WHERE `it's` = 'x' ", true},
+		{"SELECT a FROM t WHERE `b ", false},
+		{"SELECT a FROM t WHERE `b\\` = 'x' ", true},
+		{`SELECT a FROM (SELECT b `, false},
+		{`SELECT a FROM t WHERE b = ')' `, true},
+	} {
+		assert.Equal(t, tc.expected, topLevel(tc.sql+"UNION ALL", len(tc.sql)), tc.sql)
+	}
+}
+
+func TestWithFrom(t *testing.T) {
+	q, err := Parse(`SELECT requests FROM Table_A WHERE reason = 'from table_a' GROUP BY server, period(1h) LIMIT 2 BY server`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	routed, err := q.WithFrom("table_a_1h")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "table_a_1h", routed.From)
+		assert.Contains(t, routed.SQL, "from table_a_1h where reason = 'from table_a'")
+		assert.Equal(t, &LimitBy{N: 2, Dims: []string{"server"}}, routed.LimitBy)
+		assert.Equal(t, time.Hour, routed.Resolution)
+	}
+	assert.Equal(t, "table_a", q.From, "Original query should be unchanged")
+
+	q, err = Parse(`SELECT requests FROM (SELECT * FROM Table_A)`)
+	if assert.NoError(t, err) {
+		_, err = q.WithFrom("table_a_1h")
+		assert.Error(t, err, "Queries of subqueries can't be routed to another table")
+	}
+}
+
 func TestParseIt(t *testing.T) {
 	_, err := Parse(`select * from TableA  group by concat('_', ct1, concat('|', ct2)) as _crosstab`)
 	assert.NoError(t, err)
 }
 
+func TestRestrict(t *testing.T) {
+	restrict := func(table string) (string, error) {
+		switch table {
+		case "tablea":
+			return "app = 'x'", nil
+		case "tableb":
+			return "", nil
+		}
+		return "", fmt.Errorf("Not authorized to query table %v", table)
+	}
+
+	restricted, err := Restrict("SELECT * FROM TableA WHERE x = 'CN' OR y = 1", restrict)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from TableA where (x = 'CN' or y = 1) and (app = 'x')", restricted)
+	}
+
+	restricted, err = Restrict("SELECT * FROM TableA", restrict)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from TableA where (app = 'x')", restricted)
+	}
+
+	restricted, err = Restrict("SELECT * FROM TableB", restrict)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from TableB", restricted, "Unrestricted table should be left alone")
+	}
+
+	restricted, err = Restrict("SELECT * FROM (SELECT * FROM TableA WHERE dim IN (SELECT dim FROM TableA)) GROUP BY y", restrict)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from (select * from TableA where (dim in (select dim from TableA where (app = 'x'))) and (app = 'x')) group by y", restricted)
+	}
+
+	_, err = Restrict("SELECT * FROM TableB WHERE dim IN (SELECT dim FROM TableC)", restrict)
+	assert.Error(t, err, "Unauthorized table in subquery should be rejected")
+
+	restricted, err = Restrict("SELECT * FROM TableA UNION ALL SELECT * FROM TableB", restrict)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from TableA where (app = 'x') union all select * from TableB", restricted)
+	}
+
+	restricted, err = Restrict("SELECT * FROM TableA ORDER BY a DESC LIMIT 2 BY y LIMIT 5", restrict)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from TableA where (app = 'x') order by a desc limit 2 by y limit 5", restricted)
+	}
+
+	_, err = Restrict("SELECT * FROM TableB UNION ALL SELECT * FROM TableC", restrict)
+	assert.Error(t, err, "Unauthorized table in union should be rejected")
+
+	assert.NoError(t, ValidateWhere("app = 'x' AND dim IN ('a', 'b')"))
+	assert.Error(t, ValidateWhere("app = "))
+}
+
 type testexpr struct {
 	val goexpr.Expr
 }
@@ -0,0 +1,75 @@
+package sql
+
+import (
+	"regexp"
+	"strings"
+)
+
+var unionRegex = regexp.MustCompile("(?i)\\s+union(\\s+all)?\\s+")
+
+// splitUnion splits the given SQL into the SELECTs that are combined with UNION
+// ALL by the outermost query. If the query doesn't use UNION ALL, this returns
+// just the original SQL.
+func splitUnion(sqlString string) ([]string, error) {
+	var parts []string
+	start := 0
+	for _, match := range unionRegex.FindAllStringSubmatchIndex(sqlString, -1) {
+		if !topLevel(sqlString, match[0]) {
+			continue
+		}
+		if match[2] < 0 {
+			return nil, ErrUnionDistinct
+		}
+		parts = append(parts, strings.TrimSpace(sqlString[start:match[0]]))
+		start = match[1]
+	}
+	return append(parts, strings.TrimSpace(sqlString[start:])), nil
+}
+
+// parseUnion parses the given SELECTs into a Query that combines their results.
+// The ORDER BY and LIMIT clauses of the last SELECT apply to the combined
+// result, not just the last SELECT.
+func parseUnion(parts []string) (*Query, error) {
+	q := &Query{}
+	sqls := make([]string, 0, len(parts))
+	var suffix string
+	for i, part := range parts {
+		stmt, ext, err := parseSelect(part)
+		if err != nil {
+			return nil, err
+		}
+		if i < len(parts)-1 {
+			if len(stmt.OrderBy) > 0 || stmt.Limit != nil || ext.limitBy != nil {
+				return nil, ErrUnionOrderBy
+			}
+		} else {
+			err = q.applyOrderBy(stmt)
+			if err != nil {
+				return nil, err
+			}
+			err = q.applyLimit(stmt)
+			if err != nil {
+				return nil, err
+			}
+			suffix = nodeToString(stmt.OrderBy)
+			if ext.limitBy != nil {
+				q.LimitBy = ext.limitBy
+				suffix += " " + ext.limitBy.String()
+			}
+			if stmt.Limit != nil {
+				suffix += nodeToString(stmt.Limit)
+			}
+			stmt.OrderBy = nil
+			stmt.Limit = nil
+			ext.limitBy = nil
+		}
+		sub, err := parse(stmt, ext)
+		if err != nil {
+			return nil, err
+		}
+		q.Union = append(q.Union, sub)
+		sqls = append(sqls, sub.SQL)
+	}
+	q.SQL = strings.Join(sqls, " union all ") + suffix
+	return q, nil
+}
@@ -0,0 +1,347 @@
+// Package statsd provides a StatsD listener that feeds metrics into a zenodb
+// stream. It understands counters, gauges, timers and sets along with
+// DogStatsD-style tags, which become dims.
+package statsd
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/golog"
+)
+
+const (
+	typeCounter      = "c"
+	typeGauge        = "g"
+	typeTimer        = "ms"
+	typeHistogram    = "h"
+	typeDistribution = "d"
+	typeSet          = "s"
+
+	maxPacketSize = 65535
+
+	// countSuffix is appended to the names of timers to name the val that
+	// records how many values they received
+	countSuffix = "_count"
+
+	// gaugeTTL is how long to remember the value of a gauge that isn't being
+	// updated anymore.
+	gaugeTTL = 1 * time.Hour
+)
+
+var (
+	log = golog.LoggerFor("zenodb.statsd")
+)
+
+// InsertFN inserts a point into a stream, matching the signature of
+// zenodb.DB.InsertRaw.
+type InsertFN func(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
+
+// Opts configures a StatsD listener.
+type Opts struct {
+	// Stream is the stream into which to insert metrics.
+	Stream string
+	// FlushInterval controls how frequently aggregated metrics are inserted,
+	// defaults to 10 seconds.
+	FlushInterval time.Duration
+	// MaxTimerValues limits how many values of each timer are inserted per
+	// FlushInterval, defaults to 1000. Beyond that, a uniform random sample of
+	// the values is inserted.
+	MaxTimerValues int
+}
+
+// metric is a single parsed StatsD metric.
+type metric struct {
+	name       string
+	typ        string
+	value      float64
+	member     string
+	relative   bool
+	sampleRate float64
+	tags       map[string]interface{}
+}
+
+// Serve reads StatsD metrics from conn until it's closed. Counters, gauges and
+// sets are aggregated and inserted once per FlushInterval. Timers (including
+// histograms and distributions) are inserted as individual values so that they
+// can be queried with AVG, MIN, MAX or PERCENTILE, along with a <name>_count
+// val that estimates how many values were received based on their sample
+// rates.
+func Serve(conn net.PacketConn, insert InsertFN, opts *Opts) error {
+	if opts.Stream == "" {
+		return fmt.Errorf("Please specify a stream")
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.MaxTimerValues <= 0 {
+		opts.MaxTimerValues = 1000
+	}
+
+	a := newAggregator(insert, opts.Stream, opts.MaxTimerValues)
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(opts.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.flush(time.Now())
+			case <-stop:
+				a.flush(time.Now())
+				close(stopped)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	log.Debugf("Listening for StatsD metrics at %v", conn.LocalAddr())
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			metrics, parseErr := parseLine(line)
+			if parseErr != nil {
+				log.Debugf("Unable to parse StatsD line %v: %v", line, parseErr)
+				continue
+			}
+			for _, m := range metrics {
+				a.add(m, now)
+			}
+		}
+	}
+}
+
+// parseLine parses a line in the form:
+//
+//	name:value[:value...]|type[|@samplerate][|#tag:value,tag...]
+func parseLine(line string) ([]*metric, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("missing type")
+	}
+	nameAndValues := strings.Split(parts[0], ":")
+	if len(nameAndValues) < 2 || nameAndValues[0] == "" {
+		return nil, fmt.Errorf("expected name:value")
+	}
+	name := nameAndValues[0]
+	typ := parts[1]
+
+	sampleRate := float64(1)
+	tags := make(map[string]interface{})
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate %v", part[1:])
+			}
+			sampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 2 {
+					tags[kv[0]] = kv[1]
+				} else {
+					tags[kv[0]] = ""
+				}
+			}
+		}
+	}
+
+	metrics := make([]*metric, 0, len(nameAndValues)-1)
+	for _, value := range nameAndValues[1:] {
+		m := &metric{
+			name:       name,
+			typ:        typ,
+			sampleRate: sampleRate,
+			tags:       tags,
+		}
+		switch typ {
+		case typeSet:
+			m.member = value
+		case typeCounter, typeGauge, typeTimer, typeHistogram, typeDistribution:
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %v: %v", value, err)
+			}
+			m.value = v
+			m.relative = typ == typeGauge && (value[0] == '+' || value[0] == '-')
+		default:
+			return nil, fmt.Errorf("unknown type %v", typ)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// point is a value awaiting insertion.
+type point struct {
+	name  string
+	ts    time.Time
+	dims  map[string]interface{}
+	value float64
+}
+
+// aggregate tracks a counter, gauge, set or timer between flushes.
+type aggregate struct {
+	name    string
+	dims    map[string]interface{}
+	value   float64
+	members map[string]bool
+	// values holds a sample of a timer's values
+	values []float64
+	// received is how many values a timer has received
+	received int
+	updated  bool
+	lastSeen time.Time
+}
+
+type aggregator struct {
+	insert         InsertFN
+	stream         string
+	maxTimerValues int
+	counters       map[string]*aggregate
+	gauges         map[string]*aggregate
+	sets           map[string]*aggregate
+	timers         map[string]*aggregate
+	mx             sync.Mutex
+}
+
+func newAggregator(insert InsertFN, stream string, maxTimerValues int) *aggregator {
+	return &aggregator{
+		insert:         insert,
+		stream:         stream,
+		maxTimerValues: maxTimerValues,
+		counters:       make(map[string]*aggregate),
+		gauges:         make(map[string]*aggregate),
+		sets:           make(map[string]*aggregate),
+		timers:         make(map[string]*aggregate),
+	}
+}
+
+func (a *aggregator) add(m *metric, now time.Time) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	switch m.typ {
+	case typeCounter:
+		agg := a.aggregateFor(a.counters, m, now)
+		agg.value += m.value / m.sampleRate
+	case typeGauge:
+		// Gauges keep their value across flushes so that relative updates apply
+		// to the last known value.
+		agg := a.aggregateFor(a.gauges, m, now)
+		if m.relative {
+			agg.value += m.value
+		} else {
+			agg.value = m.value
+		}
+	case typeSet:
+		agg := a.aggregateFor(a.sets, m, now)
+		if agg.members == nil {
+			agg.members = make(map[string]bool)
+		}
+		agg.members[m.member] = true
+	default:
+		// Keep a uniform random sample of at most maxTimerValues values
+		// (reservoir sampling) and estimate the total count from the sample rate.
+		agg := a.aggregateFor(a.timers, m, now)
+		agg.value += 1 / m.sampleRate
+		agg.received++
+		if len(agg.values) < a.maxTimerValues {
+			agg.values = append(agg.values, m.value)
+		} else if i := rand.Intn(agg.received); i < a.maxTimerValues {
+			agg.values[i] = m.value
+		}
+	}
+}
+
+func (a *aggregator) aggregateFor(aggregates map[string]*aggregate, m *metric, now time.Time) *aggregate {
+	key := keyFor(m)
+	agg := aggregates[key]
+	if agg == nil {
+		agg = &aggregate{name: m.name, dims: m.tags}
+		aggregates[key] = agg
+	}
+	agg.updated = true
+	agg.lastSeen = now
+	return agg
+}
+
+// flush inserts all metrics received since the last flush.
+func (a *aggregator) flush(now time.Time) {
+	a.mx.Lock()
+	var points []*point
+	for _, agg := range a.timers {
+		for _, value := range agg.values {
+			points = append(points, &point{agg.name, now, agg.dims, value})
+		}
+		points = append(points, &point{agg.name + countSuffix, now, agg.dims, agg.value})
+	}
+	a.timers = make(map[string]*aggregate)
+	for _, agg := range a.counters {
+		points = append(points, &point{agg.name, now, agg.dims, agg.value})
+	}
+	a.counters = make(map[string]*aggregate)
+	for _, agg := range a.sets {
+		points = append(points, &point{agg.name, now, agg.dims, float64(len(agg.members))})
+	}
+	a.sets = make(map[string]*aggregate)
+	for key, agg := range a.gauges {
+		if agg.updated {
+			points = append(points, &point{agg.name, now, agg.dims, agg.value})
+			agg.updated = false
+		} else if now.Sub(agg.lastSeen) > gaugeTTL {
+			// Forget gauges that aren't being updated anymore
+			delete(a.gauges, key)
+		}
+	}
+	a.mx.Unlock()
+
+	failed := 0
+	var lastErr error
+	for _, p := range points {
+		err := a.insert(a.stream, p.ts, bytemap.New(p.dims), bytemap.NewFloat(map[string]float64{p.name: p.value}))
+		if err != nil {
+			failed++
+			lastErr = err
+		}
+	}
+	if failed > 0 {
+		log.Errorf("Unable to insert %d of %d StatsD points: %v", failed, len(points), lastErr)
+	}
+}
+
+// keyFor identifies a metric by its name, type and tags.
+func keyFor(m *metric) string {
+	tags := make([]string, 0, len(m.tags))
+	for key, value := range m.tags {
+		tags = append(tags, fmt.Sprintf("%v:%v", key, value))
+	}
+	sort.Strings(tags)
+	return m.typ + "|" + m.name + "|" + strings.Join(tags, ",")
+}
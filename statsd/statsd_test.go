@@ -0,0 +1,134 @@
+package statsd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	metrics, err := parseLine("requests:2|c|@0.5|#host:a,canary")
+	if assert.NoError(t, err) && assert.Len(t, metrics, 1) {
+		m := metrics[0]
+		assert.Equal(t, "requests", m.name)
+		assert.Equal(t, typeCounter, m.typ)
+		assert.EqualValues(t, 2, m.value)
+		assert.EqualValues(t, 0.5, m.sampleRate)
+		assert.Equal(t, map[string]interface{}{"host": "a", "canary": ""}, m.tags)
+	}
+
+	metrics, err = parseLine("latency:10:20.5|ms")
+	if assert.NoError(t, err) && assert.Len(t, metrics, 2) {
+		assert.EqualValues(t, 10, metrics[0].value)
+		assert.EqualValues(t, 20.5, metrics[1].value)
+	}
+
+	metrics, err = parseLine("queue:-3|g")
+	if assert.NoError(t, err) && assert.Len(t, metrics, 1) {
+		assert.True(t, metrics[0].relative)
+		assert.EqualValues(t, -3, metrics[0].value)
+	}
+
+	metrics, err = parseLine("users:bob|s")
+	if assert.NoError(t, err) && assert.Len(t, metrics, 1) {
+		assert.Equal(t, "bob", metrics[0].member)
+	}
+
+	for _, line := range []string{"requests", "requests:1", ":1|c", "requests:x|c", "requests:1|q", "requests:1|c|@2"} {
+		_, err = parseLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	type inserted struct {
+		dims map[string]interface{}
+		vals map[string]interface{}
+	}
+	var points []*inserted
+	a := newAggregator(func(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+		assert.Equal(t, "statsd", stream)
+		points = append(points, &inserted{dims.AsMap(), vals.AsMap()})
+		return nil
+	}, "statsd", 1000)
+
+	add := func(line string) {
+		metrics, err := parseLine(line)
+		if assert.NoError(t, err) {
+			for _, m := range metrics {
+				a.add(m, time.Now())
+			}
+		}
+	}
+
+	add("requests:1|c|#host:a")
+	add("requests:2|c|@0.5|#host:a")
+	add("requests:1|c|#host:b")
+	add("queue:10|g")
+	add("queue:-3|g")
+	add("users:bob|s")
+	add("users:bob|s")
+	add("users:alice|s")
+	add("latency:10:20|ms")
+	add("latency:30|ms|@0.5")
+
+	a.flush(time.Now())
+	vals := make(map[string][]float64)
+	for _, p := range points {
+		for name, val := range p.vals {
+			vals[name] = append(vals[name], val.(float64))
+			if name == "requests" {
+				if p.dims["host"] == "a" {
+					assert.EqualValues(t, 5, val)
+				} else {
+					assert.EqualValues(t, 1, val)
+				}
+			}
+		}
+	}
+	assert.Len(t, vals["requests"], 2)
+	assert.Equal(t, []float64{7}, vals["queue"])
+	assert.Equal(t, []float64{2}, vals["users"])
+	assert.Equal(t, []float64{10, 20, 30}, vals["latency"])
+	assert.Equal(t, []float64{4}, vals["latency_count"], "Timer count should account for sample rate")
+
+	// Unchanged gauges, counters and sets aren't reported again
+	points = nil
+	a.flush(time.Now())
+	assert.Empty(t, points)
+
+	add("queue:+1|g")
+	a.flush(time.Now())
+	if assert.Len(t, points, 1) {
+		assert.EqualValues(t, 8, points[0].vals["queue"])
+	}
+
+	a.flush(time.Now().Add(gaugeTTL + time.Minute))
+	assert.Empty(t, a.gauges, "Stale gauges should be forgotten")
+}
+
+func TestMaxTimerValues(t *testing.T) {
+	var values []float64
+	var count float64
+	a := newAggregator(func(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+		for name, val := range vals.AsMap() {
+			if name == "latency" {
+				values = append(values, val.(float64))
+			} else {
+				count = val.(float64)
+			}
+		}
+		return nil
+	}, "statsd", 10)
+
+	for i := 0; i < 1000; i++ {
+		metrics, _ := parseLine(fmt.Sprintf("latency:%d|ms", i))
+		a.add(metrics[0], time.Now())
+	}
+	a.flush(time.Now())
+	assert.Len(t, values, 10, "Should insert at most MaxTimerValues values")
+	assert.EqualValues(t, 1000, count, "Count should include all values")
+}
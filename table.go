@@ -28,6 +28,7 @@ type TableStats struct {
 	InsertedPoints int64
 	DroppedPoints  int64
 	ExpiredValues  int64
+	RejectedPoints int64
 }
 
 // TableOpts configures a table.
@@ -45,6 +46,12 @@ type TableOpts struct {
 	// RetentionPeriod limits how long data is kept in the table (based on the
 	// timestamp of the data itself).
 	RetentionPeriod time.Duration
+	// SegmentPeriod sets how much time is covered by each on-disk segment. Flushes
+	// only rewrite the segments touched by new data, and segments that fall
+	// entirely outside of the RetentionPeriod are deleted. If 0, defaults to a
+	// tenth of the RetentionPeriod. It is always rounded up to a multiple of the
+	// table's resolution.
+	SegmentPeriod time.Duration
 	// Backfill limits how far back to grab data from the WAL when first creating
 	// a table. If 0, backfill is limited only by the RetentionPeriod.
 	Backfill time.Duration
@@ -58,8 +65,17 @@ type TableOpts struct {
 	// Virtual, if true, means that the table's data isn't actually stored or
 	// queryable. Virtual tables are useful for defining a base set of fields
 	// from which other tables can select.
-	Virtual      bool
-	dependencyOf []*TableOpts
+	Virtual bool
+	// Rollups configures tiers that keep this table's data at coarser
+	// resolutions for longer than its RetentionPeriod. Each tier is maintained
+	// automatically as a table named <name>_<resolution> (e.g. combined_1h) that
+	// reads the same stream as this table, with its own WAL offset, so that the
+	// data remains available after it ages out of this table. Queries against
+	// this table are routed to the finest tier that covers the requested time
+	// range and resolution.
+	Rollups          []*RollupOpts
+	rollupResolution time.Duration
+	dependencyOf     []*TableOpts
 }
 
 type table struct {
@@ -78,6 +94,8 @@ type table struct {
 	highWaterMarkDisk   int64
 	highWaterMarkMemory int64
 	highWaterMarkMx     sync.RWMutex
+	rollups             []*table
+	rollupsMx           sync.RWMutex
 }
 
 // CreateTable creates a table based on the given opts.
@@ -105,6 +123,17 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 		}
 	}
 	opts.Name = strings.ToLower(opts.Name)
+	if opts.rollupResolution > 0 {
+		q.Resolution = opts.rollupResolution
+	}
+
+	var rollups []*table
+	if !opts.Virtual {
+		rollups, err = db.createRollups(opts, q.Resolution)
+		if err != nil {
+			return err
+		}
+	}
 
 	t := &table{
 		TableOpts: opts,
@@ -112,6 +141,7 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 		fields:    fields,
 		db:        db,
 		log:       golog.LoggerFor("zenodb." + opts.Name),
+		rollups:   rollups,
 	}
 
 	t.log.Debugf("Fields will be: %v", fields)
@@ -124,6 +154,7 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 			dir:             filepath.Join(db.opts.Dir, t.Name),
 			minFlushLatency: t.MinFlushLatency,
 			maxFlushLatency: t.MaxFlushLatency,
+			segmentPeriod:   t.segmentPeriod(),
 		})
 		if rsErr != nil {
 			return rsErr
@@ -175,7 +206,10 @@ func (t *table) Alter(opts *TableOpts) error {
 	}
 	t.applyWhere(q.Where)
 	t.applyFields(fields)
-	return nil
+	if t.Virtual {
+		return nil
+	}
+	return t.alterRollups(opts)
 }
 
 func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields, err error) {
@@ -183,6 +217,14 @@ func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields,
 	if err != nil {
 		return
 	}
+	if q.Union != nil {
+		err = sql.ErrUnionNotAllowed
+		return
+	}
+	if q.Subtotals != nil {
+		err = sql.ErrRollupNotAllowed
+		return
+	}
 	if !opts.View {
 		fields, err = q.Fields.Get(nil)
 	} else {
@@ -274,7 +316,7 @@ func (t *table) startWALProcessing(walOffset wal.Offset) error {
 		if walErr != nil {
 			return walErr
 		}
-		go t.db.capWALAge(w)
+		go t.db.capWALAge(t.From, w)
 		t.db.streams[t.From] = w
 	}
 
@@ -343,6 +385,27 @@ func (t *table) truncateBefore() time.Time {
 	return t.db.clock.Now().Add(-1 * t.RetentionPeriod)
 }
 
+// segmentPeriod returns the effective SegmentPeriod, which is always positive.
+func (t *table) segmentPeriod() time.Duration {
+	period := t.SegmentPeriod
+	if period <= 0 {
+		period = t.RetentionPeriod / 10
+	}
+	if t.Resolution <= 0 {
+		if period <= 0 {
+			return defaultSegmentPeriod
+		}
+		return period
+	}
+	if period < t.Resolution {
+		return t.Resolution
+	}
+	if remainder := period % t.Resolution; remainder != 0 {
+		period += t.Resolution - remainder
+	}
+	return period
+}
+
 func (t *table) backfillTo() time.Time {
 	if t.Backfill == 0 {
 		return time.Time{}
@@ -350,8 +413,11 @@ func (t *table) backfillTo() time.Time {
 	return t.db.clock.Now().Add(-1 * t.Backfill)
 }
 
-func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
-	return t.rowStore.iterate(ctx, outFields, includeMemStore, onValue)
+// iterate iterates over the rows in this table, skipping segments that fall
+// entirely outside of (asOf, until]. Zero values for asOf and until mean
+// unbounded.
+func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, asOf time.Time, until time.Time, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
+	return t.rowStore.iterate(ctx, outFields, includeMemStore, asOf, until, onValue)
 }
 
 // shouldSort determines whether or not a flush should be sorted. The flush will
@@ -0,0 +1,213 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
+)
+
+// WALStats are stats for the write-ahead log of a stream.
+type WALStats struct {
+	// RetainedBytes is how much WAL data is currently kept on disk.
+	RetainedBytes int64
+	// DurableOffset is the earliest offset still needed by any table or
+	// follower. Data prior to this offset is cleaned up automatically.
+	DurableOffset wal.Offset
+}
+
+// WALStats returns the WALStats for the named stream.
+func (db *DB) WALStats(stream string) WALStats {
+	db.walStatsMutex.RLock()
+	defer db.walStatsMutex.RUnlock()
+	return db.walStats[stream]
+}
+
+// AllWALStats returns the WALStats for all streams, keyed to the stream names.
+func (db *DB) AllWALStats() map[string]WALStats {
+	m := make(map[string]WALStats)
+	db.walStatsMutex.RLock()
+	for stream, stats := range db.walStats {
+		m[stream] = stats
+	}
+	db.walStatsMutex.RUnlock()
+	return m
+}
+
+// PrintWALStats prints the stats for the named stream to a string.
+func (db *DB) PrintWALStats(stream string) string {
+	stats := db.WALStats(stream)
+	return fmt.Sprintf("%v\tRetained: %v    Durable Offset: %v",
+		stream,
+		humanize.Bytes(uint64(stats.RetainedBytes)),
+		stats.DurableOffset)
+}
+
+// capWALAge periodically cleans up the WAL for the given stream. Data that's no
+// longer needed by any table or follower is truncated. MaxWALSize remains as a
+// hard limit in case some table or follower falls too far behind.
+func (db *DB) capWALAge(stream string, w *wal.WAL) {
+	for {
+		time.Sleep(1 * time.Minute)
+		db.waitForBackupToFinish()
+		durableOffset := db.durableWALOffset(stream)
+		if durableOffset != nil {
+			log.Debugf("Truncating WAL for %v before %v", stream, durableOffset)
+			err := w.TruncateBefore(durableOffset)
+			if err != nil {
+				log.Errorf("Error truncating WAL for %v before %v: %v", stream, durableOffset, err)
+			}
+		}
+		err := w.TruncateToSize(int64(db.opts.MaxWALSize))
+		if err != nil {
+			log.Errorf("Error truncating WAL: %v", err)
+		}
+		err = w.CompressBeforeSize(int64(db.opts.WALCompressionSize))
+		if err != nil {
+			log.Errorf("Error compressing WAL: %v", err)
+		}
+		db.updateWALStats(stream, durableOffset)
+	}
+}
+
+// durableWALOffset returns the earliest offset in the given stream's WAL that's
+// still needed by some table or follower, or nil if it's not yet known which
+// data is needed.
+func (db *DB) durableWALOffset(stream string) wal.Offset {
+	var earliest wal.Offset
+	include := func(offset wal.Offset) {
+		if earliest == nil || earliest.After(offset) {
+			earliest = offset
+		}
+	}
+
+	if !db.opts.Passthrough {
+		db.tablesMutex.RLock()
+		tables := make([]*table, 0, len(db.orderedTables))
+		for _, t := range db.orderedTables {
+			if !t.Virtual && t.From == stream {
+				tables = append(tables, t)
+			}
+		}
+		db.tablesMutex.RUnlock()
+		for _, t := range tables {
+			include(t.durableWALOffset())
+		}
+	}
+
+	db.followerOffsetsMutex.RLock()
+	defer db.followerOffsetsMutex.RUnlock()
+	followers := db.followerOffsets[stream]
+	partitions := make(map[int]bool, len(followers))
+	for _, follower := range followers {
+		partitions[follower.partition] = true
+		include(follower.offset)
+	}
+	if db.opts.Passthrough && len(partitions) < db.opts.NumPartitions {
+		// Until every partition has a connected follower (e.g. after a restart),
+		// we don't know what data they still need.
+		return nil
+	}
+
+	return earliest
+}
+
+// durableWALOffset returns the offset prior to which this table no longer needs
+// data from the WAL, either because it has been durably flushed or because it
+// falls outside of the table's retention period and backfill depth.
+func (t *table) durableWALOffset() wal.Offset {
+	t.rowStore.filesMx.Lock()
+	offset := t.rowStore.walOffset
+	t.rowStore.filesMx.Unlock()
+
+	offsetByRetentionPeriod := wal.NewOffsetForTS(t.truncateBefore())
+	if offsetByRetentionPeriod.After(offset) {
+		offset = offsetByRetentionPeriod
+	}
+	offsetByBackfillDepth := wal.NewOffsetForTS(t.backfillTo())
+	if offsetByBackfillDepth.After(offset) {
+		offset = offsetByBackfillDepth
+	}
+	return offset
+}
+
+// followerOffset is the earliest offset still needed by a connected follower.
+type followerOffset struct {
+	partition int
+	offset    wal.Offset
+}
+
+// registerFollower records the earliest offset needed by the given follower and
+// returns an id with which to ack and unregister it. Followers request data
+// starting at their durable offsets whenever they (re)connect, so this is the
+// earliest data they might still need until they ack a later offset.
+func (db *DB) registerFollower(f *common.Follow) int {
+	earliest := f.EarliestOffset
+	first := true
+	for _, partition := range f.Partitions {
+		for _, t := range partition.Tables {
+			offset := t.Offset
+			if f.EarliestOffset.After(offset) {
+				offset = f.EarliestOffset
+			}
+			if first || earliest.After(offset) {
+				earliest = offset
+				first = false
+			}
+		}
+	}
+
+	db.followerOffsetsMutex.Lock()
+	defer db.followerOffsetsMutex.Unlock()
+	offsets := db.followerOffsets[f.Stream]
+	if offsets == nil {
+		offsets = make(map[int]*followerOffset)
+		db.followerOffsets[f.Stream] = offsets
+	}
+	db.nextFollowerID++
+	offsets[db.nextFollowerID] = &followerOffset{partition: f.PartitionNumber, offset: earliest}
+	return db.nextFollowerID
+}
+
+// ackFollower records that the identified follower has durably stored all data
+// prior to the given offset, so it won't need that data again.
+func (db *DB) ackFollower(stream string, id int, offset wal.Offset) {
+	db.followerOffsetsMutex.Lock()
+	defer db.followerOffsetsMutex.Unlock()
+	follower := db.followerOffsets[stream][id]
+	if follower != nil && offset.After(follower.offset) {
+		follower.offset = offset
+	}
+}
+
+// unregisterFollower stops tracking the identified follower once it has
+// disconnected. If it was the only follower of its partition, cleanup pauses
+// until that partition reconnects.
+func (db *DB) unregisterFollower(stream string, id int) {
+	db.followerOffsetsMutex.Lock()
+	delete(db.followerOffsets[stream], id)
+	db.followerOffsetsMutex.Unlock()
+}
+
+func (db *DB) updateWALStats(stream string, durableOffset wal.Offset) {
+	var retainedBytes int64
+	files, err := ioutil.ReadDir(filepath.Join(db.opts.Dir, "_wal", stream))
+	if err != nil {
+		log.Errorf("Unable to list WAL files for %v: %v", stream, err)
+	}
+	for _, file := range files {
+		retainedBytes += file.Size()
+	}
+
+	db.walStatsMutex.Lock()
+	db.walStats[stream] = WALStats{
+		RetainedBytes: retainedBytes,
+		DurableOffset: durableOffset,
+	}
+	db.walStatsMutex.Unlock()
+	log.Debug(db.PrintWALStats(stream))
+}
@@ -0,0 +1,62 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDurableWALOffsetForFollowers(t *testing.T) {
+	db := &DB{
+		opts:            &DBOpts{Passthrough: true, NumPartitions: 2},
+		followerOffsets: make(map[string]map[int]*followerOffset),
+	}
+
+	now := time.Now()
+	early := wal.NewOffsetForTS(now.Add(-2 * time.Hour))
+	middle := wal.NewOffsetForTS(now.Add(-1 * time.Hour))
+	late := wal.NewOffsetForTS(now)
+
+	follow := func(partition int, earliest wal.Offset, tableOffsets ...wal.Offset) int {
+		tables := make([]*common.PartitionTable, 0, len(tableOffsets))
+		for _, offset := range tableOffsets {
+			tables = append(tables, &common.PartitionTable{Name: "t", Offset: offset})
+		}
+		return db.registerFollower(&common.Follow{
+			Stream:          "s",
+			EarliestOffset:  earliest,
+			PartitionNumber: partition,
+			Partitions:      map[string]*common.Partition{"": {Tables: tables}},
+		})
+	}
+
+	replicaA := follow(0, nil, early, late)
+	assert.Nil(t, db.durableWALOffset("s"), "Shouldn't clean up until all partitions have registered")
+
+	other := follow(1, middle, early)
+	assert.Equal(t, early, db.durableWALOffset("s"), "Earliest table offset should take precedence")
+
+	replicaB := follow(0, late, late)
+	assert.Equal(t, early, db.durableWALOffset("s"), "Another replica of the same partition shouldn't replace the first one")
+
+	db.ackFollower("s", replicaA, late)
+	assert.Equal(t, middle, db.durableWALOffset("s"), "Acks should advance the durable offset")
+	db.ackFollower("s", replicaA, early)
+	assert.Equal(t, middle, db.durableWALOffset("s"), "Acks shouldn't move the durable offset backwards")
+
+	db.ackFollower("s", other, late)
+	assert.Equal(t, late, db.durableWALOffset("s"), "Once all followers have acked, durable offset should be the earliest ack")
+
+	db.unregisterFollower("s", replicaA)
+	db.unregisterFollower("s", replicaB)
+	assert.Nil(t, db.durableWALOffset("s"), "Shouldn't clean up while a partition has no connected followers")
+	db.ackFollower("s", replicaA, late)
+	assert.Nil(t, db.durableWALOffset("s"), "Acks from disconnected followers should be ignored")
+
+	follow(0, middle, middle)
+	assert.Equal(t, middle, db.durableWALOffset("s"), "Reconnecting follower should hold back cleanup from where it resumes")
+	assert.Nil(t, db.durableWALOffset("other"))
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/zenodb"
+)
+
+type SnapshotRequest struct {
+	Dir string `json:"dir"`
+}
+
+// snapshot takes a snapshot of the database to the directory given in the
+// request, which is relative to the configured SnapshotDir. Admin endpoints are
+// only available to clients presenting the static auth token.
+func (h *handler) snapshot(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+		return
+	}
+
+	if !h.authenticateAdmin(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	snapshot := &SnapshotRequest{}
+	err := json.NewDecoder(req.Body).Decode(snapshot)
+	if err != nil {
+		badRequest(resp, "Error decoding JSON: %v", err)
+		return
+	}
+	dir, err := zenodb.SnapshotDir(h.SnapshotDir, snapshot.Dir)
+	if err != nil {
+		badRequest(resp, "%v", err)
+		return
+	}
+
+	log.Debugf("Taking snapshot to %v", dir)
+	err = h.db.Snapshot(dir)
+	if err != nil {
+		internalServerError(resp, "Unable to take snapshot: %v", err)
+		return
+	}
+
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	resp.WriteHeader(http.StatusCreated)
+	json.NewEncoder(resp).Encode(snapshot)
+}
+
+// Stats are statistics for the database's tables and streams.
+type Stats struct {
+	Tables map[string]zenodb.TableStats `json:"tables"`
+	// WALRetainedBytes is how much WAL data is kept on disk for each stream.
+	WALRetainedBytes map[string]int64 `json:"walRetainedBytes"`
+}
+
+// stats reports statistics for the database.
+func (h *handler) stats(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticateAdmin(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	stats := &Stats{
+		Tables:           h.db.AllTableStats(),
+		WALRetainedBytes: make(map[string]int64),
+	}
+	for stream, walStats := range h.db.AllWALStats() {
+		stats.WALRetainedBytes[stream] = walStats.RetainedBytes
+	}
+
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	json.NewEncoder(resp).Encode(stats)
+}
+
+func (h *handler) authenticateAdmin(req *http.Request) bool {
+	return h.Opts.Password != "" && constantTimeEquals(req.Header.Get(authheader), h.Opts.Password)
+}
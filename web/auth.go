@@ -1,11 +1,14 @@
 package web
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"net/http"
 	"time"
+
+	"github.com/getlantern/zenodb/rbac"
 )
 
 const (
@@ -18,141 +21,192 @@ const (
 
 var (
 	sessionTimeout = 1 * time.Hour
+	loginTimeout   = 1 * time.Minute
 )
 
+// AuthProvider is an identity provider with which users log in to the web UI.
+type AuthProvider interface {
+	// LoginURL returns the URL to which users are redirected in order to log
+	// in. state has to be passed back to the callback at /oauth/code and
+	// verifier is the PKCE code verifier for this login.
+	LoginURL(state string, verifier string) (string, error)
+
+	// Login exchanges the code received at the callback for the logged in
+	// user, failing if the user isn't allowed to use zeno.
+	Login(code string, state string, verifier string) (*AuthData, error)
+
+	// Revalidate checks that a user whose session expired is still allowed to
+	// use zeno, failing if they have to log in again. It may update ad, for
+	// example with refreshed tokens.
+	Revalidate(ad *AuthData) error
+}
+
 type AuthData struct {
 	AccessToken string
-	Expiration  time.Time
+	// RefreshToken, if the AuthProvider issued one, is used to revalidate the
+	// user once their session expires.
+	RefreshToken string
+	Expiration   time.Time
+	// Login identifies the user, used to look up their roles.
+	Login string
+	// Groups are the groups to which the user belongs, which can also have
+	// roles.
+	Groups []string
+}
+
+// authFlow tracks a login in progress.
+type authFlow struct {
+	State      string
+	Verifier   string
+	Expiration time.Time
 }
 
-func (h *handler) authenticate(resp http.ResponseWriter, req *http.Request) bool {
-	// First check for static auth token
-	if h.Opts.Password != "" {
-		password := req.Header.Get(authheader)
-		if password != "" {
-			result := password == h.Opts.Password
-			return result
+// authenticate checks that the request comes from an authorized user and
+// returns the rbac.Access granted to them, nil meaning unrestricted access.
+func (h *handler) authenticate(resp http.ResponseWriter, req *http.Request) (*rbac.Access, bool) {
+	// First check for static auth token or role-based token
+	if h.Opts.Password != "" || h.Opts.Policy != nil {
+		token := req.Header.Get(authheader)
+		if token != "" {
+			if h.Opts.Password != "" && constantTimeEquals(token, h.Opts.Password) {
+				return nil, true
+			}
+			if h.Opts.Policy != nil {
+				return h.Opts.Policy.AccessForToken(token)
+			}
+			return nil, false
 		}
 	}
 
-	// Then check for GitHub credentials
+	// Then check for a session with the AuthProvider
 	cookie, err := req.Cookie(authcookie)
 	if err == nil {
 		ad := &AuthData{}
 		err = h.sc.Decode(authcookie, cookie.Value, ad)
 		if err == nil {
-			if ad.Expiration.Before(time.Now()) {
-				return true
+			if h.Opts.Policy != nil && ad.Login == "" {
+				// Logged in before we tracked logins, need to log in again
+				h.requestAuthorization(resp, req)
+				return nil, false
+			}
+			if ad.Expiration.After(time.Now()) {
+				return h.accessForUser(ad)
 			}
-			inOrg, err := h.userInOrg(ad.AccessToken)
+			err = h.authProvider.Revalidate(ad)
 			if err != nil {
-				log.Errorf("Unable to check if user is in org: %v", err)
-			} else if inOrg {
+				log.Debugf("Unable to revalidate %v, logging in again: %v", ad.Login, err)
+			} else {
 				ad.Expiration = time.Now().Add(sessionTimeout)
-				return true
+				h.setAuthCookie(resp, ad)
+				return h.accessForUser(ad)
 			}
 		}
 	}
 
-	// User not logged in, request authorization from OAuth provider
+	// User not logged in, request authorization from AuthProvider
 	h.requestAuthorization(resp, req)
 
-	return false
+	return nil, false
+}
+
+// accessForUser looks up the access granted to the given user based on their
+// login and groups. Without a Policy, all users who are able to log in have
+// unrestricted access.
+func (h *handler) accessForUser(ad *AuthData) (*rbac.Access, bool) {
+	if h.Opts.Policy == nil {
+		return nil, true
+	}
+	access, found := h.Opts.Policy.AccessFor(append([]string{ad.Login}, ad.Groups...)...)
+	if !found {
+		log.Debugf("User %v has no roles", ad.Login)
+	}
+	return access, found
 }
 
 func (h *handler) requestAuthorization(resp http.ResponseWriter, req *http.Request) {
-	xsrfExpiration := time.Now().Add(1 * time.Minute)
-	state, err := h.sc.Encode(xsrftoken, xsrfExpiration)
+	flow := &authFlow{
+		State:      randomString(),
+		Verifier:   randomString(),
+		Expiration: time.Now().Add(loginTimeout),
+	}
+	// Keep the flow in a cookie so that the callback only succeeds in the
+	// browser that started the login.
+	cookieData, err := h.sc.Encode(xsrftoken, flow)
 	if err != nil {
 		log.Errorf("Unable to encode xsrf token: %v", err)
 		// TODO: figure out how to handle this
 		return
 	}
-
-	u, err := buildURL("https://github.com/login/oauth/authorize", map[string]string{
-		"client_id": h.OAuthClientID,
-		"state":     state,
-		"scope":     "read:org",
+	http.SetCookie(resp, &http.Cookie{
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		Name:     xsrftoken,
+		Value:    cookieData,
+		Expires:  flow.Expiration,
 	})
+
+	u, err := h.authProvider.LoginURL(flow.State, flow.Verifier)
 	if err != nil {
-		panic(err)
+		log.Errorf("Unable to build login URL: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	log.Debugf("Redirecting to: %v", u.String())
+	log.Debugf("Redirecting to: %v", u)
 
-	resp.Header().Set("Location", u.String())
+	resp.Header().Set("Location", u)
 	resp.WriteHeader(http.StatusTemporaryRedirect)
 }
 
 func (h *handler) oauthCode(resp http.ResponseWriter, req *http.Request) {
 	code := req.URL.Query().Get("code")
 	state := req.URL.Query().Get("state")
-	var xsrfExpiration time.Time
-	err := h.sc.Decode(xsrftoken, state, &xsrfExpiration)
-	if err != nil {
-		log.Errorf("Unable to decode xsrf token, may indicate attempted attack, re-authorizing: %v", err)
-		h.requestAuthorization(resp, req)
+	flow := &authFlow{}
+	cookie, err := req.Cookie(xsrftoken)
+	if err == nil {
+		err = h.sc.Decode(xsrftoken, cookie.Value, flow)
 	}
-	if time.Now().After(xsrfExpiration) {
-		log.Error("XSRF Token expired, re-authorizing")
+	if err != nil || flow.State != state {
+		log.Errorf("Unable to verify xsrf token, may indicate attempted attack, re-authorizing: %v", err)
 		h.requestAuthorization(resp, req)
 		return
 	}
-
-	u, err := buildURL("https://github.com/login/oauth/access_token", map[string]string{
-		"client_id":     h.OAuthClientID,
-		"client_secret": h.OAuthClientSecret,
-		"code":          code,
-		"state":         state,
-	})
-	if err != nil {
-		panic(err)
-	}
-
-	post, _ := http.NewRequest(http.MethodPost, u.String(), nil)
-	post.Header.Set("Accept", "application/json")
-	tokenResp, err := h.client.Do(post)
-	if err != nil {
-		log.Errorf("Error requesting access token, re-authorizing: %v", err)
+	if time.Now().After(flow.Expiration) {
+		log.Error("XSRF Token expired, re-authorizing")
 		h.requestAuthorization(resp, req)
 		return
 	}
+	http.SetCookie(resp, &http.Cookie{
+		Path:   "/",
+		Name:   xsrftoken,
+		MaxAge: -1,
+	})
 
-	defer tokenResp.Body.Close()
-	body, err := ioutil.ReadAll(tokenResp.Body)
+	ad, err := h.authProvider.Login(code, flow.State, flow.Verifier)
 	if err != nil {
-		log.Errorf("Error reading access token, re-authorizing: %v", err)
-		h.requestAuthorization(resp, req)
+		log.Errorf("Unable to log in: %v", err)
+		resp.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	tokenData := make(map[string]string)
-	err = json.Unmarshal(body, &tokenData)
+	ad.Expiration = time.Now().Add(sessionTimeout)
+	err = h.setAuthCookie(resp, ad)
 	if err != nil {
-		log.Errorf("Error unmarshalling access token, re-authorizing: %v", err)
-		h.requestAuthorization(resp, req)
+		log.Errorf("Unable to encode authcookie: %v", err)
+		// TODO: figure out what to handle here
 		return
 	}
 
-	accessToken := tokenData["access_token"]
-	inOrg, err := h.userInOrg(accessToken)
-	if err != nil {
-		log.Errorf("Unable to check if user is in org, re-authorizing: %v", err)
-	} else if !inOrg {
-		log.Errorf("User not in needed org")
-		// TODO: figure out what to do
-		return
-	}
+	log.Debug("User logged in!")
+	resp.Header().Set("Location", "/")
+	resp.WriteHeader(http.StatusTemporaryRedirect)
+}
 
-	ad := &AuthData{
-		AccessToken: accessToken,
-		Expiration:  time.Now().Add(sessionTimeout),
-	}
+func (h *handler) setAuthCookie(resp http.ResponseWriter, ad *AuthData) error {
 	cookieData, err := h.sc.Encode(authcookie, ad)
 	if err != nil {
-		log.Errorf("Unable to encode authcookie: %v", err)
-		// TODO: figure out what to handle here
-		return
+		return err
 	}
 	http.SetCookie(resp, &http.Cookie{
 		Path:    "/",
@@ -161,41 +215,25 @@ func (h *handler) oauthCode(resp http.ResponseWriter, req *http.Request) {
 		Value:   cookieData,
 		Expires: time.Now().Add(365 * 24 * time.Hour),
 	})
-
-	log.Debug("User logged in!")
-	resp.Header().Set("Location", "/")
-	resp.WriteHeader(http.StatusTemporaryRedirect)
+	return nil
 }
 
-func (h *handler) userInOrg(accessToken string) (bool, error) {
-	req, _ := http.NewRequest(http.MethodGet, "https://api.github.com/user/orgs", nil)
-	req.Header.Set("Authorization", fmt.Sprintf("token %v", accessToken))
-	resp, err := h.client.Do(req)
-	if err != nil {
-		return false, fmt.Errorf("Unable to get user orgs from GitHub: %v", err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false, fmt.Errorf("Unable to read user orgs from GitHub: %v", err)
-	}
-	if resp.StatusCode > 299 {
-		return false, fmt.Errorf("Got response status %d: %v", resp.StatusCode, string(body))
-	}
-	orgs := make([]map[string]interface{}, 0)
-	err = json.Unmarshal(body, &orgs)
-	if err != nil {
-		if err != nil {
-			return false, fmt.Errorf("Unable to unmarshal user orgs from GitHub: %v", err)
-		}
-	}
+// randomString returns a random URL-safe string suitable for use as an OAuth
+// state or PKCE verifier.
+func randomString() string {
+	b := make([]byte, randomKeyLength)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
 
-	for _, org := range orgs {
-		if org["login"] == h.GitHubOrg {
-			return true, nil
-		}
-	}
+// pkceChallenge computes the S256 PKCE code challenge for the given verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
 
-	log.Debugf("User not in org %v", h.GitHubOrg)
-	return false, nil
+// constantTimeEquals compares secrets without leaking how much of them matched
+// through timing.
+func constantTimeEquals(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// githubProvider authenticates users with GitHub, allowing in members of a
+// specific org.
+type githubProvider struct {
+	clientID     string
+	clientSecret string
+	org          string
+	client       *http.Client
+}
+
+// NewGitHubProvider constructs an AuthProvider that logs in users with GitHub
+// and requires them to be members of the given org.
+func NewGitHubProvider(clientID string, clientSecret string, org string) (AuthProvider, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, errors.New("missing OAuthClientID and/or OAuthClientSecret")
+	}
+	if org == "" {
+		return nil, errors.New("no GitHubOrg specified")
+	}
+	return &githubProvider{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		org:          org,
+		client:       &http.Client{},
+	}, nil
+}
+
+func (p *githubProvider) LoginURL(state string, verifier string) (string, error) {
+	u, err := buildURL("https://github.com/login/oauth/authorize", map[string]string{
+		"client_id":             p.clientID,
+		"state":                 state,
+		"scope":                 "read:org",
+		"code_challenge":        pkceChallenge(verifier),
+		"code_challenge_method": "S256",
+	})
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (p *githubProvider) Login(code string, state string, verifier string) (*AuthData, error) {
+	u, err := buildURL("https://github.com/login/oauth/access_token", map[string]string{
+		"client_id":     p.clientID,
+		"client_secret": p.clientSecret,
+		"code":          code,
+		"state":         state,
+		"code_verifier": verifier,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	post, _ := http.NewRequest(http.MethodPost, u.String(), nil)
+	post.Header.Set("Accept", "application/json")
+	tokenResp, err := p.client.Do(post)
+	if err != nil {
+		return nil, fmt.Errorf("Error requesting access token: %v", err)
+	}
+
+	defer tokenResp.Body.Close()
+	body, err := ioutil.ReadAll(tokenResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading access token: %v", err)
+	}
+
+	tokenData := make(map[string]string)
+	err = json.Unmarshal(body, &tokenData)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling access token: %v", err)
+	}
+
+	ad := &AuthData{AccessToken: tokenData["access_token"]}
+	err = p.Revalidate(ad)
+	if err != nil {
+		return nil, err
+	}
+	ad.Login, err = p.userLogin(ad.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+func (p *githubProvider) Revalidate(ad *AuthData) error {
+	inOrg, err := p.userInOrg(ad.AccessToken)
+	if err != nil {
+		return fmt.Errorf("Unable to check if user is in org: %v", err)
+	}
+	if !inOrg {
+		return fmt.Errorf("User not in org %v", p.org)
+	}
+	return nil
+}
+
+func (p *githubProvider) userLogin(accessToken string) (string, error) {
+	body, err := p.get("https://api.github.com/user", accessToken)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get user from GitHub: %v", err)
+	}
+	user := make(map[string]interface{})
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		return "", fmt.Errorf("Unable to unmarshal user from GitHub: %v", err)
+	}
+	login, _ := user["login"].(string)
+	if login == "" {
+		return "", fmt.Errorf("GitHub user has no login")
+	}
+	return login, nil
+}
+
+func (p *githubProvider) userInOrg(accessToken string) (bool, error) {
+	body, err := p.get("https://api.github.com/user/orgs", accessToken)
+	if err != nil {
+		return false, fmt.Errorf("Unable to get user orgs from GitHub: %v", err)
+	}
+	orgs := make([]map[string]interface{}, 0)
+	err = json.Unmarshal(body, &orgs)
+	if err != nil {
+		return false, fmt.Errorf("Unable to unmarshal user orgs from GitHub: %v", err)
+	}
+
+	for _, org := range orgs {
+		if org["login"] == p.org {
+			return true, nil
+		}
+	}
+
+	log.Debugf("User not in org %v", p.org)
+	return false, nil
+}
+
+func (p *githubProvider) get(url string, accessToken string) ([]byte, error) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", fmt.Sprintf("token %v", accessToken))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Got response status %d: %v", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,410 @@
+package web
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	// allowedClockSkew is how far our clock may be off from the issuer's when
+	// checking token expiration.
+	allowedClockSkew = 1 * time.Minute
+)
+
+// OIDCOpts configures an OpenID Connect AuthProvider.
+type OIDCOpts struct {
+	// Issuer is the issuer URL, from which the provider configuration is
+	// discovered.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL of zeno's /oauth/code endpoint as registered with
+	// the issuer.
+	RedirectURL string
+	// Scopes are the scopes to request, defaults to openid, profile, email and
+	// offline_access. Without offline_access, most issuers don't grant a
+	// refresh token and users have to log in again whenever their session
+	// expires.
+	Scopes []string
+	// UsernameClaim is the ID token claim that identifies users, defaults to
+	// email.
+	UsernameClaim string
+	// GroupsClaim is the ID token claim that lists the user's groups, defaults
+	// to groups.
+	GroupsClaim string
+	// AllowedGroups, if specified, restricts login to members of at least one
+	// of these groups.
+	AllowedGroups []string
+	// Client is the http.Client used to talk to the issuer, defaults to a new
+	// http.Client.
+	Client *http.Client
+}
+
+// oidcConfiguration is the subset of the OpenID provider metadata that we use.
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcProvider struct {
+	opts   OIDCOpts
+	config *oidcConfiguration
+
+	keys   map[string]*rsa.PublicKey
+	keysMx sync.Mutex
+}
+
+// NewOIDCProvider constructs an AuthProvider that logs in users with the
+// OpenID Connect issuer at opts.Issuer using the authorization code flow with
+// PKCE.
+func NewOIDCProvider(opts *OIDCOpts) (AuthProvider, error) {
+	if opts.Issuer == "" {
+		return nil, errors.New("no OIDC issuer specified")
+	}
+	if opts.ClientID == "" {
+		return nil, errors.New("no OIDC client id specified")
+	}
+	if opts.RedirectURL == "" {
+		return nil, errors.New("no OIDC redirect URL specified")
+	}
+	p := &oidcProvider{opts: *opts}
+	if len(p.opts.Scopes) == 0 {
+		p.opts.Scopes = []string{"openid", "profile", "email", "offline_access"}
+	}
+	if p.opts.UsernameClaim == "" {
+		p.opts.UsernameClaim = "email"
+	}
+	if p.opts.GroupsClaim == "" {
+		p.opts.GroupsClaim = "groups"
+	}
+	if p.opts.Client == nil {
+		p.opts.Client = &http.Client{}
+	}
+
+	p.config = &oidcConfiguration{}
+	err := p.getJSON(strings.TrimSuffix(p.opts.Issuer, "/")+oidcDiscoveryPath, p.config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to discover OIDC configuration: %v", err)
+	}
+	if p.config.Issuer != p.opts.Issuer {
+		return nil, fmt.Errorf("Discovered issuer %v doesn't match configured issuer %v", p.config.Issuer, p.opts.Issuer)
+	}
+	if p.config.AuthorizationEndpoint == "" || p.config.TokenEndpoint == "" || p.config.JWKSURI == "" {
+		return nil, errors.New("OIDC configuration is missing authorization_endpoint, token_endpoint or jwks_uri")
+	}
+	err = p.refreshKeys()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) LoginURL(state string, verifier string) (string, error) {
+	u, err := buildURL(p.config.AuthorizationEndpoint, map[string]string{
+		"response_type":         "code",
+		"client_id":             p.opts.ClientID,
+		"redirect_uri":          p.opts.RedirectURL,
+		"scope":                 strings.Join(p.opts.Scopes, " "),
+		"state":                 state,
+		"nonce":                 state,
+		"code_challenge":        pkceChallenge(verifier),
+		"code_challenge_method": "S256",
+	})
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (p *oidcProvider) Login(code string, state string, verifier string) (*AuthData, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.opts.RedirectURL)
+	form.Set("code_verifier", verifier)
+	tokenData, claims, err := p.requestTokens(form)
+	if err != nil {
+		return nil, err
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+
+	login, _ := claims[p.opts.UsernameClaim].(string)
+	if login == "" {
+		return nil, fmt.Errorf("ID token is missing %v claim", p.opts.UsernameClaim)
+	}
+	ad := &AuthData{
+		AccessToken:  tokenData.AccessToken,
+		RefreshToken: tokenData.RefreshToken,
+		Login:        login,
+		Groups:       stringsClaim(claims[p.opts.GroupsClaim]),
+	}
+	if !p.inAllowedGroup(ad.Groups) {
+		return nil, fmt.Errorf("User %v not in any of groups %v", login, strings.Join(p.opts.AllowedGroups, ", "))
+	}
+	return ad, nil
+}
+
+// Revalidate uses the user's refresh token to obtain a new ID token from the
+// issuer, picking up any changes to their groups. Users whose issuer didn't
+// grant a refresh token (e.g. because offline_access wasn't requested) have to
+// log in again.
+func (p *oidcProvider) Revalidate(ad *AuthData) error {
+	if ad.RefreshToken == "" {
+		return errors.New("No refresh token")
+	}
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", ad.RefreshToken)
+	tokenData, claims, err := p.requestTokens(form)
+	if err != nil {
+		return err
+	}
+	if login, _ := claims[p.opts.UsernameClaim].(string); login != ad.Login {
+		return fmt.Errorf("Refreshed ID token is for %v instead of %v", login, ad.Login)
+	}
+	groups := stringsClaim(claims[p.opts.GroupsClaim])
+	if !p.inAllowedGroup(groups) {
+		return fmt.Errorf("User %v no longer in any of groups %v", ad.Login, strings.Join(p.opts.AllowedGroups, ", "))
+	}
+	ad.AccessToken = tokenData.AccessToken
+	if tokenData.RefreshToken != "" {
+		// Issuer rotated the refresh token
+		ad.RefreshToken = tokenData.RefreshToken
+	}
+	ad.Groups = groups
+	return nil
+}
+
+// oidcTokens is the subset of the token endpoint's response that we use.
+type oidcTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+}
+
+// requestTokens posts the given grant to the token endpoint and returns the
+// tokens along with the verified claims of the ID token.
+func (p *oidcProvider) requestTokens(form url.Values) (*oidcTokens, map[string]interface{}, error) {
+	req, _ := http.NewRequest(http.MethodPost, p.config.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.opts.ClientID), url.QueryEscape(p.opts.ClientSecret))
+	resp, err := p.opts.Client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error requesting ID token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading ID token: %v", err)
+	}
+	if resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("Got response status %d requesting ID token: %v", resp.StatusCode, string(body))
+	}
+	tokenData := &oidcTokens{}
+	err = json.Unmarshal(body, tokenData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error unmarshalling ID token: %v", err)
+	}
+	if tokenData.IDToken == "" {
+		return nil, nil, errors.New("Token response did not include an ID token")
+	}
+
+	claims, err := p.verify(tokenData.IDToken, time.Now())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid ID token: %v", err)
+	}
+	return tokenData, claims, nil
+}
+
+func (p *oidcProvider) inAllowedGroup(groups []string) bool {
+	if len(p.opts.AllowedGroups) == 0 {
+		return true
+	}
+	for _, allowed := range p.opts.AllowedGroups {
+		for _, group := range groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify verifies the signature and standard claims of an RS256 signed ID token
+// and returns its claims.
+func (p *oidcProvider) verify(idToken string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	header := &struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeJWTPart(parts[0], header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %v", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %v", err)
+	}
+	key, err := p.keyFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return nil, fmt.Errorf("bad signature: %v", err)
+	}
+
+	claims := make(map[string]interface{})
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != p.config.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", iss)
+	}
+	audienceMatches := false
+	for _, aud := range stringsClaim(claims["aud"]) {
+		if aud == p.opts.ClientID {
+			audienceMatches = true
+			break
+		}
+	}
+	if !audienceMatches {
+		return nil, errors.New("token not issued for this client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("missing expiration")
+	}
+	if now.Add(-1 * allowedClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+// keyFor returns the key with the given id, refreshing keys from the issuer if
+// it's not known in case the issuer rotated its keys.
+func (p *oidcProvider) keyFor(kid string) (*rsa.PublicKey, error) {
+	p.keysMx.Lock()
+	key := p.keys[kid]
+	p.keysMx.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	err := p.refreshKeys()
+	if err != nil {
+		return nil, err
+	}
+	p.keysMx.Lock()
+	key = p.keys[kid]
+	p.keysMx.Unlock()
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %v", kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) refreshKeys() error {
+	jwks := &struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err := p.getJSON(p.config.JWKSURI, jwks)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch OIDC signing keys: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, nErr := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(jwk.E)
+		if nErr != nil || eErr != nil {
+			log.Debugf("Ignoring malformed signing key %v", jwk.Kid)
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keysMx.Lock()
+	p.keys = keys
+	p.keysMx.Unlock()
+	return nil
+}
+
+func (p *oidcProvider) getJSON(url string, result interface{}) error {
+	resp, err := p.opts.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("Got response status %d: %v", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, result)
+}
+
+func decodeJWTPart(part string, result interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, result)
+}
+
+// stringsClaim interprets a claim that may either be a single string or a list
+// of strings.
+func stringsClaim(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		result := make([]string, 0, len(c))
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
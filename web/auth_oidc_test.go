@@ -0,0 +1,300 @@
+package web
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testClientID     = "zeno"
+	testClientSecret = "zenosecret"
+	testRedirectURL  = "https://zeno.example.com/oauth/code"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+
+	p, err := NewOIDCProvider(&OIDCOpts{
+		Issuer:        issuer.URL,
+		ClientID:      testClientID,
+		ClientSecret:  testClientSecret,
+		RedirectURL:   testRedirectURL,
+		AllowedGroups: []string{"zeno-users"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	login := func(claims map[string]interface{}, verifierOverride string) (*AuthData, error) {
+		state, verifier := randomString(), randomString()
+		loginURL, err := p.LoginURL(state, verifier)
+		if !assert.NoError(t, err) {
+			return nil, err
+		}
+		u, _ := url.Parse(loginURL)
+		q := u.Query()
+		assert.Equal(t, issuer.URL+"/authorize", fmt.Sprintf("%v://%v%v", u.Scheme, u.Host, u.Path))
+		assert.Equal(t, testRedirectURL, q.Get("redirect_uri"))
+		assert.Equal(t, "S256", q.Get("code_challenge_method"))
+		assert.Contains(t, strings.Split(q.Get("scope"), " "), "offline_access")
+		if claims["nonce"] == nil {
+			claims["nonce"] = q.Get("nonce")
+		}
+		code := issuer.authorize(q.Get("code_challenge"), claims)
+		if verifierOverride != "" {
+			verifier = verifierOverride
+		}
+		return p.Login(code, q.Get("state"), verifier)
+	}
+
+	ad, err := login(issuer.claims("alice@example.com", "zeno-users", "admins"), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice@example.com", ad.Login)
+		assert.Equal(t, []string{"zeno-users", "admins"}, ad.Groups)
+		assert.Equal(t, "access-token", ad.AccessToken)
+		assert.NotEmpty(t, ad.RefreshToken)
+
+		oldRefreshToken := ad.RefreshToken
+		issuer.setGroups("alice@example.com", "zeno-users")
+		if assert.NoError(t, p.Revalidate(ad), "OIDC session should be revalidated with refresh token") {
+			assert.Equal(t, []string{"zeno-users"}, ad.Groups, "Revalidation should pick up changed groups")
+			assert.NotEqual(t, oldRefreshToken, ad.RefreshToken, "Rotated refresh token should be kept")
+		}
+		assert.Error(t, p.Revalidate(&AuthData{Login: ad.Login, RefreshToken: oldRefreshToken}), "Used refresh token should be rejected")
+		assert.Error(t, p.Revalidate(&AuthData{Login: ad.Login}), "Session without refresh token should require logging in again")
+
+		issuer.setGroups("alice@example.com", "others")
+		assert.Error(t, p.Revalidate(ad), "User who left allowed groups should have to log in again")
+	}
+
+	ad, err = login(issuer.claims("alice@example.com", "zeno-users"), "")
+	if assert.NoError(t, err) {
+		ad.Login = "bob@example.com"
+		assert.Error(t, p.Revalidate(ad), "Refresh token for other user should be rejected")
+	}
+
+	_, err = login(issuer.claims("bob@example.com", "others"), "")
+	assert.Error(t, err, "User outside of allowed groups should be rejected")
+
+	_, err = login(issuer.claims("alice@example.com", "zeno-users"), randomString())
+	assert.Error(t, err, "Wrong PKCE verifier should be rejected")
+
+	claims := issuer.claims("alice@example.com", "zeno-users")
+	claims["nonce"] = "wrong"
+	_, err = login(claims, "")
+	assert.Error(t, err, "Wrong nonce should be rejected")
+
+	claims = issuer.claims("alice@example.com", "zeno-users")
+	claims["exp"] = time.Now().Add(-1 * time.Hour).Unix()
+	_, err = login(claims, "")
+	assert.Error(t, err, "Expired ID token should be rejected")
+
+	claims = issuer.claims("alice@example.com", "zeno-users")
+	claims["aud"] = []string{"other"}
+	_, err = login(claims, "")
+	assert.Error(t, err, "ID token for other client should be rejected")
+
+	issuer.rotateKey()
+	_, err = login(issuer.claims("alice@example.com", "zeno-users"), "")
+	assert.NoError(t, err, "Rotated signing key should be picked up")
+
+	issuer.signWith, _ = rsa.GenerateKey(rand.Reader, 2048)
+	_, err = login(issuer.claims("alice@example.com", "zeno-users"), "")
+	assert.Error(t, err, "ID token signed with unknown key should be rejected")
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+
+	_, err := NewOIDCProvider(&OIDCOpts{
+		Issuer:      issuer.URL + "/other",
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+	})
+	assert.Error(t, err)
+}
+
+// fakeIssuer is a minimal OpenID Connect issuer that hands out ID tokens for
+// pre-authorized codes.
+type fakeIssuer struct {
+	*httptest.Server
+	t        *testing.T
+	key      *rsa.PrivateKey
+	kid      string
+	signWith *rsa.PrivateKey
+	codes    map[string]*fakeGrant
+	// refreshes are the claims for outstanding refresh tokens
+	refreshes map[string]map[string]interface{}
+	mx        sync.Mutex
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	issuer := &fakeIssuer{t: t, codes: make(map[string]*fakeGrant), refreshes: make(map[string]map[string]interface{})}
+	issuer.rotateKey()
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (issuer *fakeIssuer) rotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		issuer.t.Fatal(err)
+	}
+	issuer.mx.Lock()
+	issuer.key = key
+	issuer.signWith = key
+	issuer.kid = randomString()
+	issuer.mx.Unlock()
+}
+
+func (issuer *fakeIssuer) claims(email string, groups ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    issuer.URL,
+		"aud":    testClientID,
+		"sub":    email,
+		"email":  email,
+		"groups": groups,
+		"exp":    time.Now().Add(5 * time.Minute).Unix(),
+	}
+}
+
+func (issuer *fakeIssuer) authorize(challenge string, claims map[string]interface{}) string {
+	code := randomString()
+	issuer.mx.Lock()
+	issuer.codes[code] = &fakeGrant{challenge, claims}
+	issuer.mx.Unlock()
+	return code
+}
+
+// setGroups changes the groups in ID tokens issued for the given user's refresh
+// tokens.
+func (issuer *fakeIssuer) setGroups(email string, groups ...string) {
+	issuer.mx.Lock()
+	defer issuer.mx.Unlock()
+	for _, claims := range issuer.refreshes {
+		if claims["email"] == email {
+			claims["groups"] = groups
+		}
+	}
+}
+
+func (issuer *fakeIssuer) discovery(resp http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(resp).Encode(map[string]string{
+		"issuer":                 issuer.URL,
+		"authorization_endpoint": issuer.URL + "/authorize",
+		"token_endpoint":         issuer.URL + "/token",
+		"jwks_uri":               issuer.URL + "/jwks",
+	})
+}
+
+func (issuer *fakeIssuer) jwks(resp http.ResponseWriter, req *http.Request) {
+	issuer.mx.Lock()
+	key, kid := issuer.key, issuer.kid
+	issuer.mx.Unlock()
+	json.NewEncoder(resp).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func (issuer *fakeIssuer) token(resp http.ResponseWriter, req *http.Request) {
+	clientID, clientSecret, _ := req.BasicAuth()
+	if clientID != testClientID || clientSecret != testClientSecret {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	req.ParseForm()
+	var claims map[string]interface{}
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		issuer.mx.Lock()
+		grant := issuer.codes[req.PostForm.Get("code")]
+		delete(issuer.codes, req.PostForm.Get("code"))
+		issuer.mx.Unlock()
+		if grant == nil || req.PostForm.Get("redirect_uri") != testRedirectURL {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if pkceChallenge(req.PostForm.Get("code_verifier")) != grant.challenge {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		claims = grant.claims
+	case "refresh_token":
+		// Refresh tokens are single use
+		issuer.mx.Lock()
+		claims = issuer.refreshes[req.PostForm.Get("refresh_token")]
+		delete(issuer.refreshes, req.PostForm.Get("refresh_token"))
+		issuer.mx.Unlock()
+		if claims == nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	refreshClaims := make(map[string]interface{}, len(claims))
+	for key, value := range claims {
+		if key != "nonce" {
+			refreshClaims[key] = value
+		}
+	}
+	refreshToken := randomString()
+	issuer.mx.Lock()
+	issuer.refreshes[refreshToken] = refreshClaims
+	issuer.mx.Unlock()
+	json.NewEncoder(resp).Encode(map[string]string{
+		"access_token":  "access-token",
+		"token_type":    "Bearer",
+		"refresh_token": refreshToken,
+		"id_token":      issuer.sign(claims),
+	})
+}
+
+func (issuer *fakeIssuer) sign(claims map[string]interface{}) string {
+	issuer.mx.Lock()
+	key, kid := issuer.signWith, issuer.kid
+	issuer.mx.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		issuer.t.Fatal(err)
+	}
+	return strings.Join([]string{signingInput, base64.RawURLEncoding.EncodeToString(signature)}, ".")
+}
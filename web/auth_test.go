@@ -0,0 +1,41 @@
+package web
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/zenodb/rbac"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticateToken(t *testing.T) {
+	policy, err := rbac.New(&rbac.Config{
+		Roles:      []*rbac.Role{{Name: "team-x", Tables: []string{"inbound"}, Where: "app = 'x'"}},
+		Tokens:     map[string][]string{"s3cr3t": {"team-x"}},
+		Principals: map[string][]string{"octocat": {"team-x"}, "data-team": {"team-x"}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &handler{Opts: Opts{Password: "pwd", Policy: policy}}
+
+	authenticate := func(token string) (*rbac.Access, bool) {
+		req := httptest.NewRequest("GET", "/run", nil)
+		req.Header.Set(authheader, token)
+		return h.authenticate(httptest.NewRecorder(), req)
+	}
+
+	access, ok := authenticate("pwd")
+	assert.True(t, ok)
+	assert.Nil(t, access, "Password should grant unrestricted access")
+
+	access, ok = authenticate("s3cr3t")
+	if assert.True(t, ok) {
+		assert.Equal(t, "team-x", access.Name())
+	}
+
+	_, ok = authenticate("octocat")
+	assert.False(t, ok, "User name sent as a token should be rejected")
+	_, ok = authenticate("data-team")
+	assert.False(t, ok, "Group name sent as a token should be rejected")
+}
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"time"
@@ -26,6 +27,7 @@ const (
 var (
 	cacheBucket     = []byte("cache")
 	permalinkBucket = []byte("permalink")
+	queryBucket     = []byte("query")
 )
 
 type cache struct {
@@ -119,6 +121,10 @@ func newCache(cacheDir string, ttl time.Duration) (*cache, error) {
 			return bucketErr
 		}
 		_, bucketErr = tx.CreateBucketIfNotExists(permalinkBucket)
+		if bucketErr != nil {
+			return bucketErr
+		}
+		_, bucketErr = tx.CreateBucketIfNotExists(queryBucket)
 		return bucketErr
 	})
 	if err != nil {
@@ -180,6 +186,38 @@ func (c *cache) getByPermalink(permalink string) (ce cacheEntry, err error) {
 	return
 }
 
+// permalinkQuery records the query behind a permalink along with the name of
+// the rbac.Access with which it was run.
+type permalinkQuery struct {
+	SQL    string
+	Access string
+}
+
+func (c *cache) rememberQuery(permalink []byte, pq *permalinkQuery) error {
+	b, err := json.Marshal(pq)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queryBucket).Put(permalink, b)
+	})
+}
+
+// queryForPermalink returns the query behind the given permalink, or nil if the
+// permalink is unknown.
+func (c *cache) queryForPermalink(permalink string) (pq *permalinkQuery, err error) {
+	key := uuid.Parse(permalink)
+	err = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queryBucket).Get(key)
+		if b == nil {
+			return nil
+		}
+		pq = &permalinkQuery{}
+		return json.Unmarshal(b, pq)
+	})
+	return
+}
+
 func (c *cache) put(sql string, ce cacheEntry) error {
 	key := []byte(sql)
 
@@ -81,4 +81,17 @@ func TestCache(t *testing.T) {
 	}
 	assert.EqualValues(t, []byte("1"), ce.data())
 	assert.EqualValues(t, statusSuccess, ce.status())
+
+	err = cache.rememberQuery(ce.permalinkBytes(), &permalinkQuery{SQL: "a", Access: "team-x"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	pq, err := cache.queryForPermalink(ce.permalink())
+	if assert.NoError(t, err) && assert.NotNil(t, pq) {
+		assert.Equal(t, "a", pq.SQL)
+		assert.Equal(t, "team-x", pq.Access)
+	}
+	pq, err = cache.queryForPermalink(permalink)
+	assert.NoError(t, err)
+	assert.Nil(t, pq, "Permalink without remembered query should be unknown")
 }
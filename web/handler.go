@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/rbac"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"net/http"
@@ -26,26 +27,47 @@ type Opts struct {
 	CacheDir          string
 	CacheTTL          time.Duration
 	Password          string
-	QueryTimeout      time.Duration
-	MaxResponseBytes  int
+	// SnapshotDir is the directory in which admins may take snapshots via
+	// /admin/snapshot. Snapshots are disabled if it's not specified.
+	SnapshotDir      string
+	QueryTimeout     time.Duration
+	MaxResponseBytes int
+	// PrometheusStream is the stream into which to insert data received via
+	// Prometheus remote write, defaults to "prometheus".
+	PrometheusStream string
+	// PrometheusCounters controls how Prometheus counters are stored, either
+	// PrometheusCountersRaw (the default) or PrometheusCountersDelta.
+	PrometheusCounters string
+	// APITokens are scoped tokens that grant write access to specific streams.
+	APITokens []*APIToken
+	// Policy, if specified, limits which tables and rows users and tokens may
+	// query. The Password still grants unrestricted access.
+	Policy *rbac.Policy
+	// AuthProvider is the identity provider with which users log in, defaults
+	// to GitHub using OAuthClientID, OAuthClientSecret and GitHubOrg.
+	AuthProvider AuthProvider
 }
 
 type handler struct {
 	Opts
-	db     *zenodb.DB
-	fs     http.Handler
-	sc     *securecookie.SecureCookie
-	client *http.Client
-	cache  *cache
+	db    *zenodb.DB
+	fs    http.Handler
+	sc    *securecookie.SecureCookie
+	cache *cache
+
+	authProvider AuthProvider
+	promCounters *promCounters
+	apiTokens    map[string]*scopedToken
 }
 
 func Configure(db *zenodb.DB, router *mux.Router, opts *Opts) error {
-	if opts.OAuthClientID == "" || opts.OAuthClientSecret == "" {
-		return errors.New("Unable to start web server, missing OAuthClientID and/or OAuthClientSecret")
-	}
-
-	if opts.GitHubOrg == "" {
-		return errors.New("Unable to start web server, no GitHubOrg specified")
+	authProvider := opts.AuthProvider
+	if authProvider == nil {
+		var err error
+		authProvider, err = NewGitHubProvider(opts.OAuthClientID, opts.OAuthClientSecret, opts.GitHubOrg)
+		if err != nil {
+			return fmt.Errorf("Unable to start web server, %v", err)
+		}
 	}
 
 	if opts.CacheDir == "" {
@@ -64,6 +86,24 @@ func Configure(db *zenodb.DB, router *mux.Router, opts *Opts) error {
 		opts.MaxResponseBytes = 25 * 1024 * 1024 // 25 MB
 	}
 
+	if opts.PrometheusStream == "" {
+		opts.PrometheusStream = "prometheus"
+	}
+
+	switch opts.PrometheusCounters {
+	case "":
+		opts.PrometheusCounters = PrometheusCountersRaw
+	case PrometheusCountersRaw, PrometheusCountersDelta:
+		// okay
+	default:
+		return fmt.Errorf("Unable to start web server, unknown PrometheusCounters %v", opts.PrometheusCounters)
+	}
+
+	apiTokens, err := newScopedTokens(opts.APITokens)
+	if err != nil {
+		return fmt.Errorf("Unable to start web server, invalid API tokens: %v", err)
+	}
+
 	hashKey := []byte(opts.HashKey)
 	blockKey := []byte(opts.BlockKey)
 
@@ -91,15 +131,22 @@ func Configure(db *zenodb.DB, router *mux.Router, opts *Opts) error {
 	}
 
 	h := &handler{
-		Opts:   *opts,
-		db:     db,
-		sc:     securecookie.New(hashKey, blockKey),
-		client: &http.Client{},
-		cache:  cache,
+		Opts:  *opts,
+		db:    db,
+		sc:    securecookie.New(hashKey, blockKey),
+		cache: cache,
+
+		authProvider: authProvider,
+		promCounters: newPromCounters(),
+		apiTokens:    apiTokens,
 	}
 
 	router.StrictSlash(true)
 	router.HandleFunc("/insert/{stream}", h.insert)
+	router.HandleFunc("/influx/write", h.insertInflux)
+	router.HandleFunc("/prometheus/write", h.insertPrometheus)
+	router.HandleFunc("/admin/snapshot", h.snapshot)
+	router.HandleFunc("/admin/stats", h.stats)
 	router.HandleFunc("/oauth/code", h.oauthCode)
 	router.PathPrefix("/async").HandlerFunc(h.asyncQuery)
 	router.PathPrefix("/run").HandlerFunc(h.runQuery)
@@ -6,7 +6,7 @@ import (
 )
 
 func (h *handler) index(resp http.ResponseWriter, req *http.Request) {
-	if !h.authenticate(resp, req) {
+	if _, ok := h.authenticate(resp, req); !ok {
 		return
 	}
 
@@ -0,0 +1,271 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/rpc"
+)
+
+const (
+	maxInfluxLineLength = 1024 * 1024
+)
+
+var (
+	influxPrecisions = map[string]time.Duration{
+		"":   time.Nanosecond,
+		"n":  time.Nanosecond,
+		"ns": time.Nanosecond,
+		"u":  time.Microsecond,
+		"us": time.Microsecond,
+		"µ":  time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+	}
+)
+
+// influxPoint is a point parsed from a line of InfluxDB line protocol.
+type influxPoint struct {
+	stream string
+	ts     time.Time
+	dims   map[string]interface{}
+	vals   map[string]float64
+}
+
+// insertInflux inserts points in InfluxDB line protocol, one point per line.
+// The measurement determines the stream, tags become dims and fields become
+// vals. All other lines are still inserted if some lines can't be parsed or
+// inserted, and the response is an InsertReport with errors keyed to the
+// (1-based) line numbers.
+func (h *handler) insertInflux(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+		return
+	}
+
+	precision, found := influxPrecisions[req.URL.Query().Get("precision")]
+	if !found {
+		badRequest(resp, "Unknown precision %v", req.URL.Query().Get("precision"))
+		return
+	}
+
+	grant := h.authorizeInsert(req)
+	rejected := make(map[string]int)
+	rateLimited := 0
+	report := &rpc.InsertReport{
+		Errors: make(map[int]string),
+	}
+	now := time.Now()
+	scanner := bufio.NewScanner(req.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxInfluxLineLength)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			// Ignore blank lines and comments
+			continue
+		}
+		report.Received++
+		point, err := parseInfluxLine(line, precision, now)
+		if err != nil {
+			report.Errors[lineNumber] = err.Error()
+			continue
+		}
+		authErr := grant.allow(point.stream)
+		if authErr != nil {
+			report.Errors[lineNumber] = authErr.Error()
+			rejected[point.stream]++
+			if authErr == errRateLimited {
+				rateLimited++
+			}
+			continue
+		}
+		insertErr := h.db.InsertRaw(point.stream, point.ts, bytemap.New(point.dims), bytemap.NewFloat(point.vals))
+		if insertErr != nil {
+			report.Errors[lineNumber] = fmt.Sprintf("Unable to insert: %v", insertErr)
+			continue
+		}
+		report.Succeeded++
+	}
+	if err := scanner.Err(); err != nil {
+		// We can't continue reading after an error, so stop here
+		report.Received++
+		report.Errors[lineNumber+1] = err.Error()
+	}
+
+	for stream, count := range rejected {
+		h.db.RecordRejectedInserts(stream, count)
+	}
+
+	if len(report.Errors) > 0 {
+		log.Errorf("Unable to insert %d of %d line(s)", len(report.Errors), report.Received)
+	}
+	status := grant.status(insertStatus(report), report.Succeeded, rateLimited)
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(report)
+}
+
+// parseInfluxLine parses a single line of line protocol in the form:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// Timestamps are interpreted in units of precision. Lines without a timestamp
+// are recorded at now.
+func parseInfluxLine(line string, precision time.Duration, now time.Time) (*influxPoint, error) {
+	sections := splitInflux(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("expected measurement, fields and optional timestamp separated by spaces")
+	}
+
+	point := &influxPoint{
+		ts:   now,
+		dims: make(map[string]interface{}),
+		vals: make(map[string]float64),
+	}
+
+	key := splitInflux(sections[0], ',', false)
+	point.stream = unescapeInflux(key[0])
+	if point.stream == "" || sections[0][0] == ',' {
+		return nil, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range key[1:] {
+		name, value, err := splitInfluxPair(tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %v: %v", tag, err)
+		}
+		point.dims[name] = unescapeInflux(value)
+	}
+
+	for _, field := range splitInflux(sections[1], ',', true) {
+		name, value, err := splitInfluxPair(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %v: %v", field, err)
+		}
+		val, err := parseInfluxFieldValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for field %v: %v", name, err)
+		}
+		point.vals[name] = val
+	}
+	if len(point.vals) == 0 {
+		return nil, fmt.Errorf("need at least one field")
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %v: %v", sections[2], err)
+		}
+		if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+			return nil, fmt.Errorf("timestamp %v out of range", sections[2])
+		}
+		point.ts = time.Unix(0, ts*int64(precision))
+	}
+
+	return point, nil
+}
+
+// splitInflux splits s on occurrences of sep that are neither escaped nor, if
+// respectQuotes is true, inside of double quotes. Escapes are preserved in the
+// result.
+func splitInflux(s string, sep byte, respectQuotes bool) []string {
+	var parts []string
+	start := 0
+	escaped := false
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"' && respectQuotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			if i > start {
+				parts = append(parts, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// splitInfluxPair splits s into an unescaped key and a still escaped value.
+func splitInfluxPair(s string) (string, string, error) {
+	escaped := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '=':
+			key := unescapeInflux(s[:i])
+			if key == "" {
+				return "", "", fmt.Errorf("missing key")
+			}
+			if i == len(s)-1 {
+				return "", "", fmt.Errorf("missing value")
+			}
+			return key, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("missing =")
+}
+
+func unescapeInflux(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	result := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i < len(s)-1 {
+			switch s[i+1] {
+			case ',', ' ', '=', '"', '\\':
+				i++
+			}
+		}
+		result = append(result, s[i])
+	}
+	return string(result)
+}
+
+// parseInfluxFieldValue parses a float, integer or boolean field value. String
+// values can't be stored as vals and are rejected.
+func parseInfluxFieldValue(value string) (float64, error) {
+	if value[0] == '"' {
+		return 0, fmt.Errorf("string values are not supported")
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	last := value[len(value)-1]
+	if last == 'i' || last == 'u' {
+		i, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return float64(i), nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	now := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	point, err := parseInfluxLine(`cpu\ load,host=server\ 1,region=us\,west usage=0.5,count=3i,up=t 1483326245`, time.Second, now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "cpu load", point.stream)
+		assert.Equal(t, map[string]interface{}{"host": "server 1", "region": "us,west"}, point.dims)
+		assert.Equal(t, map[string]float64{"usage": 0.5, "count": 3, "up": 1}, point.vals)
+		assert.Equal(t, now, point.ts.UTC())
+	}
+
+	point, err = parseInfluxLine("mem free=12", time.Nanosecond, now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mem", point.stream)
+		assert.Empty(t, point.dims)
+		assert.Equal(t, now, point.ts, "Missing timestamp should default to now")
+	}
+
+	point, err = parseInfluxLine("mem free=12 1483326245000", time.Millisecond, now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, now, point.ts.UTC())
+	}
+
+	_, err = parseInfluxLine("mem free=12 9223372036854775", time.Millisecond, now)
+	assert.Error(t, err, "Timestamps that overflow at the given precision should be rejected")
+	_, err = parseInfluxLine("mem free=12 -9223372036854775", time.Millisecond, now)
+	assert.Error(t, err, "Negative timestamps that overflow at the given precision should be rejected")
+
+	for _, line := range []string{
+		"mem",
+		",host=a free=12",
+		"mem,host free=12",
+		"mem free=",
+		`mem msg="a string"`,
+		"mem free=abc",
+		"mem free=12 notatimestamp",
+		"mem free=12 1 extra",
+	} {
+		_, err = parseInfluxLine(line, time.Nanosecond, now)
+		assert.Error(t, err, line)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/getlantern/zenodb/rpc"
 	"github.com/gorilla/mux"
 )
 
@@ -24,6 +25,8 @@ type Point struct {
 	Vals map[string]float64     `json:"vals,omitempty"`
 }
 
+// insert inserts a stream of JSON points, responding with an InsertReport. All
+// valid points are inserted even if some points fail.
 func (h *handler) insert(resp http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
 		resp.WriteHeader(http.StatusMethodNotAllowed)
@@ -39,35 +42,78 @@ func (h *handler) insert(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	stream := mux.Vars(req)["stream"]
+	grant := h.authorizeInsert(req)
+	rejected := 0
+	rateLimited := 0
+	report := &rpc.InsertReport{
+		Errors: make(map[int]string),
+	}
 	dec := json.NewDecoder(req.Body)
-	for {
+	for i := 0; ; i++ {
 		point := &Point{}
 		err := dec.Decode(point)
 		if err == io.EOF {
 			// Done reading points
-			resp.WriteHeader(http.StatusCreated)
-			return
+			break
 		}
+		report.Received++
 		if err != nil {
-			badRequest(resp, "Error decoding JSON: %v", err)
-			return
+			// We can't reliably continue decoding after an error, so stop here
+			report.Errors[i] = fmt.Sprintf("Error decoding JSON: %v", err)
+			break
 		}
 		if len(point.Dims) == 0 {
-			badRequest(resp, "Need at least one dim")
-			return
+			report.Errors[i] = "Need at least one dim"
+			continue
 		}
 		if len(point.Vals) == 0 {
-			badRequest(resp, "Need at least one val")
-			return
+			report.Errors[i] = "Need at least one val"
+			continue
 		}
 		if point.Ts.IsZero() {
 			point.Ts = time.Now()
 		}
 
+		authErr := grant.allow(stream)
+		if authErr != nil {
+			report.Errors[i] = authErr.Error()
+			rejected++
+			if authErr == errRateLimited {
+				rateLimited++
+			}
+			continue
+		}
+
 		insertErr := h.db.Insert(stream, point.Ts, point.Dims, point.Vals)
 		if insertErr != nil {
-			internalServerError(resp, "Error submitting point: %v", insertErr)
+			report.Errors[i] = fmt.Sprintf("Unable to insert: %v", insertErr)
+			continue
 		}
+		report.Succeeded++
+	}
+
+	if report.Succeeded < report.Received {
+		log.Errorf("Failed to insert %d of %d points into %v", report.Received-report.Succeeded, report.Received, stream)
+	}
+	if rejected > 0 {
+		h.db.RecordRejectedInserts(stream, rejected)
+	}
+	status := grant.status(insertStatus(report), report.Succeeded, rateLimited)
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(report)
+}
+
+// insertStatus returns the status with which to respond to an insert with the
+// given report. Partially successful inserts respond with 207 Multi-Status.
+func insertStatus(report *rpc.InsertReport) int {
+	switch {
+	case report.Succeeded == report.Received:
+		return http.StatusCreated
+	case report.Succeeded == 0:
+		return http.StatusBadRequest
+	default:
+		return http.StatusMultiStatus
 	}
 }
 
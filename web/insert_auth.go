@@ -0,0 +1,207 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/yaml"
+)
+
+var (
+	errUnauthorized = errors.New("Unauthorized")
+	errRateLimited  = errors.New("Rate limit exceeded")
+)
+
+// APIToken is a scoped token that clients can present in the
+// X-Zeno-Auth-Token header in order to insert data.
+type APIToken struct {
+	// Token is the secret value of the token.
+	Token string `yaml:"token"`
+	// Streams lists the streams into which the token may insert, "*" allows all
+	// streams.
+	Streams []string `yaml:"streams"`
+	// RateLimit caps how many points per second may be inserted with this
+	// token. 0 means unlimited.
+	RateLimit float64 `yaml:"ratelimit"`
+}
+
+// LoadAPITokens loads a list of APITokens from the YAML file at filename.
+func LoadAPITokens(filename string) ([]*APIToken, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read API tokens from %v: %v", filename, err)
+	}
+	var tokens []*APIToken
+	err = yaml.Unmarshal(b, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse API tokens from %v: %v", filename, err)
+	}
+	return tokens, nil
+}
+
+type scopedToken struct {
+	allStreams bool
+	streams    map[string]bool
+	limiter    *rateLimiter
+}
+
+func newScopedTokens(tokens []*APIToken) (map[string]*scopedToken, error) {
+	result := make(map[string]*scopedToken, len(tokens))
+	for _, token := range tokens {
+		if token.Token == "" {
+			return nil, errors.New("API token must not be empty")
+		}
+		if result[token.Token] != nil {
+			return nil, errors.New("Duplicate API token")
+		}
+		if token.RateLimit < 0 {
+			return nil, fmt.Errorf("API token rate limit %v must not be negative", token.RateLimit)
+		}
+		st := &scopedToken{streams: make(map[string]bool, len(token.Streams))}
+		for _, stream := range token.Streams {
+			stream = normalizeStream(stream)
+			if stream == "*" {
+				st.allStreams = true
+			}
+			st.streams[stream] = true
+		}
+		if token.RateLimit > 0 {
+			st.limiter = newRateLimiter(token.RateLimit)
+		}
+		result[token.Token] = st
+	}
+	return result, nil
+}
+
+func (st *scopedToken) allow(stream string, points int) error {
+	if !st.allStreams && !st.streams[normalizeStream(stream)] {
+		return fmt.Errorf("Not authorized to insert into stream %v", stream)
+	}
+	if st.limiter != nil && !st.limiter.allowN(time.Now(), points) {
+		return errRateLimited
+	}
+	return nil
+}
+
+// insertGrant captures what a given request is allowed to insert.
+type insertGrant struct {
+	authenticated bool
+	// token restricts the grant, nil means unrestricted
+	token *scopedToken
+}
+
+// allow checks whether a single point may be inserted into the given stream.
+func (g *insertGrant) allow(stream string) error {
+	return g.allowN(stream, 1)
+}
+
+// allowN checks whether a batch of the given number of points may be inserted
+// into the given stream. The batch is either allowed or rejected as a whole.
+func (g *insertGrant) allowN(stream string, points int) error {
+	if !g.authenticated {
+		return errUnauthorized
+	}
+	if g.token == nil {
+		return nil
+	}
+	return g.token.allow(stream, points)
+}
+
+// status adjusts the status of an insert response to reflect authorization
+// failures.
+func (g *insertGrant) status(status int, succeeded int, rateLimited int) int {
+	if !g.authenticated {
+		return http.StatusUnauthorized
+	}
+	if succeeded == 0 && rateLimited > 0 {
+		return http.StatusTooManyRequests
+	}
+	return status
+}
+
+// authorizeInsert determines what the given request may insert based on the
+// X-Zeno-Auth-Token header. The static password grants unrestricted access. If
+// neither a password nor any API tokens are configured, inserts are open to
+// everyone.
+func (h *handler) authorizeInsert(req *http.Request) *insertGrant {
+	if h.Opts.Password == "" && len(h.apiTokens) == 0 {
+		return &insertGrant{authenticated: true}
+	}
+	presented := req.Header.Get(authheader)
+	if presented == "" {
+		return &insertGrant{}
+	}
+	if h.Opts.Password != "" && constantTimeEquals(presented, h.Opts.Password) {
+		return &insertGrant{authenticated: true}
+	}
+	// Compare against every token rather than looking it up so that timing
+	// doesn't reveal anything about valid tokens
+	var token *scopedToken
+	for value, candidate := range h.apiTokens {
+		if constantTimeEquals(presented, value) {
+			token = candidate
+		}
+	}
+	if token == nil {
+		return &insertGrant{}
+	}
+	return &insertGrant{authenticated: true, token: token}
+}
+
+// rateLimiter is a token bucket that allows up to rate events per second with
+// bursts of up to one second's worth of events.
+type rateLimiter struct {
+	rate      float64
+	available float64
+	last      time.Time
+	mx        sync.Mutex
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, available: burstFor(rate)}
+}
+
+func (rl *rateLimiter) allow(now time.Time) bool {
+	return rl.allowN(now, 1)
+}
+
+// allowN allows n events at once if enough have accrued. Batches larger than
+// the burst are allowed once the full burst has accrued, after which the excess
+// has to accrue before anything else is allowed.
+func (rl *rateLimiter) allowN(now time.Time, n int) bool {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	burst := burstFor(rl.rate)
+	if !rl.last.IsZero() {
+		rl.available += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.available > burst {
+			rl.available = burst
+		}
+	}
+	rl.last = now
+	needed := float64(n)
+	if needed > burst {
+		needed = burst
+	}
+	if rl.available < needed {
+		return false
+	}
+	rl.available -= float64(n)
+	return true
+}
+
+func burstFor(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+func normalizeStream(stream string) string {
+	return strings.TrimSpace(strings.ToLower(stream))
+}
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizeInsert(t *testing.T) {
+	tokens, err := newScopedTokens([]*APIToken{
+		{Token: "scoped", Streams: []string{"Inbound"}},
+		{Token: "all", Streams: []string{"*"}, RateLimit: 2},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &handler{Opts: Opts{Password: "pwd"}, apiTokens: tokens}
+
+	grantFor := func(token string) *insertGrant {
+		req := httptest.NewRequest(http.MethodPost, "/insert/inbound", nil)
+		if token != "" {
+			req.Header.Set(authheader, token)
+		}
+		return h.authorizeInsert(req)
+	}
+
+	assert.Equal(t, errUnauthorized, grantFor("").allow("inbound"))
+	assert.Equal(t, errUnauthorized, grantFor("bad").allow("inbound"))
+	assert.Equal(t, http.StatusUnauthorized, grantFor("bad").status(http.StatusCreated, 0, 0))
+	assert.NoError(t, grantFor("pwd").allow("anything"))
+
+	scoped := grantFor("scoped")
+	assert.NoError(t, scoped.allow("inbound"))
+	assert.NoError(t, scoped.allow(" INBOUND"))
+	assert.Error(t, scoped.allow("outbound"))
+	assert.NoError(t, scoped.allowN("inbound", 1000), "Batches should be unlimited without a rate limit")
+	assert.Error(t, scoped.allowN("outbound", 10))
+
+	all := grantFor("all")
+	assert.NoError(t, all.allow("outbound"))
+	assert.NoError(t, all.allow("inbound"))
+	assert.Equal(t, errRateLimited, all.allow("inbound"))
+	assert.Equal(t, http.StatusTooManyRequests, all.status(http.StatusBadRequest, 0, 1))
+
+	open := &handler{}
+	assert.NoError(t, open.authorizeInsert(httptest.NewRequest(http.MethodPost, "/insert/inbound", nil)).allow("inbound"), "Inserts should be open if no password or tokens configured")
+
+	_, err = newScopedTokens([]*APIToken{{Token: "a"}, {Token: "a"}})
+	assert.Error(t, err, "Duplicate tokens should be rejected")
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2)
+	now := time.Now()
+	assert.True(t, rl.allow(now))
+	assert.True(t, rl.allow(now))
+	assert.False(t, rl.allow(now), "Burst should be exhausted")
+	assert.True(t, rl.allow(now.Add(500*time.Millisecond)), "Should refill at rate")
+	assert.False(t, rl.allow(now.Add(500*time.Millisecond)))
+	assert.True(t, rl.allow(now.Add(10*time.Second)))
+	assert.True(t, rl.allow(now.Add(10*time.Second)))
+	assert.False(t, rl.allow(now.Add(10*time.Second)), "Refill should be capped at burst")
+
+	rl = newRateLimiter(2)
+	assert.True(t, rl.allowN(now, 2))
+	assert.False(t, rl.allowN(now, 2), "Batch should be rejected as a whole")
+	assert.True(t, rl.allowN(now.Add(time.Second), 5), "Batch larger than burst should be allowed once burst has accrued")
+	assert.False(t, rl.allow(now.Add(2*time.Second)), "Excess of large batch should have to accrue first")
+	assert.True(t, rl.allow(now.Add(3*time.Second)))
+}
@@ -0,0 +1,15 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertStatus(t *testing.T) {
+	assert.Equal(t, http.StatusCreated, insertStatus(&rpc.InsertReport{Received: 3, Succeeded: 3}))
+	assert.Equal(t, http.StatusMultiStatus, insertStatus(&rpc.InsertReport{Received: 3, Succeeded: 1, Errors: map[int]string{2: "bad", 3: "bad"}}))
+	assert.Equal(t, http.StatusBadRequest, insertStatus(&rpc.InsertReport{Received: 3, Errors: map[int]string{1: "bad", 2: "bad", 3: "bad"}}))
+}
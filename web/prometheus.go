@@ -0,0 +1,387 @@
+package web
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/golang/snappy"
+)
+
+const (
+	// PrometheusCountersRaw stores Prometheus counters as their raw, cumulative
+	// values.
+	PrometheusCountersRaw = "raw"
+	// PrometheusCountersDelta stores the change in Prometheus counters since the
+	// prior sample, which can then be summed like any other val.
+	PrometheusCountersDelta = "delta"
+
+	promNameLabel = "__name__"
+
+	// promCounterTTL is how long to remember the last value of a counter that
+	// isn't being reported anymore.
+	promCounterTTL = 1 * time.Hour
+
+	// Metric types from the MetricMetadata in a remote write request
+	promTypeCounter   = 1
+	promTypeHistogram = 3
+	promTypeSummary   = 5
+
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+type promSample struct {
+	value float64
+	ts    int64
+}
+
+type promTimeSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+// promWriteRequest is a decoded Prometheus remote write request.
+type promWriteRequest struct {
+	timeSeries []*promTimeSeries
+	// types records the metric type of metric families, if known
+	types map[string]uint64
+}
+
+// promCounters tracks the latest value of Prometheus counters in order to
+// compute per-interval deltas. Counters that haven't been seen for
+// promCounterTTL are forgotten so that churning series don't accumulate.
+type promCounters struct {
+	last       map[string]*promCounter
+	lastPruned time.Time
+	mx         sync.Mutex
+}
+
+type promCounter struct {
+	value float64
+	seen  time.Time
+}
+
+func newPromCounters() *promCounters {
+	return &promCounters{last: make(map[string]*promCounter), lastPruned: time.Now()}
+}
+
+// insertPrometheus handles snappy-compressed protobuf remote write requests
+// from Prometheus. Each sample's labels become dims and the metric name becomes
+// the name of the val. All samples are inserted into the configured stream.
+//
+// Prometheus retries the whole request on 429 and 5xx responses, so the
+// request is authorized and rate limited as a whole before anything is
+// inserted, and failures after some samples were inserted respond with a
+// non-retryable status so that those samples aren't inserted again.
+func (h *handler) insertPrometheus(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		badRequest(resp, "Error reading request: %v", err)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		badRequest(resp, "Error decompressing request: %v", err)
+		return
+	}
+	wr, err := decodePromWriteRequest(data)
+	if err != nil {
+		badRequest(resp, "Error decoding request: %v", err)
+		return
+	}
+
+	for _, series := range wr.timeSeries {
+		if series.labels[promNameLabel] == "" {
+			badRequest(resp, "Time series is missing %v", promNameLabel)
+			return
+		}
+	}
+
+	samples := 0
+	for _, series := range wr.timeSeries {
+		for _, sample := range series.samples {
+			if storable(sample.value) {
+				samples++
+			}
+		}
+	}
+
+	grant := h.authorizeInsert(req)
+	authErr := grant.allowN(h.PrometheusStream, samples)
+	if authErr != nil {
+		h.db.RecordRejectedInserts(h.PrometheusStream, samples)
+		status := http.StatusForbidden
+		rateLimited := 0
+		if authErr == errRateLimited {
+			rateLimited = samples
+		}
+		resp.WriteHeader(grant.status(status, 0, rateLimited))
+		log.Errorf("Rejected %d sample(s): %v", samples, authErr)
+		fmt.Fprintf(resp, "Rejected %d sample(s): %v\n", samples, authErr)
+		return
+	}
+
+	deltas := h.PrometheusCounters == PrometheusCountersDelta
+	inserted := 0
+	failed := 0
+	var lastErr error
+	for _, series := range wr.timeSeries {
+		name := series.labels[promNameLabel]
+		dims := make(map[string]interface{}, len(series.labels))
+		for key, value := range series.labels {
+			if key != promNameLabel {
+				dims[key] = value
+			}
+		}
+		isCounter := deltas && wr.isCounter(name)
+		seriesKey := promSeriesKey(series.labels)
+		for _, sample := range series.samples {
+			value := sample.value
+			if !storable(value) {
+				// Ignore stale markers and other values that we can't store
+				continue
+			}
+			if isCounter {
+				var ok bool
+				value, ok = h.promCounters.delta(seriesKey, value, time.Now())
+				if !ok {
+					continue
+				}
+			}
+			ts := time.Unix(0, sample.ts*int64(time.Millisecond))
+			insertErr := h.db.InsertRaw(h.PrometheusStream, ts, bytemap.New(dims), bytemap.NewFloat(map[string]float64{name: value}))
+			if insertErr != nil {
+				failed++
+				lastErr = insertErr
+				continue
+			}
+			inserted++
+		}
+	}
+
+	if failed > 0 {
+		if inserted > 0 {
+			// Retrying would insert the samples that did succeed again
+			badRequest(resp, "Inserted %d sample(s) but unable to insert %d sample(s): %v", inserted, failed, lastErr)
+			return
+		}
+		internalServerError(resp, "Unable to insert %d sample(s): %v", failed, lastErr)
+		return
+	}
+	resp.WriteHeader(http.StatusCreated)
+}
+
+// storable determines whether the given sample value can be stored. This
+// excludes stale markers, which are NaNs.
+func storable(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// isCounter determines whether the named metric is a counter, using the
+// metadata included in the request if available and falling back to the
+// Prometheus naming conventions.
+func (wr *promWriteRequest) isCounter(name string) bool {
+	if t, found := wr.types[name]; found {
+		return t == promTypeCounter
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if strings.HasSuffix(name, suffix) {
+			if t, found := wr.types[strings.TrimSuffix(name, suffix)]; found {
+				return t == promTypeHistogram || t == promTypeSummary
+			}
+			return true
+		}
+	}
+	return strings.HasSuffix(name, "_total")
+}
+
+// delta returns the change in the counter identified by key since its prior
+// sample. A decrease means that the counter was reset, in which case the whole
+// new value is the delta. The first sample of a counter has no baseline, so no
+// delta is returned for it.
+func (c *promCounters) delta(key string, value float64, now time.Time) (float64, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if now.Sub(c.lastPruned) > promCounterTTL {
+		c.prune(now)
+	}
+	last := c.last[key]
+	c.last[key] = &promCounter{value, now}
+	if last == nil || now.Sub(last.seen) > promCounterTTL {
+		return 0, false
+	}
+	if value < last.value {
+		return value, true
+	}
+	return value - last.value, true
+}
+
+// prune forgets counters that haven't been seen for promCounterTTL.
+func (c *promCounters) prune(now time.Time) {
+	for key, counter := range c.last {
+		if now.Sub(counter.seen) > promCounterTTL {
+			delete(c.last, key)
+		}
+	}
+	c.lastPruned = now
+}
+
+func promSeriesKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// decodePromWriteRequest decodes a WriteRequest protobuf message:
+//
+//	message WriteRequest {
+//	  repeated TimeSeries timeseries = 1;
+//	  repeated MetricMetadata metadata = 3;
+//	}
+//	message TimeSeries {
+//	  repeated Label labels = 1;
+//	  repeated Sample samples = 2;
+//	}
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//	message MetricMetadata { MetricType type = 1; string metric_family_name = 2; ... }
+func decodePromWriteRequest(data []byte) (*promWriteRequest, error) {
+	wr := &promWriteRequest{types: make(map[string]uint64)}
+	err := readProto(data, func(field int, value uint64, b []byte) error {
+		switch field {
+		case 1:
+			series, err := decodePromTimeSeries(b)
+			if err != nil {
+				return err
+			}
+			wr.timeSeries = append(wr.timeSeries, series)
+		case 3:
+			var t uint64
+			var name string
+			err := readProto(b, func(field int, value uint64, b []byte) error {
+				switch field {
+				case 1:
+					t = value
+				case 2:
+					name = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("invalid metadata: %v", err)
+			}
+			wr.types[name] = t
+		}
+		return nil
+	})
+	return wr, err
+}
+
+func decodePromTimeSeries(data []byte) (*promTimeSeries, error) {
+	series := &promTimeSeries{labels: make(map[string]string)}
+	err := readProto(data, func(field int, value uint64, b []byte) error {
+		switch field {
+		case 1:
+			var name, labelValue string
+			err := readProto(b, func(field int, value uint64, b []byte) error {
+				switch field {
+				case 1:
+					name = string(b)
+				case 2:
+					labelValue = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("invalid label: %v", err)
+			}
+			series.labels[name] = labelValue
+		case 2:
+			sample := promSample{}
+			err := readProto(b, func(field int, value uint64, b []byte) error {
+				switch field {
+				case 1:
+					sample.value = math.Float64frombits(value)
+				case 2:
+					sample.ts = int64(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("invalid sample: %v", err)
+			}
+			series.samples = append(series.samples, sample)
+		}
+		return nil
+	})
+	return series, err
+}
+
+// readProto reads the fields of a protobuf message, calling onField with the
+// numeric value of varint and fixed width fields or with the data of length
+// delimited fields.
+func readProto(data []byte, onField func(field int, value uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		var value uint64
+		var b []byte
+		switch key & 7 {
+		case protoVarint:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint for field %d", field)
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("truncated fixed64 for field %d", field)
+			}
+			value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fmt.Errorf("invalid length for field %d", field)
+			}
+			b = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case protoFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("truncated fixed32 for field %d", field)
+			}
+			value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d for field %d", key&7, field)
+		}
+		err := onField(field, value, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodePromWriteRequest(t *testing.T) {
+	series := protoMessage(
+		protoBytesField(1, protoMessage(protoBytesField(1, []byte(promNameLabel)), protoBytesField(2, []byte("http_requests_total")))),
+		protoBytesField(1, protoMessage(protoBytesField(1, []byte("code")), protoBytesField(2, []byte("200")))),
+		protoBytesField(2, protoMessage(protoFixed64Field(1, math.Float64bits(5)), protoVarintField(2, 1000))),
+		protoBytesField(2, protoMessage(protoFixed64Field(1, math.Float64bits(7.5)), protoVarintField(2, 2000))),
+	)
+	metadata := protoMessage(protoVarintField(1, promTypeSummary), protoBytesField(2, []byte("latency")))
+	data := protoMessage(protoBytesField(1, series), protoBytesField(3, metadata))
+
+	wr, err := decodePromWriteRequest(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, wr.timeSeries, 1) {
+		ts := wr.timeSeries[0]
+		assert.Equal(t, map[string]string{promNameLabel: "http_requests_total", "code": "200"}, ts.labels)
+		assert.Equal(t, []promSample{{5, 1000}, {7.5, 2000}}, ts.samples)
+	}
+
+	assert.True(t, wr.isCounter("http_requests_total"))
+	assert.True(t, wr.isCounter("latency_count"))
+	assert.False(t, wr.isCounter("latency"))
+	assert.False(t, wr.isCounter("memory_bytes"))
+
+	_, err = decodePromWriteRequest(data[:len(data)-1])
+	assert.Error(t, err, "Truncated request should fail to decode")
+}
+
+func TestPromCounterDeltas(t *testing.T) {
+	c := newPromCounters()
+	now := time.Now()
+	_, ok := c.delta("a", 10, now)
+	assert.False(t, ok, "First sample should have no delta")
+	delta, ok := c.delta("a", 15, now)
+	assert.True(t, ok)
+	assert.EqualValues(t, 5, delta)
+	delta, ok = c.delta("a", 3, now)
+	assert.True(t, ok)
+	assert.EqualValues(t, 3, delta, "Reset counter should report new value")
+	_, ok = c.delta("b", 15, now)
+	assert.False(t, ok, "Counters should be tracked independently")
+
+	later := now.Add(promCounterTTL + time.Second)
+	_, ok = c.delta("a", 20, later)
+	assert.False(t, ok, "Expired counter should have no delta")
+	assert.Len(t, c.last, 1, "Expired counters should be pruned")
+	delta, ok = c.delta("a", 25, later)
+	assert.True(t, ok)
+	assert.EqualValues(t, 5, delta)
+}
+
+func protoMessage(fields ...[]byte) []byte {
+	var result []byte
+	for _, field := range fields {
+		result = append(result, field...)
+	}
+	return result
+}
+
+func protoKey(field int, wireType int) []byte {
+	return protoVarint64(uint64(field<<3 | wireType))
+}
+
+func protoVarint64(value uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, value)]
+}
+
+func protoVarintField(field int, value uint64) []byte {
+	return append(protoKey(field, protoVarint), protoVarint64(value)...)
+}
+
+func protoFixed64Field(field int, value uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, value)
+	return append(protoKey(field, protoFixed64), b...)
+}
+
+func protoBytesField(field int, data []byte) []byte {
+	result := append(protoKey(field, protoBytes), protoVarint64(uint64(len(data)))...)
+	return append(result, data...)
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/rbac"
 	"github.com/gorilla/mux"
 	"github.com/retailnext/hllpp"
 )
@@ -33,6 +34,7 @@ type QueryResult struct {
 	Permalink          string
 	TS                 int64
 	TSCardinality      uint64
+	TimeZone           string
 	Fields             []string
 	FieldCardinalities []uint64
 	Dims               []string
@@ -41,9 +43,11 @@ type QueryResult struct {
 }
 
 type ResultRow struct {
-	TS   int64
-	Key  map[string]interface{}
-	Vals []float64
+	TS  int64
+	Key map[string]interface{}
+	// Vals are the values for each field, with missing values (e.g. from
+	// fill(null)) as nil
+	Vals []interface{}
 }
 
 func (h *handler) runQuery(resp http.ResponseWriter, req *http.Request) {
@@ -55,13 +59,31 @@ func (h *handler) asyncQuery(resp http.ResponseWriter, req *http.Request) {
 }
 
 func (h *handler) cachedQuery(resp http.ResponseWriter, req *http.Request) {
-	if !h.authenticate(resp, req) {
+	access, ok := h.authenticate(resp, req)
+	if !ok {
 		resp.WriteHeader(http.StatusForbidden)
 		return
 	}
 
 	log.Debug(req.URL)
 	permalink := mux.Vars(req)["permalink"]
+	pq, err := h.cache.queryForPermalink(permalink)
+	if err != nil {
+		internalServerError(resp, "Unable to look up permalink: %v", err)
+		return
+	}
+	if pq == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	if pq.Access != access.Name() {
+		// Permalinks can be shared, so don't reveal results obtained with someone
+		// else's access. Instead, run the query with the requester's own access.
+		ce, queryErr := h.query(req, pq.SQL, access)
+		h.respondWithCacheEntry(resp, req, ce, queryErr, shortTimeout)
+		return
+	}
+
 	ce, err := h.cache.getByPermalink(permalink)
 	if ce == nil {
 		http.NotFound(resp, req)
@@ -71,7 +93,8 @@ func (h *handler) cachedQuery(resp http.ResponseWriter, req *http.Request) {
 }
 
 func (h *handler) sqlQuery(resp http.ResponseWriter, req *http.Request, timeout time.Duration) {
-	if !h.authenticate(resp, req) {
+	access, ok := h.authenticate(resp, req)
+	if !ok {
 		resp.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -79,7 +102,7 @@ func (h *handler) sqlQuery(resp http.ResponseWriter, req *http.Request, timeout
 	log.Debug(req.URL)
 	sqlString, _ := url.QueryUnescape(req.URL.RawQuery)
 
-	ce, err := h.query(req, sqlString)
+	ce, err := h.query(req, sqlString, access)
 	h.respondWithCacheEntry(resp, req, ce, err, timeout)
 }
 
@@ -124,15 +147,21 @@ func (h *handler) respondError(resp http.ResponseWriter, req *http.Request, ce c
 	resp.Write(ce.error())
 }
 
-func (h *handler) query(req *http.Request, sqlString string) (ce cacheEntry, err error) {
+func (h *handler) query(req *http.Request, sqlString string, access *rbac.Access) (ce cacheEntry, err error) {
+	// Results depend on the roles of the user, so cache them separately
+	cacheKey := sqlString
+	if access != nil {
+		cacheKey = fmt.Sprintf("%v|%v", access.Name(), sqlString)
+	}
+
 	if req.Header.Get("Cache-control") == "no-cache" {
-		ce, err = h.cache.begin(sqlString)
+		ce, err = h.cache.begin(cacheKey)
 		if err != nil {
 			return
 		}
 	} else {
 		var created bool
-		ce, created, err = h.cache.getOrBegin(sqlString)
+		ce, created, err = h.cache.getOrBegin(cacheKey)
 		if err != nil || !created {
 			return
 		}
@@ -141,11 +170,15 @@ func (h *handler) query(req *http.Request, sqlString string) (ce cacheEntry, err
 			return
 		}
 	}
+	err = h.cache.rememberQuery(ce.permalinkBytes(), &permalinkQuery{SQL: sqlString, Access: access.Name()})
+	if err != nil {
+		return
+	}
 
 	// Run the query in the background
 	go func() {
 		var result *QueryResult
-		result, err = h.doQuery(sqlString, ce.permalink())
+		result, err = h.doQuery(sqlString, ce.permalink(), access)
 		if err != nil {
 			err = fmt.Errorf("Unable to query: %v", err)
 			log.Error(err)
@@ -164,7 +197,7 @@ func (h *handler) query(req *http.Request, sqlString string) (ce cacheEntry, err
 				ce = ce.succeed(resultBytes)
 			}
 		}
-		h.cache.put(sqlString, ce)
+		h.cache.put(cacheKey, ce)
 		log.Debugf("Cached results for %v", sqlString)
 	}()
 
@@ -193,8 +226,8 @@ func compress(resultBytes []byte, err error) ([]byte, error) {
 	return compressed, nil
 }
 
-func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, error) {
-	rs, err := h.db.Query(sqlString, false, nil, false)
+func (h *handler) doQuery(sqlString string, permalink string, access *rbac.Access) (*QueryResult, error) {
+	rs, err := h.db.QueryRestricted(sqlString, false, nil, false, access.RestrictFN())
 	if err != nil {
 		return nil, err
 	}
@@ -205,6 +238,10 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 		SQL:       sqlString,
 		Permalink: permalink,
 		TS:        time.Now().UnixNano() / nanosPerMilli,
+		TimeZone:  time.UTC.String(),
+	}
+	if calendar := core.CalendarFor(rs); calendar != nil {
+		result.TimeZone = calendar.TimeZone()
 	}
 	groupBy := rs.GetGroupBy()
 	if len(groupBy) > 0 {
@@ -278,11 +315,16 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 		resultRow := &ResultRow{
 			TS:   row.TS / nanosPerMilli,
 			Key:  key,
-			Vals: make([]float64, 0, len(row.Values)),
+			Vals: make([]interface{}, 0, len(row.Values)),
 		}
 
 		for i, value := range row.Values {
-			resultRow.Vals = append(resultRow.Vals, value)
+			if math.IsNaN(value) {
+				// JSON has no NaN, encode as null
+				resultRow.Vals = append(resultRow.Vals, nil)
+			} else {
+				resultRow.Vals = append(resultRow.Vals, value)
+			}
 			encoding.Binary.PutUint64(cbytes, math.Float64bits(value))
 			fieldCardinalities[i].Add(cbytes)
 		}
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
@@ -182,11 +183,23 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 		dimWidths = append(dimWidths, len(dim))
 	}
 
-	for _, fieldName := range md.FieldNames {
+	crosstabLevels := 0
+	for i, fieldName := range md.FieldNames {
 		labelWidth := len(fieldName)
 		if totalLabelWidth > labelWidth {
 			labelWidth = totalLabelWidth
 		}
+		if md.CrosstabHeaders != nil {
+			headers := md.CrosstabHeaders[i]
+			if len(headers) > crosstabLevels {
+				crosstabLevels = len(headers)
+			}
+			for _, header := range headers {
+				if len(header) > labelWidth {
+					labelWidth = len(header)
+				}
+			}
+		}
 		fieldWidths = append(fieldWidths, labelWidth)
 	}
 
@@ -206,7 +219,7 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 			// } else {
 			val = row.Values[i]
 			// }
-			width := len(fmt.Sprintf("%.4f", val))
+			width := len(formatValue(val))
 			if width > fieldWidths[i] {
 				fieldWidths[i] = width
 			}
@@ -250,7 +263,7 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 	}
 	for _, width := range fieldWidths {
 		fieldLabelFormats = append(fieldLabelFormats, "%"+fmt.Sprint(width+4)+"v")
-		fieldFormats = append(fieldFormats, "%"+fmt.Sprint(width+4)+".4f")
+		fieldFormats = append(fieldFormats, "%"+fmt.Sprint(width+4)+"v")
 	}
 
 	// if result.IsCrosstab {
@@ -278,6 +291,22 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 	// 	fmt.Fprint(stdout, "\n")
 	// }
 
+	// Print nested crosstab header rows
+	for level := 0; level < crosstabLevels; level++ {
+		fmt.Fprintf(stdout, "# %-33v", "")
+		for i := range groupBy {
+			fmt.Fprintf(stdout, dimFormats[i], "")
+		}
+		for i := range md.FieldNames {
+			header := ""
+			if headers := md.CrosstabHeaders[i]; level < len(headers) {
+				header = headers[level]
+			}
+			fmt.Fprintf(stdout, fieldLabelFormats[i], header)
+		}
+		fmt.Fprint(stdout, "\n")
+	}
+
 	// Print header row
 	fmt.Fprintf(stdout, "# %-33v", "time")
 	for i, dim := range groupBy {
@@ -301,8 +330,9 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 	// }
 	fmt.Fprint(stdout, "\n")
 
+	location := locationFor(md)
 	for _, row := range rows {
-		fmt.Fprintf(stdout, "%-35v", encoding.TimeFromInt(row.TS).In(time.UTC).Format(time.RFC1123))
+		fmt.Fprintf(stdout, "%-35v", encoding.TimeFromInt(row.TS).In(location).Format(time.RFC1123))
 		for i, dim := range groupBy {
 			val := row.Key.Get(dim)
 			fmt.Fprintf(stdout, dimFormats[i], nilToDash(val))
@@ -316,7 +346,7 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 			// } else {
 			val = row.Values[i]
 			// }
-			fmt.Fprintf(stdout, fieldFormats[outIdx], val)
+			fmt.Fprintf(stdout, fieldFormats[outIdx], formatValue(val))
 			outIdx++
 		}
 
@@ -346,10 +376,11 @@ func dumpCSV(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core
 
 	i := 0
 	var knownDims []string
+	location := locationFor(md)
 	err := iterate(func(row *core.FlatRow) (bool, error) {
 		dims := row.Key.AsMap()
 		rowStrings := make([]string, 0, 1+len(dims)+len(md.FieldNames))
-		rowStrings = append(rowStrings, encoding.TimeFromInt(row.TS).In(time.UTC).Format(time.RFC3339))
+		rowStrings = append(rowStrings, encoding.TimeFromInt(row.TS).In(location).Format(time.RFC3339))
 		for i := range md.FieldNames {
 			var value float64
 			// if result.IsCrosstab {
@@ -357,7 +388,12 @@ func dumpCSV(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core
 			// } else {
 			value = row.Values[i]
 			// }
-			rowStrings = append(rowStrings, fmt.Sprintf("%f", value))
+			if math.IsNaN(value) {
+				// Missing value from fill(null)
+				rowStrings = append(rowStrings, "")
+			} else {
+				rowStrings = append(rowStrings, fmt.Sprintf("%f", value))
+			}
 		}
 		// First add known dims
 		for _, dim := range knownDims {
@@ -464,6 +500,15 @@ func nilToBlank(val interface{}) interface{} {
 	return val
 }
 
+// formatValue formats a field value for plain text output, showing missing
+// values (e.g. from fill(null)) as a dash.
+func formatValue(val float64) string {
+	if math.IsNaN(val) {
+		return "-"
+	}
+	return fmt.Sprintf("%.4f", val)
+}
+
 func nilToDash(val interface{}) interface{} {
 	if val == nil {
 		return "-----"
@@ -483,15 +528,30 @@ func numFieldsFor(md *common.QueryMetaData) int {
 	return numFields
 }
 
+// locationFor returns the location in which to display times for the query,
+// falling back to UTC if the server didn't specify a known time zone.
+func locationFor(md *common.QueryMetaData) *time.Location {
+	if md.TimeZone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(md.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
 func printQueryStats(stderr io.Writer, md *common.QueryMetaData) {
 	// TODO: maybe restore additional stats?
 	if !*queryStats {
 		return
 	}
 	fmt.Fprintln(stderr, "-------------------------------------------------")
-	fmt.Fprintf(stderr, "# As Of:      %v\n", md.AsOf.In(time.UTC).Format(time.RFC1123))
-	fmt.Fprintf(stderr, "# Until:      %v\n", md.Until.In(time.UTC).Format(time.RFC1123))
+	location := locationFor(md)
+	fmt.Fprintf(stderr, "# As Of:      %v\n", md.AsOf.In(location).Format(time.RFC1123))
+	fmt.Fprintf(stderr, "# Until:      %v\n", md.Until.In(location).Format(time.RFC1123))
 	fmt.Fprintf(stderr, "# Resolution: %v\n", md.Resolution)
+	fmt.Fprintf(stderr, "# Time Zone:  %v\n", location)
 	fmt.Fprintln(stderr, "\n")
 	fmt.Fprintln(stderr, md.Plan)
 	fmt.Fprintln(stderr, "\n")
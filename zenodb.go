@@ -78,7 +78,9 @@ type DBOpts struct {
 	// WALSyncInterval governs how frequently to sync the WAL to disk. 0 means
 	// it syncs after every write (which is not great for performance).
 	WALSyncInterval time.Duration
-	// MaxWALSize limits how much WAL data to keep (in bytes)
+	// MaxWALSize limits how much WAL data to keep (in bytes). WAL data that's no
+	// longer needed by any table or follower is cleaned up automatically, this is
+	// a hard limit in case some table or follower falls too far behind.
 	MaxWALSize int
 	// WALCompressionSize specifies the size beyond which to compress WAL segments
 	WALCompressionSize int
@@ -101,8 +103,10 @@ type DBOpts struct {
 	// leader
 	MaxFollowAge time.Duration
 	// Follow is a function that allows a follower to request following a stream
-	// from a passthrough node.
-	Follow                     func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error)
+	// from a passthrough node. It should periodically ack the durableOffset to
+	// the passthrough node so that it can clean up WAL data the follower no
+	// longer needs.
+	Follow                     func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error, durableOffset func() wal.Offset)
 	RegisterRemoteQueryHandler func(partition int, query planner.QueryClusterFN)
 }
 
@@ -115,6 +119,12 @@ type DB struct {
 	streams              map[string]*wal.WAL
 	newStreamSubscriber  map[string]chan *tableWithOffset
 	tablesMutex          sync.RWMutex
+	snapshotMutex        sync.RWMutex
+	followerOffsets      map[string]map[int]*followerOffset
+	nextFollowerID       int
+	followerOffsetsMutex sync.RWMutex
+	walStats             map[string]WALStats
+	walStatsMutex        sync.RWMutex
 	isSorting            bool
 	nextTableToSort      int
 	memory               uint64
@@ -134,6 +144,8 @@ func NewDB(opts *DBOpts) (*DB, error) {
 		tables:              make(map[string]*table),
 		streams:             make(map[string]*wal.WAL),
 		newStreamSubscriber: make(map[string]chan *tableWithOffset),
+		followerOffsets:     make(map[string]map[int]*followerOffset),
+		walStats:            make(map[string]WALStats),
 		followerJoined:      make(chan *follower, opts.NumPartitions),
 		remoteQueryHandlers: make(map[int]chan planner.QueryClusterFN),
 	}
@@ -277,14 +289,15 @@ func (db *DB) AllTableStats() map[string]TableStats {
 func (db *DB) PrintTableStats(table string) string {
 	stats := db.TableStats(table)
 	now := db.clock.Now()
-	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Expired: %v",
+	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Expired: %v    Rejected: %v",
 		table,
 		now.In(time.UTC),
 		humanize.Comma(stats.FilteredPoints),
 		humanize.Comma(stats.QueuedPoints),
 		humanize.Comma(stats.InsertedPoints),
 		humanize.Comma(stats.DroppedPoints),
-		humanize.Comma(stats.ExpiredValues))
+		humanize.Comma(stats.ExpiredValues),
+		humanize.Comma(stats.RejectedPoints))
 }
 
 func (db *DB) getTable(table string) *table {
@@ -298,21 +311,6 @@ func (db *DB) now(table string) time.Time {
 	return db.clock.Now()
 }
 
-func (db *DB) capWALAge(wal *wal.WAL) {
-	for {
-		time.Sleep(1 * time.Minute)
-		db.waitForBackupToFinish()
-		err := wal.TruncateToSize(int64(db.opts.MaxWALSize))
-		if err != nil {
-			log.Errorf("Error truncating WAL: %v", err)
-		}
-		err = wal.CompressBeforeSize(int64(db.opts.WALCompressionSize))
-		if err != nil {
-			log.Errorf("Error compressing WAL: %v", err)
-		}
-	}
-}
-
 func (db *DB) trackMemStats() {
 	for {
 		db.updateMemStats()
@@ -389,7 +387,7 @@ func (a byCurrentSize) Less(i, j int) bool { return a[i].size > a[j].size }
 
 // waitForBackupToFinish waits until there's no .backup_lock file in the dbdir
 func (db *DB) waitForBackupToFinish() {
-	lockFile := filepath.Join(db.opts.Dir, ".backup_lock")
+	lockFile := filepath.Join(db.opts.Dir, backupLockFilename)
 	start := time.Now()
 	for {
 		fi, err := os.Stat(lockFile)
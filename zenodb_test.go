@@ -90,8 +90,8 @@ func doTestCluster(t *testing.T, numPartitions int, partitionBy []string) {
 				NumPartitions:  numPartitions,
 				Partition:      part,
 				MaxMemoryRatio: 0.00001,
-				Follow: func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error) {
-					leader.Follow(f(), cb)
+				Follow: func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error, durableOffset func() wal.Offset) {
+					leader.Follow(f(), cb, nil)
 				},
 				RegisterRemoteQueryHandler: func(partition int, query planner.QueryClusterFN) {
 					var register func()
@@ -353,7 +353,7 @@ view_a:
 
 	table := db.getTable("test_a")
 	fields := table.getFields()
-	table.iterate(context.Background(), fields, true, func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+	table.iterate(context.Background(), fields, true, time.Time{}, time.Time{}, func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
 		log.Debugf("Dims: %v")
 		for i, val := range vals {
 			field := fields[i]